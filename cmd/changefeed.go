@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/steveperjesi/integra-demo/internal/db"
+	"github.com/steveperjesi/integra-demo/user"
+)
+
+const (
+	changeFeedMinReconnect = time.Second
+	changeFeedMaxReconnect = time.Minute
+)
+
+// Builds the user change feed for a Postgres DATABASE_URL, or returns nil
+// for the other backends or when CHANGE_FEED turns it off
+func newChangeFeed(databaseURL string) (*user.ChangeFeed, error) {
+	if value := os.Getenv("CHANGE_FEED"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CHANGE_FEED: must be true or false")
+		}
+
+		if !enabled {
+			return nil, nil
+		}
+	}
+
+	backend, dsn := db.DriverPostgres, db.DSN()
+	if databaseURL != "" {
+		var err error
+		if backend, dsn, err = db.ParseURL(databaseURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if backend != db.DriverPostgres {
+		return nil, nil
+	}
+
+	return user.ListenForChanges(dsn, changeFeedMinReconnect, changeFeedMaxReconnect), nil
+}
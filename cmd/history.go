@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/steveperjesi/integra-demo/user"
+)
+
+// How often versions older than the retention are pruned
+const pruneInterval = time.Hour
+
+// Reads USER_HISTORY_RETENTION, how long earlier versions of users are kept
+// for as_of reads. Empty or zero keeps them forever.
+func historyRetention() (time.Duration, error) {
+	value := os.Getenv("USER_HISTORY_RETENTION")
+	if value == "" {
+		return 0, nil
+	}
+
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		return 0, fmt.Errorf("invalid USER_HISTORY_RETENTION: must be a duration")
+	}
+
+	return retention, nil
+}
+
+// Prunes versions older than retention now and every pruneInterval until ctx
+// is done
+func pruneVersions(ctx context.Context, store user.VersionStore, retention time.Duration) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		pruned, err := store.PruneVersions(ctx, time.Now().Add(-retention))
+		if err != nil && ctx.Err() == nil {
+			log.Print("failed to prune user versions: ", err)
+		} else if pruned > 0 {
+			log.Printf("pruned %d user versions", pruned)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
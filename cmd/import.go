@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/steveperjesi/integra-demo/user"
+)
+
+const (
+	importUsage = "usage: import <users.json | ->"
+	// Recorded in the audit trail for users created by an import
+	importActor = "import"
+)
+
+// Handles `app import FILE`, bulk creating the users in a JSON array read
+// from FILE, or stdin for `-`, against DATABASE_URL
+func runImport(args []string) error {
+	if len(args) != 1 {
+		return errors.New(importUsage)
+	}
+
+	users, err := readImport(args[0])
+	if err != nil {
+		return err
+	}
+
+	repo, closeRepo, err := newRepository(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+	defer closeRepo()
+
+	if _, ok := repo.(*user.MemoryRepository); ok {
+		return errors.New("the memory backend keeps nothing an import could load into")
+	}
+
+	store, ok := repo.(user.BulkStore)
+	if !ok {
+		return errors.New("the storage backend does not support bulk loads")
+	}
+
+	results, err := store.BulkCreate(context.Background(), users, importActor)
+	if err != nil {
+		return err
+	}
+
+	var created, duplicates, invalid int
+	for _, result := range results {
+		switch result.Outcome {
+		case user.BulkCreated:
+			created++
+			continue
+		case user.BulkInvalid:
+			invalid++
+			fmt.Printf("row %d: %s: %s\n", result.Row, result.Outcome, result.Error)
+		default:
+			duplicates++
+			fmt.Printf("row %d: %s\n", result.Row, result.Outcome)
+		}
+	}
+
+	fmt.Printf("created %d, duplicates %d, invalid %d\n", created, duplicates, invalid)
+	return nil
+}
+
+func readImport(path string) ([]user.User, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var users []user.User
+	if err := json.NewDecoder(r).Decode(&users); err != nil {
+		return nil, fmt.Errorf("invalid import: must be a JSON array of users: %w", err)
+	}
+
+	return users, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/steveperjesi/integra-demo/user"
+)
+
+const rotateKeysUsage = "usage: rotate-keys [batch size]"
+
+// Handles `app rotate-keys [N]`, moving every stored user under the primary
+// key of USER_KEYRING_FILE, N rows per transaction
+func runRotateKeys(args []string) error {
+	if len(args) > 1 {
+		return errors.New(rotateKeysUsage)
+	}
+
+	batchSize := user.DefaultRotateBatchSize
+	if len(args) == 1 {
+		var err error
+		if batchSize, err = strconv.Atoi(args[0]); err != nil || batchSize < 1 {
+			return user.ErrInvalidBatchSize
+		}
+	}
+
+	repo, closeRepo, err := newRepository(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+	defer closeRepo()
+
+	store, ok := repo.(user.KeyStore)
+	if !ok {
+		return errors.New("the memory backend stores nothing to encrypt")
+	}
+
+	rotated, err := store.RotateKeys(context.Background(), batchSize)
+	fmt.Printf("rewrote %d rows\n", rotated)
+	return err
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	_ "github.com/steveperjesi/integra-demo/docs"
@@ -25,35 +31,215 @@ import (
 // @BasePath:       /
 
 var (
-	defaultServerPort = "8080"
+	defaultServerPort      = "8080"
+	defaultShutdownTimeout = 15 * time.Second
 )
 
-func newUserService() *user.UserService {
+func newUserService(repo user.Repository, requireIfMatch bool, retention time.Duration) *user.UserService {
 	return &user.UserService{
-		ConnectDB:           db.Connect,
-		ValidateUserID:      user.ValidateUserID,
-		CheckUserNameExists: user.CheckUserNameExists,
-		CreateUserFunc:      user.CreateUser,
-		UpdateUserFunc:      user.UpdateUser,
-		DeleteUserFunc:      user.DeleteUser,
-		GetUserFunc:         user.GetUser,
-		GetAllUsersFunc:     user.GetAllUsers,
+		Repo:             repo,
+		RequireIfMatch:   requireIfMatch,
+		VersionRetention: retention,
 	}
 }
 
-func StartServer() *echo.Echo {
+// Reads REQUIRE_IF_MATCH. When on, updates and deletes without an If-Match
+// header are rejected with 428 instead of overwriting blindly.
+func requireIfMatchEnabled() (bool, error) {
+	value := os.Getenv("REQUIRE_IF_MATCH")
+	if value == "" {
+		return false, nil
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid REQUIRE_IF_MATCH: must be true or false")
+	}
+
+	return enabled, nil
+}
+
+// Reads STORAGE_BACKEND, which chose between Postgres and memory before
+// DATABASE_URL did. It is still honored when DATABASE_URL is empty, and
+// must agree with it otherwise.
+func legacyStorageBackend(databaseURL string, backend string) (string, error) {
+	legacy := os.Getenv("STORAGE_BACKEND")
+	if legacy == "" {
+		return backend, nil
+	}
+
+	if legacy != db.DriverPostgres && legacy != db.DriverMemory {
+		return "", fmt.Errorf("unknown STORAGE_BACKEND %q", legacy)
+	}
+
+	if databaseURL != "" && legacy != backend {
+		return "", fmt.Errorf("STORAGE_BACKEND %q contradicts DATABASE_URL; unset STORAGE_BACKEND", legacy)
+	}
+
+	log.Print("STORAGE_BACKEND is deprecated; set DATABASE_URL instead, e.g. memory://")
+	return legacy, nil
+}
+
+// Opens the SQL database chosen by the DATABASE_URL scheme. When
+// DATABASE_URL is empty, Postgres is reached through the DB_* variables,
+// unless STORAGE_BACKEND=memory. A nil *sql.DB with a nil error means the
+// memory backend was chosen.
+func openDatabase(databaseURL string) (*sql.DB, db.Dialect, error) {
+	backend, dsn := db.DriverPostgres, db.DSN()
+	if databaseURL != "" {
+		var err error
+		if backend, dsn, err = db.ParseURL(databaseURL); err != nil {
+			return nil, db.Dialect{}, err
+		}
+	}
+
+	backend, err := legacyStorageBackend(databaseURL, backend)
+	if err != nil {
+		return nil, db.Dialect{}, err
+	}
+
+	if backend == db.DriverMemory {
+		return nil, db.Dialect{}, nil
+	}
+
+	poolConfig, err := db.LoadPoolConfig()
+	if err != nil {
+		return nil, db.Dialect{}, err
+	}
+
+	if backend == db.DriverSQLite {
+		dbcon, err := db.OpenSQLite(dsn, poolConfig)
+		return dbcon, db.SQLite, err
+	}
+
+	// One pool for the lifetime of the process, shared by every request
+	dbcon, err := db.OpenPool(db.DriverPostgres, dsn, poolConfig)
+	return dbcon, db.Postgres, err
+}
+
+// Builds the user storage backend chosen by DATABASE_URL, migrating the
+// schema first when DB_AUTO_MIGRATE is on. The returned func releases
+// whatever the backend holds open.
+func newRepository(databaseURL string) (user.Repository, func() error, error) {
+	dbcon, dialect, err := openDatabase(databaseURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if dbcon == nil {
+		// No database at all, so none of the DB_* variables are needed
+		return user.NewMemoryRepository(), func() error { return nil }, nil
+	}
+
+	autoMigrate, err := autoMigrateEnabled(dialect)
+	if err != nil {
+		dbcon.Close()
+		return nil, nil, err
+	}
+
+	if autoMigrate {
+		if err := migrateUp(dbcon, dialect); err != nil {
+			dbcon.Close()
+			return nil, nil, err
+		}
+	}
+
+	keys, err := db.LoadKeyring()
+	if err != nil {
+		dbcon.Close()
+		return nil, nil, err
+	}
+
+	repo := user.NewSQLRepository(dbcon, dialect).WithKeyring(keys)
+
+	replica, err := openReplica(os.Getenv("DATABASE_REPLICA_URL"), dialect)
+	if err != nil {
+		dbcon.Close()
+		return nil, nil, err
+	}
+
+	if replica == nil {
+		return repo, dbcon.Close, nil
+	}
+
+	interval, err := db.ReplicaCheckInterval()
+	if err != nil {
+		replica.Close()
+		dbcon.Close()
+		return nil, nil, err
+	}
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	go replica.Watch(watchCtx, interval)
+
+	closeAll := func() error {
+		stopWatching()
+		replica.Close()
+		return dbcon.Close()
+	}
+
+	return repo.WithReplica(replica), closeAll, nil
+}
+
+// Opens the read replica named by DATABASE_REPLICA_URL, if any. Replicas are
+// only supported for a Postgres primary.
+func openReplica(replicaURL string, primary db.Dialect) (*db.Replica, error) {
+	if replicaURL == "" {
+		return nil, nil
+	}
+
+	backend, dsn, err := db.ParseURL(replicaURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DATABASE_REPLICA_URL: %w", err)
+	}
+
+	if backend != db.DriverPostgres || primary.Name != db.DriverPostgres {
+		return nil, errors.New("DATABASE_REPLICA_URL needs a Postgres primary and replica")
+	}
+
+	poolConfig, err := db.LoadPoolConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return db.OpenReplica(db.DriverPostgres, dsn, poolConfig)
+}
+
+// changes is nil when there is no change feed
+func StartServer(repo user.Repository, requireIfMatch bool, retention time.Duration, changes user.ChangeSource) *echo.Echo {
 	e := echo.New()
-	userService := newUserService()
+	e.Use(handlers.ReadConsistency())
+	userService := newUserService(repo, requireIfMatch, retention)
 
 	e.GET("/ping", func(c echo.Context) error {
 		return c.String(http.StatusOK, "PONG")
 	})
 
 	e.GET("/users", handlers.GetAllUsers(userService))
+	if changes != nil {
+		e.GET("/users/changes", handlers.StreamUserChanges(changes))
+	}
+	e.GET("/users/search", handlers.SearchUsers(userService))
 	e.GET("/users/:user_id", handlers.GetUserByID(userService))
 	e.POST("/users", handlers.CreateUser(userService))
-	e.PUT("/users", handlers.UpdateUser(userService))
+	if store, ok := repo.(user.BulkStore); ok {
+		e.POST("/users/bulk", handlers.BulkCreateUsers(store))
+	}
+	// Superseded by PUT and PATCH on /users/:user_id; kept for one release
+	e.PUT("/users", handlers.UpdateUser(userService), handlers.Deprecated())
+	e.PUT("/users/:user_id", handlers.ReplaceUser(userService))
+	e.PATCH("/users/:user_id", handlers.PatchUser(userService))
 	e.DELETE("/users/:user_id", handlers.DeleteUser(userService))
+	e.POST("/users/:user_id/restore", handlers.RestoreUser(userService))
+	e.GET("/users/:user_id/history", handlers.GetUserHistory(userService))
+
+	admin := e.Group("/admin", handlers.RequireAdmin(os.Getenv("ADMIN_TOKEN")))
+	admin.DELETE("/users/:user_id", handlers.PurgeUser(userService))
+
+	if store, ok := repo.(user.OutboxStore); ok {
+		admin.GET("/outbox", handlers.GetOutboxEvents(store))
+		admin.POST("/outbox/:event_id/requeue", handlers.RequeueOutboxEvent(store))
+	}
 
 	e.Static("/swagger", "swagger-ui")
 	e.Static("/docs", "docs")
@@ -64,12 +250,96 @@ func StartServer() *echo.Echo {
 }
 
 func main() {
-	err := godotenv.Load()
+	// The .env file is optional so the app can run purely from the environment
+	if err := godotenv.Load(); err != nil {
+		log.Print("no .env file loaded: ", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		if err := runRotateKeys(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImport(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	requireIfMatch, err := requireIfMatchEnabled()
 	if err != nil {
-		log.Fatal("error loading .env file")
+		log.Fatal(err)
 	}
 
-	e := StartServer()
+	retention, err := historyRetention()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	repo, closeRepo, err := newRepository(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatalf("failed to set up storage: %v", err)
+	}
+	defer closeRepo()
+
+	// Versions are only pruned when a retention is set
+	pruneCtx, stopPruning := context.WithCancel(context.Background())
+	defer stopPruning()
+
+	if store, ok := repo.(user.VersionStore); ok && retention > 0 {
+		go pruneVersions(pruneCtx, store, retention)
+	}
+
+	// Delivers outbox events until the server has shut down
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	var relayDone chan struct{}
+
+	if store, ok := repo.(user.OutboxStore); ok {
+		relay, err := newRelay(store)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if relay != nil {
+			relayDone = make(chan struct{})
+			go func() {
+				defer close(relayDone)
+				relay.Run(relayCtx)
+			}()
+		}
+	}
+
+	changeFeed, err := newChangeFeed(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// A nil *user.ChangeFeed must not become a non-nil ChangeSource
+	var changes user.ChangeSource
+	feedCtx, stopFeed := context.WithCancel(context.Background())
+	defer stopFeed()
+
+	if changeFeed != nil {
+		changes = changeFeed
+
+		go func() {
+			if err := changeFeed.Run(feedCtx); err != nil {
+				log.Print("change feed stopped: ", err)
+			}
+		}()
+	}
+
+	e := StartServer(repo, requireIfMatch, retention, changes)
 
 	port := os.Getenv("DEMO_PORT")
 	if port == "" {
@@ -83,7 +353,31 @@ func main() {
 		ReadTimeout: 10 * time.Second,
 	}
 
-	if err := e.StartServer(&s); err != nil {
-		log.Fatalf("failed to start server: %v", err)
+	go func() {
+		if err := e.StartServer(&s); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("failed to start server: %v", err)
+		}
+	}()
+
+	// Wait for an interrupt, then drain in-flight requests before the
+	// deferred storage close runs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	// Stopping the feed ends the change streams, which would otherwise hold
+	// up the shutdown
+	stopFeed()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("server shutdown error: %v", err)
+	}
+
+	stopRelay()
+	if relayDone != nil {
+		<-relayDone
 	}
 }
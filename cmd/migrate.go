@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/steveperjesi/integra-demo/internal/db"
+)
+
+const migrateUsage = "usage: migrate up | down | status | goto <version> | collisions"
+
+// Handles `app migrate up|down|status|goto N|collisions` against DATABASE_URL
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	dbcon, dialect, err := openDatabase(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+
+	if dbcon == nil {
+		return errors.New("the memory backend has no schema to migrate")
+	}
+	defer dbcon.Close()
+
+	migrator, err := db.NewMigrator(dbcon, dialect)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return err
+	case "down":
+		rolledBack, err := migrator.Down(ctx)
+		if rolledBack != nil {
+			fmt.Printf("rolled back %04d_%s\n", rolledBack.Version, rolledBack.Name)
+		} else if err == nil {
+			fmt.Println("no applied migrations")
+		}
+		return err
+	case "goto":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid version %q: must be an integer", args[1])
+		}
+
+		changed, err := migrator.Goto(ctx, version)
+		for _, m := range changed {
+			fmt.Printf("migrated %04d_%s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	case "collisions":
+		collisions, err := db.FindUserCollisions(ctx, dbcon)
+		if err != nil {
+			return err
+		}
+
+		if len(collisions) == 0 {
+			fmt.Println("no colliding users")
+			return nil
+		}
+
+		for _, c := range collisions {
+			fmt.Printf("%s %q:\n", c.Field, c.Key)
+			for _, u := range c.Users {
+				fmt.Printf("  user_id=%d user_name=%q email=%q\n", u.UserID, u.UserName, u.Email)
+			}
+		}
+		return nil
+	default:
+		return errors.New(migrateUsage)
+	}
+}
+
+// Applies pending migrations on startup
+func migrateUp(dbcon *sql.DB, dialect db.Dialect) error {
+	migrator, err := db.NewMigrator(dbcon, dialect)
+	if err != nil {
+		return err
+	}
+
+	applied, err := migrator.Up(context.Background())
+	for _, m := range applied {
+		log.Printf("applied migration %04d_%s", m.Version, m.Name)
+	}
+
+	return err
+}
+
+// DB_AUTO_MIGRATE turns on migrating at server start. It defaults to on for
+// SQLite, where the binary owns the database file, and off for Postgres.
+func autoMigrateEnabled(dialect db.Dialect) (bool, error) {
+	value := os.Getenv("DB_AUTO_MIGRATE")
+	if value == "" {
+		return dialect.Name == db.DriverSQLite, nil
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid DB_AUTO_MIGRATE: must be true or false")
+	}
+
+	return enabled, nil
+}
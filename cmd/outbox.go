@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/steveperjesi/integra-demo/user"
+)
+
+// Builds the outbox relay from the OUTBOX_* variables, or returns nil when
+// OUTBOX_RELAY turns it off. Events go to OUTBOX_WEBHOOK_URL when set and to
+// the log otherwise.
+func newRelay(store user.OutboxStore) (*user.Relay, error) {
+	if value := os.Getenv("OUTBOX_RELAY"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OUTBOX_RELAY: must be true or false")
+		}
+
+		if !enabled {
+			return nil, nil
+		}
+	}
+
+	config := user.DefaultRelayConfig()
+
+	if value := os.Getenv("OUTBOX_POLL_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid OUTBOX_POLL_INTERVAL: must be a positive duration")
+		}
+		config.PollInterval = interval
+	}
+
+	if value := os.Getenv("OUTBOX_MAX_ATTEMPTS"); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < 1 {
+			return nil, fmt.Errorf("invalid OUTBOX_MAX_ATTEMPTS: must be a positive integer")
+		}
+		config.MaxAttempts = attempts
+	}
+
+	var sink user.Sink = user.LogSink{}
+
+	if url := os.Getenv("OUTBOX_WEBHOOK_URL"); url != "" {
+		// Give up on an attempt well inside the lease
+		sink = &user.WebhookSink{URL: url, Client: &http.Client{Timeout: config.Lease / 2}}
+	}
+
+	return user.NewRelay(store, sink, config), nil
+}
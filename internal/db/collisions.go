@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Collision is a set of users whose user_name or email are equal once
+// normalized, which the case-insensitive unique indexes reject
+type Collision struct {
+	// Field is "user_name" or "email"
+	Field string
+	// Key is the normalized value the users share
+	Key   string
+	Users []CollidingUser
+}
+
+type CollidingUser struct {
+	UserID   int64
+	UserName string
+	Email    string
+}
+
+// CollisionError stops the migration to case-insensitive unique indexes
+// while users still collide
+type CollisionError struct {
+	Collisions []Collision
+}
+
+func (e *CollisionError) Error() string {
+	return fmt.Sprintf("%d user_name or email values are shared by several users once case and surrounding whitespace are ignored; run `migrate collisions` to list them", len(e.Collisions))
+}
+
+// Runs collision queries on the pool, or inside a migration's transaction
+type collisionQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Lists the users that collide under case-insensitive, whitespace-trimmed
+// user_name and email, so they can be cleaned up before migrating. Works on
+// any schema version, including before the unique indexes exist.
+func FindUserCollisions(ctx context.Context, dbcon *sql.DB) ([]Collision, error) {
+	return findUserCollisions(ctx, dbcon)
+}
+
+// Fails with a CollisionError when any users collide
+func checkUserCollisions(ctx context.Context, tx *sql.Tx) error {
+	collisions, err := findUserCollisions(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	if len(collisions) > 0 {
+		return &CollisionError{Collisions: collisions}
+	}
+
+	return nil
+}
+
+func findUserCollisions(ctx context.Context, q collisionQueryer) ([]Collision, error) {
+	var collisions []Collision
+
+	for _, field := range []string{"user_name", "email"} {
+		// field is one of the two fixed column names above
+		key := "LOWER(TRIM(" + field + "))"
+		query := `SELECT ` + key + `, user_id, user_name, email FROM users
+WHERE ` + key + ` IN (SELECT ` + key + ` FROM users GROUP BY ` + key + ` HAVING COUNT(*) > 1)
+ORDER BY 1, user_id`
+
+		found, err := queryCollisions(ctx, q, field, query)
+		if err != nil {
+			return nil, err
+		}
+		collisions = append(collisions, found...)
+	}
+
+	return collisions, nil
+}
+
+// Groups the rows of a collision query, which are ordered by key
+func queryCollisions(ctx context.Context, q collisionQueryer, field string, query string) ([]Collision, error) {
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var collisions []Collision
+
+	for rows.Next() {
+		var key string
+		var u CollidingUser
+		if err := rows.Scan(&key, &u.UserID, &u.UserName, &u.Email); err != nil {
+			return nil, err
+		}
+
+		if len(collisions) == 0 || collisions[len(collisions)-1].Key != key {
+			collisions = append(collisions, Collision{Field: field, Key: key})
+		}
+		last := &collisions[len(collisions)-1]
+		last.Users = append(last.Users, u)
+	}
+
+	return collisions, rows.Err()
+}
@@ -0,0 +1,26 @@
+package db
+
+import sq "github.com/Masterminds/squirrel"
+
+// Dialect captures the SQL differences between the supported databases so
+// the same squirrel-built queries can run against each of them
+type Dialect struct {
+	Name        string
+	Placeholder sq.PlaceholderFormat
+	// Returning is true when INSERT/UPDATE ... RETURNING can be relied on.
+	// Otherwise the generated ID is read back with LastInsertId.
+	Returning bool
+	// ForUpdate is true when SELECT ... FOR UPDATE locks rows. SQLite has no
+	// row locks; its transactions take the database write lock instead.
+	ForUpdate bool
+	// Copy is true when rows can be bulk loaded with COPY FROM STDIN
+	Copy bool
+	// Trigram is true when pg_trgm's similarity functions and indexes are
+	// there to search with
+	Trigram bool
+}
+
+var (
+	Postgres = Dialect{Name: DriverPostgres, Placeholder: sq.Dollar, Returning: true, ForUpdate: true, Copy: true, Trigram: true}
+	SQLite   = Dialect{Name: DriverSQLite, Placeholder: sq.Question, Returning: false}
+)
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Postgres SQLSTATEs for the constraint violations told apart below
+const (
+	pqUniqueViolation = "23505"
+	pqCheckViolation  = "23514"
+)
+
+// Unique indexes on users, named so violations can be told apart
+const (
+	IndexUsersUserName = "idx_users_user_name_lower"
+	IndexUsersEmail    = "idx_users_email_lower"
+	// On the email blind index. SQLite names the column instead:
+	// "users.email_hash".
+	IndexUsersEmailHash = "idx_users_email_hash"
+)
+
+// CHECK constraints on users are named users_<column>_check, after the
+// field they guard
+const (
+	CheckUsersUserName   = "users_user_name_check"
+	CheckUsersFirstName  = "users_first_name_check"
+	CheckUsersLastName   = "users_last_name_check"
+	CheckUsersEmail      = "users_email_check"
+	CheckUsersUserStatus = "users_user_status_check"
+)
+
+// Returns the name of the unique index or constraint err violated, if it is
+// a unique violation. SQLite only names the index for expression indexes;
+// otherwise the table and column are returned, e.g. "users.user_name".
+func UniqueViolation(err error) (string, bool) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Constraint, pqErr.Code == pqUniqueViolation
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		// "UNIQUE constraint failed: index 'name'" or "... failed: table.column"
+		_, target, _ := strings.Cut(sqliteErr.Error(), "UNIQUE constraint failed: ")
+		target, _, _ = strings.Cut(target, " (")
+		if name, ok := strings.CutPrefix(target, "index '"); ok {
+			target = strings.TrimSuffix(name, "'")
+		}
+		return target, true
+	}
+
+	return "", false
+}
+
+// Returns the name of the CHECK constraint err violated, if it is a check
+// violation from either database
+func CheckViolation(err error) (string, bool) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Constraint, pqErr.Code == pqCheckViolation
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_CHECK {
+		// "CHECK constraint failed: name (275)"
+		_, name, _ := strings.Cut(sqliteErr.Error(), "CHECK constraint failed: ")
+		name, _, _ = strings.Cut(name, " (")
+		return name, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,106 @@
+package db_test
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/steveperjesi/integra-demo/internal/db"
+)
+
+var _ = ginkgo.Describe("UniqueViolation", func() {
+	ginkgo.It("recognizes a Postgres unique violation, even wrapped", func() {
+		_, ok := db.UniqueViolation(fmt.Errorf("insert: %w", &pq.Error{Code: "23505"}))
+		gomega.Expect(ok).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("names the violated Postgres constraint", func() {
+		index, ok := db.UniqueViolation(&pq.Error{Code: "23505", Constraint: db.IndexUsersEmail})
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(index).To(gomega.Equal(db.IndexUsersEmail))
+	})
+
+	ginkgo.It("ignores other errors", func() {
+		for _, err := range []error{nil, errors.New("boom"), &pq.Error{Code: "23502"}} {
+			_, ok := db.UniqueViolation(err)
+			gomega.Expect(ok).To(gomega.BeFalse())
+		}
+	})
+
+	ginkgo.It("recognizes a SQLite unique violation", func() {
+		cfg, err := db.LoadPoolConfig()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		conn, err := db.OpenSQLite(":memory:", cfg)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer conn.Close()
+
+		_, err = conn.Exec(`CREATE TABLE t (name TEXT UNIQUE)`)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		_, err = conn.Exec(`INSERT INTO t (name) VALUES ('a')`)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		_, err = conn.Exec(`INSERT INTO t (name) VALUES ('a')`)
+		_, ok := db.UniqueViolation(err)
+		gomega.Expect(ok).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("names the violated SQLite index", func() {
+		cfg, err := db.LoadPoolConfig()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		conn, err := db.OpenSQLite(":memory:", cfg)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer conn.Close()
+
+		_, err = conn.Exec(`CREATE TABLE t (name TEXT)`)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		_, err = conn.Exec(`CREATE UNIQUE INDEX idx_t_name_lower ON t (LOWER(name))`)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		_, err = conn.Exec(`INSERT INTO t (name) VALUES ('a')`)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		_, err = conn.Exec(`INSERT INTO t (name) VALUES ('A')`)
+		index, ok := db.UniqueViolation(err)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(index).To(gomega.Equal("idx_t_name_lower"))
+	})
+})
+
+var _ = ginkgo.Describe("CheckViolation", func() {
+	ginkgo.It("names the violated Postgres constraint", func() {
+		name, ok := db.CheckViolation(fmt.Errorf("update: %w", &pq.Error{Code: "23514", Constraint: db.CheckUsersEmail}))
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(name).To(gomega.Equal(db.CheckUsersEmail))
+	})
+
+	ginkgo.It("ignores other errors", func() {
+		_, ok := db.CheckViolation(&pq.Error{Code: "23505"})
+		gomega.Expect(ok).To(gomega.BeFalse())
+
+		_, ok = db.CheckViolation(errors.New("boom"))
+		gomega.Expect(ok).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("names the violated SQLite constraint", func() {
+		cfg, err := db.LoadPoolConfig()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		conn, err := db.OpenSQLite(":memory:", cfg)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer conn.Close()
+
+		_, err = conn.Exec(`CREATE TABLE t (status TEXT CONSTRAINT t_status_check CHECK (status IN ('A', 'I')))`)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		_, err = conn.Exec(`INSERT INTO t (status) VALUES ('Z')`)
+		name, ok := db.CheckViolation(err)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(name).To(gomega.Equal("t_status_check"))
+	})
+})
@@ -0,0 +1,293 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Encrypted values are stored as enc:<key id>:<wrapped data key>:<data>,
+// the last two base64 encoded
+const encryptedPrefix = "enc:"
+
+const keySize = 32
+
+var (
+	ErrKeyringRequired = errors.New("encrypted user data needs a keyring: set USER_KEYRING_FILE")
+	ErrUnknownKey      = errors.New("value is encrypted with a key missing from the keyring")
+	ErrMalformedValue  = errors.New("encrypted value is malformed or was tampered with")
+)
+
+// Keyring holds the keys PII columns are encrypted with. Each value is
+// sealed with a data key of its own, which is stored alongside it wrapped by
+// the keyring's primary key (envelope encryption). Moving values to a new
+// primary only rewraps their data keys; the data isn't re-encrypted.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+	// Keys the blind index; unlike the wrapping keys it can't be rotated
+	// without recomputing every index
+	indexKey []byte
+}
+
+// The keyring file. Keys are base64 encoded 32 byte AES-256 keys; IDs name
+// them in the values they wrap and can't contain a colon.
+type keyringFile struct {
+	Primary  string            `json:"primary"`
+	Keys     map[string]string `json:"keys"`
+	IndexKey string            `json:"index_key"`
+}
+
+// Reads the keyring named by USER_KEYRING_FILE. A nil keyring with a nil
+// error means none is configured and PII is stored in plaintext.
+func LoadKeyring() (*Keyring, error) {
+	path := os.Getenv("USER_KEYRING_FILE")
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid USER_KEYRING_FILE: %w", err)
+	}
+
+	keys, err := ParseKeyring(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid USER_KEYRING_FILE: %w", err)
+	}
+
+	return keys, nil
+}
+
+func ParseKeyring(data []byte) (*Keyring, error) {
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	if _, ok := file.Keys[file.Primary]; !ok {
+		return nil, errors.New("primary must name one of the keys")
+	}
+
+	k := &Keyring{primary: file.Primary, keys: make(map[string]cipher.AEAD, len(file.Keys))}
+
+	for id, encoded := range file.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key id %q: must be non-empty without a colon", id)
+		}
+
+		key, err := decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+
+		if k.keys[id], err = newAEAD(key); err != nil {
+			return nil, err
+		}
+	}
+
+	indexKey, err := decodeKey(file.IndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index_key: %w", err)
+	}
+	k.indexKey = indexKey
+
+	return k, nil
+}
+
+// ID of the key new values are wrapped with
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// Encrypts plaintext under a fresh data key wrapped by the primary key
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	wrapped, err := seal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return "", err
+	}
+
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := seal(data, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + k.primary + ":" + encode(wrapped) + ":" + encode(sealed), nil
+}
+
+// Decrypts a value from Encrypt. Values that aren't encrypted, written
+// before a keyring was configured, are returned as they are. Safe to call on
+// a nil keyring, which only fails for encrypted values.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	if k == nil {
+		return "", ErrKeyringRequired
+	}
+
+	id, wrapped, sealed, err := splitEncrypted(value)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := k.unwrap(id, wrapped)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(data, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// Brings a stored value under the primary key: plaintext is encrypted and
+// a data key wrapped by another key is rewrapped. Reports whether the value
+// changed.
+func (k *Keyring) Rewrap(value string) (string, bool, error) {
+	if !IsEncrypted(value) {
+		encrypted, err := k.Encrypt(value)
+		return encrypted, err == nil, err
+	}
+
+	id, wrapped, sealed, err := splitEncrypted(value)
+	if err != nil {
+		return "", false, err
+	}
+
+	if id == k.primary {
+		return value, false, nil
+	}
+
+	dataKey, err := k.unwrap(id, wrapped)
+	if err != nil {
+		return "", false, err
+	}
+
+	rewrapped, err := seal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return "", false, err
+	}
+
+	return encryptedPrefix + k.primary + ":" + encode(rewrapped) + ":" + encode(sealed), true, nil
+}
+
+// Returns a keyed hash of value that can be indexed and compared for
+// equality without revealing it. Callers normalize value first.
+func (k *Keyring) BlindIndex(value string) string {
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Reports whether a stored value was written by Encrypt
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+func (k *Keyring) unwrap(id string, wrapped []byte) ([]byte, error) {
+	wrapper, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return open(wrapper, wrapped, []byte(id))
+}
+
+func splitEncrypted(value string) (string, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, ErrMalformedValue
+	}
+
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, ErrMalformedValue
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, ErrMalformedValue
+	}
+
+	return parts[0], wrapped, sealed, nil
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("must be base64")
+	}
+
+	if len(key) != keySize {
+		return nil, fmt.Errorf("must be %d bytes", keySize)
+	}
+
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Seals plaintext behind a random nonce, which is prepended
+func seal(aead cipher.AEAD, plaintext []byte, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformedValue
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return nil, ErrMalformedValue
+	}
+
+	return plaintext, nil
+}
+
+func encode(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
@@ -0,0 +1,162 @@
+package db_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/steveperjesi/integra-demo/internal/db"
+)
+
+const (
+	testKey1     = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testKey2     = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+	testIndexKey = "aW5kZXgta2V5LWluZGV4LWtleS1pbmRleC1rZXktMzI="
+)
+
+func keyringJSON(primary string, keys map[string]string) string {
+	var entries []string
+	for id, key := range keys {
+		entries = append(entries, `"`+id+`": "`+key+`"`)
+	}
+	return `{"primary": "` + primary + `", "keys": {` + strings.Join(entries, ", ") + `}, "index_key": "` + testIndexKey + `"}`
+}
+
+func mustParseKeyring(primary string, keys map[string]string) *db.Keyring {
+	k, err := db.ParseKeyring([]byte(keyringJSON(primary, keys)))
+	gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	return k
+}
+
+var _ = ginkgo.Describe("Keyring", func() {
+	both := map[string]string{"k1": testKey1, "k2": testKey2}
+
+	ginkgo.It("round trips a value through a fresh data key each time", func() {
+		k := mustParseKeyring("k1", both)
+
+		first, err := k.Encrypt("jdoe@example.com")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(first).To(gomega.HavePrefix("enc:k1:"))
+		gomega.Expect(first).ToNot(gomega.ContainSubstring("jdoe"))
+		gomega.Expect(db.IsEncrypted(first)).To(gomega.BeTrue())
+
+		second, err := k.Encrypt("jdoe@example.com")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(second).ToNot(gomega.Equal(first))
+
+		plaintext, err := k.Decrypt(first)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(plaintext).To(gomega.Equal("jdoe@example.com"))
+	})
+
+	ginkgo.It("passes plaintext through, even without a keyring", func() {
+		var none *db.Keyring
+
+		plaintext, err := none.Decrypt("John")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(plaintext).To(gomega.Equal("John"))
+
+		encrypted, err := mustParseKeyring("k1", both).Encrypt("John")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		_, err = none.Decrypt(encrypted)
+		gomega.Expect(err).To(gomega.Equal(db.ErrKeyringRequired))
+	})
+
+	ginkgo.It("rewraps the data key under a new primary without touching the data", func() {
+		old := mustParseKeyring("k1", both)
+		encrypted, err := old.Encrypt("Doe")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		k := mustParseKeyring("k2", both)
+
+		rewrapped, changed, err := k.Rewrap(encrypted)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(changed).To(gomega.BeTrue())
+		gomega.Expect(rewrapped).To(gomega.HavePrefix("enc:k2:"))
+
+		data := func(value string) string { return value[strings.LastIndex(value, ":"):] }
+		gomega.Expect(data(rewrapped)).To(gomega.Equal(data(encrypted)))
+
+		// Readable with k2 alone now
+		only2 := mustParseKeyring("k2", map[string]string{"k2": testKey2})
+		plaintext, err := only2.Decrypt(rewrapped)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(plaintext).To(gomega.Equal("Doe"))
+
+		_, err = only2.Decrypt(encrypted)
+		gomega.Expect(err).To(gomega.Equal(db.ErrUnknownKey))
+
+		same, changed, err := k.Rewrap(rewrapped)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(changed).To(gomega.BeFalse())
+		gomega.Expect(same).To(gomega.Equal(rewrapped))
+
+		fromPlaintext, changed, err := k.Rewrap("Doe")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(changed).To(gomega.BeTrue())
+		gomega.Expect(fromPlaintext).To(gomega.HavePrefix("enc:k2:"))
+	})
+
+	ginkgo.It("rejects tampered values", func() {
+		k := mustParseKeyring("k1", both)
+		encrypted, err := k.Encrypt("John")
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		tampered := encrypted[:len(encrypted)-2] + "AA"
+		if tampered == encrypted {
+			tampered = encrypted[:len(encrypted)-2] + "BB"
+		}
+
+		_, err = k.Decrypt(tampered)
+		gomega.Expect(err).To(gomega.Equal(db.ErrMalformedValue))
+
+		_, err = k.Decrypt("enc:k1:nope")
+		gomega.Expect(err).To(gomega.Equal(db.ErrMalformedValue))
+	})
+
+	ginkgo.It("computes a stable blind index that doesn't depend on the primary", func() {
+		k1 := mustParseKeyring("k1", both)
+		k2 := mustParseKeyring("k2", both)
+
+		gomega.Expect(k1.BlindIndex("jdoe@example.com")).To(gomega.HaveLen(64))
+		gomega.Expect(k1.BlindIndex("jdoe@example.com")).To(gomega.Equal(k2.BlindIndex("jdoe@example.com")))
+		gomega.Expect(k1.BlindIndex("jdoe@example.com")).ToNot(gomega.Equal(k1.BlindIndex("asmith@example.com")))
+	})
+
+	ginkgo.It("rejects malformed keyrings", func() {
+		for _, data := range []string{
+			`not json`,
+			keyringJSON("k3", both),
+			keyringJSON("k1", map[string]string{"k1": "short"}),
+			keyringJSON("k1", map[string]string{"k1": testKey1, "a:b": testKey2}),
+			`{"primary": "k1", "keys": {"k1": "` + testKey1 + `"}}`,
+		} {
+			_, err := db.ParseKeyring([]byte(data))
+			gomega.Expect(err).To(gomega.HaveOccurred(), data)
+		}
+	})
+
+	ginkgo.It("is loaded from USER_KEYRING_FILE when set", func() {
+		ginkgo.DeferCleanup(os.Unsetenv, "USER_KEYRING_FILE")
+
+		os.Unsetenv("USER_KEYRING_FILE")
+		k, err := db.LoadKeyring()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(k).To(gomega.BeNil())
+
+		path := filepath.Join(ginkgo.GinkgoT().TempDir(), "keyring.json")
+		gomega.Expect(os.WriteFile(path, []byte(keyringJSON("k2", both)), 0o600)).To(gomega.Succeed())
+		os.Setenv("USER_KEYRING_FILE", path)
+
+		k, err = db.LoadKeyring()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(k.Primary()).To(gomega.Equal("k2"))
+
+		os.Setenv("USER_KEYRING_FILE", filepath.Join(path, "missing"))
+		_, err = db.LoadKeyring()
+		gomega.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("invalid USER_KEYRING_FILE")))
+	})
+})
@@ -0,0 +1,373 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// Arbitrary key for pg_advisory_lock, shared by every instance of the app
+const migrationLockKey = 7_265_110_323
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Checks run before a migration's up script, inside its transaction, so it
+// fails with an error saying what to fix rather than a raw constraint
+// violation
+var upChecks = map[int64]func(ctx context.Context, tx *sql.Tx) error{
+	7: checkUserCollisions,
+}
+
+// Migration is one versioned schema change, loaded from
+// migrations/<dialect>/<version>_<name>.{up,down}.sql
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	// AppliedAt is nil when the migration is pending
+	AppliedAt *time.Time
+}
+
+// Migrator applies the embedded migrations for one dialect and records them
+// in the schema_migrations table
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+func NewMigrator(dbcon *sql.DB, dialect Dialect) (*Migrator, error) {
+	migrations, err := LoadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:         dbcon,
+		dialect:    dialect,
+		migrations: migrations,
+	}, nil
+}
+
+// Returns the embedded migrations for the dialect, ordered by version
+func LoadMigrations(dialect Dialect) ([]Migration, error) {
+	dir := path.Join("migrations", dialect.Name)
+
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %w", dialect.Name, err)
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		versionPart, label, ok := strings.Cut(strings.TrimSuffix(name, "."+direction+".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+
+		version, err := strconv.ParseInt(versionPart, 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %q", name)
+		}
+
+		contents, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, label)
+		}
+
+		if direction == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Returns the highest known migration version
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Applies every pending migration
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.Goto(ctx, m.Latest())
+}
+
+// Rolls back the most recently applied migration. Returns nil when there is
+// nothing to roll back.
+func (m *Migrator) Down(ctx context.Context) (*Migration, error) {
+	var rolledBack *Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; ok {
+				if err := m.run(ctx, conn, mig, false); err != nil {
+					return err
+				}
+				rolledBack = &mig
+				return nil
+			}
+		}
+
+		return nil
+	})
+
+	return rolledBack, err
+}
+
+// Migrates up or down until exactly the migrations <= version are applied.
+// Goto(0) rolls back everything.
+func (m *Migrator) Goto(ctx context.Context, version int64) ([]Migration, error) {
+	if version < 0 || (version > 0 && m.find(version) == nil) {
+		return nil, fmt.Errorf("unknown migration version %d", version)
+	}
+
+	var changed []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		// Roll back newest first, then apply oldest first
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; ok && mig.Version > version {
+				if err := m.run(ctx, conn, mig, false); err != nil {
+					return err
+				}
+				changed = append(changed, mig)
+			}
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; !ok && mig.Version <= version {
+				if err := m.run(ctx, conn, mig, true); err != nil {
+					return err
+				}
+				changed = append(changed, mig)
+			}
+		}
+
+		return nil
+	})
+
+	return changed, err
+}
+
+// Reports every known migration and when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			status := MigrationStatus{Migration: mig}
+			if appliedAt, ok := applied[mig.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+func (m *Migrator) find(version int64) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+// Runs fn on a dedicated connection while holding the migration lock, so
+// concurrent instances starting up don't race each other.
+//
+// Postgres uses a session-level advisory lock. SQLite pools are opened with
+// _txlock=immediate, so each migration transaction already holds the
+// database write lock and re-checks its own state before running.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.dialect.Name == DriverPostgres {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey)
+	}
+
+	if _, err := conn.ExecContext(ctx, m.trackingTableSQL()); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	return fn(conn)
+}
+
+func (m *Migrator) trackingTableSQL() string {
+	appliedAtType := "TIMESTAMPTZ"
+	if m.dialect.Name == DriverSQLite {
+		appliedAtType = "TIMESTAMP"
+	}
+
+	return `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version BIGINT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    applied_at ` + appliedAtType + ` NOT NULL
+)`
+}
+
+// Returns applied migration versions and when they were applied
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// Applies (up) or rolls back (down) a single migration in its own
+// transaction, together with its schema_migrations bookkeeping
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, mig Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Another instance may have gotten here first
+	countQuery, countArgs, err := sq.Select("COUNT(*)").
+		From("schema_migrations").
+		Where(sq.Eq{"version": mig.Version}).
+		PlaceholderFormat(m.dialect.Placeholder).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	var count int
+	if err := tx.QueryRowContext(ctx, countQuery, countArgs...).Scan(&count); err != nil {
+		return err
+	}
+	if (count == 1) == up {
+		return nil
+	}
+
+	script := mig.Down
+	bookkeeping := sq.Sqlizer(sq.Delete("schema_migrations").
+		Where(sq.Eq{"version": mig.Version}).
+		PlaceholderFormat(m.dialect.Placeholder))
+
+	if up {
+		script = mig.Up
+		bookkeeping = sq.Insert("schema_migrations").
+			Columns("version", "name", "applied_at").
+			Values(mig.Version, mig.Name, time.Now().UTC()).
+			PlaceholderFormat(m.dialect.Placeholder)
+	}
+
+	query, args, err := bookkeeping.ToSql()
+	if err != nil {
+		return err
+	}
+
+	if check := upChecks[mig.Version]; up && check != nil {
+		if err := check(ctx, tx); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %w", mig.Version, mig.Name, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d_%s failed: %w", mig.Version, mig.Name, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
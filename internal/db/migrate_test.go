@@ -0,0 +1,290 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/steveperjesi/integra-demo/internal/db"
+)
+
+var _ = ginkgo.Describe("LoadMigrations", func() {
+	ginkgo.It("loads matching migrations for every dialect", func() {
+		pg, err := db.LoadMigrations(db.Postgres)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		lite, err := db.LoadMigrations(db.SQLite)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		gomega.Expect(pg).ToNot(gomega.BeEmpty())
+		gomega.Expect(lite).To(gomega.HaveLen(len(pg)))
+
+		for i := range pg {
+			gomega.Expect(lite[i].Version).To(gomega.Equal(pg[i].Version))
+			gomega.Expect(lite[i].Name).To(gomega.Equal(pg[i].Name))
+			if i > 0 {
+				gomega.Expect(pg[i].Version).To(gomega.BeNumerically(">", pg[i-1].Version))
+			}
+		}
+	})
+})
+
+var _ = ginkgo.Describe("Migrator", func() {
+	var (
+		ctx      context.Context
+		conn     *sql.DB
+		migrator *db.Migrator
+	)
+
+	tableExists := func(name string) bool {
+		var count int
+		err := conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&count)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		return count == 1
+	}
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+
+		cfg, err := db.LoadPoolConfig()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		conn, err = db.OpenSQLite(":memory:", cfg)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		migrator, err = db.NewMigrator(conn, db.SQLite)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.AfterEach(func() {
+		conn.Close()
+	})
+
+	ginkgo.It("applies every pending migration once", func() {
+		applied, err := migrator.Up(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(applied).ToNot(gomega.BeEmpty())
+		gomega.Expect(tableExists("users")).To(gomega.BeTrue())
+
+		applied, err = migrator.Up(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(applied).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("reports pending and applied migrations", func() {
+		statuses, err := migrator.Status(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		for _, s := range statuses {
+			gomega.Expect(s.AppliedAt).To(gomega.BeNil())
+		}
+
+		_, err = migrator.Up(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		statuses, err = migrator.Status(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		for _, s := range statuses {
+			gomega.Expect(s.AppliedAt).ToNot(gomega.BeNil())
+		}
+	})
+
+	ginkgo.It("rolls back the latest migration with Down", func() {
+		_, err := migrator.Up(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		rolledBack, err := migrator.Down(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(rolledBack.Version).To(gomega.Equal(migrator.Latest()))
+
+		statuses, err := migrator.Status(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(statuses[len(statuses)-1].AppliedAt).To(gomega.BeNil())
+	})
+
+	ginkgo.It("returns nil from Down when nothing is applied", func() {
+		rolledBack, err := migrator.Down(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(rolledBack).To(gomega.BeNil())
+	})
+
+	ginkgo.It("migrates to a version with Goto", func() {
+		_, err := migrator.Goto(ctx, 1)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(tableExists("users")).To(gomega.BeTrue())
+
+		_, err = migrator.Goto(ctx, 0)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(tableExists("users")).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("backfills user timestamps from the audit trail", func() {
+		_, err := migrator.Goto(ctx, 4)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		_, err = conn.Exec(`INSERT INTO users (user_name, first_name, last_name, email, user_status) VALUES ('jdoe', 'John', 'Doe', 'jdoe@example.com', 'A')`)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		_, err = conn.Exec(`INSERT INTO user_audit (user_id, actor, operation, changes, created_at) VALUES (1, 'tester', 'create', '{}', ?)`, created)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		_, err = migrator.Up(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		var createdAt, updatedAt time.Time
+		err = conn.QueryRow(`SELECT created_at, updated_at FROM users WHERE user_id = 1`).Scan(&createdAt, &updatedAt)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(createdAt.Equal(created)).To(gomega.BeTrue())
+		gomega.Expect(updatedAt.Equal(created)).To(gomega.BeTrue())
+
+		_, err = migrator.Goto(ctx, 4)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("reports users that collide ignoring case and refuses to migrate them", func() {
+		_, err := migrator.Goto(ctx, 6)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		for _, u := range [][2]string{
+			{"jdoe", "jdoe@example.com"},
+			{"JDoe", "john@example.com"},
+			{"asmith", " John@Example.com"},
+			{"bwayne", "bwayne@example.com"},
+		} {
+			_, err = conn.Exec(`INSERT INTO users (user_name, first_name, last_name, email, user_status) VALUES (?, 'First', 'Last', ?, 'A')`, u[0], u[1])
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		}
+
+		collisions, err := db.FindUserCollisions(ctx, conn)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(collisions).To(gomega.Equal([]db.Collision{
+			{Field: "user_name", Key: "jdoe", Users: []db.CollidingUser{
+				{UserID: 1, UserName: "jdoe", Email: "jdoe@example.com"},
+				{UserID: 2, UserName: "JDoe", Email: "john@example.com"},
+			}},
+			{Field: "email", Key: "john@example.com", Users: []db.CollidingUser{
+				{UserID: 2, UserName: "JDoe", Email: "john@example.com"},
+				{UserID: 3, UserName: "asmith", Email: " John@Example.com"},
+			}},
+		}))
+
+		_, err = migrator.Up(ctx)
+		var collisionErr *db.CollisionError
+		gomega.Expect(errors.As(err, &collisionErr)).To(gomega.BeTrue())
+		gomega.Expect(collisionErr.Collisions).To(gomega.Equal(collisions))
+
+		// Once cleaned up, the migration goes through and normalizes emails
+		_, err = conn.Exec(`DELETE FROM users WHERE user_id = 2`)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		collisions, err = db.FindUserCollisions(ctx, conn)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(collisions).To(gomega.BeEmpty())
+
+		_, err = migrator.Up(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		var email string
+		err = conn.QueryRow(`SELECT email FROM users WHERE user_id = 3`).Scan(&email)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(email).To(gomega.Equal("john@example.com"))
+
+		_, err = conn.Exec(`INSERT INTO users (user_name, first_name, last_name, email, user_status) VALUES ('BWAYNE', 'First', 'Last', 'b@example.com', 'A')`)
+		index, _ := db.UniqueViolation(err)
+		gomega.Expect(index).To(gomega.Equal(db.IndexUsersUserName))
+	})
+
+	ginkgo.It("normalizes user_names that only differ by surrounding whitespace once they no longer collide", func() {
+		_, err := migrator.Goto(ctx, 6)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		for _, u := range [][2]string{
+			{"jdoe", "jdoe@example.com"},
+			{"jdoe ", "john@example.com"},
+		} {
+			_, err = conn.Exec(`INSERT INTO users (user_name, first_name, last_name, email, user_status) VALUES (?, 'First', 'Last', ?, 'A')`, u[0], u[1])
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		}
+
+		_, err = migrator.Up(ctx)
+		var collisionErr *db.CollisionError
+		gomega.Expect(errors.As(err, &collisionErr)).To(gomega.BeTrue())
+		gomega.Expect(collisionErr.Collisions).To(gomega.HaveLen(1))
+		gomega.Expect(collisionErr.Collisions[0].Key).To(gomega.Equal("jdoe"))
+
+		_, err = conn.Exec(`UPDATE users SET user_name = 'john ' WHERE user_id = 2`)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		_, err = migrator.Up(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		var userName string
+		err = conn.QueryRow(`SELECT user_name FROM users WHERE user_id = 2`).Scan(&userName)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(userName).To(gomega.Equal("john"))
+	})
+
+	ginkgo.It("folds invalid statuses into valid ones and keeps IDs when adding CHECK constraints", func() {
+		_, err := migrator.Goto(ctx, 10)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		for _, u := range [][2]string{{"jdoe", "t"}, {"asmith", "Z"}, {"purged", "A"}} {
+			_, err = conn.Exec(`INSERT INTO users (user_name, first_name, last_name, email, user_status) VALUES (?, 'First', 'Last', ? || '@example.com', ?)`, u[0], u[0], u[1])
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		}
+		_, err = conn.Exec(`DELETE FROM users WHERE user_name = 'purged'`)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		_, err = migrator.Up(ctx)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		var statuses string
+		err = conn.QueryRow(`SELECT GROUP_CONCAT(user_status, '') FROM (SELECT user_status FROM users ORDER BY user_id)`).Scan(&statuses)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(statuses).To(gomega.Equal("TI"))
+
+		_, err = conn.Exec(`INSERT INTO users (user_name, first_name, last_name, email, user_status) VALUES ('bwayne', 'First', 'Last', 'b@example.com', 'A')`)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		var id int64
+		err = conn.QueryRow(`SELECT user_id FROM users WHERE user_name = 'bwayne'`).Scan(&id)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(id).To(gomega.Equal(int64(4)))
+
+		_, err = conn.Exec(`UPDATE users SET email = 'nobody' WHERE user_id = 4`)
+		name, ok := db.CheckViolation(err)
+		gomega.Expect(ok).To(gomega.BeTrue())
+		gomega.Expect(name).To(gomega.Equal(db.CheckUsersEmail))
+	})
+
+	ginkgo.It("rejects unknown versions", func() {
+		_, err := migrator.Goto(ctx, 9999)
+		gomega.Expect(err).To(gomega.MatchError("unknown migration version 9999"))
+	})
+})
+
+var _ = ginkgo.Describe("Migrator on Postgres", func() {
+	ginkgo.It("holds an advisory lock while migrating", func() {
+		conn, mock, err := sqlmock.New()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		defer conn.Close()
+
+		migrator, err := db.NewMigrator(conn, db.Postgres)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").
+			WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}))
+		mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		_, err = migrator.Status(context.Background())
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(mock.ExpectationsWereMet()).To(gomega.Succeed())
+	})
+})
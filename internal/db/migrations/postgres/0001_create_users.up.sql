@@ -6,4 +6,6 @@ CREATE TABLE IF NOT EXISTS users (
     email VARCHAR(255) NOT NULL,
     user_status VARCHAR(1) NOT NULL,
     department VARCHAR(255)
-);
\ No newline at end of file
+);
+CREATE INDEX IF NOT EXISTS idx_users_email ON users (email);
+CREATE INDEX IF NOT EXISTS idx_users_user_status ON users (user_status);
@@ -0,0 +1,2 @@
+-- Row version for optimistic concurrency, bumped on every write
+ALTER TABLE users ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1,10 @@
+-- No foreign key to users: the trail outlives a purged user
+CREATE TABLE IF NOT EXISTS user_audit (
+    audit_id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    operation VARCHAR(32) NOT NULL,
+    changes JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_user_audit_user_id_created_at ON user_audit (user_id, created_at);
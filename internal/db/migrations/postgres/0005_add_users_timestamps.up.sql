@@ -0,0 +1,9 @@
+-- Maintained by the store. Existing users are backfilled from the audit
+-- trail where it reaches back far enough.
+ALTER TABLE users ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE users ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+UPDATE users SET
+    created_at = COALESCE((SELECT MIN(a.created_at) FROM user_audit a WHERE a.user_id = users.user_id), created_at),
+    updated_at = COALESCE((SELECT MAX(a.created_at) FROM user_audit a WHERE a.user_id = users.user_id), updated_at);
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users (created_at);
+CREATE INDEX IF NOT EXISTS idx_users_updated_at ON users (updated_at);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_users_email_lower;
+DROP INDEX IF EXISTS idx_users_user_name_lower;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_user_name ON users (user_name);
+CREATE INDEX IF NOT EXISTS idx_users_email ON users (email);
@@ -0,0 +1,17 @@
+-- Events for downstream systems, written in the same transaction as the
+-- user change and delivered by the relay. No foreign key to users: events
+-- for a purged user still have to go out.
+CREATE TABLE IF NOT EXISTS user_outbox (
+    event_id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    event_type VARCHAR(32) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    delivered_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_user_outbox_status_next_attempt_at ON user_outbox (status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_user_outbox_user_id_event_id ON user_outbox (user_id, event_id);
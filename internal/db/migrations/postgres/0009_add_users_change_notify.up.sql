@@ -0,0 +1,26 @@
+-- Announces every change to a user row on the user_changes channel. The
+-- payload names the row only; NOTIFY payloads are capped at 8000 bytes and
+-- listeners read the row itself when they need it.
+CREATE OR REPLACE FUNCTION notify_user_change() RETURNS trigger AS $$
+DECLARE
+    changed users%ROWTYPE;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD;
+    ELSE
+        changed := NEW;
+    END IF;
+
+    PERFORM pg_notify('user_changes', json_build_object(
+        'op', lower(TG_OP),
+        'user_id', changed.user_id,
+        'version', changed.version
+    )::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_notify_change
+    AFTER INSERT OR UPDATE OR DELETE ON users
+    FOR EACH ROW EXECUTE FUNCTION notify_user_change();
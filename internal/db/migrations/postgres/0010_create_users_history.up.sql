@@ -0,0 +1,20 @@
+-- Earlier versions of user rows, written by the store whenever a user is
+-- changed or purged. A version was current from its updated_at until
+-- valid_to; the row in users is current from its updated_at on.
+CREATE TABLE IF NOT EXISTS users_history (
+    history_id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    user_name VARCHAR(50) NOT NULL,
+    first_name VARCHAR(255) NOT NULL,
+    last_name VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    user_status VARCHAR(1) NOT NULL,
+    department VARCHAR(255),
+    deleted_at TIMESTAMPTZ,
+    version BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    valid_to TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_users_history_user_id_valid_to ON users_history (user_id, valid_to);
+CREATE INDEX IF NOT EXISTS idx_users_history_valid_to ON users_history (valid_to);
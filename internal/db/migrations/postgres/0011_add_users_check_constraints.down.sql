@@ -0,0 +1,5 @@
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_last_name_check;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_first_name_check;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_user_name_check;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_check;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_user_status_check;
@@ -0,0 +1,11 @@
+-- Statuses stored before updates were validated are folded into a valid one
+-- the way SetUserStatus does: a/i/t in any case, anything else inactive.
+UPDATE users SET user_status = CASE UPPER(TRIM(user_status)) WHEN 'A' THEN 'A' WHEN 'T' THEN 'T' ELSE 'I' END
+WHERE user_status NOT IN ('A', 'I', 'T');
+-- Named users_<column>_check so violations map back to the field. Fails if
+-- a user has a blank name or a malformed email; fix those before migrating.
+ALTER TABLE users ADD CONSTRAINT users_user_status_check CHECK (user_status IN ('A', 'I', 'T'));
+ALTER TABLE users ADD CONSTRAINT users_email_check CHECK (email ~ '^[^@[:space:]]+@[^@[:space:]]+\.[^@[:space:]]+$');
+ALTER TABLE users ADD CONSTRAINT users_user_name_check CHECK (TRIM(user_name) <> '');
+ALTER TABLE users ADD CONSTRAINT users_first_name_check CHECK (TRIM(first_name) <> '');
+ALTER TABLE users ADD CONSTRAINT users_last_name_check CHECK (TRIM(last_name) <> '');
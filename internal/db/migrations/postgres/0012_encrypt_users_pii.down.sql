@@ -0,0 +1,30 @@
+CREATE OR REPLACE FUNCTION notify_user_change() RETURNS trigger AS $$
+DECLARE
+    changed users%ROWTYPE;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD;
+    ELSE
+        changed := NEW;
+    END IF;
+
+    PERFORM pg_notify('user_changes', json_build_object(
+        'op', lower(TG_OP),
+        'user_id', changed.user_id,
+        'version', changed.version
+    )::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- Fails while encrypted rows remain; they can't be decrypted in SQL.
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_check;
+ALTER TABLE users ADD CONSTRAINT users_email_check CHECK (email ~ '^[^@[:space:]]+@[^@[:space:]]+\.[^@[:space:]]+$');
+DROP INDEX IF EXISTS idx_users_email_hash;
+ALTER TABLE users DROP COLUMN IF EXISTS email_hash;
+ALTER TABLE users_history ALTER COLUMN email TYPE VARCHAR(255);
+ALTER TABLE users_history ALTER COLUMN last_name TYPE VARCHAR(255);
+ALTER TABLE users_history ALTER COLUMN first_name TYPE VARCHAR(255);
+ALTER TABLE users ALTER COLUMN email TYPE VARCHAR(255);
+ALTER TABLE users ALTER COLUMN last_name TYPE VARCHAR(255);
+ALTER TABLE users ALTER COLUMN first_name TYPE VARCHAR(255);
@@ -0,0 +1,41 @@
+-- With a keyring configured, first_name, last_name and email are stored
+-- encrypted, which outgrows VARCHAR(255). Rows already stored stay in
+-- plaintext until `rotate-keys` encrypts them.
+ALTER TABLE users ALTER COLUMN first_name TYPE TEXT;
+ALTER TABLE users ALTER COLUMN last_name TYPE TEXT;
+ALTER TABLE users ALTER COLUMN email TYPE TEXT;
+ALTER TABLE users_history ALTER COLUMN first_name TYPE TEXT;
+ALTER TABLE users_history ALTER COLUMN last_name TYPE TEXT;
+ALTER TABLE users_history ALTER COLUMN email TYPE TEXT;
+-- Keyed hash of the lowercased email, so encrypted emails can still be
+-- looked up and kept unique
+ALTER TABLE users ADD COLUMN email_hash VARCHAR(64);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_hash ON users (email_hash);
+-- Only a plaintext email can be checked for shape
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_check;
+ALTER TABLE users ADD CONSTRAINT users_email_check CHECK (email LIKE 'enc:%' OR email ~ '^[^@[:space:]]+@[^@[:space:]]+\.[^@[:space:]]+$');
+-- `rotate-keys` rewrites rows without changing the user or its version;
+-- change feed listeners aren't told about those writes.
+CREATE OR REPLACE FUNCTION notify_user_change() RETURNS trigger AS $$
+DECLARE
+    changed users%ROWTYPE;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD;
+    ELSE
+        changed := NEW;
+    END IF;
+
+    IF TG_OP = 'UPDATE' AND NEW.version = OLD.version THEN
+        RETURN NULL;
+    END IF;
+
+    PERFORM pg_notify('user_changes', json_build_object(
+        'op', lower(TG_OP),
+        'user_id', changed.user_id,
+        'version', changed.version
+    )::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,5 @@
+-- pg_trgm is left installed; other schemas in the database may use it.
+DROP INDEX IF EXISTS idx_users_user_name_trgm;
+DROP INDEX IF EXISTS idx_users_first_name_trgm;
+DROP INDEX IF EXISTS idx_users_last_name_trgm;
+DROP INDEX IF EXISTS idx_users_email_trgm;
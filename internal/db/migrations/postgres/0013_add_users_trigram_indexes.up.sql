@@ -0,0 +1,8 @@
+-- Trigram indexes behind GET /users/search. They serve both the word
+-- similarity (<%) and substring (LIKE '%q%') matches the search makes on
+-- the lowercased columns.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS idx_users_user_name_trgm ON users USING GIN (LOWER(user_name) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_first_name_trgm ON users USING GIN (LOWER(first_name) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_last_name_trgm ON users USING GIN (LOWER(last_name) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_email_trgm ON users USING GIN (LOWER(email) gin_trgm_ops);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_users_email_domain_hash;
+ALTER TABLE users_history DROP COLUMN IF EXISTS email_domain_hash;
+ALTER TABLE users DROP COLUMN IF EXISTS email_domain_hash;
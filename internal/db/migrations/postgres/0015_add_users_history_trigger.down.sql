@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS users_record_version ON users;
+DROP FUNCTION IF EXISTS record_user_version();
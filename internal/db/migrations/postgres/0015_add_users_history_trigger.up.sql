@@ -0,0 +1,29 @@
+-- Versions are kept by the database rather than the store, so writes made
+-- outside it (psql, other services) leave one as well. Updates that keep
+-- the version, as `rotate-keys` makes, aren't a change of the user.
+CREATE OR REPLACE FUNCTION record_user_version() RETURNS trigger AS $$
+DECLARE
+    ended_at TIMESTAMPTZ := now();
+BEGIN
+    IF TG_OP = 'UPDATE' THEN
+        IF NEW.version = OLD.version THEN
+            RETURN NULL;
+        END IF;
+
+        -- The old version stops being current at the new updated_at, or now
+        -- when the write didn't move it forward
+        IF NEW.updated_at > OLD.updated_at THEN
+            ended_at := NEW.updated_at;
+        END IF;
+    END IF;
+
+    INSERT INTO users_history (user_id, user_name, first_name, last_name, email, user_status, department, deleted_at, version, created_at, updated_at, valid_to, email_domain_hash)
+    VALUES (OLD.user_id, OLD.user_name, OLD.first_name, OLD.last_name, OLD.email, OLD.user_status, OLD.department, OLD.deleted_at, OLD.version, OLD.created_at, OLD.updated_at, ended_at, OLD.email_domain_hash);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_record_version
+    AFTER UPDATE OR DELETE ON users
+    FOR EACH ROW EXECUTE FUNCTION record_user_version();
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS users (
+    -- AUTOINCREMENT keeps IDs from being reused, like an identity column
+    user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_name VARCHAR(50) NOT NULL,
+    first_name VARCHAR(255) NOT NULL,
+    last_name VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    user_status VARCHAR(1) NOT NULL,
+    department VARCHAR(255)
+);
+CREATE INDEX IF NOT EXISTS idx_users_email ON users (email);
+CREATE INDEX IF NOT EXISTS idx_users_user_status ON users (user_status);
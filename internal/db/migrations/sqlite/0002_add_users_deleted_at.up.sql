@@ -0,0 +1,2 @@
+-- Soft delete: deleted rows keep their data until they are purged
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP;
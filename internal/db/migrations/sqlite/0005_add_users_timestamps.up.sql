@@ -0,0 +1,10 @@
+-- Maintained by the store. SQLite can't add a column defaulting to the
+-- current time, so existing users are backfilled: from the audit trail where
+-- it reaches back far enough, otherwise with the time of the migration.
+ALTER TABLE users ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00';
+ALTER TABLE users ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00';
+UPDATE users SET
+    created_at = COALESCE((SELECT MIN(a.created_at) FROM user_audit a WHERE a.user_id = users.user_id), strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    updated_at = COALESCE((SELECT MAX(a.created_at) FROM user_audit a WHERE a.user_id = users.user_id), strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'));
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users (created_at);
+CREATE INDEX IF NOT EXISTS idx_users_updated_at ON users (updated_at);
@@ -0,0 +1,3 @@
+-- Soft-deleted users keep their user_name, so the index covers every row.
+-- Fails if duplicates already exist; resolve them before migrating.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_user_name ON users (user_name);
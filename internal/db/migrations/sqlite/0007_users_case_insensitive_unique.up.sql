@@ -0,0 +1,12 @@
+-- The old indexes go first, so normalizing can't trip them on rows like
+-- "jdoe" and "jdoe ". The migrator checks beforehand that no rows collide
+-- once normalized; `migrate collisions` lists those that do. SQLite's LOWER() only
+-- folds ASCII letters.
+DROP INDEX IF EXISTS idx_users_user_name;
+DROP INDEX IF EXISTS idx_users_email;
+-- Stored values are normalized like new writes: user_name trimmed, email
+-- trimmed and lowercased.
+UPDATE users SET user_name = TRIM(user_name), email = LOWER(TRIM(email))
+WHERE user_name <> TRIM(user_name) OR email <> LOWER(TRIM(email));
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_user_name_lower ON users (LOWER(user_name));
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users (LOWER(email));
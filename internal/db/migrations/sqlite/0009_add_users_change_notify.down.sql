@@ -0,0 +1,3 @@
+-- SQLite has no LISTEN/NOTIFY. The version is kept so both dialects share
+-- one migration history.
+SELECT 1;
@@ -0,0 +1,25 @@
+-- Rebuilds users without the CHECK constraints
+CREATE TABLE users_unchecked (
+    user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_name VARCHAR(50) NOT NULL,
+    first_name VARCHAR(255) NOT NULL,
+    last_name VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    user_status VARCHAR(1) NOT NULL,
+    department VARCHAR(255),
+    deleted_at TIMESTAMP,
+    version INTEGER NOT NULL DEFAULT 1,
+    created_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00',
+    updated_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00'
+);
+INSERT INTO users_unchecked (user_id, user_name, first_name, last_name, email, user_status, department, deleted_at, version, created_at, updated_at)
+SELECT user_id, user_name, first_name, last_name, email, user_status, department, deleted_at, version, created_at, updated_at FROM users;
+DELETE FROM sqlite_sequence WHERE name = 'users_unchecked';
+INSERT INTO sqlite_sequence (name, seq) SELECT 'users_unchecked', seq FROM sqlite_sequence WHERE name = 'users';
+DROP TABLE users;
+ALTER TABLE users_unchecked RENAME TO users;
+CREATE INDEX IF NOT EXISTS idx_users_user_status ON users (user_status);
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users (created_at);
+CREATE INDEX IF NOT EXISTS idx_users_updated_at ON users (updated_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_user_name_lower ON users (LOWER(user_name));
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users (LOWER(email));
@@ -0,0 +1,38 @@
+-- Statuses stored before updates were validated are folded into a valid one
+-- the way SetUserStatus does: a/i/t in any case, anything else inactive.
+UPDATE users SET user_status = CASE UPPER(TRIM(user_status)) WHEN 'A' THEN 'A' WHEN 'T' THEN 'T' ELSE 'I' END
+WHERE user_status NOT IN ('A', 'I', 'T');
+-- SQLite can't add a CHECK to an existing table, so users is rebuilt with
+-- them. Named users_<column>_check so violations map back to the field.
+-- Fails if a user has a blank name or a malformed email; fix those before
+-- migrating. SQLite has no regular expressions, so the email shape is
+-- spelled out with LIKE and GLOB.
+CREATE TABLE users_checked (
+    user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_name VARCHAR(50) NOT NULL CONSTRAINT users_user_name_check CHECK (TRIM(user_name) <> ''),
+    first_name VARCHAR(255) NOT NULL CONSTRAINT users_first_name_check CHECK (TRIM(first_name) <> ''),
+    last_name VARCHAR(255) NOT NULL CONSTRAINT users_last_name_check CHECK (TRIM(last_name) <> ''),
+    email VARCHAR(255) NOT NULL CONSTRAINT users_email_check CHECK (
+        email LIKE '_%@_%._%'
+        AND email NOT LIKE '%@%@%'
+        AND email NOT GLOB ('*[ ' || char(9, 10, 13) || ']*')
+    ),
+    user_status VARCHAR(1) NOT NULL CONSTRAINT users_user_status_check CHECK (user_status IN ('A', 'I', 'T')),
+    department VARCHAR(255),
+    deleted_at TIMESTAMP,
+    version INTEGER NOT NULL DEFAULT 1,
+    created_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00',
+    updated_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00'
+);
+INSERT INTO users_checked (user_id, user_name, first_name, last_name, email, user_status, department, deleted_at, version, created_at, updated_at)
+SELECT user_id, user_name, first_name, last_name, email, user_status, department, deleted_at, version, created_at, updated_at FROM users;
+-- Carry the AUTOINCREMENT counter over so purged IDs are never reused
+DELETE FROM sqlite_sequence WHERE name = 'users_checked';
+INSERT INTO sqlite_sequence (name, seq) SELECT 'users_checked', seq FROM sqlite_sequence WHERE name = 'users';
+DROP TABLE users;
+ALTER TABLE users_checked RENAME TO users;
+CREATE INDEX IF NOT EXISTS idx_users_user_status ON users (user_status);
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users (created_at);
+CREATE INDEX IF NOT EXISTS idx_users_updated_at ON users (updated_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_user_name_lower ON users (LOWER(user_name));
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users (LOWER(email));
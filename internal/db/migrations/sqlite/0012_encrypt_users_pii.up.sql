@@ -0,0 +1,39 @@
+-- With a keyring configured, first_name, last_name and email are stored
+-- encrypted. SQLite doesn't enforce VARCHAR lengths, but users is rebuilt
+-- so the email check lets encrypted values through, and gains email_hash: a
+-- keyed hash of the lowercased email so encrypted emails can still be
+-- looked up and kept unique. Rows already stored stay in plaintext until
+-- `rotate-keys` encrypts them.
+CREATE TABLE users_encrypted (
+    user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_name VARCHAR(50) NOT NULL CONSTRAINT users_user_name_check CHECK (TRIM(user_name) <> ''),
+    first_name TEXT NOT NULL CONSTRAINT users_first_name_check CHECK (TRIM(first_name) <> ''),
+    last_name TEXT NOT NULL CONSTRAINT users_last_name_check CHECK (TRIM(last_name) <> ''),
+    email TEXT NOT NULL CONSTRAINT users_email_check CHECK (
+        email LIKE 'enc:%'
+        OR (
+            email LIKE '_%@_%._%'
+            AND email NOT LIKE '%@%@%'
+            AND email NOT GLOB ('*[ ' || char(9, 10, 13) || ']*')
+        )
+    ),
+    user_status VARCHAR(1) NOT NULL CONSTRAINT users_user_status_check CHECK (user_status IN ('A', 'I', 'T')),
+    department VARCHAR(255),
+    deleted_at TIMESTAMP,
+    version INTEGER NOT NULL DEFAULT 1,
+    created_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00',
+    updated_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00',
+    email_hash VARCHAR(64)
+);
+INSERT INTO users_encrypted (user_id, user_name, first_name, last_name, email, user_status, department, deleted_at, version, created_at, updated_at)
+SELECT user_id, user_name, first_name, last_name, email, user_status, department, deleted_at, version, created_at, updated_at FROM users;
+DELETE FROM sqlite_sequence WHERE name = 'users_encrypted';
+INSERT INTO sqlite_sequence (name, seq) SELECT 'users_encrypted', seq FROM sqlite_sequence WHERE name = 'users';
+DROP TABLE users;
+ALTER TABLE users_encrypted RENAME TO users;
+CREATE INDEX IF NOT EXISTS idx_users_user_status ON users (user_status);
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users (created_at);
+CREATE INDEX IF NOT EXISTS idx_users_updated_at ON users (updated_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_user_name_lower ON users (LOWER(user_name));
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users (LOWER(email));
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_hash ON users (email_hash);
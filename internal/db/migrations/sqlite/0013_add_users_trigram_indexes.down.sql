@@ -0,0 +1,3 @@
+-- SQLite has no trigram indexes; searches are scored in the application.
+-- The version is kept so both dialects share one migration history.
+SELECT 1;
@@ -0,0 +1,7 @@
+-- Keyed hash of the lowercased domain of the email, so lists can still be
+-- filtered on email_domain when emails are encrypted. Versions keep it too
+-- for as_of lists. Rows stored before stay without one until `rotate-keys`
+-- gives it them.
+ALTER TABLE users ADD COLUMN email_domain_hash VARCHAR(64);
+ALTER TABLE users_history ADD COLUMN email_domain_hash VARCHAR(64);
+CREATE INDEX IF NOT EXISTS idx_users_email_domain_hash ON users (email_domain_hash);
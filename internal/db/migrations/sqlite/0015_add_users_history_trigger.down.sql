@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS users_record_version_delete;
+DROP TRIGGER IF EXISTS users_record_version_update;
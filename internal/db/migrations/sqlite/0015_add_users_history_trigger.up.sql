@@ -0,0 +1,23 @@
+-- Versions are kept by the database rather than the store, so writes made
+-- outside it leave one as well. Updates that keep the version, as
+-- `rotate-keys` makes, aren't a change of the user. The old version stops
+-- being current at the new updated_at, or now when the write didn't move it;
+-- now is written in the layout the driver writes times in.
+CREATE TRIGGER IF NOT EXISTS users_record_version_update
+AFTER UPDATE ON users
+FOR EACH ROW WHEN NEW.version <> OLD.version
+BEGIN
+    INSERT INTO users_history (user_id, user_name, first_name, last_name, email, user_status, department, deleted_at, version, created_at, updated_at, valid_to, email_domain_hash)
+    VALUES (OLD.user_id, OLD.user_name, OLD.first_name, OLD.last_name, OLD.email, OLD.user_status, OLD.department, OLD.deleted_at, OLD.version, OLD.created_at, OLD.updated_at,
+        CASE WHEN NEW.updated_at <> OLD.updated_at THEN NEW.updated_at ELSE strftime('%Y-%m-%d %H:%M:%f+00:00', 'now') END,
+        OLD.email_domain_hash);
+END;
+
+CREATE TRIGGER IF NOT EXISTS users_record_version_delete
+AFTER DELETE ON users
+FOR EACH ROW
+BEGIN
+    INSERT INTO users_history (user_id, user_name, first_name, last_name, email, user_status, department, deleted_at, version, created_at, updated_at, valid_to, email_domain_hash)
+    VALUES (OLD.user_id, OLD.user_name, OLD.first_name, OLD.last_name, OLD.email, OLD.user_status, OLD.department, OLD.deleted_at, OLD.version, OLD.created_at, OLD.updated_at,
+        strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'), OLD.email_domain_hash);
+END;
@@ -1,6 +1,9 @@
 package db
 
-import "database/sql"
+import (
+	"database/sql"
+	"time"
+)
 
 type UserDB struct {
 	UserID     int64
@@ -10,4 +13,79 @@ type UserDB struct {
 	Email      string
 	UserStatus string
 	Department sql.NullString
+	DeletedAt  sql.NullTime
+	Version    int64
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	// Blind indexes of the email and of its domain, set when PII is
+	// encrypted. Only written; reads don't select them.
+	EmailHash       sql.NullString
+	EmailDomainHash sql.NullString
+}
+
+// Returns the scan destinations in the same order as AllColumns
+func (u *UserDB) ScanFields() []interface{} {
+	return []interface{}{
+		&u.UserID,
+		&u.UserName,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.UserStatus,
+		&u.Department,
+		&u.DeletedAt,
+		&u.Version,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+	}
+}
+
+type AuditDB struct {
+	AuditID   int64
+	UserID    int64
+	Actor     string
+	Operation string
+	Changes   []byte
+	CreatedAt time.Time
+}
+
+// Returns the scan destinations in the same order as AuditColumns
+func (a *AuditDB) ScanFields() []interface{} {
+	return []interface{}{
+		&a.AuditID,
+		&a.UserID,
+		&a.Actor,
+		&a.Operation,
+		&a.Changes,
+		&a.CreatedAt,
+	}
+}
+
+type OutboxDB struct {
+	EventID       int64
+	UserID        int64
+	EventType     string
+	Payload       []byte
+	Status        string
+	Attempts      int
+	LastError     sql.NullString
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	DeliveredAt   sql.NullTime
+}
+
+// Returns the scan destinations in the same order as OutboxColumns
+func (o *OutboxDB) ScanFields() []interface{} {
+	return []interface{}{
+		&o.EventID,
+		&o.UserID,
+		&o.EventType,
+		&o.Payload,
+		&o.Status,
+		&o.Attempts,
+		&o.LastError,
+		&o.NextAttemptAt,
+		&o.CreatedAt,
+		&o.DeliveredAt,
+	}
 }
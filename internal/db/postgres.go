@@ -1,15 +1,71 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
-func Connect() (*sql.DB, error) {
-	dsn := fmt.Sprintf(
+const (
+	defaultMaxOpenConns    = 25
+	defaultMaxIdleConns    = 25
+	defaultConnMaxLifetime = 30 * time.Minute
+	defaultConnMaxIdleTime = 5 * time.Minute
+	defaultPingTimeout     = 5 * time.Second
+)
+
+// PoolConfig holds the settings for the long-lived *sql.DB connection pool
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	PingTimeout     time.Duration
+}
+
+// Returns the pool settings from the environment, using defaults for
+// anything that is not set
+func LoadPoolConfig() (PoolConfig, error) {
+	cfg := PoolConfig{
+		MaxOpenConns:    defaultMaxOpenConns,
+		MaxIdleConns:    defaultMaxIdleConns,
+		ConnMaxLifetime: defaultConnMaxLifetime,
+		ConnMaxIdleTime: defaultConnMaxIdleTime,
+		PingTimeout:     defaultPingTimeout,
+	}
+
+	var err error
+
+	if cfg.MaxOpenConns, err = envInt("DB_MAX_OPEN_CONNS", cfg.MaxOpenConns); err != nil {
+		return cfg, err
+	}
+
+	if cfg.MaxIdleConns, err = envInt("DB_MAX_IDLE_CONNS", cfg.MaxIdleConns); err != nil {
+		return cfg, err
+	}
+
+	if cfg.ConnMaxLifetime, err = envDuration("DB_CONN_MAX_LIFETIME", cfg.ConnMaxLifetime); err != nil {
+		return cfg, err
+	}
+
+	if cfg.ConnMaxIdleTime, err = envDuration("DB_CONN_MAX_IDLE_TIME", cfg.ConnMaxIdleTime); err != nil {
+		return cfg, err
+	}
+
+	if cfg.PingTimeout, err = envDuration("DB_PING_TIMEOUT", cfg.PingTimeout); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+func DSN() string {
+	return fmt.Sprintf(
 		"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
 		os.Getenv("DB_HOST"),
 		os.Getenv("DB_USER"),
@@ -17,5 +73,69 @@ func Connect() (*sql.DB, error) {
 		os.Getenv("DB_NAME"),
 		os.Getenv("DB_PORT"),
 	)
-	return sql.Open("postgres", dsn)
+}
+
+// Opens a connection pool, applies the pool settings and verifies the
+// database is reachable. The caller owns the pool and must Close it.
+func OpenPool(driver, dsn string, cfg PoolConfig) (*sql.DB, error) {
+	dbcon, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ConfigurePool(dbcon, cfg); err != nil {
+		dbcon.Close()
+		return nil, err
+	}
+
+	return dbcon, nil
+}
+
+// Applies the pool settings to an open *sql.DB and pings it
+func ConfigurePool(dbcon *sql.DB, cfg PoolConfig) error {
+	applyPoolSettings(dbcon, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.PingTimeout)
+	defer cancel()
+
+	if err := dbcon.PingContext(ctx); err != nil {
+		return fmt.Errorf("database ping failed: %w", err)
+	}
+
+	return nil
+}
+
+func applyPoolSettings(dbcon *sql.DB, cfg PoolConfig) {
+	dbcon.SetMaxOpenConns(cfg.MaxOpenConns)
+	dbcon.SetMaxIdleConns(cfg.MaxIdleConns)
+	dbcon.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	dbcon.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+}
+
+func envInt(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: must be an integer", key)
+	}
+
+	return n, nil
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: must be a duration such as 30s or 5m", key)
+	}
+
+	return d, nil
 }
@@ -2,9 +2,12 @@ package db_test
 
 import (
 	"database/sql"
+	"errors"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/onsi/ginkgo/v2"
 	"github.com/onsi/gomega"
 	"github.com/steveperjesi/integra-demo/internal/db"
@@ -15,41 +18,93 @@ func TestDB(t *testing.T) {
 	ginkgo.RunSpecs(t, "DB Suite")
 }
 
-var _ = ginkgo.Describe("Connect", func() {
-	var (
-		conn *sql.DB
-		err  error
-	)
+var _ = ginkgo.Describe("DSN", func() {
+	ginkgo.AfterEach(func() {
+		for _, key := range []string{"DB_HOST", "DB_USER", "DB_PASSWORD", "DB_NAME", "DB_PORT"} {
+			os.Unsetenv(key)
+		}
+	})
 
-	ginkgo.BeforeEach(func() {
-		// Set fake or test DB credentials (use real ones in a CI or Docker-based test DB setup)
+	ginkgo.It("builds the Postgres DSN from the DB_* variables", func() {
 		os.Setenv("DB_HOST", "localhost")
 		os.Setenv("DB_USER", "postgres")
 		os.Setenv("DB_PASSWORD", "password")
 		os.Setenv("DB_NAME", "testdb")
 		os.Setenv("DB_PORT", "5432")
+
+		gomega.Expect(db.DSN()).To(gomega.Equal("host=localhost user=postgres password=password dbname=testdb port=5432 sslmode=disable"))
 	})
+})
 
+var _ = ginkgo.Describe("LoadPoolConfig", func() {
 	ginkgo.AfterEach(func() {
-		if conn != nil {
-			conn.Close()
+		os.Unsetenv("DB_MAX_OPEN_CONNS")
+		os.Unsetenv("DB_CONN_MAX_LIFETIME")
+	})
+
+	ginkgo.It("returns defaults when nothing is set", func() {
+		cfg, err := db.LoadPoolConfig()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(cfg.MaxOpenConns).To(gomega.Equal(25))
+		gomega.Expect(cfg.ConnMaxLifetime).To(gomega.Equal(30 * time.Minute))
+	})
+
+	ginkgo.It("reads overrides from the environment", func() {
+		os.Setenv("DB_MAX_OPEN_CONNS", "50")
+		os.Setenv("DB_CONN_MAX_LIFETIME", "1h")
+
+		cfg, err := db.LoadPoolConfig()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(cfg.MaxOpenConns).To(gomega.Equal(50))
+		gomega.Expect(cfg.ConnMaxLifetime).To(gomega.Equal(time.Hour))
+	})
+
+	ginkgo.It("returns an error for invalid values", func() {
+		os.Setenv("DB_MAX_OPEN_CONNS", "lots")
+
+		_, err := db.LoadPoolConfig()
+		gomega.Expect(err).To(gomega.MatchError("invalid DB_MAX_OPEN_CONNS: must be an integer"))
+	})
+})
+
+var _ = ginkgo.Describe("ConfigurePool", func() {
+	var (
+		conn *sql.DB
+		mock sqlmock.Sqlmock
+		cfg  db.PoolConfig
+	)
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		conn, mock, err = sqlmock.New(sqlmock.MonitorPingsOption(true))
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		cfg = db.PoolConfig{
+			MaxOpenConns:    10,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: time.Minute,
+			ConnMaxIdleTime: time.Minute,
+			PingTimeout:     time.Second,
 		}
 	})
 
-	ginkgo.Context("when environment variables are set correctly", func() {
-		ginkgo.It("returns a *sql.DB without error", func() {
-			conn, err = db.Connect()
-			gomega.Expect(err).ToNot(gomega.HaveOccurred())
-			gomega.Expect(conn).ToNot(gomega.BeNil())
-		})
+	ginkgo.AfterEach(func() {
+		conn.Close()
 	})
 
-	ginkgo.Context("when environment variables are missing", func() {
-		ginkgo.It("returns a *sql.DB with a bad DSN", func() {
-			os.Unsetenv("DB_HOST")
-			conn, err = db.Connect()
-			gomega.Expect(err).ToNot(gomega.HaveOccurred())
-			gomega.Expect(conn).ToNot(gomega.BeNil())
-		})
+	ginkgo.It("applies the settings and pings the database", func() {
+		mock.ExpectPing()
+
+		err := db.ConfigurePool(conn, cfg)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(conn.Stats().MaxOpenConnections).To(gomega.Equal(10))
+		gomega.Expect(mock.ExpectationsWereMet()).To(gomega.Succeed())
+	})
+
+	ginkgo.It("returns an error when the ping fails", func() {
+		mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+
+		err := db.ConfigurePool(conn, cfg)
+		gomega.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("connection refused")))
 	})
 })
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// How often a replica is pinged when DB_REPLICA_CHECK_INTERVAL is unset
+const defaultReplicaCheckInterval = 5 * time.Second
+
+// Replica is a read-only copy of the primary database. Reads go to it while
+// its health checks pass and fall back to the primary otherwise.
+type Replica struct {
+	db          *sql.DB
+	pingTimeout time.Duration
+	healthy     atomic.Bool
+}
+
+// Opens a replica connection pool. Unlike OpenPool it doesn't fail when the
+// replica is unreachable; the replica just stays unhealthy until a check
+// passes.
+func OpenReplica(driver, dsn string, cfg PoolConfig) (*Replica, error) {
+	dbcon, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	applyPoolSettings(dbcon, cfg)
+
+	return NewReplica(dbcon, cfg.PingTimeout), nil
+}
+
+// Wraps an open pool as a replica. It is unhealthy until the first Check.
+func NewReplica(dbcon *sql.DB, pingTimeout time.Duration) *Replica {
+	return &Replica{db: dbcon, pingTimeout: pingTimeout}
+}
+
+func (r *Replica) DB() *sql.DB {
+	return r.db
+}
+
+func (r *Replica) Close() error {
+	return r.db.Close()
+}
+
+func (r *Replica) Healthy() bool {
+	return r.healthy.Load()
+}
+
+// Pings the replica and records whether it is healthy
+func (r *Replica) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.pingTimeout)
+	defer cancel()
+
+	err := r.db.PingContext(ctx)
+	r.setHealthy(err == nil, err)
+
+	return err
+}
+
+// Takes the replica out of rotation until the next passing Check, after a
+// read on it failed to reach the database
+func (r *Replica) MarkUnhealthy(err error) {
+	r.setHealthy(false, err)
+}
+
+// Checks the replica every interval until ctx is done, starting right away
+func (r *Replica) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r.Check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Logs only transitions, so a replica that stays down doesn't flood the log
+func (r *Replica) setHealthy(healthy bool, err error) {
+	if r.healthy.Swap(healthy) == healthy {
+		return
+	}
+
+	if healthy {
+		log.Print("read replica is healthy, routing reads to it")
+	} else {
+		log.Print("read replica is unhealthy, routing reads to the primary: ", err)
+	}
+}
+
+// Reads the DB_REPLICA_CHECK_INTERVAL duration
+func ReplicaCheckInterval() (time.Duration, error) {
+	return envDuration("DB_REPLICA_CHECK_INTERVAL", defaultReplicaCheckInterval)
+}
+
+// Reports whether err means the database couldn't be reached, as opposed to
+// the query itself failing
+func IsConnError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr)
+}
+
+type primaryKey struct{}
+
+// Marks ctx so reads made with it skip the replica and see the primary's
+// latest writes
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// Reports whether ctx asks for reads from the primary
+func PrimaryRequested(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryKey{}).(bool)
+	return primary
+}
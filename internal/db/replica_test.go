@@ -0,0 +1,111 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/steveperjesi/integra-demo/internal/db"
+)
+
+var _ = ginkgo.Describe("Replica", func() {
+	var (
+		conn    *sql.DB
+		mock    sqlmock.Sqlmock
+		replica *db.Replica
+	)
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		conn, mock, err = sqlmock.New(sqlmock.MonitorPingsOption(true))
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		replica = db.NewReplica(conn, time.Second)
+	})
+
+	ginkgo.AfterEach(func() {
+		conn.Close()
+	})
+
+	ginkgo.It("is unhealthy until a check passes", func() {
+		gomega.Expect(replica.Healthy()).To(gomega.BeFalse())
+
+		mock.ExpectPing()
+		gomega.Expect(replica.Check(context.Background())).To(gomega.Succeed())
+		gomega.Expect(replica.Healthy()).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("goes unhealthy when a check fails or a read can't reach it", func() {
+		mock.ExpectPing()
+		replica.Check(context.Background())
+
+		replica.MarkUnhealthy(driver.ErrBadConn)
+		gomega.Expect(replica.Healthy()).To(gomega.BeFalse())
+
+		mock.ExpectPing()
+		replica.Check(context.Background())
+		gomega.Expect(replica.Healthy()).To(gomega.BeTrue())
+
+		mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+		gomega.Expect(replica.Check(context.Background())).ToNot(gomega.Succeed())
+		gomega.Expect(replica.Healthy()).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("checks right away and stops watching with its context", func() {
+		mock.ExpectPing()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			replica.Watch(ctx, time.Hour)
+			close(done)
+		}()
+
+		gomega.Eventually(replica.Healthy).Should(gomega.BeTrue())
+		cancel()
+		gomega.Eventually(done).Should(gomega.BeClosed())
+		gomega.Expect(mock.ExpectationsWereMet()).To(gomega.Succeed())
+	})
+})
+
+var _ = ginkgo.Describe("IsConnError", func() {
+	ginkgo.It("recognizes errors reaching the database", func() {
+		for _, err := range []error{
+			driver.ErrBadConn,
+			sql.ErrConnDone,
+			io.EOF,
+			fmt.Errorf("read: %w", io.ErrUnexpectedEOF),
+			&net.OpError{Op: "dial", Err: errors.New("connection refused")},
+		} {
+			gomega.Expect(db.IsConnError(err)).To(gomega.BeTrue(), err.Error())
+		}
+	})
+
+	ginkgo.It("ignores query errors and cancellation", func() {
+		for _, err := range []error{
+			nil,
+			sql.ErrNoRows,
+			errors.New("syntax error"),
+			context.Canceled,
+			context.DeadlineExceeded,
+		} {
+			gomega.Expect(db.IsConnError(err)).To(gomega.BeFalse())
+		}
+	})
+})
+
+var _ = ginkgo.Describe("WithPrimary", func() {
+	ginkgo.It("marks a context as needing the primary", func() {
+		ctx := context.Background()
+		gomega.Expect(db.PrimaryRequested(ctx)).To(gomega.BeFalse())
+		gomega.Expect(db.PrimaryRequested(db.WithPrimary(ctx))).To(gomega.BeTrue())
+	})
+})
@@ -1,5 +1,9 @@
 package db
 
 const (
-	AllColumns = `"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department"`
+	AllColumns = `"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "deleted_at", "version", "created_at", "updated_at"`
+
+	AuditColumns = `"audit_id", "user_id", "actor", "operation", "changes", "created_at"`
+
+	OutboxColumns = `"event_id", "user_id", "event_type", "payload", "status", "attempts", "last_error", "next_attempt_at", "created_at", "delivered_at"`
 )
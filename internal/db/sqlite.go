@@ -0,0 +1,60 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// Connection settings applied to every SQLite connection. Immediate
+// transactions take the write lock up front, which avoids deadlocks when a
+// read transaction later tries to write.
+var sqliteParams = []string{
+	"_pragma=busy_timeout(5000)",
+	"_pragma=foreign_keys(1)",
+	"_txlock=immediate",
+	"_time_format=sqlite",
+}
+
+// Opens a SQLite database file. The schema is managed by the migrations.
+//
+// SQLite allows a single writer, so the pool is pinned to one connection
+// that never expires. This also keeps ":memory:" databases alive for the
+// life of the pool.
+func OpenSQLite(dsn string, cfg PoolConfig) (*sql.DB, error) {
+	cfg.MaxOpenConns = 1
+	cfg.MaxIdleConns = 1
+	cfg.ConnMaxLifetime = 0
+	cfg.ConnMaxIdleTime = 0
+
+	return OpenPool(DriverSQLite, sqliteDSN(dsn), cfg)
+}
+
+// Appends the connection settings, keeping any the caller already set
+func sqliteDSN(dsn string) string {
+	var params []string
+	for _, param := range sqliteParams {
+		name, _, _ := strings.Cut(param, "=")
+		if name == "_pragma" {
+			pragma, _, _ := strings.Cut(strings.TrimPrefix(param, "_pragma="), "(")
+			if strings.Contains(dsn, "_pragma="+pragma) {
+				continue
+			}
+		} else if strings.Contains(dsn, name+"=") {
+			continue
+		}
+		params = append(params, param)
+	}
+
+	if len(params) == 0 {
+		return dsn
+	}
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+
+	return dsn + separator + strings.Join(params, "&")
+}
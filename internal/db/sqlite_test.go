@@ -0,0 +1,33 @@
+package db_test
+
+import (
+	"database/sql"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/steveperjesi/integra-demo/internal/db"
+)
+
+var _ = ginkgo.Describe("OpenSQLite", func() {
+	var conn *sql.DB
+
+	ginkgo.AfterEach(func() {
+		if conn != nil {
+			conn.Close()
+		}
+	})
+
+	ginkgo.It("pins the pool to one connection with foreign keys on", func() {
+		cfg, err := db.LoadPoolConfig()
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+		conn, err = db.OpenSQLite(":memory:", cfg)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(conn.Stats().MaxOpenConnections).To(gomega.Equal(1))
+
+		var foreignKeys int
+		err = conn.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys)
+		gomega.Expect(err).ToNot(gomega.HaveOccurred())
+		gomega.Expect(foreignKeys).To(gomega.Equal(1))
+	})
+})
@@ -0,0 +1,39 @@
+package db_test
+
+import (
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/steveperjesi/integra-demo/internal/db"
+)
+
+var _ = ginkgo.Describe("ParseURL", func() {
+	ginkgo.DescribeTable("picks the backend from the scheme",
+		func(rawURL, backend, dsn string) {
+			gotBackend, gotDSN, err := db.ParseURL(rawURL)
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			gomega.Expect(gotBackend).To(gomega.Equal(backend))
+			gomega.Expect(gotDSN).To(gomega.Equal(dsn))
+		},
+		ginkgo.Entry("postgres", "postgres://u:p@localhost:5432/demo", db.DriverPostgres, "postgres://u:p@localhost:5432/demo"),
+		ginkgo.Entry("postgresql", "postgresql://localhost/demo", db.DriverPostgres, "postgresql://localhost/demo"),
+		ginkgo.Entry("sqlite absolute path", "sqlite:///var/lib/demo/users.db", db.DriverSQLite, "/var/lib/demo/users.db"),
+		ginkgo.Entry("sqlite relative path", "sqlite://users.db", db.DriverSQLite, "users.db"),
+		ginkgo.Entry("sqlite with pragmas", "sqlite://users.db?_pragma=journal_mode(WAL)", db.DriverSQLite, "users.db?_pragma=journal_mode(WAL)"),
+		ginkgo.Entry("memory", "memory://", db.DriverMemory, ""),
+	)
+
+	ginkgo.It("rejects unknown schemes", func() {
+		_, _, err := db.ParseURL("mysql://localhost/demo")
+		gomega.Expect(err).To(gomega.MatchError(`unsupported database url scheme "mysql"`))
+	})
+
+	ginkgo.It("rejects a url without a scheme", func() {
+		_, _, err := db.ParseURL("users.db")
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("rejects a sqlite url without a path", func() {
+		_, _, err := db.ParseURL("sqlite://")
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
@@ -1,27 +1,111 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/steveperjesi/integra-demo/user"
 )
 
+const (
+	// Changes held for a slow change stream client before it is sent a
+	// resync instead
+	changeStreamBuffer    = 64
+	changeStreamKeepAlive = 30 * time.Second
+)
+
 // @Summary      Get all users
-// @Description  Retrieves all user information
+// @Description  Lists users in user_id order, or the order given by sort, streamed as rows are read. With a limit, pages through them: pass each page's next_cursor as the cursor for the next, which is null on the last page. Send Accept: application/x-ndjson for one user per line instead of a JSON envelope; a paged NDJSON response sends the next cursor in the X-Next-Cursor trailer. An error after the first user cuts the response short rather than changing the status.
 // @Tags         users
 // @Accept       json
-// @Produce      json
-// @Success      200 {object} []user.User
+// @Produce      json,application/x-ndjson
+// @Param        include_deleted query bool false "Include soft-deleted users"
+// @Param        created_after query string false "Only users created after this RFC 3339 time"
+// @Param        created_before query string false "Only users created before this RFC 3339 time"
+// @Param        updated_after query string false "Only users last changed after this RFC 3339 time"
+// @Param        updated_before query string false "Only users last changed before this RFC 3339 time"
+// @Param        as_of query string false "Users as they were at this RFC 3339 time"
+// @Param        user_status query string false "Only users with this status" Enums(A, I, T)
+// @Param        department query string false "Only users in this department; empty for users without one"
+// @Param        email_domain query string false "Only users with an email at this domain, e.g. example.com"
+// @Param        user_name query string false "Only users whose user_name starts with this, ignoring case"
+// @Param        sort query string false "Columns to order by, descending when prefixed with -, e.g. last_name,-user_id. One of user_id, user_name, first_name, last_name, email, user_status, department, created_at, updated_at. first_name, last_name and email return 400 when they are encrypted"
+// @Param        limit query int false "Page size, from 1 to 1000; every user when left out"
+// @Param        cursor query string false "next_cursor from the previous page, listed with the same sort"
+// @Param        include_total query bool false "Also count the users on every page"
+// @Param        X-Read-Consistency header string false "strong reads from the primary instead of a replica" Enums(eventual, strong)
+// @Success      200 {object} UsersResponse
+// @Header       200 {integer} X-Total-Count "Users on every page, when include_total is set"
+// @Failure      400 {object} ErrorResponse
 // @Failure      500 {object} ErrorResponse
 // @Router       /users [get]
 func GetAllUsers(service user.Service) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		users, err := service.GetAll(c)
+		opts, err := listParams(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		includeTotal, err := boolParam(c, "include_total", user.ErrInvalidIncludeTotal)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
 		}
-		return c.JSON(http.StatusOK, users)
+
+		var total *int64
+		if includeTotal {
+			count, err := service.CountAll(c.Request().Context(), opts)
+			if err != nil {
+				return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+			}
+			total = &count
+		}
+
+		stream := newUserStream(c.Response(), acceptsNDJSON(c), opts.Limit > 0, total)
+
+		nextCursor, err := service.StreamAll(c.Request().Context(), opts, stream.write)
+		if err != nil && !c.Response().Committed {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		} else if err != nil {
+			// The 200 is already out, so the client can only be told by
+			// cutting the response off before it is complete
+			log.Print("users stream failed: ", err)
+			panic(http.ErrAbortHandler)
+		}
+
+		return stream.close(nextCursor)
+	}
+}
+
+// @Summary      Search users
+// @Description  Finds live users by partial or misspelled names and emails. Ranks them by the trigram word similarity of q to user_name, first_name, last_name and email, best first, and highlights the stretch of each field that matched. With a keyring configured only user_name is searched, as the others are encrypted.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        q query string true "Text to search for, up to 100 characters"
+// @Param        limit query int false "Number of results, 1 to 100" default(20)
+// @Param        X-Read-Consistency header string false "strong reads from the primary instead of a replica" Enums(eventual, strong)
+// @Success      200 {object} SearchResponse
+// @Failure      400 {object} ErrorResponse
+// @Failure      500 {object} ErrorResponse
+// @Router       /users/search [get]
+func SearchUsers(service user.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		opts, err := searchParams(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		results, err := service.Search(c.Request().Context(), opts)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+		return c.JSON(http.StatusOK, SearchResponse{Results: results})
 	}
 }
 
@@ -31,15 +115,34 @@ func GetAllUsers(service user.Service) echo.HandlerFunc {
 // @Accept       json
 // @Produce      json
 // @Param        user_id path string true "User ID"
+// @Param        include_deleted query bool false "Include soft-deleted users"
+// @Param        as_of query string false "The user as they were at this RFC 3339 time"
+// @Param        X-Read-Consistency header string false "strong reads from the primary instead of a replica" Enums(eventual, strong)
 // @Success      200 {object} user.User
+// @Header       200 {string} ETag "Current version of the user, left out for as_of reads"
 // @Failure      400 {object} ErrorResponse
+// @Failure      404 {object} ErrorResponse
 // @Failure      500 {object} ErrorResponse
 // @Router       /users/{user_id} [get]
 func GetUserByID(service user.Service) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		user, err := service.GetByID(c)
+		id, err := userIDParam(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		opts, err := getParams(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		user, err := service.GetByID(c.Request().Context(), id, opts)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+		// An old version can't be the precondition for a write
+		if opts.AsOf == nil {
+			setETag(c, user)
 		}
 		return c.JSON(http.StatusOK, user)
 	}
@@ -51,66 +154,484 @@ func GetUserByID(service user.Service) echo.HandlerFunc {
 // @Accept       json
 // @Produce      json
 // @Param        user body user.User true "User data"
+// @Param        X-Actor header string false "Who is making the change, recorded in the audit trail"
 // @Success      201 {object} user.User
 // @Failure      400 {object} ErrorResponse
+// @Failure      409 {object} ErrorResponse
 // @Failure      500 {object} ErrorResponse
 // @Router       /users [post]
 func CreateUser(service user.Service) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		var userRequest user.User
 		if err := c.Bind(&userRequest); err != nil {
-			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return c.JSON(http.StatusBadRequest, errorResponse(err))
 		}
 		if err := userRequest.ValidateNewUserRequest(); err != nil {
-			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
 		}
-		newUser, err := service.Create(c, &userRequest)
+		newUser, err := service.Create(c.Request().Context(), &userRequest, actor(c))
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
 		}
 		return c.JSON(http.StatusCreated, newUser)
 	}
 }
 
+// @Summary      Create many users
+// @Description  Creates up to 50000 users from a JSON array in one load. Every user is validated like a single create and reported on by its index in the array: created, duplicate_user_name, duplicate_email or invalid. One bad user doesn't stop the others.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        users body []user.User true "Users to create"
+// @Param        X-Actor header string false "Who is making the change, recorded in the audit trail"
+// @Success      200 {object} BulkResponse
+// @Failure      400 {object} ErrorResponse
+// @Failure      500 {object} ErrorResponse
+// @Router       /users/bulk [post]
+func BulkCreateUsers(store user.BulkStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var users []user.User
+		if err := c.Bind(&users); err != nil {
+			return c.JSON(http.StatusBadRequest, errorResponse(err))
+		}
+
+		results, err := store.BulkCreate(c.Request().Context(), users, actor(c))
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+		return c.JSON(http.StatusOK, newBulkResponse(results))
+	}
+}
+
 // @Summary      Update an existing user
-// @Description  Updates an existing user based on the given body
+// @Description  Deprecated: use PUT /users/{user_id} or PATCH /users/{user_id}. Updates the non-empty values in the body on the user with its user_id; responses carry a Deprecation header.
 // @Tags         users
 // @Accept       json
 // @Produce      json
 // @Param        user body user.User true "Updated user data"
+// @Param        If-Match header string false "ETag from a previous read; the update fails with 412 if the user changed since"
+// @Param        X-Actor header string false "Who is making the change, recorded in the audit trail"
 // @Success      200 {object} user.User
+// @Header       200 {string} ETag "New version of the user"
 // @Failure      400 {object} ErrorResponse
+// @Failure      409 {object} ErrorResponse
+// @Failure      412 {object} ErrorResponse
+// @Failure      428 {object} ErrorResponse
 // @Failure      500 {object} ErrorResponse
+// @Header       200 {string} Deprecation "Always true"
+// @Deprecated
 // @Router       /users [put]
 func UpdateUser(service user.Service) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		var userRequest user.User
 		if err := c.Bind(&userRequest); err != nil {
-			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return c.JSON(http.StatusBadRequest, errorResponse(err))
+		}
+		cond, err := precondition(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
 		}
-		updatedUser, err := service.Update(c, &userRequest)
+
+		updatedUser, err := service.Update(c.Request().Context(), &userRequest, cond, actor(c))
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
 		}
+		setETag(c, updatedUser)
 		return c.JSON(http.StatusOK, updatedUser)
 	}
 }
 
+// @Summary      Replace a user
+// @Description  Replaces the full representation of a user. Every field a new user requires must be given, and fields left out are cleared, so a missing department removes it. user_id may be left out of the body but otherwise must match the path. created_at, updated_at and deleted_at are ignored.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        user_id path string true "User ID"
+// @Param        user body user.User true "The user's new representation"
+// @Param        If-Match header string false "ETag from a previous read; the replace fails with 412 if the user changed since"
+// @Param        X-Actor header string false "Who is making the change, recorded in the audit trail"
+// @Success      200 {object} user.User
+// @Header       200 {string} ETag "New version of the user"
+// @Failure      400 {object} ErrorResponse
+// @Failure      404 {object} ErrorResponse
+// @Failure      409 {object} ErrorResponse
+// @Failure      412 {object} ErrorResponse
+// @Failure      428 {object} ErrorResponse
+// @Failure      500 {object} ErrorResponse
+// @Router       /users/{user_id} [put]
+func ReplaceUser(service user.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := userIDParam(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		var userRequest user.User
+		if err := c.Bind(&userRequest); err != nil {
+			return c.JSON(http.StatusBadRequest, errorResponse(err))
+		}
+
+		cond, err := precondition(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		replacedUser, err := service.Replace(c.Request().Context(), id, &userRequest, cond, actor(c))
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+		setETag(c, replacedUser)
+		return c.JSON(http.StatusOK, replacedUser)
+	}
+}
+
+// @Summary      Patch a user
+// @Description  Applies a JSON Merge Patch (RFC 7396) to a user: fields left out keep their value and null clears one, so "department": null removes the department; the other fields can't be null. The patched user must pass the same checks as a new one. created_at, updated_at and deleted_at are ignored, and user_id can't be changed.
+// @Tags         users
+// @Accept       application/merge-patch+json
+// @Produce      json
+// @Param        user_id path string true "User ID"
+// @Param        patch body user.User true "Fields to change"
+// @Param        If-Match header string false "ETag from a previous read; the patch fails with 412 if the user changed since"
+// @Param        X-Actor header string false "Who is making the change, recorded in the audit trail"
+// @Success      200 {object} user.User
+// @Header       200 {string} ETag "New version of the user"
+// @Failure      400 {object} ErrorResponse
+// @Failure      404 {object} ErrorResponse
+// @Failure      409 {object} ErrorResponse
+// @Failure      412 {object} ErrorResponse
+// @Failure      415 {object} ErrorResponse
+// @Failure      428 {object} ErrorResponse
+// @Failure      500 {object} ErrorResponse
+// @Router       /users/{user_id} [patch]
+func PatchUser(service user.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !isMediaType(c.Request().Header.Get(echo.HeaderContentType), user.MergePatchType) {
+			c.Response().Header().Set("Accept-Patch", user.MergePatchType)
+			return c.JSON(http.StatusUnsupportedMediaType, errorResponse(user.ErrUnsupportedPatch))
+		}
+
+		id, err := userIDParam(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		cond, err := precondition(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		patch, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, errorResponse(err))
+		}
+
+		patchedUser, err := service.Patch(c.Request().Context(), id, patch, cond, actor(c))
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+		setETag(c, patchedUser)
+		return c.JSON(http.StatusOK, patchedUser)
+	}
+}
+
 // @Summary      Delete a user
-// @Description  Deletes a user by user_id
+// @Description  Soft deletes a user by user_id. The user can be restored until it is purged.
 // @Tags         users
 // @Accept       json
 // @Produce      json
 // @Param        user_id path string true "User ID"
+// @Param        If-Match header string false "ETag from a previous read; the delete fails with 412 if the user changed since"
+// @Param        X-Actor header string false "Who is making the change, recorded in the audit trail"
 // @Success      204 {string} string "No Content"
 // @Failure      400 {object} ErrorResponse
+// @Failure      412 {object} ErrorResponse
+// @Failure      428 {object} ErrorResponse
 // @Failure      500 {object} ErrorResponse
 // @Router       /users/{user_id} [delete]
 func DeleteUser(service user.Service) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		if err := service.DeleteByID(c); err != nil {
-			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		id, err := userIDParam(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		cond, err := precondition(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		if err := service.DeleteByID(c.Request().Context(), id, cond, actor(c)); err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// @Summary      Restore a deleted user
+// @Description  Restores a soft-deleted user by user_id
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        user_id path string true "User ID"
+// @Param        X-Actor header string false "Who is making the change, recorded in the audit trail"
+// @Success      200 {object} user.User
+// @Failure      400 {object} ErrorResponse
+// @Failure      404 {object} ErrorResponse
+// @Failure      409 {object} ErrorResponse
+// @Failure      500 {object} ErrorResponse
+// @Router       /users/{user_id}/restore [post]
+func RestoreUser(service user.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := userIDParam(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		restoredUser, err := service.RestoreByID(c.Request().Context(), id, actor(c))
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+		setETag(c, restoredUser)
+		return c.JSON(http.StatusOK, restoredUser)
+	}
+}
+
+// @Summary      Purge a user
+// @Description  Permanently removes a user by user_id. Requires the admin token.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        user_id path string true "User ID"
+// @Param        X-Admin-Token header string true "Admin token"
+// @Param        X-Actor header string false "Who is making the change, recorded in the audit trail"
+// @Success      204 {string} string "No Content"
+// @Failure      400 {object} ErrorResponse
+// @Failure      403 {object} ErrorResponse
+// @Failure      404 {object} ErrorResponse
+// @Failure      500 {object} ErrorResponse
+// @Router       /admin/users/{user_id} [delete]
+func PurgeUser(service user.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := userIDParam(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		if err := service.PurgeByID(c.Request().Context(), id, actor(c)); err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// @Summary      Get a user's change history
+// @Description  Lists the audit trail for user_id, newest first. Entries outlive a purged user.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        user_id path string true "User ID"
+// @Param        from query string false "Only entries at or after this RFC 3339 time"
+// @Param        to query string false "Only entries before this RFC 3339 time"
+// @Param        operation query string false "Only entries for this operation" Enums(create, update, status_change, delete, restore, purge)
+// @Param        limit query int false "Page size, 1 to 500" default(50)
+// @Param        offset query int false "Entries to skip" default(0)
+// @Param        X-Read-Consistency header string false "strong reads from the primary instead of a replica" Enums(eventual, strong)
+// @Success      200 {object} HistoryResponse
+// @Failure      400 {object} ErrorResponse
+// @Failure      500 {object} ErrorResponse
+// @Router       /users/{user_id}/history [get]
+func GetUserHistory(service user.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := userIDParam(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		opts, err := historyParams(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		entries, err := service.HistoryByID(c.Request().Context(), id, opts)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+		return c.JSON(http.StatusOK, HistoryResponse{Entries: entries})
+	}
+}
+
+// @Summary      Stream user changes
+// @Description  Streams committed changes to users as server-sent events, one per change, named after the op. A resync event means changes may have been missed and anything derived from users should be reloaded. Only available on Postgres.
+// @Tags         users
+// @Produce      text/event-stream
+// @Success      200 {object} user.Change
+// @Failure      404 {object} ErrorResponse
+// @Router       /users/changes [get]
+func StreamUserChanges(changes user.ChangeSource) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		subscription, unsubscribe := changes.Subscribe(changeStreamBuffer)
+		defer unsubscribe()
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set(echo.HeaderCacheControl, "no-cache")
+		res.WriteHeader(http.StatusOK)
+		res.Flush()
+
+		// Keeps idle proxies from closing a quiet stream
+		keepAlive := time.NewTicker(changeStreamKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-c.Request().Context().Done():
+				return nil
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(res, ": keep-alive\n\n"); err != nil {
+					return nil
+				}
+			case change, ok := <-subscription:
+				if !ok {
+					return nil
+				}
+
+				data, err := json.Marshal(change)
+				if err != nil {
+					return err
+				}
+
+				if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", change.Op, data); err != nil {
+					return nil
+				}
+			}
+			res.Flush()
+		}
+	}
+}
+
+// @Summary      List outbox events
+// @Description  Lists the events published about user changes, oldest first, with their delivery state. Use status=dead to inspect dead-lettered events. Requires the admin token.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        status query string false "Only events in this delivery state" Enums(pending, delivered, dead)
+// @Param        limit query int false "Page size, 1 to 500" default(50)
+// @Param        offset query int false "Events to skip" default(0)
+// @Param        X-Admin-Token header string true "Admin token"
+// @Success      200 {object} OutboxResponse
+// @Failure      400 {object} ErrorResponse
+// @Failure      403 {object} ErrorResponse
+// @Failure      500 {object} ErrorResponse
+// @Router       /admin/outbox [get]
+func GetOutboxEvents(store user.OutboxStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		opts, err := outboxParams(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		events, err := store.Events(c.Request().Context(), opts)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+		return c.JSON(http.StatusOK, OutboxResponse{Events: events})
+	}
+}
+
+// @Summary      Requeue a dead outbox event
+// @Description  Gives a dead-lettered event a fresh set of delivery attempts. It is delivered after any newer events of the same user that already went out. Requires the admin token.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        event_id path string true "Event ID"
+// @Param        X-Admin-Token header string true "Admin token"
+// @Success      204 {string} string "No Content"
+// @Failure      400 {object} ErrorResponse
+// @Failure      403 {object} ErrorResponse
+// @Failure      404 {object} ErrorResponse
+// @Failure      409 {object} ErrorResponse
+// @Failure      500 {object} ErrorResponse
+// @Router       /admin/outbox/{event_id}/requeue [post]
+func RequeueOutboxEvent(store user.OutboxStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := eventIDParam(c)
+		if err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
+		}
+
+		if err := store.RequeueEvent(c.Request().Context(), id); err != nil {
+			return c.JSON(errorStatus(err, http.StatusInternalServerError), errorResponse(err))
 		}
 		return c.NoContent(http.StatusNoContent)
 	}
 }
+
+// Maps known user errors to their HTTP status, falling back to the
+// handler's default
+func errorStatus(err error, fallback int) int {
+	var invalid *user.ValidationError
+
+	switch {
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest
+	case errors.Is(err, user.ErrUserNotFound),
+		errors.Is(err, user.ErrEventNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, user.ErrUserNotDeleted),
+		errors.Is(err, user.ErrEventNotDead),
+		errors.Is(err, user.ErrUserExists),
+		errors.Is(err, user.ErrEmailExists):
+		return http.StatusConflict
+	case errors.Is(err, user.ErrInvalidUserID),
+		errors.Is(err, user.ErrInvalidIncludeDeleted),
+		errors.Is(err, user.ErrInvalidTimeFilter),
+		errors.Is(err, user.ErrInvalidAsOf),
+		errors.Is(err, user.ErrAsOfBeyondRetention),
+		errors.Is(err, user.ErrInvalidPageLimit),
+		errors.Is(err, user.ErrInvalidCursor),
+		errors.Is(err, user.ErrInvalidIncludeTotal),
+		errors.Is(err, user.ErrInvalidSort),
+		errors.Is(err, user.ErrInvalidEmailDomain),
+		errors.Is(err, user.ErrEncryptedField),
+		errors.Is(err, user.ErrInvalidSearchQuery),
+		errors.Is(err, user.ErrInvalidSearchLimit),
+		errors.Is(err, user.ErrInvalidIfMatch),
+		errors.Is(err, user.ErrInvalidOperation),
+		errors.Is(err, user.ErrInvalidDateRange),
+		errors.Is(err, user.ErrInvalidLimit),
+		errors.Is(err, user.ErrInvalidOffset),
+		errors.Is(err, user.ErrInvalidEventStatus),
+		errors.Is(err, user.ErrInvalidEventID),
+		errors.Is(err, user.ErrInvalidBulkSize),
+		errors.Is(err, user.ErrInvalidPatch):
+		return http.StatusBadRequest
+	case errors.Is(err, user.ErrUnsupportedPatch):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, user.ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, user.ErrPreconditionRequired):
+		return http.StatusPreconditionRequired
+	default:
+		return fallback
+	}
+}
+
+// Names the offending field when err is a validation error
+func errorResponse(err error) ErrorResponse {
+	response := ErrorResponse{Error: err.Error()}
+
+	var invalid *user.ValidationError
+	if errors.As(err, &invalid) {
+		response.Field = invalid.Field
+	}
+
+	return response
+}
+
+// Exposes the user's row version for use in a later If-Match
+func setETag(c echo.Context, u *user.User) {
+	if u != nil && u.Version != 0 {
+		c.Response().Header().Set("ETag", user.ETag(u.Version))
+	}
+}
@@ -1,16 +1,19 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	"github.com/steveperjesi/integra-demo/internal/db"
 	"github.com/steveperjesi/integra-demo/user"
 )
 
@@ -27,10 +30,16 @@ var _ = Describe("GetAllUsers Handler", func() {
 		rec = httptest.NewRecorder()
 
 		mockService = &user.MockUserService{
-			GetAllFunc: func(c echo.Context) ([]user.User, error) {
-				return []user.User{
+			StreamAllFunc: func(ctx context.Context, opts user.ListOptions, fn func(user.User) error) (string, error) {
+				for _, u := range []user.User{
 					{ID: 1, UserName: "jdoe", FirstName: "John", LastName: "Doe"},
-				}, nil
+					{ID: 2, UserName: "asmith", FirstName: "Alice", LastName: "Smith"},
+				} {
+					if err := fn(u); err != nil {
+						return "", err
+					}
+				}
+				return "", nil
 			},
 		}
 
@@ -45,11 +54,169 @@ var _ = Describe("GetAllUsers Handler", func() {
 		Expect(err).To(BeNil())
 		Expect(rec.Code).To(Equal(http.StatusOK))
 
-		var users []user.User
-		err = json.NewDecoder(rec.Body).Decode(&users)
+		var response UsersResponse
+		err = json.NewDecoder(rec.Body).Decode(&response)
 		Expect(err).To(BeNil())
-		Expect(users).To(HaveLen(1))
-		Expect(users[0].UserName).To(Equal("jdoe"))
+		Expect(response.Items).To(HaveLen(2))
+		Expect(response.Items[0].UserName).To(Equal("jdoe"))
+		Expect(response.NextCursor).To(BeNil())
+		Expect(response.Total).To(BeNil())
+	})
+
+	It("returns no items when there are no users", func() {
+		mockService.StreamAllFunc = func(ctx context.Context, opts user.ListOptions, fn func(user.User) error) (string, error) {
+			return "", nil
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+
+		Expect(handler(e.NewContext(req, rec))).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(MatchJSON(`{"items": [], "next_cursor": null}`))
+	})
+
+	It("streams one user per line when NDJSON is accepted", func() {
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		req.Header.Set(echo.HeaderAccept, MIMEApplicationNDJSON)
+
+		Expect(handler(e.NewContext(req, rec))).To(Succeed())
+		Expect(rec.Header().Get(echo.HeaderContentType)).To(Equal(MIMEApplicationNDJSON))
+
+		lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+		Expect(lines).To(HaveLen(2))
+
+		var u user.User
+		Expect(json.Unmarshal([]byte(lines[1]), &u)).To(Succeed())
+		Expect(u.UserName).To(Equal("asmith"))
+	})
+
+	It("returns a page with the cursor for the next one and the total", func() {
+		first := user.CursorAfter(user.User{ID: 1}, nil).Encode()
+		second := user.CursorAfter(user.User{ID: 2}, nil).Encode()
+
+		var got user.ListOptions
+		mockService.StreamAllFunc = func(ctx context.Context, opts user.ListOptions, fn func(user.User) error) (string, error) {
+			got = opts
+			return second, fn(user.User{ID: 2, UserName: "asmith"})
+		}
+		mockService.CountAllFunc = func(ctx context.Context, opts user.ListOptions) (int64, error) {
+			return 7, nil
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/users?limit=1&include_total=true&cursor="+first, nil)
+
+		Expect(handler(e.NewContext(req, rec))).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(got.Limit).To(Equal(1))
+		Expect(got.After.Keys).To(Equal([]string{"1"}))
+		Expect(rec.Header().Get(HeaderTotalCount)).To(Equal("7"))
+
+		var response UsersResponse
+		Expect(json.NewDecoder(rec.Body).Decode(&response)).To(Succeed())
+		Expect(response.Items).To(HaveLen(1))
+		Expect(*response.NextCursor).To(Equal(second))
+		Expect(*response.Total).To(Equal(int64(7)))
+	})
+
+	It("sends the next cursor of an NDJSON page in a trailer", func() {
+		next := user.CursorAfter(user.User{ID: 1}, nil).Encode()
+
+		mockService.StreamAllFunc = func(ctx context.Context, opts user.ListOptions, fn func(user.User) error) (string, error) {
+			return next, fn(user.User{ID: 1, UserName: "jdoe"})
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/users?limit=1", nil)
+		req.Header.Set(echo.HeaderAccept, MIMEApplicationNDJSON)
+
+		Expect(handler(e.NewContext(req, rec))).To(Succeed())
+
+		result := rec.Result()
+		Expect(result.Header.Get("Trailer")).To(Equal(HeaderNextCursor))
+		Expect(result.Trailer.Get(HeaderNextCursor)).To(Equal(next))
+		Expect(strings.Count(rec.Body.String(), "\n")).To(Equal(1))
+	})
+
+	It("returns an error status when the read fails before any user is sent", func() {
+		mockService.StreamAllFunc = func(ctx context.Context, opts user.ListOptions, fn func(user.User) error) (string, error) {
+			return "", fmt.Errorf("connection refused")
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+
+		Expect(handler(e.NewContext(req, rec))).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusInternalServerError))
+	})
+
+	It("aborts the response when the read fails part way through", func() {
+		mockService.StreamAllFunc = func(ctx context.Context, opts user.ListOptions, fn func(user.User) error) (string, error) {
+			if err := fn(user.User{ID: 1, UserName: "jdoe"}); err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("connection reset")
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		c := e.NewContext(req, rec)
+
+		Expect(func() { handler(c) }).To(PanicWith(http.ErrAbortHandler))
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).ToNot(HaveSuffix("]"))
+	})
+})
+
+var _ = Describe("SearchUsers Handler", func() {
+	var (
+		e           *echo.Echo
+		mockService *user.MockUserService
+		rec         *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		e = echo.New()
+		rec = httptest.NewRecorder()
+		mockService = &user.MockUserService{}
+	})
+
+	It("returns the ranked results with their highlights", func() {
+		var got user.SearchOptions
+		mockService.SearchFunc = func(ctx context.Context, opts user.SearchOptions) ([]user.SearchResult, error) {
+			got = opts
+			return []user.SearchResult{{
+				User:       user.User{ID: 1, UserName: "jdoe"},
+				Score:      0.4,
+				Highlights: map[string]string{"user_name": "<em>jd</em>oe"},
+			}}, nil
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/users/search?q=jdo&limit=5", nil)
+
+		Expect(SearchUsers(mockService)(e.NewContext(req, rec))).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(got).To(Equal(user.SearchOptions{Query: "jdo", Limit: 5}))
+
+		var response SearchResponse
+		Expect(json.NewDecoder(rec.Body).Decode(&response)).To(Succeed())
+		Expect(response.Results).To(HaveLen(1))
+		Expect(response.Results[0].Score).To(Equal(0.4))
+		Expect(response.Results[0].Highlights["user_name"]).To(Equal("<em>jd</em>oe"))
+	})
+
+	It("defaults the limit and rejects a malformed one with 400", func() {
+		var got user.SearchOptions
+		mockService.SearchFunc = func(ctx context.Context, opts user.SearchOptions) ([]user.SearchResult, error) {
+			got = opts
+			return nil, user.ErrInvalidSearchQuery
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/users/search", nil)
+		Expect(SearchUsers(mockService)(e.NewContext(req, rec))).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(got.Limit).To(Equal(user.DefaultSearchLimit))
+
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/users/search?q=jdoe&limit=many", nil)
+		Expect(SearchUsers(mockService)(e.NewContext(req, rec))).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
 	})
 })
 
@@ -66,8 +233,8 @@ var _ = Describe("GetUserByID Handler", func() {
 		rec = httptest.NewRecorder()
 
 		mockService = &user.MockUserService{
-			GetByIDFunc: func(c echo.Context) (*user.User, error) {
-				return &user.User{ID: 1, UserName: "jdoe"}, nil
+			GetByIDFunc: func(ctx context.Context, id int64, opts user.GetOptions) (*user.User, error) {
+				return &user.User{ID: 1, UserName: "jdoe", Version: 3}, nil
 			},
 		}
 	})
@@ -85,13 +252,42 @@ var _ = Describe("GetUserByID Handler", func() {
 		err := handler(c)
 		Expect(err).To(BeNil())
 		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("ETag")).To(Equal(`"3"`))
+	})
+
+	It("returns the user as of a time without an ETag", func() {
+		var got user.GetOptions
+		mockService.GetByIDFunc = func(ctx context.Context, id int64, opts user.GetOptions) (*user.User, error) {
+			got = opts
+			return &user.User{ID: 1, UserName: "jdoe", Version: 2}, nil
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/users/1?as_of=2024-01-01T00:00:00Z", nil)
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+
+		Expect(handler(c)).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(*got.AsOf).To(Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)))
+		Expect(rec.Header().Get("ETag")).To(BeEmpty())
 	})
 
-	It("returns 500 when user_id is invalid", func() {
-		mockService.GetByIDFunc = func(c echo.Context) (*user.User, error) {
-			return nil, fmt.Errorf("invalid user_id: must be an integer")
+	It("returns 400 when as_of is older than the history kept", func() {
+		mockService.GetByIDFunc = func(ctx context.Context, id int64, opts user.GetOptions) (*user.User, error) {
+			return nil, user.ErrAsOfBeyondRetention
 		}
 
+		req := httptest.NewRequest(http.MethodGet, "/users/1?as_of=2000-01-01T00:00:00Z", nil)
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+
+		Expect(handler(c)).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("returns 400 when user_id is invalid", func() {
 		req := httptest.NewRequest(http.MethodGet, "/users/foo", nil)
 		c := e.NewContext(req, rec)
 		c.SetParamNames("user_id")
@@ -99,11 +295,11 @@ var _ = Describe("GetUserByID Handler", func() {
 
 		err := handler(c)
 		Expect(err).To(BeNil())
-		Expect(rec.Code).To(Equal(http.StatusInternalServerError))
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
 	})
 
 	It("returns 500 when user not found", func() {
-		mockService.GetByIDFunc = func(c echo.Context) (*user.User, error) {
+		mockService.GetByIDFunc = func(ctx context.Context, id int64, opts user.GetOptions) (*user.User, error) {
 			return nil, fmt.Errorf("user not found")
 		}
 
@@ -131,7 +327,7 @@ var _ = Describe("CreateUser Handler", func() {
 		rec = httptest.NewRecorder()
 
 		mockService = &user.MockUserService{
-			CreateFunc: func(c echo.Context, u *user.User) (*user.User, error) {
+			CreateFunc: func(ctx context.Context, u *user.User, actor string) (*user.User, error) {
 				return &user.User{
 					ID:         1,
 					UserName:   u.UserName,
@@ -165,7 +361,7 @@ var _ = Describe("CreateUser Handler", func() {
 	})
 
 	It("returns 400 on bad JSON", func() {
-		mockService.CreateFunc = func(c echo.Context, u *user.User) (*user.User, error) {
+		mockService.CreateFunc = func(ctx context.Context, u *user.User, actor string) (*user.User, error) {
 			return nil, fmt.Errorf("code=400, message=Syntax error: offset=14, error=invalid character '}' looking for beginning of value, internal=invalid character '}' looking for beginning of value")
 		}
 
@@ -180,11 +376,11 @@ var _ = Describe("CreateUser Handler", func() {
 	})
 
 	It("returns 500 on service error", func() {
-		mockService.CreateFunc = func(c echo.Context, u *user.User) (*user.User, error) {
-			return nil, fmt.Errorf("missing first_name")
+		mockService.CreateFunc = func(ctx context.Context, u *user.User, actor string) (*user.User, error) {
+			return nil, fmt.Errorf("connection refused")
 		}
 
-		body := `{"user_name":"jdoe"}`
+		body := `{"user_name":"jdoe","first_name":"john","last_name":"doe","email":"jdoe@test.com"}`
 		req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		c := e.NewContext(req, rec)
@@ -193,6 +389,63 @@ var _ = Describe("CreateUser Handler", func() {
 		Expect(err).To(BeNil())
 		Expect(rec.Code).To(Equal(http.StatusInternalServerError))
 	})
+
+	It("returns 400 naming the field that failed validation", func() {
+		body := `{"user_name":"jdoe","first_name":"john","last_name":"doe","email":"not-an-email"}`
+		req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		c := e.NewContext(req, rec)
+
+		Expect(handler(c)).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(rec.Body.String()).To(MatchJSON(`{"error":"invalid email: must look like name@example.com","field":"email"}`))
+	})
+
+	It("returns 400 when the database rejects a value", func() {
+		mockService.CreateFunc = func(ctx context.Context, u *user.User, actor string) (*user.User, error) {
+			return nil, user.ErrInvalidStatus
+		}
+
+		body := `{"user_name":"jdoe","first_name":"john","last_name":"doe","email":"jdoe@test.com"}`
+		req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		c := e.NewContext(req, rec)
+
+		Expect(handler(c)).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(rec.Body.String()).To(ContainSubstring(`"field":"user_status"`))
+	})
+
+	It("returns 409 when the user_name is taken", func() {
+		mockService.CreateFunc = func(ctx context.Context, u *user.User, actor string) (*user.User, error) {
+			return nil, user.ErrUserExists
+		}
+
+		body := `{"user_name":"jdoe","first_name":"John","last_name":"Doe","email":"jdoe@example.com"}`
+		req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		c := e.NewContext(req, rec)
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusConflict))
+	})
+
+	It("returns 409 when the email is taken", func() {
+		mockService.CreateFunc = func(ctx context.Context, u *user.User, actor string) (*user.User, error) {
+			return nil, user.ErrEmailExists
+		}
+
+		body := `{"user_name":"jdoe","first_name":"John","last_name":"Doe","email":"jdoe@example.com"}`
+		req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		c := e.NewContext(req, rec)
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusConflict))
+		Expect(rec.Body.String()).To(ContainSubstring("email already exists"))
+	})
 })
 
 var _ = Describe("UpdateUser Handler", func() {
@@ -208,12 +461,13 @@ var _ = Describe("UpdateUser Handler", func() {
 		rec = httptest.NewRecorder()
 
 		mockService = &user.MockUserService{
-			UpdateFunc: func(c echo.Context, u *user.User) (*user.User, error) {
+			UpdateFunc: func(ctx context.Context, u *user.User, cond user.Precondition, actor string) (*user.User, error) {
 				u.ID = 1
 				u.UserName = "jdoe"
 				u.FirstName = "john"
 				u.LastName = "doe"
 				u.Email = "jdoe@newemail.com"
+				u.Version = 2
 				return u, nil
 			},
 		}
@@ -234,10 +488,11 @@ var _ = Describe("UpdateUser Handler", func() {
 		err := handler(c)
 		Expect(err).To(BeNil())
 		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("ETag")).To(Equal(`"2"`))
 	})
 
 	It("returns 400 on bad JSON", func() {
-		mockService.UpdateFunc = func(c echo.Context, u *user.User) (*user.User, error) {
+		mockService.UpdateFunc = func(ctx context.Context, u *user.User, cond user.Precondition, actor string) (*user.User, error) {
 			return nil, fmt.Errorf("code=400, message=Syntax error: offset=12, error=invalid character '}' looking for beginning of value, internal=invalid character '}' looking for beginning of value")
 		}
 
@@ -252,7 +507,7 @@ var _ = Describe("UpdateUser Handler", func() {
 	})
 
 	It("returns 500 on invalid user", func() {
-		mockService.UpdateFunc = func(c echo.Context, u *user.User) (*user.User, error) {
+		mockService.UpdateFunc = func(ctx context.Context, u *user.User, cond user.Precondition, actor string) (*user.User, error) {
 			return nil, fmt.Errorf("no rows updated")
 		}
 
@@ -265,6 +520,193 @@ var _ = Describe("UpdateUser Handler", func() {
 		Expect(err).To(BeNil())
 		Expect(rec.Code).To(Equal(http.StatusInternalServerError))
 	})
+
+	It("returns 412 when the user changed since the If-Match version", func() {
+		mockService.UpdateFunc = func(ctx context.Context, u *user.User, cond user.Precondition, actor string) (*user.User, error) {
+			return nil, user.ErrVersionMismatch
+		}
+
+		body := `{"user_id":1,"user_status":"A"}`
+		req := httptest.NewRequest(http.MethodPut, "/users", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("If-Match", `"1"`)
+		c := e.NewContext(req, rec)
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusPreconditionFailed))
+	})
+
+	It("returns 428 when If-Match is required but missing", func() {
+		mockService.UpdateFunc = func(ctx context.Context, u *user.User, cond user.Precondition, actor string) (*user.User, error) {
+			return nil, user.ErrPreconditionRequired
+		}
+
+		body := `{"user_id":1,"user_status":"A"}`
+		req := httptest.NewRequest(http.MethodPut, "/users", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		c := e.NewContext(req, rec)
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusPreconditionRequired))
+	})
+})
+
+var _ = Describe("ReplaceUser Handler", func() {
+	var (
+		e           *echo.Echo
+		mockService *user.MockUserService
+		rec         *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		e = echo.New()
+		rec = httptest.NewRecorder()
+		mockService = &user.MockUserService{}
+	})
+
+	putRequest := func(body string) echo.Context {
+		req := httptest.NewRequest(http.MethodPut, "/users/1", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+		return c
+	}
+
+	It("replaces the user in the path and returns the ETag", func() {
+		mockService.ReplaceFunc = func(ctx context.Context, id int64, u *user.User, cond user.Precondition, actor string) (*user.User, error) {
+			Expect(id).To(Equal(int64(1)))
+			Expect(u.Email).To(Equal("jdoe@example.com"))
+			Expect(u.Department).To(BeNil())
+			Expect(cond).To(Equal(user.Precondition{Version: 2, Given: true}))
+			Expect(actor).To(Equal("alice"))
+			u.ID, u.Version = id, 3
+			return u, nil
+		}
+
+		c := putRequest(`{"user_name":"jdoe","first_name":"John","last_name":"Doe","email":"jdoe@example.com","user_status":"A"}`)
+		c.Request().Header.Set("If-Match", `"2"`)
+		c.Request().Header.Set(HeaderActor, "alice")
+
+		Expect(ReplaceUser(mockService)(c)).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("ETag")).To(Equal(`"3"`))
+		Expect(rec.Header().Get(HeaderDeprecation)).To(BeEmpty())
+	})
+
+	It("returns 400 on bad JSON or a bad user_id", func() {
+		Expect(ReplaceUser(mockService)(putRequest(`{"user_name":`))).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+
+		rec = httptest.NewRecorder()
+		c := putRequest(`{}`)
+		c.SetParamValues("abc")
+		Expect(ReplaceUser(mockService)(c)).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("names user_id when the body's conflicts with the path", func() {
+		mockService.ReplaceFunc = func(ctx context.Context, id int64, u *user.User, cond user.Precondition, actor string) (*user.User, error) {
+			return nil, user.ErrUserIDMismatch
+		}
+
+		Expect(ReplaceUser(mockService)(putRequest(`{"user_id":2}`))).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+
+		var response ErrorResponse
+		Expect(json.Unmarshal(rec.Body.Bytes(), &response)).To(Succeed())
+		Expect(response.Field).To(Equal("user_id"))
+	})
+
+	It("returns 404 for a missing user and 412 for a stale If-Match", func() {
+		for err, status := range map[error]int{
+			user.ErrUserNotFound:    http.StatusNotFound,
+			user.ErrVersionMismatch: http.StatusPreconditionFailed,
+		} {
+			err := err
+			mockService.ReplaceFunc = func(ctx context.Context, id int64, u *user.User, cond user.Precondition, actor string) (*user.User, error) {
+				return nil, err
+			}
+
+			rec = httptest.NewRecorder()
+			Expect(ReplaceUser(mockService)(putRequest(`{}`))).To(Succeed())
+			Expect(rec.Code).To(Equal(status), err.Error())
+		}
+	})
+})
+
+var _ = Describe("PatchUser Handler", func() {
+	var (
+		e           *echo.Echo
+		mockService *user.MockUserService
+		rec         *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		e = echo.New()
+		rec = httptest.NewRecorder()
+		mockService = &user.MockUserService{}
+	})
+
+	patchRequest := func(body string, contentType string) echo.Context {
+		req := httptest.NewRequest(http.MethodPatch, "/users/1", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, contentType)
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+		return c
+	}
+
+	It("passes the raw patch, precondition and actor through and returns the ETag", func() {
+		var gotPatch string
+		var gotCond user.Precondition
+		mockService.PatchFunc = func(ctx context.Context, id int64, patch []byte, cond user.Precondition, actor string) (*user.User, error) {
+			Expect(id).To(Equal(int64(1)))
+			Expect(actor).To(Equal("alice"))
+			gotPatch, gotCond = string(patch), cond
+			return &user.User{ID: 1, UserName: "jdoe", Version: 3}, nil
+		}
+
+		c := patchRequest(`{"department":null}`, "application/merge-patch+json; charset=utf-8")
+		c.Request().Header.Set("If-Match", `"2"`)
+		c.Request().Header.Set(HeaderActor, "alice")
+
+		Expect(PatchUser(mockService)(c)).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("ETag")).To(Equal(`"3"`))
+		Expect(gotPatch).To(Equal(`{"department":null}`))
+		Expect(gotCond).To(Equal(user.Precondition{Version: 2, Given: true}))
+	})
+
+	It("returns 415 with Accept-Patch for other content types", func() {
+		c := patchRequest(`{"department":null}`, echo.MIMEApplicationJSON)
+
+		Expect(PatchUser(mockService)(c)).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusUnsupportedMediaType))
+		Expect(rec.Header().Get("Accept-Patch")).To(Equal(user.MergePatchType))
+	})
+
+	It("maps patch and validation errors to their statuses", func() {
+		for err, status := range map[error]int{
+			user.ErrInvalidPatch:    http.StatusBadRequest,
+			user.ErrPatchUserID:     http.StatusBadRequest,
+			user.ErrMissingEmail:    http.StatusBadRequest,
+			user.ErrUserNotFound:    http.StatusNotFound,
+			user.ErrEmailExists:     http.StatusConflict,
+			user.ErrVersionMismatch: http.StatusPreconditionFailed,
+		} {
+			err := err
+			mockService.PatchFunc = func(ctx context.Context, id int64, patch []byte, cond user.Precondition, actor string) (*user.User, error) {
+				return nil, err
+			}
+
+			rec = httptest.NewRecorder()
+			Expect(PatchUser(mockService)(patchRequest(`{}`, user.MergePatchType))).To(Succeed())
+			Expect(rec.Code).To(Equal(status), err.Error())
+		}
+	})
 })
 
 var _ = Describe("DeleteUser Handler", func() {
@@ -280,7 +722,7 @@ var _ = Describe("DeleteUser Handler", func() {
 		rec = httptest.NewRecorder()
 
 		mockService = &user.MockUserService{
-			DeleteByIDFunc: func(c echo.Context) error {
+			DeleteByIDFunc: func(ctx context.Context, id int64, cond user.Precondition, actor string) error {
 				return nil
 			},
 		}
@@ -302,10 +744,6 @@ var _ = Describe("DeleteUser Handler", func() {
 	})
 
 	It("returns 400 on invalid ID", func() {
-		mockService.DeleteByIDFunc = func(c echo.Context) error {
-			return fmt.Errorf("invalid user_id: must be an integer")
-		}
-
 		req := httptest.NewRequest(http.MethodDelete, "/users/foo", nil)
 		c := e.NewContext(req, rec)
 		c.SetParamNames("user_id")
@@ -317,7 +755,7 @@ var _ = Describe("DeleteUser Handler", func() {
 	})
 
 	It("returns 500 on service error", func() {
-		mockService.DeleteByIDFunc = func(c echo.Context) error {
+		mockService.DeleteByIDFunc = func(ctx context.Context, id int64, cond user.Precondition, actor string) error {
 			return fmt.Errorf("user not found")
 		}
 
@@ -328,6 +766,720 @@ var _ = Describe("DeleteUser Handler", func() {
 
 		err := handler(c)
 		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusInternalServerError))
+	})
+
+	It("returns 412 when the user changed since the If-Match version", func() {
+		mockService.DeleteByIDFunc = func(ctx context.Context, id int64, cond user.Precondition, actor string) error {
+			return user.ErrVersionMismatch
+		}
+
+		req := httptest.NewRequest(http.MethodDelete, "/users/1", nil)
+		req.Header.Set("If-Match", `"1"`)
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusPreconditionFailed))
+	})
+})
+
+var _ = Describe("RestoreUser Handler", func() {
+	var (
+		e           *echo.Echo
+		mockService *user.MockUserService
+		handler     echo.HandlerFunc
+		rec         *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		e = echo.New()
+		rec = httptest.NewRecorder()
+
+		mockService = &user.MockUserService{
+			RestoreByIDFunc: func(ctx context.Context, id int64, actor string) (*user.User, error) {
+				return &user.User{ID: 1, UserName: "jdoe"}, nil
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		handler = RestoreUser(mockService)
+	})
+
+	It("returns 200 and the restored user", func() {
+		req := httptest.NewRequest(http.MethodPost, "/users/1/restore", nil)
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+	})
+
+	It("returns 404 when the user does not exist", func() {
+		mockService.RestoreByIDFunc = func(ctx context.Context, id int64, actor string) (*user.User, error) {
+			return nil, user.ErrUserNotFound
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/users/99/restore", nil)
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("99")
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("returns 409 when the user is not deleted", func() {
+		mockService.RestoreByIDFunc = func(ctx context.Context, id int64, actor string) (*user.User, error) {
+			return nil, user.ErrUserNotDeleted
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/users/1/restore", nil)
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusConflict))
+	})
+})
+
+var _ = Describe("PurgeUser Handler", func() {
+	var (
+		e           *echo.Echo
+		mockService *user.MockUserService
+		handler     echo.HandlerFunc
+		rec         *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		e = echo.New()
+		rec = httptest.NewRecorder()
+
+		mockService = &user.MockUserService{
+			PurgeByIDFunc: func(ctx context.Context, id int64, actor string) error {
+				return nil
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		handler = RequireAdmin("secret")(PurgeUser(mockService))
+	})
+
+	It("returns 204 with the admin token", func() {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/users/1", nil)
+		req.Header.Set(HeaderAdminToken, "secret")
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusNoContent))
+	})
+
+	It("returns 403 without the admin token", func() {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/users/1", nil)
+		req.Header.Set(HeaderAdminToken, "wrong")
+		c := e.NewContext(req, rec)
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("returns 403 when no admin token is configured", func() {
+		handler = RequireAdmin("")(PurgeUser(mockService))
+
+		req := httptest.NewRequest(http.MethodDelete, "/admin/users/1", nil)
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("returns 404 when the user does not exist", func() {
+		mockService.PurgeByIDFunc = func(ctx context.Context, id int64, actor string) error {
+			return user.ErrUserNotFound
+		}
+
+		req := httptest.NewRequest(http.MethodDelete, "/admin/users/99", nil)
+		req.Header.Set(HeaderAdminToken, "secret")
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("99")
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusNotFound))
+	})
+})
+
+var _ = Describe("GetUserHistory Handler", func() {
+	var (
+		e           *echo.Echo
+		mockService *user.MockUserService
+		handler     echo.HandlerFunc
+		rec         *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		e = echo.New()
+		rec = httptest.NewRecorder()
+
+		mockService = &user.MockUserService{
+			HistoryByIDFunc: func(ctx context.Context, id int64, opts user.HistoryOptions) ([]user.AuditEntry, error) {
+				return []user.AuditEntry{
+					{ID: 1, UserID: 1, Actor: "alice", Operation: user.OpCreate},
+				}, nil
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		handler = GetUserHistory(mockService)
+	})
+
+	It("returns 200 and the entries", func() {
+		req := httptest.NewRequest(http.MethodGet, "/users/1/history", nil)
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+
+		var resp HistoryResponse
+		Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+		Expect(resp.Entries).To(HaveLen(1))
+		Expect(resp.Entries[0].Actor).To(Equal("alice"))
+	})
+
+	It("returns 400 on an invalid filter", func() {
+		mockService.HistoryByIDFunc = func(ctx context.Context, id int64, opts user.HistoryOptions) ([]user.AuditEntry, error) {
+			return nil, user.ErrInvalidOperation
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/users/1/history?operation=rename", nil)
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	})
+})
+
+// Hands out one prepared subscription
+type fakeChangeSource struct {
+	changes      chan user.Change
+	unsubscribed bool
+}
+
+func (f *fakeChangeSource) Subscribe(buffer int) (<-chan user.Change, func()) {
+	return f.changes, func() { f.unsubscribed = true }
+}
+
+var _ = Describe("StreamUserChanges Handler", func() {
+	var (
+		e      *echo.Echo
+		source *fakeChangeSource
+		rec    *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		e = echo.New()
+		rec = httptest.NewRecorder()
+		source = &fakeChangeSource{changes: make(chan user.Change, 10)}
+	})
+
+	It("streams each change as a server-sent event until the feed stops", func() {
+		source.changes <- user.Change{Op: user.ChangeInsert, UserID: 1, Version: 1}
+		source.changes <- user.Change{Op: user.ChangeResync}
+		close(source.changes)
+
+		req := httptest.NewRequest(http.MethodGet, "/users/changes", nil)
+		c := e.NewContext(req, rec)
+
+		Expect(StreamUserChanges(source)(c)).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get(echo.HeaderContentType)).To(Equal("text/event-stream"))
+		Expect(rec.Body.String()).To(Equal(
+			"event: insert\ndata: {\"op\":\"insert\",\"user_id\":1,\"version\":1}\n\n" +
+				"event: resync\ndata: {\"op\":\"resync\",\"user_id\":0,\"version\":0}\n\n",
+		))
+		Expect(source.unsubscribed).To(BeTrue())
+	})
+
+	It("unsubscribes when the client goes away", func() {
+		reqCtx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		req := httptest.NewRequest(http.MethodGet, "/users/changes", nil).WithContext(reqCtx)
+		c := e.NewContext(req, rec)
+
+		Expect(StreamUserChanges(source)(c)).To(Succeed())
+		Expect(source.unsubscribed).To(BeTrue())
+	})
+})
+
+var _ = Describe("GetOutboxEvents Handler", func() {
+	var (
+		e         *echo.Echo
+		mockStore *user.MockOutboxStore
+		handler   echo.HandlerFunc
+		rec       *httptest.ResponseRecorder
+		given     user.OutboxOptions
+	)
+
+	BeforeEach(func() {
+		e = echo.New()
+		rec = httptest.NewRecorder()
+
+		mockStore = &user.MockOutboxStore{
+			EventsFunc: func(ctx context.Context, opts user.OutboxOptions) ([]user.OutboxEvent, error) {
+				given = opts
+				return []user.OutboxEvent{
+					{Event: user.Event{ID: 1, Type: user.EventUserCreated, UserID: 1}, Status: user.EventDead, Attempts: 10},
+				}, nil
+			},
+		}
+		handler = GetOutboxEvents(mockStore)
+	})
+
+	It("returns 200 with the events", func() {
+		req := httptest.NewRequest(http.MethodGet, "/admin/outbox?status=dead&limit=10&offset=5", nil)
+		c := e.NewContext(req, rec)
+
+		err := handler(c)
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(given).To(Equal(user.OutboxOptions{Status: user.EventDead, Limit: 10, Offset: 5}))
+
+		var resp OutboxResponse
+		Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+		Expect(resp.Events).To(HaveLen(1))
+		Expect(resp.Events[0].ID).To(Equal(int64(1)))
+		Expect(resp.Events[0].Status).To(Equal(user.EventDead))
+	})
+
+	It("pages with the default limit", func() {
+		req := httptest.NewRequest(http.MethodGet, "/admin/outbox", nil)
+		c := e.NewContext(req, rec)
+
+		Expect(handler(c)).To(Succeed())
+		Expect(given).To(Equal(user.OutboxOptions{Limit: user.DefaultHistoryLimit}))
+	})
+
+	It("returns 400 on invalid params", func() {
+		for _, query := range []string{"status=lost", "limit=0", "limit=x", "offset=-1"} {
+			rec = httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/admin/outbox?"+query, nil)
+			c := e.NewContext(req, rec)
+
+			Expect(handler(c)).To(Succeed())
+			Expect(rec.Code).To(Equal(http.StatusBadRequest), query)
+		}
+	})
+})
+
+var _ = Describe("RequeueOutboxEvent Handler", func() {
+	var (
+		e          *echo.Echo
+		mockStore  *user.MockOutboxStore
+		handler    echo.HandlerFunc
+		rec        *httptest.ResponseRecorder
+		requeueErr error
+	)
+
+	BeforeEach(func() {
+		e = echo.New()
+		rec = httptest.NewRecorder()
+		requeueErr = nil
+
+		mockStore = &user.MockOutboxStore{
+			RequeueEventFunc: func(ctx context.Context, eventID int64) error {
+				return requeueErr
+			},
+		}
+		handler = RequeueOutboxEvent(mockStore)
+	})
+
+	requeue := func(eventID string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/outbox/"+eventID+"/requeue", nil)
+		c := e.NewContext(req, rec)
+		c.SetParamNames("event_id")
+		c.SetParamValues(eventID)
+
+		Expect(handler(c)).To(Succeed())
+		return rec.Code
+	}
+
+	It("returns 204 when the event was requeued", func() {
+		Expect(requeue("1")).To(Equal(http.StatusNoContent))
+	})
+
+	It("returns 400 for an invalid event_id", func() {
+		Expect(requeue("abc")).To(Equal(http.StatusBadRequest))
+	})
+
+	It("returns 404 for an unknown event", func() {
+		requeueErr = user.ErrEventNotFound
+		Expect(requeue("99")).To(Equal(http.StatusNotFound))
+	})
+
+	It("returns 409 when the event isn't dead", func() {
+		requeueErr = user.ErrEventNotDead
+		Expect(requeue("1")).To(Equal(http.StatusConflict))
+	})
+})
+
+var _ = Describe("BulkCreateUsers Handler", func() {
+	var (
+		e         *echo.Echo
+		mockStore *user.MockBulkStore
+		handler   echo.HandlerFunc
+		rec       *httptest.ResponseRecorder
+		given     []user.User
+		givenBy   string
+		bulkErr   error
+	)
+
+	BeforeEach(func() {
+		e = echo.New()
+		rec = httptest.NewRecorder()
+		bulkErr = nil
+
+		mockStore = &user.MockBulkStore{
+			BulkCreateFunc: func(ctx context.Context, users []user.User, actor string) ([]user.BulkResult, error) {
+				given, givenBy = users, actor
+				if bulkErr != nil {
+					return nil, bulkErr
+				}
+				return []user.BulkResult{
+					{Row: 0, Outcome: user.BulkCreated, UserID: 1},
+					{Row: 1, Outcome: user.BulkDuplicateEmail},
+					{Row: 2, Outcome: user.BulkInvalid, Field: "email", Error: "missing email"},
+				}, nil
+			},
+		}
+		handler = BulkCreateUsers(mockStore)
+	})
+
+	post := func(body string) {
+		req := httptest.NewRequest(http.MethodPost, "/users/bulk", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(HeaderActor, "importer")
+		c := e.NewContext(req, rec)
+
+		Expect(handler(c)).To(Succeed())
+	}
+
+	It("returns 200 with the outcome of every user", func() {
+		post(`[{"user_name":"jdoe"},{"user_name":"asmith"},{"user_name":"nobody"}]`)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(given).To(HaveLen(3))
+		Expect(givenBy).To(Equal("importer"))
+
+		var resp BulkResponse
+		Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+		Expect(resp.Created).To(Equal(1))
+		Expect(resp.Duplicates).To(Equal(1))
+		Expect(resp.Invalid).To(Equal(1))
+		Expect(resp.Results).To(HaveLen(3))
+		Expect(resp.Results[2].Field).To(Equal("email"))
+	})
+
+	It("returns 400 when the body isn't an array of users", func() {
+		post(`{"user_name":"jdoe"}`)
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("returns 400 for an empty or oversized load", func() {
+		bulkErr = user.ErrInvalidBulkSize
+		post(`[]`)
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("returns 500 when the load fails", func() {
+		bulkErr = fmt.Errorf("copy failed")
+		post(`[{"user_name":"jdoe"}]`)
+		Expect(rec.Code).To(Equal(http.StatusInternalServerError))
+	})
+})
+
+var _ = Describe("Handlers as service adapters", func() {
+	var (
+		e           *echo.Echo
+		mockService *user.MockUserService
+		rec         *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		e = echo.New()
+		rec = httptest.NewRecorder()
+		mockService = &user.MockUserService{}
+	})
+
+	It("passes the request context to the service", func() {
+		type ctxKey struct{}
+		var got context.Context
+		mockService.StreamAllFunc = func(ctx context.Context, opts user.ListOptions, fn func(user.User) error) (string, error) {
+			got = ctx
+			return "", nil
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		req = req.WithContext(context.WithValue(req.Context(), ctxKey{}, "request"))
+
+		Expect(GetAllUsers(mockService)(e.NewContext(req, rec))).To(Succeed())
+		Expect(got.Value(ctxKey{})).To(Equal("request"))
+	})
+
+	It("parses the list filters", func() {
+		var got user.ListOptions
+		mockService.StreamAllFunc = func(ctx context.Context, opts user.ListOptions, fn func(user.User) error) (string, error) {
+			got = opts
+			return "", nil
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/users?include_deleted=true&created_after=2024-01-01T00:00:00Z&updated_before=2024-02-01T00:00:00Z", nil)
+
+		Expect(GetAllUsers(mockService)(e.NewContext(req, rec))).To(Succeed())
+		Expect(got.IncludeDeleted).To(BeTrue())
+		Expect(*got.CreatedAfter).To(Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)))
+		Expect(*got.UpdatedBefore).To(Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)))
+		Expect(got.CreatedBefore).To(BeNil())
+		Expect(got.UpdatedAfter).To(BeNil())
+	})
+
+	It("parses the list filters and sort", func() {
+		var got user.ListOptions
+		mockService.StreamAllFunc = func(ctx context.Context, opts user.ListOptions, fn func(user.User) error) (string, error) {
+			got = opts
+			return "", nil
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/users?user_status=a&department=Finance&email_domain=example.com&user_name=jd&sort=last_name,-user_id", nil)
+
+		Expect(GetAllUsers(mockService)(e.NewContext(req, rec))).To(Succeed())
+		Expect(got.UserStatus).To(Equal("A"))
+		Expect(*got.Department).To(Equal("Finance"))
+		Expect(got.EmailDomain).To(Equal("example.com"))
+		Expect(got.UserNamePrefix).To(Equal("jd"))
+		Expect(got.Sort).To(Equal([]user.SortField{{Column: "last_name"}, {Column: "user_id", Desc: true}}))
+
+		req = httptest.NewRequest(http.MethodGet, "/users?department=", nil)
+
+		Expect(GetAllUsers(mockService)(e.NewContext(req, httptest.NewRecorder()))).To(Succeed())
+		Expect(*got.Department).To(BeEmpty())
+		Expect(got.Sort).To(BeNil())
+	})
+
+	DescribeTable("rejects malformed list filters with 400",
+		func(query string) {
+			req := httptest.NewRequest(http.MethodGet, "/users?"+query, nil)
+
+			Expect(GetAllUsers(mockService)(e.NewContext(req, rec))).To(Succeed())
+			Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		},
+		Entry("time filter", "created_before=last-week"),
+		Entry("include_deleted", "include_deleted=maybe"),
+		Entry("as_of", "as_of=yesterday"),
+		Entry("limit", "limit=0"),
+		Entry("cursor", "cursor=not-a-cursor"),
+		Entry("include_total", "include_total=maybe"),
+		Entry("sort", "sort=password"),
+	)
+
+	It("passes the path ID, If-Match and X-Actor to a delete", func() {
+		var gotID int64
+		var gotCond user.Precondition
+		var gotActor string
+		mockService.DeleteByIDFunc = func(ctx context.Context, id int64, cond user.Precondition, actor string) error {
+			gotID, gotCond, gotActor = id, cond, actor
+			return nil
+		}
+
+		req := httptest.NewRequest(http.MethodDelete, "/users/123", nil)
+		req.Header.Set("If-Match", `"7"`)
+		req.Header.Set(HeaderActor, " alice ")
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("123")
+
+		Expect(DeleteUser(mockService)(c)).To(Succeed())
+		Expect(gotID).To(Equal(int64(123)))
+		Expect(gotCond).To(Equal(user.Precondition{Version: 7, Given: true}))
+		Expect(gotActor).To(Equal("alice"))
+	})
+
+	It("tells If-Match: * apart from no If-Match", func() {
+		var got user.Precondition
+		mockService.UpdateFunc = func(ctx context.Context, u *user.User, cond user.Precondition, actor string) (*user.User, error) {
+			got = cond
+			return u, nil
+		}
+
+		req := httptest.NewRequest(http.MethodPut, "/users", strings.NewReader(`{"user_id":1}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		Expect(UpdateUser(mockService)(e.NewContext(req, rec))).To(Succeed())
+		Expect(got).To(Equal(user.Precondition{}))
+
+		req = httptest.NewRequest(http.MethodPut, "/users", strings.NewReader(`{"user_id":1}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("If-Match", "*")
+		Expect(UpdateUser(mockService)(e.NewContext(req, httptest.NewRecorder()))).To(Succeed())
+		Expect(got).To(Equal(user.Precondition{Given: true}))
+	})
+
+	It("rejects a malformed If-Match with 400", func() {
+		req := httptest.NewRequest(http.MethodPut, "/users", strings.NewReader(`{"user_id":1}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("If-Match", "7")
+
+		Expect(UpdateUser(mockService)(e.NewContext(req, rec))).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	Describe("history params", func() {
+		var got user.HistoryOptions
+
+		BeforeEach(func() {
+			mockService.HistoryByIDFunc = func(ctx context.Context, id int64, opts user.HistoryOptions) ([]user.AuditEntry, error) {
+				got = opts
+				return []user.AuditEntry{}, nil
+			}
+		})
+
+		history := func(query string) {
+			req := httptest.NewRequest(http.MethodGet, "/users/123/history?"+query, nil)
+			c := e.NewContext(req, rec)
+			c.SetParamNames("user_id")
+			c.SetParamValues("123")
+			Expect(GetUserHistory(mockService)(c)).To(Succeed())
+		}
+
+		It("defaults to the first page", func() {
+			history("")
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(got).To(Equal(user.HistoryOptions{Limit: user.DefaultHistoryLimit}))
+		})
+
+		It("parses the filters", func() {
+			history("from=2024-01-01T00:00:00Z&to=2024-02-01T00:00:00%2B01:00&operation=status_change&limit=10&offset=20")
+			Expect(*got.From).To(Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)))
+			Expect(*got.To).To(Equal(time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)))
+			Expect(got.Operation).To(Equal(user.OpStatusChange))
+			Expect(got.Limit).To(Equal(10))
+			Expect(got.Offset).To(Equal(20))
+		})
+
+		DescribeTable("rejects malformed params with 400",
+			func(query string) {
+				history(query)
+				Expect(rec.Code).To(Equal(http.StatusBadRequest))
+			},
+			Entry("bad from", "from=yesterday"),
+			Entry("non-numeric limit", "limit=ten"),
+			Entry("non-numeric offset", "offset=last"),
+		)
+	})
+})
+
+var _ = Describe("user_id path param", func() {
+	DescribeTable("rejects a non-integer user_id with 400 on every route",
+		func(method string, handler func(user.Service) echo.HandlerFunc) {
+			e := echo.New()
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/users/abc", strings.NewReader(`{}`))
+			req.Header.Set(echo.HeaderContentType, user.MergePatchType)
+			c := e.NewContext(req, rec)
+			c.SetParamNames("user_id")
+			c.SetParamValues("abc")
+
+			Expect(handler(&user.MockUserService{})(c)).To(Succeed())
+			Expect(rec.Code).To(Equal(http.StatusBadRequest))
+
+			var response ErrorResponse
+			Expect(json.Unmarshal(rec.Body.Bytes(), &response)).To(Succeed())
+			Expect(response.Error).To(Equal(user.ErrInvalidUserID.Error()))
+		},
+		Entry("GetUserByID", http.MethodGet, GetUserByID),
+		Entry("ReplaceUser", http.MethodPut, ReplaceUser),
+		Entry("PatchUser", http.MethodPatch, PatchUser),
+		Entry("DeleteUser", http.MethodDelete, DeleteUser),
+		Entry("RestoreUser", http.MethodPost, RestoreUser),
+		Entry("GetUserHistory", http.MethodGet, GetUserHistory),
+		Entry("PurgeUser", http.MethodDelete, PurgeUser),
+	)
+})
+
+var _ = Describe("Deprecated middleware", func() {
+	It("marks every response of the route deprecated", func() {
+		e := echo.New()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/users", nil)
+
+		handler := Deprecated()(func(c echo.Context) error {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "bad"})
+		})
+
+		Expect(handler(e.NewContext(req, rec))).To(Succeed())
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(rec.Header().Get(HeaderDeprecation)).To(Equal("true"))
+	})
+})
+
+var _ = Describe("ReadConsistency middleware", func() {
+	var (
+		e       *echo.Echo
+		rec     *httptest.ResponseRecorder
+		primary bool
+		handler echo.HandlerFunc
+	)
+
+	BeforeEach(func() {
+		e = echo.New()
+		rec = httptest.NewRecorder()
+		handler = ReadConsistency()(func(c echo.Context) error {
+			primary = db.PrimaryRequested(c.Request().Context())
+			return c.NoContent(http.StatusOK)
+		})
+	})
+
+	DescribeTable("routes reads by the requested consistency",
+		func(value string, expected bool) {
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			req.Header.Set(HeaderReadConsistency, value)
+
+			Expect(handler(e.NewContext(req, rec))).To(Succeed())
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(primary).To(Equal(expected))
+		},
+		Entry("default", "", false),
+		Entry("eventual", "eventual", false),
+		Entry("strong", "strong", true),
+	)
+
+	It("rejects an unknown consistency with 400", func() {
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		req.Header.Set(HeaderReadConsistency, "linearizable")
+
+		Expect(handler(e.NewContext(req, rec))).To(Succeed())
 		Expect(rec.Code).To(Equal(http.StatusBadRequest))
 	})
 })
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/steveperjesi/integra-demo/internal/db"
+)
+
+const (
+	HeaderAdminToken = "X-Admin-Token"
+
+	// "strong" reads from the primary, seeing every write that has
+	// completed; "eventual" (the default) allows a read replica
+	HeaderReadConsistency = "X-Read-Consistency"
+
+	// Set on responses from deprecated routes
+	HeaderDeprecation = "Deprecation"
+)
+
+// Only lets requests through that carry the admin token in X-Admin-Token.
+// An empty token disables the protected routes entirely.
+func RequireAdmin(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			given := c.Request().Header.Get(HeaderAdminToken)
+			if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				return c.JSON(http.StatusForbidden, ErrorResponse{Error: "admin access required"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// Marks the responses of a route that is going away with a Deprecation
+// header, so clients can find their remaining calls to it
+func Deprecated() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Response().Header().Set(HeaderDeprecation, "true")
+			return next(c)
+		}
+	}
+}
+
+// Routes a request's reads to the primary when it asks for strong
+// consistency in X-Read-Consistency
+func ReadConsistency() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			switch c.Request().Header.Get(HeaderReadConsistency) {
+			case "", "eventual":
+			case "strong":
+				req := c.Request()
+				c.SetRequest(req.WithContext(db.WithPrimary(req.Context())))
+			default:
+				return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid " + HeaderReadConsistency + ": must be strong or eventual"})
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/steveperjesi/integra-demo/user"
+)
+
+// HeaderActor names who is making a change, for the audit trail
+const HeaderActor = "X-Actor"
+
+// Reads the `user_id` path param
+func userIDParam(c echo.Context) (int64, error) {
+	return user.ValidateUserID(c.Param("user_id"))
+}
+
+// Reads who is making the change from the X-Actor header. Empty means
+// anonymous.
+func actor(c echo.Context) string {
+	return strings.TrimSpace(c.Request().Header.Get(HeaderActor))
+}
+
+// Reports whether a Content-Type header names mediaType, whatever its
+// parameters
+func isMediaType(contentType string, mediaType string) bool {
+	parsed, _, err := mime.ParseMediaType(contentType)
+	return err == nil && parsed == mediaType
+}
+
+// Reads the precondition for a write from the If-Match header
+func precondition(c echo.Context) (user.Precondition, error) {
+	return user.ParsePrecondition(c.Request().Header.Get("If-Match"))
+}
+
+// Reads the optional `include_deleted` and `as_of` query params for a single
+// user
+func getParams(c echo.Context) (user.GetOptions, error) {
+	includeDeleted, err := includeDeletedParam(c)
+	if err != nil {
+		return user.GetOptions{}, err
+	}
+
+	asOf, err := timeParam(c, "as_of", user.ErrInvalidAsOf)
+	if err != nil {
+		return user.GetOptions{}, err
+	}
+
+	return user.GetOptions{IncludeDeleted: includeDeleted, AsOf: asOf}, nil
+}
+
+// Reads the `include_deleted`, `as_of`, filter, `sort`, `limit` and `cursor`
+// query params for a list. The service checks the filters' values.
+func listParams(c echo.Context) (user.ListOptions, error) {
+	includeDeleted, err := includeDeletedParam(c)
+	if err != nil {
+		return user.ListOptions{}, err
+	}
+
+	asOf, err := timeParam(c, "as_of", user.ErrInvalidAsOf)
+	if err != nil {
+		return user.ListOptions{}, err
+	}
+
+	opts := user.ListOptions{IncludeDeleted: includeDeleted, AsOf: asOf}
+
+	filters := []struct {
+		name string
+		dest **time.Time
+	}{
+		{"created_after", &opts.CreatedAfter},
+		{"created_before", &opts.CreatedBefore},
+		{"updated_after", &opts.UpdatedAfter},
+		{"updated_before", &opts.UpdatedBefore},
+	}
+
+	for _, filter := range filters {
+		if *filter.dest, err = timeParam(c, filter.name, user.ErrInvalidTimeFilter); err != nil {
+			return user.ListOptions{}, err
+		}
+	}
+
+	opts.UserStatus = strings.ToUpper(strings.TrimSpace(c.QueryParam("user_status")))
+	opts.EmailDomain = strings.TrimSpace(c.QueryParam("email_domain"))
+	opts.UserNamePrefix = strings.TrimSpace(c.QueryParam("user_name"))
+
+	// An empty department asks for users without one
+	if values, ok := c.QueryParams()["department"]; ok {
+		department := strings.TrimSpace(values[0])
+		opts.Department = &department
+	}
+
+	if opts.Sort, err = user.ParseSort(c.QueryParam("sort")); err != nil {
+		return user.ListOptions{}, err
+	}
+
+	if value := c.QueryParam("limit"); value != "" {
+		if opts.Limit, err = strconv.Atoi(value); err != nil || opts.Limit < 1 {
+			return user.ListOptions{}, user.ErrInvalidPageLimit
+		}
+	}
+
+	if value := c.QueryParam("cursor"); value != "" {
+		if opts.After, err = user.DecodeCursor(value); err != nil {
+			return user.ListOptions{}, err
+		}
+	}
+
+	return opts, nil
+}
+
+// Reads the `from`, `to`, `operation`, `limit` and `offset` query params.
+// The service checks that they make sense together.
+func historyParams(c echo.Context) (user.HistoryOptions, error) {
+	opts := user.HistoryOptions{
+		Operation: c.QueryParam("operation"),
+		Limit:     user.DefaultHistoryLimit,
+	}
+
+	var err error
+
+	if opts.From, err = timeParam(c, "from", user.ErrInvalidDateRange); err != nil {
+		return user.HistoryOptions{}, err
+	}
+
+	if opts.To, err = timeParam(c, "to", user.ErrInvalidDateRange); err != nil {
+		return user.HistoryOptions{}, err
+	}
+
+	if value := c.QueryParam("limit"); value != "" {
+		if opts.Limit, err = strconv.Atoi(value); err != nil {
+			return user.HistoryOptions{}, user.ErrInvalidLimit
+		}
+	}
+
+	if value := c.QueryParam("offset"); value != "" {
+		if opts.Offset, err = strconv.Atoi(value); err != nil {
+			return user.HistoryOptions{}, user.ErrInvalidOffset
+		}
+	}
+
+	return opts, nil
+}
+
+// Reads the `q` and `limit` query params of a search. The service checks
+// their values.
+func searchParams(c echo.Context) (user.SearchOptions, error) {
+	opts := user.SearchOptions{
+		Query: c.QueryParam("q"),
+		Limit: user.DefaultSearchLimit,
+	}
+
+	if value := c.QueryParam("limit"); value != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(value); err != nil {
+			return user.SearchOptions{}, user.ErrInvalidSearchLimit
+		}
+	}
+
+	return opts, nil
+}
+
+// Reads the `event_id` path param
+func eventIDParam(c echo.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("event_id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, user.ErrInvalidEventID
+	}
+
+	return id, nil
+}
+
+// Reads the `status`, `limit` and `offset` query params for the outbox
+func outboxParams(c echo.Context) (user.OutboxOptions, error) {
+	opts := user.OutboxOptions{
+		Status: c.QueryParam("status"),
+		Limit:  user.DefaultHistoryLimit,
+	}
+
+	var err error
+
+	if value := c.QueryParam("limit"); value != "" {
+		if opts.Limit, err = strconv.Atoi(value); err != nil {
+			return user.OutboxOptions{}, user.ErrInvalidLimit
+		}
+	}
+
+	if value := c.QueryParam("offset"); value != "" {
+		if opts.Offset, err = strconv.Atoi(value); err != nil {
+			return user.OutboxOptions{}, user.ErrInvalidOffset
+		}
+	}
+
+	return opts, opts.Validate()
+}
+
+// Reads an optional RFC 3339 timestamp query param
+func timeParam(c echo.Context, name string, invalid error) (*time.Time, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, invalid
+	}
+
+	t = t.UTC()
+	return &t, nil
+}
+
+// Reads the optional `include_deleted` query param
+func includeDeletedParam(c echo.Context) (bool, error) {
+	return boolParam(c, "include_deleted", user.ErrInvalidIncludeDeleted)
+}
+
+// Reads an optional boolean query param, false when missing
+func boolParam(c echo.Context, name string, invalid error) (bool, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, invalid
+	}
+
+	return b, nil
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/steveperjesi/integra-demo/user"
+)
+
+// Newline-delimited JSON: one user per line, no enclosing array
+const MIMEApplicationNDJSON = "application/x-ndjson"
+
+// Reports whether the client asked for NDJSON over a JSON array
+func acceptsNDJSON(c echo.Context) bool {
+	return strings.Contains(c.Request().Header.Get(echo.HeaderAccept), MIMEApplicationNDJSON)
+}
+
+const (
+	// Sent with a list when include_total is set
+	HeaderTotalCount = "X-Total-Count"
+	// Trailer carrying the next page's cursor in a paged NDJSON list, which
+	// is only known once the page has been read
+	HeaderNextCursor = "X-Next-Cursor"
+)
+
+// userStream writes users to the response one at a time, inside a
+// UsersResponse or as NDJSON. Nothing is sent until the first user, so an
+// error before then can still be answered with an error status.
+type userStream struct {
+	res     *echo.Response
+	enc     *json.Encoder
+	ndjson  bool
+	paged   bool
+	total   *int64
+	written int
+}
+
+func newUserStream(res *echo.Response, ndjson bool, paged bool, total *int64) *userStream {
+	return &userStream{res: res, enc: json.NewEncoder(res), ndjson: ndjson, paged: paged, total: total}
+}
+
+func (s *userStream) write(u user.User) error {
+	if s.written == 0 {
+		if err := s.start(); err != nil {
+			return err
+		}
+	} else if !s.ndjson {
+		if _, err := s.res.Write([]byte(",")); err != nil {
+			return err
+		}
+	}
+
+	// Encode ends every user with a newline, which NDJSON needs and a JSON
+	// array ignores
+	if err := s.enc.Encode(u); err != nil {
+		return err
+	}
+
+	s.written++
+
+	// Gets the first user out straight away; after that the server's write
+	// buffer decides when to send
+	if s.written == 1 {
+		s.res.Flush()
+	}
+
+	return nil
+}
+
+// Ends the response with the cursor for the next page, empty after the
+// last page
+func (s *userStream) close(nextCursor string) error {
+	if s.written == 0 {
+		if err := s.start(); err != nil {
+			return err
+		}
+	}
+
+	if s.ndjson {
+		if nextCursor != "" {
+			s.res.Header().Set(HeaderNextCursor, nextCursor)
+		}
+		return nil
+	}
+
+	next, err := json.Marshal(optionalString(nextCursor))
+	if err != nil {
+		return err
+	}
+
+	tail := `],"next_cursor":` + string(next)
+	if s.total != nil {
+		tail += `,"total":` + strconv.FormatInt(*s.total, 10)
+	}
+
+	_, err = s.res.Write([]byte(tail + "}"))
+	return err
+}
+
+func (s *userStream) start() error {
+	contentType := echo.MIMEApplicationJSON
+	if s.ndjson {
+		contentType = MIMEApplicationNDJSON
+	}
+
+	header := s.res.Header()
+	header.Set(echo.HeaderContentType, contentType)
+
+	if s.total != nil {
+		header.Set(HeaderTotalCount, strconv.FormatInt(*s.total, 10))
+	}
+
+	if s.ndjson && s.paged {
+		header.Set("Trailer", HeaderNextCursor)
+	}
+
+	s.res.WriteHeader(http.StatusOK)
+
+	if !s.ndjson {
+		_, err := s.res.Write([]byte(`{"items":[`))
+		return err
+	}
+
+	return nil
+}
+
+// Returns nil for an empty string, which encodes as JSON null
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
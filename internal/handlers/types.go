@@ -2,10 +2,54 @@ package handlers
 
 import "github.com/steveperjesi/integra-demo/user"
 
+// UsersResponse is a page of users. NextCursor fetches the page after it and
+// is null on the last page; Total is only sent when asked for.
 type UsersResponse struct {
-	Users []user.User `json:"users"`
+	Items      []user.User `json:"items"`
+	NextCursor *string     `json:"next_cursor"`
+	Total      *int64      `json:"total,omitempty"`
+}
+
+type SearchResponse struct {
+	Results []user.SearchResult `json:"results"`
+}
+
+type HistoryResponse struct {
+	Entries []user.AuditEntry `json:"entries"`
+}
+
+type OutboxResponse struct {
+	Events []user.OutboxEvent `json:"events"`
+}
+
+// BulkResponse counts the outcomes of a bulk load alongside the result for
+// each user
+type BulkResponse struct {
+	Created    int               `json:"created"`
+	Duplicates int               `json:"duplicates"`
+	Invalid    int               `json:"invalid"`
+	Results    []user.BulkResult `json:"results"`
+}
+
+func newBulkResponse(results []user.BulkResult) BulkResponse {
+	response := BulkResponse{Results: results}
+
+	for _, result := range results {
+		switch result.Outcome {
+		case user.BulkCreated:
+			response.Created++
+		case user.BulkInvalid:
+			response.Invalid++
+		default:
+			response.Duplicates++
+		}
+	}
+
+	return response
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// Field is the request field that failed validation, if any
+	Field string `json:"field,omitempty"`
 }
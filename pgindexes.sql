@@ -1,2 +0,0 @@
-CREATE INDEX IF NOT EXISTS idx_users_email ON users (email);
-CREATE INDEX IF NOT EXISTS idx_users_user_status ON users (user_status);
\ No newline at end of file
@@ -0,0 +1,228 @@
+package user
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/steveperjesi/integra-demo/internal/db"
+)
+
+const (
+	AuditTable = "user_audit"
+
+	// Recorded when no X-Actor header names who made the change
+	DefaultActor = "anonymous"
+)
+
+// Operations recorded in the audit trail
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	// An update that changed `user_status`, alone or with other fields
+	OpStatusChange = "status_change"
+	OpDelete       = "delete"
+	OpRestore      = "restore"
+	OpPurge        = "purge"
+)
+
+var auditOperations = []string{OpCreate, OpUpdate, OpStatusChange, OpDelete, OpRestore, OpPurge}
+
+// AuditEntry records one change made to a user
+type AuditEntry struct {
+	ID        int64  `json:"audit_id"`
+	UserID    int64  `json:"user_id"`
+	Actor     string `json:"actor"`
+	Operation string `json:"operation"`
+	// Changes holds only the fields that changed, keyed by JSON field name
+	Changes   map[string]FieldChange `json:"changes"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// FieldChange is a field's value before and after a change. A nil value
+// means the field was unset, or the user didn't exist yet (or anymore).
+type FieldChange struct {
+	Before *string `json:"before"`
+	After  *string `json:"after"`
+}
+
+// Narrows and pages a user's audit trail. Zero values don't filter.
+type HistoryOptions struct {
+	// Only entries at or after From, and before To
+	From *time.Time
+	To   *time.Time
+	// Only entries with this operation
+	Operation string
+	// Offset only applies together with a Limit
+	Limit  int
+	Offset int
+}
+
+func IsAuditOperation(op string) bool {
+	for _, known := range auditOperations {
+		if op == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds the audit entry for a change from before to after. Pass nil for
+// before on create and for after on purge.
+func newAuditEntry(actor string, op string, before *User, after *User) AuditEntry {
+	entry := AuditEntry{
+		Actor:     actor,
+		Operation: op,
+		Changes:   diffUsers(before, after),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if before != nil {
+		entry.UserID = before.ID
+	} else if after != nil {
+		entry.UserID = after.ID
+	}
+
+	if entry.Actor == "" {
+		entry.Actor = DefaultActor
+	}
+
+	// Updates are classified by what they changed
+	if op == OpUpdate {
+		if _, ok := entry.Changes["user_status"]; ok {
+			entry.Operation = OpStatusChange
+		}
+	}
+
+	return entry
+}
+
+// Compares the user fields a client can see, keyed by JSON field name
+func diffUsers(before *User, after *User) map[string]FieldChange {
+	fields := func(u *User) map[string]*string {
+		if u == nil {
+			return map[string]*string{}
+		}
+
+		values := map[string]*string{
+			"user_name":   &u.UserName,
+			"first_name":  &u.FirstName,
+			"last_name":   &u.LastName,
+			"email":       &u.Email,
+			"user_status": &u.UserStatus,
+			"department":  u.Department,
+		}
+
+		if u.DeletedAt != nil {
+			deletedAt := u.DeletedAt.UTC().Format(time.RFC3339Nano)
+			values["deleted_at"] = &deletedAt
+		}
+
+		return values
+	}
+
+	beforeFields, afterFields := fields(before), fields(after)
+
+	changes := make(map[string]FieldChange)
+
+	for _, name := range []string{"user_name", "first_name", "last_name", "email", "user_status", "department", "deleted_at"} {
+		b, a := beforeFields[name], afterFields[name]
+		if b == nil && a == nil {
+			continue
+		}
+		if b != nil && a != nil && *b == *a {
+			continue
+		}
+		changes[name] = FieldChange{Before: copyString(b), After: copyString(a)}
+	}
+
+	return changes
+}
+
+func copyString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	return &c
+}
+
+// Returns a copy of changes with fn applied to the values of the PII fields.
+// It is how they are sealed on the way into the database and opened on the
+// way out.
+func mapPIIChanges(changes map[string]FieldChange, fn func(string) (string, error)) (map[string]FieldChange, error) {
+	mapped := make(map[string]FieldChange, len(changes))
+
+	for name, change := range changes {
+		if encryptedColumns[name] {
+			var err error
+			if change.Before, err = mapPII(change.Before, fn); err != nil {
+				return nil, err
+			}
+			if change.After, err = mapPII(change.After, fn); err != nil {
+				return nil, err
+			}
+		}
+		mapped[name] = change
+	}
+
+	return mapped, nil
+}
+
+func mapPII(value *string, fn func(string) (string, error)) (*string, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	mapped, err := fn(*value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mapped, nil
+}
+
+// Seals the PII values in the changes with keys when there is a keyring
+func (a *AuditEntry) ConvertToAuditDB(keys *db.Keyring) (db.AuditDB, error) {
+	sealed, err := mapPIIChanges(a.Changes, func(value string) (string, error) {
+		return sealPII(keys, value)
+	})
+	if err != nil {
+		return db.AuditDB{}, err
+	}
+
+	changes, err := json.Marshal(sealed)
+	if err != nil {
+		return db.AuditDB{}, err
+	}
+
+	return db.AuditDB{
+		AuditID:   a.ID,
+		UserID:    a.UserID,
+		Actor:     a.Actor,
+		Operation: a.Operation,
+		Changes:   changes,
+		CreatedAt: a.CreatedAt,
+	}, nil
+}
+
+func ConvertToAuditEntry(adb *db.AuditDB, keys *db.Keyring) (AuditEntry, error) {
+	entry := AuditEntry{
+		ID:        adb.AuditID,
+		UserID:    adb.UserID,
+		Actor:     adb.Actor,
+		Operation: adb.Operation,
+		CreatedAt: adb.CreatedAt.UTC(),
+	}
+
+	var changes map[string]FieldChange
+	if err := json.Unmarshal(adb.Changes, &changes); err != nil {
+		return AuditEntry{}, err
+	}
+
+	var err error
+	if entry.Changes, err = mapPIIChanges(changes, keys.Decrypt); err != nil {
+		return AuditEntry{}, err
+	}
+
+	return entry, nil
+}
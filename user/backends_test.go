@@ -0,0 +1,33 @@
+package user_test
+
+import (
+	. "github.com/steveperjesi/integra-demo/user"
+)
+
+// The side of a repository the shared suites exercise
+type testRepository interface {
+	Repository
+	VersionStore
+	OutboxStore
+}
+
+// The repositories the shared suites run against, each opened fresh per
+// spec together with what closes it. encrypted backends store
+// first_name, last_name and email sealed.
+var backends = []struct {
+	name      string
+	encrypted bool
+	open      func() (testRepository, func())
+}{
+	{"MemoryRepository", false, func() (testRepository, func()) {
+		return NewMemoryRepository(), func() {}
+	}},
+	{"SQLRepository with SQLite", false, func() (testRepository, func()) {
+		conn := newSQLiteDB()
+		return NewSQLiteRepository(conn), func() { conn.Close() }
+	}},
+	{"SQLRepository with SQLite and a keyring", true, func() (testRepository, func()) {
+		conn := newSQLiteDB()
+		return NewSQLiteRepository(conn).WithKeyring(newTestKeyring("k1")), func() { conn.Close() }
+	}},
+}
@@ -0,0 +1,118 @@
+package user
+
+import (
+	"context"
+	"errors"
+)
+
+// Largest number of users a single bulk load takes
+const MaxBulkCreate = 50000
+
+// Temporary table a Postgres bulk load is copied into before being merged
+const bulkStagingTable = "users_staging"
+
+// What became of one user in a bulk load
+const (
+	BulkCreated           = "created"
+	BulkDuplicateUserName = "duplicate_user_name"
+	BulkDuplicateEmail    = "duplicate_email"
+	BulkInvalid           = "invalid"
+)
+
+// BulkResult is the outcome of one user in a bulk load. Duplicates are
+// judged against existing users and the earlier users of the same load.
+type BulkResult struct {
+	// Row is the user's index in the load
+	Row     int    `json:"row"`
+	Outcome string `json:"outcome"`
+	// UserID is set when the user was created
+	UserID int64 `json:"user_id,omitempty"`
+	// Field and Error explain an invalid user
+	Field string `json:"field,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// BulkStore creates many users at once. Every user is validated like a new
+// user and reported on individually; one bad user doesn't stop the others.
+// Each user created is audited and published like a single create.
+type BulkStore interface {
+	BulkCreate(ctx context.Context, users []User, actor string) ([]BulkResult, error)
+}
+
+// A user of a bulk load that passed validation and isn't a duplicate within
+// the load
+type bulkRow struct {
+	row  int
+	user User
+}
+
+// Validates a bulk load and weeds out users that repeat an earlier one.
+// Returns a result for every user, filled in for those already decided,
+// and the rows left to create.
+func prepareBulk(users []User) ([]BulkResult, []bulkRow, error) {
+	if len(users) == 0 || len(users) > MaxBulkCreate {
+		return nil, nil, ErrInvalidBulkSize
+	}
+
+	results := make([]BulkResult, len(users))
+	pending := make([]bulkRow, 0, len(users))
+
+	userNames := make(map[string]bool, len(users))
+	emails := make(map[string]bool, len(users))
+
+	for i := range users {
+		u := copyUser(users[i])
+		results[i].Row = i
+
+		if err := u.ValidateNewUserRequest(); err != nil {
+			results[i].Outcome = BulkInvalid
+			results[i].Error = err.Error()
+
+			var invalid *ValidationError
+			if errors.As(err, &invalid) {
+				results[i].Field = invalid.Field
+			}
+			continue
+		}
+		u.Normalize()
+
+		userName, email := normalizedKey(u.UserName), normalizedKey(u.Email)
+
+		switch {
+		case userNames[userName]:
+			results[i].Outcome = BulkDuplicateUserName
+		case emails[email]:
+			results[i].Outcome = BulkDuplicateEmail
+		default:
+			userNames[userName] = true
+			emails[email] = true
+			pending = append(pending, bulkRow{row: i, user: u})
+		}
+	}
+
+	return results, pending, nil
+}
+
+// Records the outcome of a create attempted for a bulk row. Errors that
+// aren't about the user itself are returned to stop the load.
+func (result *BulkResult) record(u *User, err error) error {
+	var invalid *ValidationError
+
+	switch {
+	case err == nil:
+		result.Outcome = BulkCreated
+		result.UserID = u.ID
+	case errors.Is(err, ErrUserExists):
+		result.Outcome = BulkDuplicateUserName
+	case errors.Is(err, ErrEmailExists):
+		result.Outcome = BulkDuplicateEmail
+	case errors.As(err, &invalid):
+		result.Outcome = BulkInvalid
+		result.Field = invalid.Field
+		result.Error = invalid.Error()
+	default:
+		return err
+	}
+
+	return nil
+}
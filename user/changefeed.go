@@ -0,0 +1,206 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Postgres channel the users table trigger notifies on
+const ChangeChannel = "user_changes"
+
+// Operations in a Change
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+	// Changes may have been missed, after the feed lost its connection or a
+	// subscriber fell behind. Anything derived from users should be reloaded.
+	ChangeResync = "resync"
+)
+
+// How often an idle listener connection is checked, so a dead one is
+// noticed and replaced even when no notifications arrive
+const changeFeedPingInterval = 90 * time.Second
+
+// Change is one committed change to a user row. Soft deletes and restores
+// are updates; ChangeDelete means the row was purged.
+type Change struct {
+	Op     string `json:"op"`
+	UserID int64  `json:"user_id"`
+	// Version of the row after the change, or of the purged row
+	Version int64 `json:"version"`
+}
+
+// ChangeSource is what consumers of the change feed depend on
+type ChangeSource interface {
+	Subscribe(buffer int) (<-chan Change, func())
+}
+
+// Listener is the part of *pq.Listener the change feed uses
+type Listener interface {
+	Listen(channel string) error
+	NotificationChannel() <-chan *pq.Notification
+	Ping() error
+	Close() error
+}
+
+// ChangeFeed turns the users table's notifications into Changes and fans
+// them out to subscribers. It only works on Postgres.
+type ChangeFeed struct {
+	listener Listener
+
+	mu          sync.Mutex
+	subscribers map[*changeSubscriber]struct{}
+	stopped     bool
+}
+
+type changeSubscriber struct {
+	changes chan Change
+	// Set when a change was dropped because the subscriber was full; it is
+	// sent a resync once there is room again
+	behind bool
+}
+
+// Opens a dedicated Postgres connection for the feed. The connection is
+// re-established after it is lost, waiting between minReconnect and
+// maxReconnect.
+func ListenForChanges(dsn string, minReconnect time.Duration, maxReconnect time.Duration) *ChangeFeed {
+	listener := pq.NewListener(dsn, minReconnect, maxReconnect, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			log.Print("change feed lost its connection: ", err)
+		case pq.ListenerEventReconnected:
+			log.Print("change feed reconnected")
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Print("change feed failed to reconnect: ", err)
+		}
+	})
+
+	return NewChangeFeed(listener)
+}
+
+var _ ChangeSource = (*ChangeFeed)(nil)
+
+func NewChangeFeed(listener Listener) *ChangeFeed {
+	return &ChangeFeed{
+		listener:    listener,
+		subscribers: make(map[*changeSubscriber]struct{}),
+	}
+}
+
+// Subscribe returns a channel of changes buffering up to buffer of them, and
+// a func to unsubscribe. A subscriber that falls behind gets a ChangeResync
+// in place of the changes it missed. The channel is closed when the feed
+// stops or the subscriber unsubscribes.
+func (f *ChangeFeed) Subscribe(buffer int) (<-chan Change, func()) {
+	sub := &changeSubscriber{changes: make(chan Change, buffer)}
+
+	f.mu.Lock()
+	if f.stopped {
+		close(sub.changes)
+	} else {
+		f.subscribers[sub] = struct{}{}
+	}
+	f.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+
+			if _, ok := f.subscribers[sub]; ok {
+				delete(f.subscribers, sub)
+				close(sub.changes)
+			}
+		})
+	}
+
+	return sub.changes, unsubscribe
+}
+
+// Run listens for changes until ctx is done, then closes the listener and
+// every subscriber's channel
+func (f *ChangeFeed) Run(ctx context.Context) error {
+	defer f.stop()
+
+	if err := f.listener.Listen(ChangeChannel); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(changeFeedPingInterval)
+	defer ticker.Stop()
+
+	notifications := f.listener.NotificationChannel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			// A failed ping makes the listener reconnect
+			go f.listener.Ping()
+		case n, ok := <-notifications:
+			if !ok {
+				return nil
+			}
+
+			// The listener sends nil once it has reconnected. Anything
+			// committed while it was away went unannounced.
+			if n == nil {
+				f.publish(Change{Op: ChangeResync})
+				continue
+			}
+
+			var change Change
+			if err := json.Unmarshal([]byte(n.Extra), &change); err != nil {
+				log.Printf("invalid change notification %q: %v", n.Extra, err)
+				continue
+			}
+
+			f.publish(change)
+		}
+	}
+}
+
+func (f *ChangeFeed) publish(change Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for sub := range f.subscribers {
+		// A resync covers this change too, since the subscriber reloads
+		// after it was committed
+		if sub.behind {
+			select {
+			case sub.changes <- Change{Op: ChangeResync}:
+				sub.behind = false
+			default:
+			}
+			continue
+		}
+
+		select {
+		case sub.changes <- change:
+		default:
+			sub.behind = true
+		}
+	}
+}
+
+func (f *ChangeFeed) stop() {
+	f.listener.Close()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopped = true
+	for sub := range f.subscribers {
+		delete(f.subscribers, sub)
+		close(sub.changes)
+	}
+}
@@ -0,0 +1,173 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lib/pq"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/steveperjesi/integra-demo/user"
+)
+
+// Stands in for *pq.Listener
+type fakeListener struct {
+	listenErr     error
+	listening     []string
+	notifications chan *pq.Notification
+	closed        chan struct{}
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{
+		notifications: make(chan *pq.Notification),
+		closed:        make(chan struct{}),
+	}
+}
+
+func (l *fakeListener) Listen(channel string) error {
+	l.listening = append(l.listening, channel)
+	return l.listenErr
+}
+
+func (l *fakeListener) NotificationChannel() <-chan *pq.Notification {
+	return l.notifications
+}
+
+func (l *fakeListener) Ping() error {
+	return nil
+}
+
+func (l *fakeListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+var _ = Describe("ChangeFeed", func() {
+	var (
+		listener *fakeListener
+		feed     *ChangeFeed
+		stop     context.CancelFunc
+		done     chan error
+	)
+
+	notify := func(payload string) {
+		listener.notifications <- &pq.Notification{Channel: ChangeChannel, Extra: payload}
+	}
+
+	BeforeEach(func() {
+		listener = newFakeListener()
+		feed = NewChangeFeed(listener)
+		stop = nil
+		done = make(chan error, 1)
+	})
+
+	run := func() {
+		var runCtx context.Context
+		runCtx, stop = context.WithCancel(ctx)
+		go func() {
+			done <- feed.Run(runCtx)
+		}()
+	}
+
+	AfterEach(func() {
+		if stop != nil {
+			stop()
+			Eventually(done).Should(Receive())
+		}
+	})
+
+	It("turns notifications into typed changes for every subscriber", func() {
+		first, _ := feed.Subscribe(10)
+		second, _ := feed.Subscribe(10)
+		run()
+
+		notify(`{"op":"insert","user_id":1,"version":1}`)
+		notify(`{"op":"update","user_id":1,"version":2}`)
+		notify(`{"op":"delete","user_id":1,"version":2}`)
+
+		for _, changes := range []<-chan Change{first, second} {
+			Eventually(changes).Should(Receive(Equal(Change{Op: ChangeInsert, UserID: 1, Version: 1})))
+			Eventually(changes).Should(Receive(Equal(Change{Op: ChangeUpdate, UserID: 1, Version: 2})))
+			Eventually(changes).Should(Receive(Equal(Change{Op: ChangeDelete, UserID: 1, Version: 2})))
+		}
+
+		Expect(listener.listening).To(Equal([]string{ChangeChannel}))
+	})
+
+	It("sends a resync after the listener reconnects", func() {
+		changes, _ := feed.Subscribe(10)
+		run()
+
+		listener.notifications <- nil
+
+		Eventually(changes).Should(Receive(Equal(Change{Op: ChangeResync})))
+	})
+
+	It("skips notifications it can't read", func() {
+		changes, _ := feed.Subscribe(10)
+		run()
+
+		notify(`not json`)
+		notify(`{"op":"update","user_id":2,"version":3}`)
+
+		Eventually(changes).Should(Receive(Equal(Change{Op: ChangeUpdate, UserID: 2, Version: 3})))
+	})
+
+	It("sends a resync to a subscriber that fell behind", func() {
+		changes, _ := feed.Subscribe(1)
+		run()
+
+		// The unreadable notification only returns once the one before it
+		// has been published
+		notify(`{"op":"update","user_id":1,"version":2}`)
+		notify(`{"op":"update","user_id":1,"version":3}`)
+		notify(`flush`)
+
+		Expect(changes).To(Receive(Equal(Change{Op: ChangeUpdate, UserID: 1, Version: 2})))
+		Expect(changes).ToNot(Receive())
+
+		notify(`{"op":"update","user_id":1,"version":4}`)
+		notify(`flush`)
+
+		Expect(changes).To(Receive(Equal(Change{Op: ChangeResync})))
+		Expect(changes).ToNot(Receive())
+
+		notify(`{"op":"update","user_id":1,"version":5}`)
+		Eventually(changes).Should(Receive(Equal(Change{Op: ChangeUpdate, UserID: 1, Version: 5})))
+	})
+
+	It("stops sending to a subscriber that unsubscribed", func() {
+		changes, unsubscribe := feed.Subscribe(10)
+		run()
+
+		unsubscribe()
+		unsubscribe()
+		Eventually(changes).Should(BeClosed())
+
+		notify(`{"op":"update","user_id":1,"version":2}`)
+	})
+
+	It("closes the listener and every subscription when it stops", func() {
+		changes, _ := feed.Subscribe(10)
+		run()
+
+		stop()
+		Eventually(done).Should(Receive(BeNil()))
+		stop = nil
+
+		Eventually(changes).Should(BeClosed())
+		Expect(listener.closed).To(BeClosed())
+
+		late, _ := feed.Subscribe(10)
+		Expect(late).To(BeClosed())
+	})
+
+	It("fails when it can't listen", func() {
+		listener.listenErr = errors.New("listener closed")
+		changes, _ := feed.Subscribe(10)
+
+		Expect(feed.Run(ctx)).To(MatchError("listener closed"))
+		Expect(changes).To(BeClosed())
+	})
+})
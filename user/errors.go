@@ -2,16 +2,70 @@ package user
 
 import "errors"
 
+// ValidationError is a user field that breaks a rule of the schema, whether
+// caught before the write or by a CHECK constraint
+type ValidationError struct {
+	// Field is the JSON name of the offending field
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
 var (
 	ErrMissingUserID    = errors.New("missing user_id")
-	ErrMissingUserName  = errors.New("missing user_name")
-	ErrMissingFirstName = errors.New("missing first_name")
-	ErrMissingLastName  = errors.New("missing last_name")
-	ErrMissingEmail     = errors.New("missing email")
+	ErrInvalidUserID    = errors.New("invalid user_id: must be an integer")
+	ErrMissingUserName  = &ValidationError{Field: "user_name", Message: "missing user_name"}
+	ErrMissingFirstName = &ValidationError{Field: "first_name", Message: "missing first_name"}
+	ErrMissingLastName  = &ValidationError{Field: "last_name", Message: "missing last_name"}
+	ErrMissingEmail     = &ValidationError{Field: "email", Message: "missing email"}
+	ErrInvalidEmail     = &ValidationError{Field: "email", Message: "invalid email: must look like name@example.com"}
+	ErrInvalidStatus    = &ValidationError{Field: "user_status", Message: "invalid user_status: must be one of A, I, T"}
 	ErrUserNotFound     = errors.New("user not found")
+	ErrUserNotDeleted   = errors.New("user is not deleted")
 
 	ErrUpdateUserMissingValues = errors.New("no values to update")
 	ErrUpdateUserNoRows        = errors.New("no rows updated")
 
-	ErrUserExists = errors.New("user_name already exists")
+	ErrInvalidPatch     = errors.New("invalid patch: must be a JSON object")
+	ErrUnsupportedPatch = errors.New("unsupported Content-Type: patches must be application/merge-patch+json")
+	ErrPatchUserID      = &ValidationError{Field: "user_id", Message: "invalid user_id: can't be changed"}
+	ErrUserIDMismatch   = &ValidationError{Field: "user_id", Message: "invalid user_id: must match the user_id in the path"}
+
+	ErrUserExists  = errors.New("user_name already exists")
+	ErrEmailExists = errors.New("email already exists")
+
+	ErrInvalidIncludeDeleted = errors.New("invalid include_deleted: must be true or false")
+	ErrInvalidTimeFilter     = errors.New("invalid created_after/created_before/updated_after/updated_before: must be RFC 3339 timestamps")
+	ErrInvalidAsOf           = errors.New("invalid as_of: must be an RFC 3339 timestamp")
+	ErrAsOfBeyondRetention   = errors.New("invalid as_of: older than the user history that is kept")
+	ErrInvalidPageLimit      = errors.New("invalid limit: must be an integer between 1 and 1000")
+	ErrInvalidCursor         = errors.New("invalid cursor: must be a next_cursor from an earlier page")
+	ErrInvalidIncludeTotal   = errors.New("invalid include_total: must be true or false")
+	ErrInvalidSort           = errors.New("invalid sort: must be a comma separated list of user_id, user_name, first_name, last_name, email, user_status, department, created_at and updated_at, each optionally prefixed with -")
+	ErrInvalidEmailDomain    = errors.New("invalid email_domain: must look like example.com")
+	ErrInvalidSearchQuery    = errors.New("invalid q: must be between 1 and 100 characters")
+	ErrInvalidSearchLimit    = errors.New("invalid limit: must be an integer between 1 and 100")
+	ErrEncryptedField        = errors.New("invalid sort: first_name, last_name and email are encrypted and can't be sorted on")
+
+	ErrInvalidIfMatch       = errors.New("invalid If-Match: must be a single ETag from this API")
+	ErrVersionMismatch      = errors.New("user was modified by someone else")
+	ErrPreconditionRequired = errors.New("If-Match header is required")
+
+	ErrInvalidOperation = errors.New("invalid operation: must be one of create, update, status_change, delete, restore, purge")
+	ErrInvalidDateRange = errors.New("invalid from/to: must be RFC 3339 timestamps with from before to")
+	ErrInvalidLimit     = errors.New("invalid limit: must be an integer between 1 and 500")
+	ErrInvalidOffset    = errors.New("invalid offset: must be a non-negative integer")
+
+	ErrInvalidEventStatus = errors.New("invalid status: must be one of pending, delivered, dead")
+	ErrInvalidEventID     = errors.New("invalid event_id: must be a positive integer")
+	ErrEventNotFound      = errors.New("event not found")
+	ErrEventNotDead       = errors.New("event is not dead-lettered")
+
+	ErrInvalidBulkSize = errors.New("invalid bulk load: must have between 1 and 50000 users")
+
+	ErrNoKeyring        = errors.New("no keyring configured: set USER_KEYRING_FILE")
+	ErrInvalidBatchSize = errors.New("invalid batch size: must be a positive integer")
 )
@@ -5,12 +5,16 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/steveperjesi/integra-demo/internal/db"
 )
 
 const (
 	DbName = "users"
+	// Earlier versions of users, for AsOf reads
+	HistoryTable = "users_history"
 )
 
 func (u *User) SetUserStatus(status string) {
@@ -43,15 +47,17 @@ func (u *User) setUserStatusTerminated() {
 }
 
 func (req *User) ValidateNewUserRequest() error {
+	req.Normalize()
+
 	if req.UserName == "" {
 		return ErrMissingUserName
 	}
 
-	if req.FirstName == "" {
+	if strings.TrimSpace(req.FirstName) == "" {
 		return ErrMissingFirstName
 	}
 
-	if req.LastName == "" {
+	if strings.TrimSpace(req.LastName) == "" {
 		return ErrMissingLastName
 	}
 
@@ -59,6 +65,10 @@ func (req *User) ValidateNewUserRequest() error {
 		return ErrMissingEmail
 	}
 
+	if !validEmail(req.Email) {
+		return ErrInvalidEmail
+	}
+
 	// Department is optional and allowed to be empty
 
 	// Verify the status, defaulting to `inactive`
@@ -67,23 +77,113 @@ func (req *User) ValidateNewUserRequest() error {
 	return nil
 }
 
+// Checks a user that will replace a stored one against the rules for a new
+// user. Unlike on create, a `user_status` other than A, I or T is rejected
+// rather than made inactive.
+func (req *User) ValidateReplaceRequest() error {
+	if req.UserStatus != "" {
+		status := strings.ToUpper(strings.TrimSpace(req.UserStatus))
+		if status != "A" && status != "I" && status != "T" {
+			return ErrInvalidStatus
+		}
+	}
+
+	return req.ValidateNewUserRequest()
+}
+
+// Checks the values given for an update against the rules for a new user.
+// Empty values are left as they are by the update; a `user_status` is
+// upper-cased but otherwise has to be one of A, I or T.
+func (req *User) ValidateUpdateRequest() error {
+	req.Normalize()
+
+	if req.FirstName != "" && strings.TrimSpace(req.FirstName) == "" {
+		return ErrMissingFirstName
+	}
+
+	if req.LastName != "" && strings.TrimSpace(req.LastName) == "" {
+		return ErrMissingLastName
+	}
+
+	if req.Email != "" && !validEmail(req.Email) {
+		return ErrInvalidEmail
+	}
+
+	if req.UserStatus != "" {
+		status := strings.ToUpper(strings.TrimSpace(req.UserStatus))
+		if status != "A" && status != "I" && status != "T" {
+			return ErrInvalidStatus
+		}
+		req.UserStatus = status
+	}
+
+	return nil
+}
+
+// Matches the shape the users_email_check constraint allows: a single `@`
+// with text before it, a dot inside the domain and no whitespace
+func validEmail(email string) bool {
+	if strings.IndexFunc(email, unicode.IsSpace) >= 0 {
+		return false
+	}
+
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" || strings.Contains(domain, "@") || len(domain) < 3 {
+		return false
+	}
+
+	return strings.Contains(domain[1:len(domain)-1], ".")
+}
+
+// Trims `user_name` and `email` and lowercases `email`. The case of
+// `user_name` is kept for display, but both are unique regardless of case.
+func (u *User) Normalize() {
+	u.UserName = strings.TrimSpace(u.UserName)
+	u.Email = strings.ToLower(strings.TrimSpace(u.Email))
+}
+
+// The form `user_name` and `email` are compared in, like LOWER() in the
+// unique indexes
+func normalizedKey(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
 func ValidateUserID(input string) (int64, error) {
 	id, err := strconv.ParseInt(input, 10, 64)
 	if err != nil {
-		return 0, fmt.Errorf("invalid user_id: must be an integer")
+		return 0, ErrInvalidUserID
 	}
 	return id, nil
 }
 
-func (u *User) ConvertToUserDB() db.UserDB {
+// Converts to the stored form. With a keyring, first_name, last_name and
+// email are encrypted and the email is given a blind index; without one
+// they are stored as they are.
+func (u *User) ConvertToUserDB(keys *db.Keyring) (db.UserDB, error) {
 	userDB := db.UserDB{
-		UserID:     u.ID,
-		UserName:   u.UserName,
-		UserStatus: u.UserStatus,
-		FirstName:  u.FirstName,
-		LastName:   u.LastName,
-		Email:      u.Email,
-		Department: sql.NullString{},
+		UserID:          u.ID,
+		UserName:        u.UserName,
+		UserStatus:      u.UserStatus,
+		Department:      sql.NullString{},
+		Version:         u.Version,
+		CreatedAt:       u.CreatedAt,
+		UpdatedAt:       u.UpdatedAt,
+		EmailHash:       emailHash(keys, u.Email),
+		EmailDomainHash: emailDomainHash(keys, u.Email),
+	}
+
+	var err error
+
+	if userDB.FirstName, err = sealPII(keys, u.FirstName); err != nil {
+		return db.UserDB{}, err
+	}
+
+	if userDB.LastName, err = sealPII(keys, u.LastName); err != nil {
+		return db.UserDB{}, err
+	}
+
+	if userDB.Email, err = sealPII(keys, u.Email); err != nil {
+		return db.UserDB{}, err
 	}
 
 	if u.Department != nil {
@@ -93,22 +193,147 @@ func (u *User) ConvertToUserDB() db.UserDB {
 		}
 	}
 
-	return userDB
+	if u.DeletedAt != nil {
+		userDB.DeletedAt = sql.NullTime{
+			Valid: true,
+			Time:  *u.DeletedAt,
+		}
+	}
+
+	return userDB, nil
 }
 
-func ConvertToUser(udb *db.UserDB) User {
+// Converts from the stored form, decrypting the PII columns. Rows stored
+// before a keyring was configured are read as they are.
+func ConvertToUser(udb *db.UserDB, keys *db.Keyring) (User, error) {
 	user := User{
 		ID:         udb.UserID,
 		UserName:   udb.UserName,
 		UserStatus: udb.UserStatus,
-		FirstName:  udb.FirstName,
-		LastName:   udb.LastName,
-		Email:      udb.Email,
+		Version:    udb.Version,
+		CreatedAt:  udb.CreatedAt.UTC(),
+		UpdatedAt:  udb.UpdatedAt.UTC(),
+	}
+
+	var err error
+
+	if user.FirstName, err = keys.Decrypt(udb.FirstName); err != nil {
+		return User{}, err
+	}
+
+	if user.LastName, err = keys.Decrypt(udb.LastName); err != nil {
+		return User{}, err
+	}
+
+	if user.Email, err = keys.Decrypt(udb.Email); err != nil {
+		return User{}, err
 	}
 
 	if udb.Department.Valid {
 		user.Department = &udb.Department.String
 	}
 
-	return user
+	if udb.DeletedAt.Valid {
+		user.DeletedAt = &udb.DeletedAt.Time
+	}
+
+	return user, nil
+}
+
+// Encrypts a PII value when there is a keyring. Empty values are left
+// empty, so partial updates can tell what was given.
+func sealPII(keys *db.Keyring, value string) (string, error) {
+	if keys == nil || value == "" {
+		return value, nil
+	}
+
+	return keys.Encrypt(value)
+}
+
+// Applies fn to each PII value of u in place
+func mapUserPII(u *User, fn func(string) (string, error)) error {
+	for _, value := range []*string{&u.FirstName, &u.LastName, &u.Email} {
+		mapped, err := fn(*value)
+		if err != nil {
+			return err
+		}
+		*value = mapped
+	}
+
+	return nil
+}
+
+// The blind index stored for an email, NULL without a keyring
+func emailHash(keys *db.Keyring, email string) sql.NullString {
+	if keys == nil || email == "" {
+		return sql.NullString{}
+	}
+
+	return sql.NullString{Valid: true, String: keys.BlindIndex(normalizedKey(email))}
+}
+
+// The blind index stored for the domain of an email, NULL without a keyring
+func emailDomainHash(keys *db.Keyring, email string) sql.NullString {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return sql.NullString{}
+	}
+
+	return domainHash(keys, email[at+1:])
+}
+
+// The blind index an email domain is looked up by, NULL without a keyring
+func domainHash(keys *db.Keyring, domain string) sql.NullString {
+	if keys == nil || domain == "" {
+		return sql.NullString{}
+	}
+
+	return sql.NullString{Valid: true, String: keys.BlindIndex(normalizedKey(domain))}
+}
+
+// Returns the current time at the microsecond precision Postgres keeps, so
+// timestamps compare equal after a round trip through the database
+func timestamp() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// Formats a row version as a strong ETag
+func ETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// Parses an If-Match header into the precondition for a write
+func ParsePrecondition(ifMatch string) (Precondition, error) {
+	version, err := ParseIfMatch(ifMatch)
+	if err != nil {
+		return Precondition{}, err
+	}
+
+	return Precondition{Version: version, Given: strings.TrimSpace(ifMatch) != ""}, nil
+}
+
+// Parses an If-Match header into the row version it expects. "*" matches
+// any current version and is returned as 0, same as an absent header.
+func ParseIfMatch(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "*" {
+		return 0, nil
+	}
+
+	// Weak validators can't be used for If-Match
+	if strings.HasPrefix(value, "W/") {
+		return 0, ErrInvalidIfMatch
+	}
+
+	unquoted, err := strconv.Unquote(value)
+	if err != nil {
+		return 0, ErrInvalidIfMatch
+	}
+
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, ErrInvalidIfMatch
+	}
+
+	return version, nil
 }
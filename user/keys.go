@@ -0,0 +1,17 @@
+package user
+
+import "context"
+
+// Rows re-encrypted per transaction by `rotate-keys` unless told otherwise
+const DefaultRotateBatchSize = 500
+
+// KeyStore moves stored users under the primary key of the keyring, for
+// after a key is added or a keyring is first configured. Users, their
+// earlier versions and the values held in the audit trail and the outbox are
+// rewritten in batches, each in a short transaction of its own, so the API
+// keeps serving while it runs. Versions and timestamps are left alone.
+type KeyStore interface {
+	// Encrypts plaintext rows and rewraps those under other keys, batchSize
+	// rows at a time. Returns how many rows were rewritten.
+	RotateKeys(ctx context.Context, batchSize int) (int64, error)
+}
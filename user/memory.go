@@ -0,0 +1,741 @@
+package user
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryRepository is a concurrency-safe, in-process user store for local
+// development and demos. It mirrors SQLRepository's behavior, but all
+// data is lost when the process exits.
+type MemoryRepository struct {
+	mu     sync.RWMutex
+	users  map[int64]User
+	lastID int64
+	// Audit entries in the order they were recorded
+	audit []AuditEntry
+	// Outbox events in the order they were recorded; an event's ID is its
+	// index plus one
+	outbox []OutboxEvent
+	// Earlier versions of users, for AsOf reads
+	versions []userVersion
+}
+
+// A user as it was from its UpdatedAt until validTo
+type userVersion struct {
+	user    User
+	validTo time.Time
+}
+
+var (
+	_ Repository   = (*MemoryRepository)(nil)
+	_ OutboxStore  = (*MemoryRepository)(nil)
+	_ VersionStore = (*MemoryRepository)(nil)
+	_ BulkStore    = (*MemoryRepository)(nil)
+)
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		users: make(map[int64]User),
+	}
+}
+
+func (r *MemoryRepository) List(ctx context.Context, opts ListOptions) ([]User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var results []User
+
+	users := r.users
+	if opts.AsOf != nil {
+		users = r.usersAsOf(*opts.AsOf)
+	}
+
+	order := sortOrder(opts.Sort)
+
+	for _, u := range users {
+		if u.DeletedAt != nil && !opts.IncludeDeleted {
+			continue
+		}
+		if !inTimeRange(u.CreatedAt, opts.CreatedAfter, opts.CreatedBefore) ||
+			!inTimeRange(u.UpdatedAt, opts.UpdatedAfter, opts.UpdatedBefore) {
+			continue
+		}
+		if !matchesFilters(u, opts) {
+			continue
+		}
+		if opts.After != nil && !afterCursor(u, opts.After, order) {
+			continue
+		}
+		results = append(results, copyUser(u))
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return compareUsers(results[i], results[j], order) < 0
+	})
+
+	if opts.Limit > 0 && len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+
+	return results, nil
+}
+
+// Applies the user_status, department, email_domain and user_name prefix
+// filters of opts
+func matchesFilters(u User, opts ListOptions) bool {
+	if opts.UserStatus != "" && u.UserStatus != opts.UserStatus {
+		return false
+	}
+
+	if opts.Department != nil && sortKey(u, "department") != *opts.Department {
+		return false
+	}
+
+	if opts.EmailDomain != "" && !strings.HasSuffix(normalizedKey(u.Email), "@"+normalizedKey(opts.EmailDomain)) {
+		return false
+	}
+
+	return strings.HasPrefix(strings.ToLower(u.UserName), strings.ToLower(opts.UserNamePrefix))
+}
+
+func (r *MemoryRepository) Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error) {
+	users, err := r.List(ctx, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	ranking := searchRanking{query: opts.Query, fields: searchFields}
+	for _, u := range users {
+		ranking.add(u)
+	}
+
+	return ranking.top(opts.Limit), nil
+}
+
+func (r *MemoryRepository) Count(ctx context.Context, opts ListOptions) (int64, error) {
+	opts.After, opts.Limit = nil, 0
+
+	users, err := r.List(ctx, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(users)), nil
+}
+
+// Streams a snapshot of the users taken with List, so fn can call back into
+// the repository
+func (r *MemoryRepository) Stream(ctx context.Context, opts ListOptions, fn func(User) error) error {
+	users, err := r.List(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *MemoryRepository) Get(ctx context.Context, id int64, opts GetOptions) (*User, error) {
+	if id == 0 {
+		return nil, ErrMissingUserID
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := r.users
+	if opts.AsOf != nil {
+		users = r.usersAsOf(*opts.AsOf)
+	}
+
+	u, ok := users[id]
+	if !ok || (u.DeletedAt != nil && !opts.IncludeDeleted) {
+		return nil, ErrUserNotFound
+	}
+
+	user := copyUser(u)
+	return &user, nil
+}
+
+// Returns true if `user_name` exists. Soft-deleted users keep their
+// `user_name` until they are purged.
+func (r *MemoryRepository) ExistsByUserName(ctx context.Context, userName string) (bool, error) {
+	if strings.TrimSpace(userName) == "" {
+		return false, ErrMissingUserName
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.userNameTaken(userName, 0), nil
+}
+
+func (r *MemoryRepository) Create(ctx context.Context, u *User, actor string) (*User, error) {
+	u.Normalize()
+
+	if u.UserName == "" {
+		return nil, ErrMissingUserName
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.userNameTaken(u.UserName, 0) {
+		return nil, ErrUserExists
+	}
+
+	if r.emailTaken(u.Email, 0) {
+		return nil, ErrEmailExists
+	}
+
+	// IDs behave like an identity column: increasing and never reused
+	r.lastID++
+	u.ID = r.lastID
+	u.Version = 1
+	u.CreatedAt = timestamp()
+	u.UpdatedAt = u.CreatedAt
+	r.users[u.ID] = copyUser(*u)
+	r.recordChange(newAuditEntry(actor, OpCreate, nil, u), nil, u)
+
+	return u, nil
+}
+
+func (r *MemoryRepository) BulkCreate(ctx context.Context, users []User, actor string) ([]BulkResult, error) {
+	results, pending, err := prepareBulk(users)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range pending {
+		u := p.user
+		created, err := r.Create(ctx, &u, actor)
+		if err := results[p.row].record(created, err); err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+func (r *MemoryRepository) Update(ctx context.Context, u *User, expectedVersion int64, actor string) (*User, error) {
+	if u.ID == 0 {
+		return nil, ErrMissingUserID
+	}
+
+	u.Normalize()
+
+	if u.UserName == "" && u.FirstName == "" && u.LastName == "" &&
+		u.Email == "" && u.UserStatus == "" && u.Department == nil {
+		return nil, ErrUpdateUserMissingValues
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Deleted users must be restored before they can be changed
+	existing, ok := r.users[u.ID]
+	if !ok || existing.DeletedAt != nil {
+		return nil, ErrUpdateUserNoRows
+	}
+
+	if expectedVersion != 0 && existing.Version != expectedVersion {
+		return nil, ErrVersionMismatch
+	}
+
+	if u.UserName != "" && r.userNameTaken(u.UserName, u.ID) {
+		return nil, ErrUserExists
+	}
+
+	if u.Email != "" && r.emailTaken(u.Email, u.ID) {
+		return nil, ErrEmailExists
+	}
+
+	before := copyUser(existing)
+
+	// Only update the values given
+	if u.UserName != "" {
+		existing.UserName = u.UserName
+	}
+
+	if u.FirstName != "" {
+		existing.FirstName = u.FirstName
+	}
+
+	if u.LastName != "" {
+		existing.LastName = u.LastName
+	}
+
+	if u.Email != "" {
+		existing.Email = u.Email
+	}
+
+	if u.UserStatus != "" {
+		existing.UserStatus = u.UserStatus
+	}
+
+	if u.Department != nil {
+		dept := *u.Department
+		existing.Department = &dept
+	}
+
+	existing.Version++
+	existing.UpdatedAt = timestamp()
+	r.users[u.ID] = existing
+
+	user := copyUser(existing)
+	r.recordChange(newAuditEntry(actor, OpUpdate, &before, &user), &before, &user)
+
+	return &user, nil
+}
+
+// Replaces every field a client can set, clearing `department` when it's
+// nil
+func (r *MemoryRepository) Replace(ctx context.Context, u *User, expectedVersion int64, actor string) (*User, error) {
+	if u.ID == 0 {
+		return nil, ErrMissingUserID
+	}
+
+	u.Normalize()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Deleted users must be restored before they can be changed
+	existing, ok := r.users[u.ID]
+	if !ok || existing.DeletedAt != nil {
+		return nil, ErrUserNotFound
+	}
+
+	if expectedVersion != 0 && existing.Version != expectedVersion {
+		return nil, ErrVersionMismatch
+	}
+
+	if r.userNameTaken(u.UserName, u.ID) {
+		return nil, ErrUserExists
+	}
+
+	if r.emailTaken(u.Email, u.ID) {
+		return nil, ErrEmailExists
+	}
+
+	before := copyUser(existing)
+
+	existing.UserName = u.UserName
+	existing.FirstName = u.FirstName
+	existing.LastName = u.LastName
+	existing.Email = u.Email
+	existing.UserStatus = u.UserStatus
+	existing.Department = nil
+
+	if u.Department != nil {
+		dept := *u.Department
+		existing.Department = &dept
+	}
+
+	existing.Version++
+	existing.UpdatedAt = timestamp()
+	r.users[u.ID] = existing
+
+	user := copyUser(existing)
+	r.recordChange(newAuditEntry(actor, OpUpdate, &before, &user), &before, &user)
+
+	return &user, nil
+}
+
+// Soft deletes the user by stamping `deleted_at`
+func (r *MemoryRepository) Delete(ctx context.Context, id int64, expectedVersion int64, actor string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok || u.DeletedAt != nil {
+		return ErrUserNotFound
+	}
+
+	if expectedVersion != 0 && u.Version != expectedVersion {
+		return ErrVersionMismatch
+	}
+
+	before := copyUser(u)
+
+	now := timestamp()
+	u.DeletedAt = &now
+	u.UpdatedAt = now
+	u.Version++
+	r.users[id] = u
+
+	after := copyUser(u)
+	r.recordChange(newAuditEntry(actor, OpDelete, &before, &after), &before, &after)
+
+	return nil
+}
+
+// Clears `deleted_at` on a soft-deleted user
+func (r *MemoryRepository) Restore(ctx context.Context, id int64, actor string) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	if u.DeletedAt == nil {
+		return nil, ErrUserNotDeleted
+	}
+
+	before := copyUser(u)
+
+	u.DeletedAt = nil
+	u.UpdatedAt = timestamp()
+	u.Version++
+	r.users[id] = u
+
+	user := copyUser(u)
+	r.recordChange(newAuditEntry(actor, OpRestore, &before, &user), &before, &user)
+
+	return &user, nil
+}
+
+// Permanently removes the user, deleted or not. The audit trail is kept.
+func (r *MemoryRepository) Purge(ctx context.Context, id int64, actor string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	delete(r.users, id)
+	r.recordChange(newAuditEntry(actor, OpPurge, &u, nil), &u, nil)
+
+	return nil
+}
+
+func (r *MemoryRepository) History(ctx context.Context, userID int64, opts HistoryOptions) ([]AuditEntry, error) {
+	if userID == 0 {
+		return nil, ErrMissingUserID
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entries := []AuditEntry{}
+
+	// Newest first
+	for i := len(r.audit) - 1; i >= 0; i-- {
+		entry := r.audit[i]
+
+		if entry.UserID != userID {
+			continue
+		}
+
+		if opts.From != nil && entry.CreatedAt.Before(*opts.From) {
+			continue
+		}
+
+		if opts.To != nil && !entry.CreatedAt.Before(*opts.To) {
+			continue
+		}
+
+		if opts.Operation != "" && entry.Operation != opts.Operation {
+			continue
+		}
+
+		entries = append(entries, copyAuditEntry(entry))
+	}
+
+	if opts.Limit > 0 {
+		if opts.Offset >= len(entries) {
+			return []AuditEntry{}, nil
+		}
+
+		entries = entries[opts.Offset:]
+
+		if len(entries) > opts.Limit {
+			entries = entries[:opts.Limit]
+		}
+	}
+
+	return entries, nil
+}
+
+func (r *MemoryRepository) ClaimEvents(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	leaseUntil := now.Add(lease)
+
+	// Users with an earlier pending event, which holds back their later ones
+	waiting := make(map[int64]bool)
+
+	events := []OutboxEvent{}
+
+	for i := range r.outbox {
+		if len(events) == limit {
+			break
+		}
+
+		event := &r.outbox[i]
+		if event.Status != EventPending {
+			continue
+		}
+
+		due := !waiting[event.UserID] && !event.NextAttemptAt.After(now)
+		waiting[event.UserID] = true
+
+		if due {
+			event.NextAttemptAt = leaseUntil
+			events = append(events, copyOutboxEvent(*event))
+		}
+	}
+
+	return events, nil
+}
+
+func (r *MemoryRepository) MarkDelivered(ctx context.Context, eventID int64) error {
+	return r.updatePendingEvent(eventID, func(event *OutboxEvent) {
+		deliveredAt := timestamp()
+		event.Status = EventDelivered
+		event.Attempts++
+		event.LastError = nil
+		event.DeliveredAt = &deliveredAt
+	})
+}
+
+func (r *MemoryRepository) MarkFailed(ctx context.Context, eventID int64, lastError string, retryAt time.Time) error {
+	return r.updatePendingEvent(eventID, func(event *OutboxEvent) {
+		event.Attempts++
+		event.LastError = &lastError
+		event.NextAttemptAt = retryAt.UTC()
+	})
+}
+
+func (r *MemoryRepository) MarkDead(ctx context.Context, eventID int64, lastError string) error {
+	return r.updatePendingEvent(eventID, func(event *OutboxEvent) {
+		event.Status = EventDead
+		event.Attempts++
+		event.LastError = &lastError
+	})
+}
+
+func (r *MemoryRepository) Events(ctx context.Context, opts OutboxOptions) ([]OutboxEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	events := []OutboxEvent{}
+
+	for _, event := range r.outbox {
+		if opts.Status != "" && event.Status != opts.Status {
+			continue
+		}
+		events = append(events, copyOutboxEvent(event))
+	}
+
+	if opts.Limit > 0 {
+		if opts.Offset >= len(events) {
+			return []OutboxEvent{}, nil
+		}
+
+		events = events[opts.Offset:]
+
+		if len(events) > opts.Limit {
+			events = events[:opts.Limit]
+		}
+	}
+
+	return events, nil
+}
+
+func (r *MemoryRepository) RequeueEvent(ctx context.Context, eventID int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if eventID < 1 || eventID > int64(len(r.outbox)) {
+		return ErrEventNotFound
+	}
+
+	event := &r.outbox[eventID-1]
+	if event.Status != EventDead {
+		return ErrEventNotDead
+	}
+
+	event.Status = EventPending
+	event.Attempts = 0
+	event.LastError = nil
+	event.NextAttemptAt = timestamp()
+
+	return nil
+}
+
+func (r *MemoryRepository) updatePendingEvent(eventID int64, update func(event *OutboxEvent)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if eventID < 1 || eventID > int64(len(r.outbox)) || r.outbox[eventID-1].Status != EventPending {
+		return ErrEventNotFound
+	}
+
+	update(&r.outbox[eventID-1])
+
+	return nil
+}
+
+func (r *MemoryRepository) PruneVersions(ctx context.Context, cutoff time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := r.versions[:0]
+	for _, version := range r.versions {
+		if !version.validTo.Before(cutoff) {
+			kept = append(kept, version)
+		}
+	}
+
+	pruned := int64(len(r.versions) - len(kept))
+	r.versions = kept
+
+	return pruned, nil
+}
+
+// Returns every user as it was at asOf, keyed by ID. Caller must hold r.mu.
+func (r *MemoryRepository) usersAsOf(asOf time.Time) map[int64]User {
+	users := make(map[int64]User)
+
+	for id, u := range r.users {
+		if !u.UpdatedAt.After(asOf) {
+			users[id] = u
+		}
+	}
+
+	for _, version := range r.versions {
+		if !version.user.UpdatedAt.After(asOf) && version.validTo.After(asOf) {
+			users[version.user.ID] = version.user
+		}
+	}
+
+	return users
+}
+
+// Records a change in the audit trail, the outbox and the user's versions.
+// before is nil on create and after is nil on purge. Caller must hold r.mu
+// for writing.
+func (r *MemoryRepository) recordChange(entry AuditEntry, before *User, after *User) {
+	r.recordAudit(entry)
+
+	if before != nil {
+		validTo := timestamp()
+		if after != nil {
+			validTo = after.UpdatedAt
+		}
+		r.versions = append(r.versions, userVersion{user: copyUser(*before), validTo: validTo})
+	}
+
+	event := newEvent(entry, after)
+	event.ID = int64(len(r.outbox)) + 1
+	r.outbox = append(r.outbox, OutboxEvent{
+		Event:         event,
+		Status:        EventPending,
+		NextAttemptAt: event.OccurredAt,
+	})
+}
+
+// Caller must hold r.mu for writing
+func (r *MemoryRepository) recordAudit(entry AuditEntry) {
+	entry.ID = int64(len(r.audit)) + 1
+	r.audit = append(r.audit, entry)
+}
+
+// Reports whether a user other than exceptID has userName, ignoring case.
+// Caller must hold r.mu.
+func (r *MemoryRepository) userNameTaken(userName string, exceptID int64) bool {
+	key := normalizedKey(userName)
+	for id, u := range r.users {
+		if id != exceptID && normalizedKey(u.UserName) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether a user other than exceptID has email, ignoring case.
+// Caller must hold r.mu.
+func (r *MemoryRepository) emailTaken(email string, exceptID int64) bool {
+	key := normalizedKey(email)
+	for id, u := range r.users {
+		if id != exceptID && normalizedKey(u.Email) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether t is strictly between after and before, either of which
+// may be nil
+func inTimeRange(t time.Time, after *time.Time, before *time.Time) bool {
+	if after != nil && !t.After(*after) {
+		return false
+	}
+	if before != nil && !t.Before(*before) {
+		return false
+	}
+	return true
+}
+
+// Returns a copy that shares no pointers with the stored user
+func copyUser(u User) User {
+	if u.Department != nil {
+		dept := *u.Department
+		u.Department = &dept
+	}
+	if u.DeletedAt != nil {
+		deletedAt := *u.DeletedAt
+		u.DeletedAt = &deletedAt
+	}
+	return u
+}
+
+func copyOutboxEvent(e OutboxEvent) OutboxEvent {
+	if e.User != nil {
+		u := copyUser(*e.User)
+		e.User = &u
+	}
+	if e.LastError != nil {
+		lastError := *e.LastError
+		e.LastError = &lastError
+	}
+	if e.DeliveredAt != nil {
+		deliveredAt := *e.DeliveredAt
+		e.DeliveredAt = &deliveredAt
+	}
+	e.Changes = copyChanges(e.Changes)
+	return e
+}
+
+func copyAuditEntry(a AuditEntry) AuditEntry {
+	a.Changes = copyChanges(a.Changes)
+	return a
+}
+
+func copyChanges(changes map[string]FieldChange) map[string]FieldChange {
+	copied := make(map[string]FieldChange, len(changes))
+	for name, change := range changes {
+		copied[name] = FieldChange{Before: copyString(change.Before), After: copyString(change.After)}
+	}
+	return copied
+}
@@ -0,0 +1,471 @@
+package user_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/steveperjesi/integra-demo/user"
+)
+
+// MemoryRepository
+var _ = Describe("MemoryRepository", func() {
+	var (
+		repo *MemoryRepository
+		user *User
+	)
+
+	BeforeEach(func() {
+		repo = NewMemoryRepository()
+		user = &User{
+			UserName:   "jdoe",
+			FirstName:  "John",
+			LastName:   "Doe",
+			Email:      "jdoe@example.com",
+			UserStatus: "A",
+			Department: ptr("Engineering"),
+		}
+	})
+
+	Describe("Create", func() {
+		It("assigns increasing IDs", func() {
+			first, err := repo.Create(ctx, user, "tester")
+			Expect(err).To(BeNil())
+			Expect(first.ID).To(Equal(int64(1)))
+
+			second, err := repo.Create(ctx, &User{UserName: "asmith"}, "tester")
+			Expect(err).To(BeNil())
+			Expect(second.ID).To(Equal(int64(2)))
+		})
+
+		It("does not reuse IDs after a delete", func() {
+			created, _ := repo.Create(ctx, user, "tester")
+			Expect(repo.Delete(ctx, created.ID, 0, "tester")).To(Succeed())
+
+			next, err := repo.Create(ctx, &User{UserName: "asmith"}, "tester")
+			Expect(err).To(BeNil())
+			Expect(next.ID).To(Equal(int64(2)))
+		})
+
+		It("returns ErrUserExists on a duplicate user_name", func() {
+			_, err := repo.Create(ctx, user, "tester")
+			Expect(err).To(BeNil())
+
+			_, err = repo.Create(ctx, &User{UserName: "jdoe"}, "tester")
+			Expect(err).To(Equal(ErrUserExists))
+		})
+
+		It("rejects a user_name or email taken in another case", func() {
+			repo.Create(ctx, user, "tester")
+
+			_, err := repo.Create(ctx, &User{UserName: "JDoe", Email: "john@example.com"}, "tester")
+			Expect(err).To(Equal(ErrUserExists))
+
+			_, err = repo.Create(ctx, &User{UserName: "john", Email: " JDoe@Example.com "}, "tester")
+			Expect(err).To(Equal(ErrEmailExists))
+		})
+
+		It("returns ErrMissingUserName when user_name is empty", func() {
+			_, err := repo.Create(ctx, &User{}, "tester")
+			Expect(err).To(Equal(ErrMissingUserName))
+		})
+
+		It("stores a copy of the user", func() {
+			created, _ := repo.Create(ctx, user, "tester")
+			*user.Department = "Changed"
+
+			stored, err := repo.Get(ctx, created.ID, GetOptions{})
+			Expect(err).To(BeNil())
+			Expect(*stored.Department).To(Equal("Engineering"))
+		})
+
+		It("is safe for concurrent use", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					defer GinkgoRecover()
+					_, err := repo.Create(ctx, &User{UserName: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@example.com", i)}, "tester")
+					Expect(err).To(BeNil())
+				}(i)
+			}
+			wg.Wait()
+
+			users, err := repo.List(ctx, ListOptions{})
+			Expect(err).To(BeNil())
+			Expect(users).To(HaveLen(50))
+		})
+	})
+
+	Describe("Get", func() {
+		It("returns ErrMissingUserID when id == 0", func() {
+			_, err := repo.Get(ctx, 0, GetOptions{})
+			Expect(err).To(Equal(ErrMissingUserID))
+		})
+
+		It("returns ErrUserNotFound for an unknown id", func() {
+			_, err := repo.Get(ctx, 99, GetOptions{})
+			Expect(err).To(Equal(ErrUserNotFound))
+		})
+	})
+
+	Describe("List", func() {
+		It("returns users ordered by ID", func() {
+			repo.Create(ctx, user, "tester")
+			repo.Create(ctx, &User{UserName: "asmith"}, "tester")
+
+			users, err := repo.List(ctx, ListOptions{})
+			Expect(err).To(BeNil())
+			Expect(users).To(HaveLen(2))
+			Expect(users[0].UserName).To(Equal("jdoe"))
+			Expect(users[1].UserName).To(Equal("asmith"))
+		})
+
+		It("pages after a user ID and counts across pages", func() {
+			for _, name := range []string{"jdoe", "asmith", "bjones"} {
+				_, err := repo.Create(ctx, &User{UserName: name, Email: name + "@example.com"}, "tester")
+				Expect(err).To(BeNil())
+			}
+
+			users, err := repo.List(ctx, ListOptions{After: &Cursor{Keys: []string{"1"}}, Limit: 1})
+			Expect(err).To(BeNil())
+			Expect(users).To(HaveLen(1))
+			Expect(users[0].UserName).To(Equal("asmith"))
+
+			count, err := repo.Count(ctx, ListOptions{After: &Cursor{Keys: []string{"1"}}, Limit: 1})
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(int64(3)))
+		})
+	})
+
+	Describe("List filters and sorts", func() {
+		BeforeEach(func() {
+			createListFixtures(repo)
+		})
+
+		It("filters on status, department, email domain and user_name prefix", func() {
+			expectListed(repo, ListOptions{UserStatus: "A", Department: ptr("Finance")}, 1)
+			expectListed(repo, ListOptions{Department: ptr("")}, 2, 4)
+			expectListed(repo, ListOptions{EmailDomain: "EXAMPLE.com"}, 1, 3, 4)
+			expectListed(repo, ListOptions{UserNamePrefix: "a_"}, 2)
+			expectListed(repo, ListOptions{UserNamePrefix: "ASMITH"}, 3, 5)
+		})
+
+		It("sorts and pages like the SQL repository", func() {
+			expectPaged(repo, []SortField{{Column: "last_name"}, {Column: "user_id", Desc: true}}, 1, 4, 3, 2, 5)
+			expectPaged(repo, []SortField{{Column: "department"}, {Column: "user_status", Desc: true}}, 4, 2, 5, 3, 1)
+			expectPaged(repo, []SortField{{Column: "created_at", Desc: true}}, 5, 4, 3, 2, 1)
+		})
+	})
+
+	Describe("Stream", func() {
+		It("streams the users List returns until fn fails", func() {
+			repo.Create(ctx, user, "tester")
+			repo.Create(ctx, &User{UserName: "asmith"}, "tester")
+
+			var names []string
+			err := repo.Stream(ctx, ListOptions{}, func(u User) error {
+				names = append(names, u.UserName)
+				return nil
+			})
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"jdoe", "asmith"}))
+
+			stop := errors.New("stop")
+			err = repo.Stream(ctx, ListOptions{}, func(u User) error { return stop })
+			Expect(err).To(Equal(stop))
+		})
+	})
+
+	Describe("BulkCreate", func() {
+		It("reports each user's outcome and creates the rest", func() {
+			repo.Create(ctx, user, "tester")
+
+			results, err := repo.BulkCreate(ctx, []User{
+				{UserName: "asmith", FirstName: "Alice", LastName: "Smith", Email: "a@example.com"},
+				{UserName: "ASMITH", FirstName: "Alice", LastName: "Smith", Email: "other@example.com"},
+				{UserName: "jdoe", FirstName: "John", LastName: "Doe", Email: "new@example.com"},
+				{UserName: "nolast", FirstName: "No", Email: "nolast@example.com"},
+			}, "tester")
+			Expect(err).To(BeNil())
+			Expect(results).To(Equal([]BulkResult{
+				{Row: 0, Outcome: BulkCreated, UserID: 2},
+				{Row: 1, Outcome: BulkDuplicateUserName},
+				{Row: 2, Outcome: BulkDuplicateUserName},
+				{Row: 3, Outcome: BulkInvalid, Field: "last_name", Error: "missing last_name"},
+			}))
+
+			users, err := repo.List(ctx, ListOptions{})
+			Expect(err).To(BeNil())
+			Expect(users).To(HaveLen(2))
+		})
+
+		It("rejects an empty load", func() {
+			_, err := repo.BulkCreate(ctx, []User{}, "tester")
+			Expect(err).To(Equal(ErrInvalidBulkSize))
+		})
+	})
+
+	Describe("ExistsByUserName", func() {
+		It("reports whether the user_name is taken", func() {
+			repo.Create(ctx, user, "tester")
+
+			exists, err := repo.ExistsByUserName(ctx, "jdoe")
+			Expect(err).To(BeNil())
+			Expect(exists).To(BeTrue())
+
+			exists, err = repo.ExistsByUserName(ctx, "nobody")
+			Expect(err).To(BeNil())
+			Expect(exists).To(BeFalse())
+		})
+
+		It("ignores case and surrounding whitespace", func() {
+			repo.Create(ctx, user, "tester")
+
+			exists, err := repo.ExistsByUserName(ctx, " JDOE ")
+			Expect(err).To(BeNil())
+			Expect(exists).To(BeTrue())
+		})
+
+		It("counts a soft-deleted user's user_name until it is purged", func() {
+			created, _ := repo.Create(ctx, user, "tester")
+			Expect(repo.Delete(ctx, created.ID, 0, "tester")).To(Succeed())
+
+			exists, err := repo.ExistsByUserName(ctx, "jdoe")
+			Expect(err).To(BeNil())
+			Expect(exists).To(BeTrue())
+
+			Expect(repo.Purge(ctx, created.ID, "tester")).To(Succeed())
+
+			exists, err = repo.ExistsByUserName(ctx, "jdoe")
+			Expect(err).To(BeNil())
+			Expect(exists).To(BeFalse())
+		})
+
+		It("returns ErrMissingUserName when user_name is empty", func() {
+			_, err := repo.ExistsByUserName(ctx, "")
+			Expect(err).To(Equal(ErrMissingUserName))
+		})
+	})
+
+	Describe("Update", func() {
+		It("only updates the values given", func() {
+			created, _ := repo.Create(ctx, user, "tester")
+
+			updated, err := repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 0, "tester")
+			Expect(err).To(BeNil())
+			Expect(updated.Email).To(Equal("john@example.com"))
+			Expect(updated.FirstName).To(Equal("John"))
+			Expect(*updated.Department).To(Equal("Engineering"))
+		})
+
+		It("returns ErrMissingUserID when id == 0", func() {
+			_, err := repo.Update(ctx, &User{Email: "john@example.com"}, 0, "tester")
+			Expect(err).To(Equal(ErrMissingUserID))
+		})
+
+		It("returns ErrUpdateUserMissingValues when nothing is given", func() {
+			created, _ := repo.Create(ctx, user, "tester")
+
+			_, err := repo.Update(ctx, &User{ID: created.ID}, 0, "tester")
+			Expect(err).To(Equal(ErrUpdateUserMissingValues))
+		})
+
+		It("returns ErrUserExists when renaming into a taken user_name", func() {
+			repo.Create(ctx, user, "tester")
+			other, _ := repo.Create(ctx, &User{UserName: "asmith"}, "tester")
+
+			_, err := repo.Update(ctx, &User{ID: other.ID, UserName: "jdoe"}, 0, "tester")
+			Expect(err).To(Equal(ErrUserExists))
+
+			_, err = repo.Update(ctx, &User{ID: other.ID, UserName: "asmith", Email: "a@example.com"}, 0, "tester")
+			Expect(err).To(BeNil())
+		})
+
+		It("returns ErrUpdateUserNoRows for an unknown id", func() {
+			_, err := repo.Update(ctx, &User{ID: 99, Email: "john@example.com"}, 0, "tester")
+			Expect(err).To(Equal(ErrUpdateUserNoRows))
+		})
+		It("bumps the version and rejects a stale expected version", func() {
+			created, _ := repo.Create(ctx, user, "tester")
+			Expect(created.Version).To(Equal(int64(1)))
+
+			updated, err := repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 1, "tester")
+			Expect(err).To(BeNil())
+			Expect(updated.Version).To(Equal(int64(2)))
+
+			_, err = repo.Update(ctx, &User{ID: created.ID, Email: "jd@example.com"}, 1, "tester")
+			Expect(err).To(Equal(ErrVersionMismatch))
+		})
+	})
+
+	Describe("Delete", func() {
+		It("soft deletes the user", func() {
+			created, _ := repo.Create(ctx, user, "tester")
+
+			Expect(repo.Delete(ctx, created.ID, 0, "tester")).To(Succeed())
+
+			_, err := repo.Get(ctx, created.ID, GetOptions{})
+			Expect(err).To(Equal(ErrUserNotFound))
+		})
+
+		It("returns ErrUserNotFound for an unknown id", func() {
+			Expect(repo.Delete(ctx, 99, 0, "tester")).To(MatchError(ErrUserNotFound))
+		})
+
+		It("rejects a stale expected version", func() {
+			created, _ := repo.Create(ctx, user, "tester")
+			repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 0, "tester")
+
+			Expect(repo.Delete(ctx, created.ID, 1, "tester")).To(Equal(ErrVersionMismatch))
+			Expect(repo.Delete(ctx, created.ID, 2, "tester")).To(Succeed())
+		})
+	})
+
+	Describe("soft delete", func() {
+		var id int64
+
+		BeforeEach(func() {
+			created, err := repo.Create(ctx, user, "tester")
+			Expect(err).To(BeNil())
+			id = created.ID
+			Expect(repo.Delete(ctx, id, 0, "tester")).To(Succeed())
+		})
+
+		It("hides deleted users unless asked for", func() {
+			users, err := repo.List(ctx, ListOptions{})
+			Expect(err).To(BeNil())
+			Expect(users).To(BeEmpty())
+
+			users, err = repo.List(ctx, ListOptions{IncludeDeleted: true})
+			Expect(err).To(BeNil())
+			Expect(users).To(HaveLen(1))
+			Expect(users[0].DeletedAt).ToNot(BeNil())
+
+			found, err := repo.Get(ctx, id, GetOptions{IncludeDeleted: true})
+			Expect(err).To(BeNil())
+			Expect(found.DeletedAt).ToNot(BeNil())
+		})
+
+		It("keeps the user_name reserved", func() {
+			_, err := repo.Create(ctx, &User{UserName: "jdoe"}, "tester")
+			Expect(err).To(Equal(ErrUserExists))
+		})
+
+		It("refuses to update a deleted user", func() {
+			_, err := repo.Update(ctx, &User{ID: id, Email: "john@example.com"}, 0, "tester")
+			Expect(err).To(Equal(ErrUpdateUserNoRows))
+		})
+
+		It("restores a deleted user", func() {
+			restored, err := repo.Restore(ctx, id, "tester")
+			Expect(err).To(BeNil())
+			Expect(restored.DeletedAt).To(BeNil())
+
+			_, err = repo.Restore(ctx, id, "tester")
+			Expect(err).To(Equal(ErrUserNotDeleted))
+		})
+
+		It("purges a deleted user for good", func() {
+			Expect(repo.Purge(ctx, id, "tester")).To(Succeed())
+
+			_, err := repo.Get(ctx, id, GetOptions{IncludeDeleted: true})
+			Expect(err).To(Equal(ErrUserNotFound))
+
+			_, err = repo.Restore(ctx, id, "tester")
+			Expect(err).To(Equal(ErrUserNotFound))
+		})
+	})
+
+	Describe("timestamps", func() {
+		It("sets created_at and updated_at and filters on them", func() {
+			created, _ := repo.Create(ctx, user, "tester")
+			Expect(created.CreatedAt).ToNot(BeZero())
+			Expect(created.UpdatedAt).To(Equal(created.CreatedAt))
+
+			time.Sleep(time.Millisecond)
+			cutoff := time.Now()
+			time.Sleep(time.Millisecond)
+
+			other, _ := repo.Create(ctx, &User{UserName: "asmith"}, "tester")
+
+			users, err := repo.List(ctx, ListOptions{CreatedAfter: &cutoff})
+			Expect(err).To(BeNil())
+			Expect(users).To(HaveLen(1))
+			Expect(users[0].ID).To(Equal(other.ID))
+
+			users, err = repo.List(ctx, ListOptions{CreatedBefore: &cutoff})
+			Expect(err).To(BeNil())
+			Expect(users).To(HaveLen(1))
+			Expect(users[0].ID).To(Equal(created.ID))
+
+			updated, err := repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 0, "tester")
+			Expect(err).To(BeNil())
+			Expect(updated.UpdatedAt).To(BeTemporally(">", cutoff))
+
+			users, err = repo.List(ctx, ListOptions{UpdatedBefore: &cutoff})
+			Expect(err).To(BeNil())
+			Expect(users).To(BeEmpty())
+
+			users, err = repo.List(ctx, ListOptions{UpdatedAfter: &cutoff})
+			Expect(err).To(BeNil())
+			Expect(users).To(HaveLen(2))
+		})
+	})
+
+	Describe("History", func() {
+		It("records every change, newest first", func() {
+			created, _ := repo.Create(ctx, user, "alice")
+			repo.Update(ctx, &User{ID: created.ID, UserStatus: "T"}, 0, "bob")
+			Expect(repo.Delete(ctx, created.ID, 0, "")).To(Succeed())
+
+			entries, err := repo.History(ctx, created.ID, HistoryOptions{})
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(3))
+
+			Expect(entries[0].Operation).To(Equal(OpDelete))
+			Expect(entries[0].Actor).To(Equal(DefaultActor))
+			Expect(entries[0].Changes).To(HaveKey("deleted_at"))
+			Expect(entries[0].Changes["deleted_at"].Before).To(BeNil())
+
+			Expect(entries[1].Operation).To(Equal(OpStatusChange))
+			Expect(entries[1].Changes).To(Equal(map[string]FieldChange{
+				"user_status": {Before: ptr("A"), After: ptr("T")},
+			}))
+
+			Expect(entries[2].Operation).To(Equal(OpCreate))
+			Expect(entries[2].Actor).To(Equal("alice"))
+		})
+
+		It("filters by operation and pages", func() {
+			created, _ := repo.Create(ctx, user, "alice")
+			for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+				repo.Update(ctx, &User{ID: created.ID, Email: email}, 0, "bob")
+			}
+
+			entries, err := repo.History(ctx, created.ID, HistoryOptions{Operation: OpUpdate, Limit: 2, Offset: 1})
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(2))
+			Expect(*entries[0].Changes["email"].After).To(Equal("b@example.com"))
+			Expect(*entries[1].Changes["email"].After).To(Equal("a@example.com"))
+
+			entries, err = repo.History(ctx, created.ID, HistoryOptions{Limit: 2, Offset: 10})
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+		})
+
+		It("does not record failed writes", func() {
+			created, _ := repo.Create(ctx, user, "alice")
+			_, err := repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 5, "bob")
+			Expect(err).To(Equal(ErrVersionMismatch))
+
+			entries, err := repo.History(ctx, created.ID, HistoryOptions{})
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+		})
+	})
+})
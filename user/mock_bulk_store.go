@@ -0,0 +1,19 @@
+package user
+
+import (
+	"context"
+	"errors"
+)
+
+type MockBulkStore struct {
+	BulkCreateFunc func(ctx context.Context, users []User, actor string) ([]BulkResult, error)
+}
+
+var _ BulkStore = (*MockBulkStore)(nil)
+
+func (m *MockBulkStore) BulkCreate(ctx context.Context, users []User, actor string) ([]BulkResult, error) {
+	if m.BulkCreateFunc == nil {
+		return nil, errors.New("BulkCreateFunc not implemented")
+	}
+	return m.BulkCreateFunc(ctx, users, actor)
+}
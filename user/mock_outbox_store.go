@@ -0,0 +1,60 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type MockOutboxStore struct {
+	ClaimEventsFunc   func(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error)
+	MarkDeliveredFunc func(ctx context.Context, eventID int64) error
+	MarkFailedFunc    func(ctx context.Context, eventID int64, lastError string, retryAt time.Time) error
+	MarkDeadFunc      func(ctx context.Context, eventID int64, lastError string) error
+	EventsFunc        func(ctx context.Context, opts OutboxOptions) ([]OutboxEvent, error)
+	RequeueEventFunc  func(ctx context.Context, eventID int64) error
+}
+
+var _ OutboxStore = (*MockOutboxStore)(nil)
+
+func (m *MockOutboxStore) ClaimEvents(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	if m.ClaimEventsFunc == nil {
+		return nil, errors.New("ClaimEventsFunc not implemented")
+	}
+	return m.ClaimEventsFunc(ctx, limit, lease)
+}
+
+func (m *MockOutboxStore) MarkDelivered(ctx context.Context, eventID int64) error {
+	if m.MarkDeliveredFunc == nil {
+		return errors.New("MarkDeliveredFunc not implemented")
+	}
+	return m.MarkDeliveredFunc(ctx, eventID)
+}
+
+func (m *MockOutboxStore) MarkFailed(ctx context.Context, eventID int64, lastError string, retryAt time.Time) error {
+	if m.MarkFailedFunc == nil {
+		return errors.New("MarkFailedFunc not implemented")
+	}
+	return m.MarkFailedFunc(ctx, eventID, lastError, retryAt)
+}
+
+func (m *MockOutboxStore) MarkDead(ctx context.Context, eventID int64, lastError string) error {
+	if m.MarkDeadFunc == nil {
+		return errors.New("MarkDeadFunc not implemented")
+	}
+	return m.MarkDeadFunc(ctx, eventID, lastError)
+}
+
+func (m *MockOutboxStore) Events(ctx context.Context, opts OutboxOptions) ([]OutboxEvent, error) {
+	if m.EventsFunc == nil {
+		return nil, errors.New("EventsFunc not implemented")
+	}
+	return m.EventsFunc(ctx, opts)
+}
+
+func (m *MockOutboxStore) RequeueEvent(ctx context.Context, eventID int64) error {
+	if m.RequeueEventFunc == nil {
+		return errors.New("RequeueEventFunc not implemented")
+	}
+	return m.RequeueEventFunc(ctx, eventID)
+}
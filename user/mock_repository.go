@@ -0,0 +1,115 @@
+package user
+
+import (
+	"context"
+	"errors"
+)
+
+type MockRepository struct {
+	GetFunc              func(ctx context.Context, id int64, opts GetOptions) (*User, error)
+	ListFunc             func(ctx context.Context, opts ListOptions) ([]User, error)
+	StreamFunc           func(ctx context.Context, opts ListOptions, fn func(User) error) error
+	CountFunc            func(ctx context.Context, opts ListOptions) (int64, error)
+	SearchFunc           func(ctx context.Context, opts SearchOptions) ([]SearchResult, error)
+	CreateFunc           func(ctx context.Context, u *User, actor string) (*User, error)
+	UpdateFunc           func(ctx context.Context, u *User, expectedVersion int64, actor string) (*User, error)
+	ReplaceFunc          func(ctx context.Context, u *User, expectedVersion int64, actor string) (*User, error)
+	DeleteFunc           func(ctx context.Context, id int64, expectedVersion int64, actor string) error
+	RestoreFunc          func(ctx context.Context, id int64, actor string) (*User, error)
+	PurgeFunc            func(ctx context.Context, id int64, actor string) error
+	ExistsByUserNameFunc func(ctx context.Context, userName string) (bool, error)
+	HistoryFunc          func(ctx context.Context, userID int64, opts HistoryOptions) ([]AuditEntry, error)
+}
+
+var _ Repository = (*MockRepository)(nil)
+
+func (m *MockRepository) Get(ctx context.Context, id int64, opts GetOptions) (*User, error) {
+	if m.GetFunc == nil {
+		return nil, errors.New("GetFunc not implemented")
+	}
+	return m.GetFunc(ctx, id, opts)
+}
+
+func (m *MockRepository) List(ctx context.Context, opts ListOptions) ([]User, error) {
+	if m.ListFunc == nil {
+		return nil, errors.New("ListFunc not implemented")
+	}
+	return m.ListFunc(ctx, opts)
+}
+
+func (m *MockRepository) Stream(ctx context.Context, opts ListOptions, fn func(User) error) error {
+	if m.StreamFunc == nil {
+		return errors.New("StreamFunc not implemented")
+	}
+	return m.StreamFunc(ctx, opts, fn)
+}
+
+func (m *MockRepository) Count(ctx context.Context, opts ListOptions) (int64, error) {
+	if m.CountFunc == nil {
+		return 0, errors.New("CountFunc not implemented")
+	}
+	return m.CountFunc(ctx, opts)
+}
+
+func (m *MockRepository) Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error) {
+	if m.SearchFunc == nil {
+		return nil, errors.New("SearchFunc not implemented")
+	}
+	return m.SearchFunc(ctx, opts)
+}
+
+func (m *MockRepository) Create(ctx context.Context, u *User, actor string) (*User, error) {
+	if m.CreateFunc == nil {
+		return nil, errors.New("CreateFunc not implemented")
+	}
+	return m.CreateFunc(ctx, u, actor)
+}
+
+func (m *MockRepository) Update(ctx context.Context, u *User, expectedVersion int64, actor string) (*User, error) {
+	if m.UpdateFunc == nil {
+		return nil, errors.New("UpdateFunc not implemented")
+	}
+	return m.UpdateFunc(ctx, u, expectedVersion, actor)
+}
+
+func (m *MockRepository) Replace(ctx context.Context, u *User, expectedVersion int64, actor string) (*User, error) {
+	if m.ReplaceFunc == nil {
+		return nil, errors.New("ReplaceFunc not implemented")
+	}
+	return m.ReplaceFunc(ctx, u, expectedVersion, actor)
+}
+
+func (m *MockRepository) Delete(ctx context.Context, id int64, expectedVersion int64, actor string) error {
+	if m.DeleteFunc == nil {
+		return errors.New("DeleteFunc not implemented")
+	}
+	return m.DeleteFunc(ctx, id, expectedVersion, actor)
+}
+
+func (m *MockRepository) Restore(ctx context.Context, id int64, actor string) (*User, error) {
+	if m.RestoreFunc == nil {
+		return nil, errors.New("RestoreFunc not implemented")
+	}
+	return m.RestoreFunc(ctx, id, actor)
+}
+
+func (m *MockRepository) Purge(ctx context.Context, id int64, actor string) error {
+	if m.PurgeFunc == nil {
+		return errors.New("PurgeFunc not implemented")
+	}
+	return m.PurgeFunc(ctx, id, actor)
+}
+
+func (m *MockRepository) ExistsByUserName(ctx context.Context, userName string) (bool, error) {
+	if m.ExistsByUserNameFunc == nil {
+		return false, errors.New("ExistsByUserNameFunc not implemented")
+	}
+	return m.ExistsByUserNameFunc(ctx, userName)
+}
+
+func (m *MockRepository) History(ctx context.Context, userID int64, opts HistoryOptions) ([]AuditEntry, error) {
+	if m.HistoryFunc == nil {
+		return nil, errors.New("HistoryFunc not implemented")
+	}
+	return m.HistoryFunc(ctx, userID, opts)
+}
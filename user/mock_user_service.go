@@ -1,50 +1,113 @@
 package user
 
 import (
+	"context"
 	"errors"
-
-	"github.com/labstack/echo/v4"
 )
 
 type MockUserService struct {
-	GetAllFunc     func(c echo.Context) ([]User, error)
-	GetByIDFunc    func(c echo.Context) (*User, error)
-	CreateFunc     func(c echo.Context, u *User) (*User, error)
-	UpdateFunc     func(c echo.Context, u *User) (*User, error)
-	DeleteByIDFunc func(c echo.Context) error
+	GetAllFunc      func(ctx context.Context, opts ListOptions) ([]User, error)
+	StreamAllFunc   func(ctx context.Context, opts ListOptions, fn func(User) error) (string, error)
+	CountAllFunc    func(ctx context.Context, opts ListOptions) (int64, error)
+	SearchFunc      func(ctx context.Context, opts SearchOptions) ([]SearchResult, error)
+	GetByIDFunc     func(ctx context.Context, id int64, opts GetOptions) (*User, error)
+	CreateFunc      func(ctx context.Context, u *User, actor string) (*User, error)
+	UpdateFunc      func(ctx context.Context, u *User, cond Precondition, actor string) (*User, error)
+	ReplaceFunc     func(ctx context.Context, id int64, u *User, cond Precondition, actor string) (*User, error)
+	PatchFunc       func(ctx context.Context, id int64, patch []byte, cond Precondition, actor string) (*User, error)
+	DeleteByIDFunc  func(ctx context.Context, id int64, cond Precondition, actor string) error
+	RestoreByIDFunc func(ctx context.Context, id int64, actor string) (*User, error)
+	PurgeByIDFunc   func(ctx context.Context, id int64, actor string) error
+	HistoryByIDFunc func(ctx context.Context, id int64, opts HistoryOptions) ([]AuditEntry, error)
 }
 
-func (m *MockUserService) GetAll(c echo.Context) ([]User, error) {
+func (m *MockUserService) GetAll(ctx context.Context, opts ListOptions) ([]User, error) {
 	if m.GetAllFunc == nil {
 		return nil, errors.New("GetAllFunc not implemented")
 	}
-	return m.GetAllFunc(c)
+	return m.GetAllFunc(ctx, opts)
+}
+
+func (m *MockUserService) StreamAll(ctx context.Context, opts ListOptions, fn func(User) error) (string, error) {
+	if m.StreamAllFunc == nil {
+		return "", errors.New("StreamAllFunc not implemented")
+	}
+	return m.StreamAllFunc(ctx, opts, fn)
+}
+
+func (m *MockUserService) CountAll(ctx context.Context, opts ListOptions) (int64, error) {
+	if m.CountAllFunc == nil {
+		return 0, errors.New("CountAllFunc not implemented")
+	}
+	return m.CountAllFunc(ctx, opts)
 }
 
-func (m *MockUserService) GetByID(c echo.Context) (*User, error) {
+func (m *MockUserService) Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error) {
+	if m.SearchFunc == nil {
+		return nil, errors.New("SearchFunc not implemented")
+	}
+	return m.SearchFunc(ctx, opts)
+}
+
+func (m *MockUserService) GetByID(ctx context.Context, id int64, opts GetOptions) (*User, error) {
 	if m.GetByIDFunc == nil {
 		return nil, errors.New("GetByIDFunc not implemented")
 	}
-	return m.GetByIDFunc(c)
+	return m.GetByIDFunc(ctx, id, opts)
 }
 
-func (m *MockUserService) Create(c echo.Context, u *User) (*User, error) {
+func (m *MockUserService) Create(ctx context.Context, u *User, actor string) (*User, error) {
 	if m.CreateFunc == nil {
 		return nil, errors.New("CreateFunc not implemented")
 	}
-	return m.CreateFunc(c, u)
+	return m.CreateFunc(ctx, u, actor)
 }
 
-func (m *MockUserService) Update(c echo.Context, u *User) (*User, error) {
+func (m *MockUserService) Update(ctx context.Context, u *User, cond Precondition, actor string) (*User, error) {
 	if m.UpdateFunc == nil {
 		return nil, errors.New("UpdateFunc not implemented")
 	}
-	return m.UpdateFunc(c, u)
+	return m.UpdateFunc(ctx, u, cond, actor)
+}
+
+func (m *MockUserService) Replace(ctx context.Context, id int64, u *User, cond Precondition, actor string) (*User, error) {
+	if m.ReplaceFunc == nil {
+		return nil, errors.New("ReplaceFunc not implemented")
+	}
+	return m.ReplaceFunc(ctx, id, u, cond, actor)
 }
 
-func (m *MockUserService) DeleteByID(c echo.Context) error {
+func (m *MockUserService) Patch(ctx context.Context, id int64, patch []byte, cond Precondition, actor string) (*User, error) {
+	if m.PatchFunc == nil {
+		return nil, errors.New("PatchFunc not implemented")
+	}
+	return m.PatchFunc(ctx, id, patch, cond, actor)
+}
+
+func (m *MockUserService) DeleteByID(ctx context.Context, id int64, cond Precondition, actor string) error {
 	if m.DeleteByIDFunc == nil {
 		return errors.New("DeleteByIDFunc not implemented")
 	}
-	return m.DeleteByIDFunc(c)
+	return m.DeleteByIDFunc(ctx, id, cond, actor)
+}
+
+func (m *MockUserService) RestoreByID(ctx context.Context, id int64, actor string) (*User, error) {
+	if m.RestoreByIDFunc == nil {
+		return nil, errors.New("RestoreByIDFunc not implemented")
+	}
+	return m.RestoreByIDFunc(ctx, id, actor)
+}
+
+func (m *MockUserService) PurgeByID(ctx context.Context, id int64, actor string) error {
+	if m.PurgeByIDFunc == nil {
+		return errors.New("PurgeByIDFunc not implemented")
+	}
+	return m.PurgeByIDFunc(ctx, id, actor)
+}
+
+func (m *MockUserService) HistoryByID(ctx context.Context, id int64, opts HistoryOptions) ([]AuditEntry, error) {
+	if m.HistoryByIDFunc == nil {
+		return nil, errors.New("HistoryByIDFunc not implemented")
+	}
+	return m.HistoryByIDFunc(ctx, id, opts)
 }
@@ -0,0 +1,245 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/steveperjesi/integra-demo/internal/db"
+)
+
+const OutboxTable = "user_outbox"
+
+// Event types published to downstream systems
+const (
+	EventUserCreated     = "user.created"
+	EventUserUpdated     = "user.updated"
+	EventUserActivated   = "user.activated"
+	EventUserDeactivated = "user.deactivated"
+	EventUserDeleted     = "user.deleted"
+	EventUserRestored    = "user.restored"
+	EventUserPurged      = "user.purged"
+)
+
+// Delivery states of an outbox event
+const (
+	// Waiting for its first or next delivery attempt
+	EventPending = "pending"
+	// Accepted by the sink
+	EventDelivered = "delivered"
+	// Gave up after RelayConfig.MaxAttempts; left for an operator to inspect
+	// and requeue
+	EventDead = "dead"
+)
+
+var eventStatuses = []string{EventPending, EventDelivered, EventDead}
+
+// Event tells downstream systems about one change to a user. It is what a
+// Sink receives.
+type Event struct {
+	// ID increases with every event, so consumers can use it to dedupe and
+	// to order the events of a user
+	ID     int64  `json:"event_id"`
+	Type   string `json:"type"`
+	UserID int64  `json:"user_id"`
+	Actor  string `json:"actor"`
+	// User is the user after the change; nil once purged
+	User *User `json:"user"`
+	// Changes holds only the fields that changed, as in the audit trail
+	Changes    map[string]FieldChange `json:"changes"`
+	OccurredAt time.Time              `json:"occurred_at"`
+}
+
+// OutboxEvent is an event together with its delivery state
+type OutboxEvent struct {
+	Event
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     *string    `json:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+// Narrows and pages the outbox. Zero values don't filter.
+type OutboxOptions struct {
+	// Only events in this delivery state
+	Status string
+	// Offset only applies together with a Limit
+	Limit  int
+	Offset int
+}
+
+// OutboxStore is the side of a repository the relay delivers from. Both
+// repositories write an event to it in the same transaction as every user
+// change.
+type OutboxStore interface {
+	// ClaimEvents returns up to limit events that are due, oldest first,
+	// and holds them for lease so no other relay takes them meanwhile. Only
+	// a user's oldest pending event is ever due, which keeps each user's
+	// events in order.
+	ClaimEvents(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error)
+	MarkDelivered(ctx context.Context, eventID int64) error
+	// MarkFailed counts a failed attempt and schedules the next one
+	MarkFailed(ctx context.Context, eventID int64, lastError string, retryAt time.Time) error
+	// MarkDead counts a failed attempt and stops retrying. Later events of
+	// the same user are no longer held back by it.
+	MarkDead(ctx context.Context, eventID int64, lastError string) error
+	// Events lists the outbox, oldest first
+	Events(ctx context.Context, opts OutboxOptions) ([]OutboxEvent, error)
+	// RequeueEvent gives a dead event a fresh set of attempts
+	RequeueEvent(ctx context.Context, eventID int64) error
+}
+
+func IsEventStatus(status string) bool {
+	for _, known := range eventStatuses {
+		if status == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the outbox listing options, the same way history options are
+func (o OutboxOptions) Validate() error {
+	if o.Status != "" && !IsEventStatus(o.Status) {
+		return ErrInvalidEventStatus
+	}
+
+	if o.Limit < 1 || o.Limit > MaxHistoryLimit {
+		return ErrInvalidLimit
+	}
+
+	if o.Offset < 0 {
+		return ErrInvalidOffset
+	}
+
+	return nil
+}
+
+// Builds the event published for the change an audit entry records. after
+// is the user after the change, nil on purge.
+func newEvent(entry AuditEntry, after *User) Event {
+	event := Event{
+		Type:       EventUserUpdated,
+		UserID:     entry.UserID,
+		Actor:      entry.Actor,
+		Changes:    entry.Changes,
+		OccurredAt: entry.CreatedAt,
+	}
+
+	if after != nil {
+		u := copyUser(*after)
+		event.User = &u
+	}
+
+	switch entry.Operation {
+	case OpCreate:
+		event.Type = EventUserCreated
+	case OpStatusChange:
+		event.Type = EventUserDeactivated
+		if after != nil && after.UserStatus == "A" {
+			event.Type = EventUserActivated
+		}
+	case OpDelete:
+		event.Type = EventUserDeleted
+	case OpRestore:
+		event.Type = EventUserRestored
+	case OpPurge:
+		event.Type = EventUserPurged
+	}
+
+	return event
+}
+
+// What is stored in the `payload` column; the rest of the event has columns
+// of its own
+type eventPayload struct {
+	Actor   string                 `json:"actor"`
+	User    *User                  `json:"user"`
+	Changes map[string]FieldChange `json:"changes"`
+}
+
+// Applies fn to the PII values of the user and the changes, returning a
+// copy
+func (p eventPayload) mapPII(fn func(string) (string, error)) (eventPayload, error) {
+	mapped := eventPayload{Actor: p.Actor}
+
+	if p.User != nil {
+		u := copyUser(*p.User)
+		if err := mapUserPII(&u, fn); err != nil {
+			return eventPayload{}, err
+		}
+		mapped.User = &u
+	}
+
+	var err error
+	if mapped.Changes, err = mapPIIChanges(p.Changes, fn); err != nil {
+		return eventPayload{}, err
+	}
+
+	return mapped, nil
+}
+
+// Seals the PII values in the payload with keys when there is a keyring
+func (e *Event) ConvertToOutboxDB(keys *db.Keyring) (db.OutboxDB, error) {
+	sealed, err := eventPayload{Actor: e.Actor, User: e.User, Changes: e.Changes}.mapPII(func(value string) (string, error) {
+		return sealPII(keys, value)
+	})
+	if err != nil {
+		return db.OutboxDB{}, err
+	}
+
+	payload, err := json.Marshal(sealed)
+	if err != nil {
+		return db.OutboxDB{}, err
+	}
+
+	return db.OutboxDB{
+		EventID:       e.ID,
+		UserID:        e.UserID,
+		EventType:     e.Type,
+		Payload:       payload,
+		Status:        EventPending,
+		NextAttemptAt: e.OccurredAt,
+		CreatedAt:     e.OccurredAt,
+	}, nil
+}
+
+func ConvertToOutboxEvent(odb *db.OutboxDB, keys *db.Keyring) (OutboxEvent, error) {
+	var stored eventPayload
+	if err := json.Unmarshal(odb.Payload, &stored); err != nil {
+		return OutboxEvent{}, err
+	}
+
+	payload, err := stored.mapPII(keys.Decrypt)
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+
+	event := OutboxEvent{
+		Event: Event{
+			ID:         odb.EventID,
+			Type:       odb.EventType,
+			UserID:     odb.UserID,
+			Actor:      payload.Actor,
+			User:       payload.User,
+			Changes:    payload.Changes,
+			OccurredAt: odb.CreatedAt.UTC(),
+		},
+		Status:        odb.Status,
+		Attempts:      odb.Attempts,
+		NextAttemptAt: odb.NextAttemptAt.UTC(),
+	}
+
+	if odb.LastError.Valid {
+		lastError := odb.LastError.String
+		event.LastError = &lastError
+	}
+
+	if odb.DeliveredAt.Valid {
+		deliveredAt := odb.DeliveredAt.Time.UTC()
+		event.DeliveredAt = &deliveredAt
+	}
+
+	return event, nil
+}
@@ -0,0 +1,215 @@
+package user_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/steveperjesi/integra-demo/user"
+)
+
+// Both repositories implement the outbox the same way
+var _ = Describe("OutboxStore", func() {
+	for _, backend := range backends {
+		backend := backend
+
+		Describe(backend.name, func() {
+			var (
+				repo  testRepository
+				store OutboxStore
+				user  *User
+			)
+
+			BeforeEach(func() {
+				var closeRepo func()
+				repo, closeRepo = backend.open()
+				DeferCleanup(closeRepo)
+				store = repo
+
+				user = &User{
+					UserName:   "jdoe",
+					FirstName:  "John",
+					LastName:   "Doe",
+					Email:      "jdoe@example.com",
+					UserStatus: "A",
+				}
+			})
+
+			eventTypes := func(events []OutboxEvent) []string {
+				var types []string
+				for _, event := range events {
+					types = append(types, event.Type)
+				}
+				return types
+			}
+
+			It("writes an event for every change", func() {
+				created, err := repo.Create(ctx, user, "alice")
+				Expect(err).To(BeNil())
+				repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 0, "bob")
+				repo.Update(ctx, &User{ID: created.ID, UserStatus: "I"}, 0, "bob")
+				repo.Update(ctx, &User{ID: created.ID, UserStatus: "A"}, 0, "bob")
+				Expect(repo.Delete(ctx, created.ID, 0, "bob")).To(Succeed())
+				repo.Restore(ctx, created.ID, "bob")
+				Expect(repo.Purge(ctx, created.ID, "admin")).To(Succeed())
+
+				events, err := store.Events(ctx, OutboxOptions{})
+				Expect(err).To(BeNil())
+				Expect(eventTypes(events)).To(Equal([]string{
+					EventUserCreated, EventUserUpdated, EventUserDeactivated, EventUserActivated,
+					EventUserDeleted, EventUserRestored, EventUserPurged,
+				}))
+
+				first := events[0]
+				Expect(first.ID).To(Equal(int64(1)))
+				Expect(first.UserID).To(Equal(created.ID))
+				Expect(first.Actor).To(Equal("alice"))
+				Expect(first.User.Email).To(Equal("jdoe@example.com"))
+				Expect(first.Status).To(Equal(EventPending))
+				Expect(first.Attempts).To(BeZero())
+
+				Expect(events[1].Changes).To(Equal(map[string]FieldChange{
+					"email": {Before: ptr("jdoe@example.com"), After: ptr("john@example.com")},
+				}))
+				Expect(events[4].User.DeletedAt).ToNot(BeNil())
+				Expect(events[6].User).To(BeNil())
+			})
+
+			It("does not write an event for a failed change", func() {
+				created, _ := repo.Create(ctx, user, "alice")
+				_, err := repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 5, "bob")
+				Expect(err).To(Equal(ErrVersionMismatch))
+
+				events, err := store.Events(ctx, OutboxOptions{})
+				Expect(err).To(BeNil())
+				Expect(events).To(HaveLen(1))
+			})
+
+			It("only hands out a user's oldest pending event", func() {
+				jdoe, _ := repo.Create(ctx, user, "tester")
+				repo.Update(ctx, &User{ID: jdoe.ID, Email: "john@example.com"}, 0, "tester")
+				repo.Create(ctx, &User{UserName: "asmith", FirstName: "Alice", LastName: "Smith", Email: "a@example.com", UserStatus: "I"}, "tester")
+
+				claimed, err := store.ClaimEvents(ctx, 10, time.Minute)
+				Expect(err).To(BeNil())
+				Expect(claimed).To(HaveLen(2))
+				Expect(claimed[0].ID).To(Equal(int64(1)))
+				Expect(claimed[1].ID).To(Equal(int64(3)))
+
+				// Claimed events are leased, and still hold back the rest
+				claimed, err = store.ClaimEvents(ctx, 10, time.Minute)
+				Expect(err).To(BeNil())
+				Expect(claimed).To(BeEmpty())
+
+				Expect(store.MarkDelivered(ctx, 1)).To(Succeed())
+
+				claimed, err = store.ClaimEvents(ctx, 10, time.Minute)
+				Expect(err).To(BeNil())
+				Expect(claimed).To(HaveLen(1))
+				Expect(claimed[0].ID).To(Equal(int64(2)))
+			})
+
+			It("hands out an event again once its lease runs out", func() {
+				repo.Create(ctx, user, "tester")
+
+				claimed, err := store.ClaimEvents(ctx, 10, -time.Second)
+				Expect(err).To(BeNil())
+				Expect(claimed).To(HaveLen(1))
+
+				claimed, err = store.ClaimEvents(ctx, 10, time.Minute)
+				Expect(err).To(BeNil())
+				Expect(claimed).To(HaveLen(1))
+			})
+
+			It("holds back a user's events while one is retrying", func() {
+				created, _ := repo.Create(ctx, user, "tester")
+				repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 0, "tester")
+
+				store.ClaimEvents(ctx, 10, time.Minute)
+				Expect(store.MarkFailed(ctx, 1, "sink down", time.Now().Add(time.Hour))).To(Succeed())
+
+				claimed, err := store.ClaimEvents(ctx, 10, time.Minute)
+				Expect(err).To(BeNil())
+				Expect(claimed).To(BeEmpty())
+
+				events, err := store.Events(ctx, OutboxOptions{Status: EventPending, Limit: 1})
+				Expect(err).To(BeNil())
+				Expect(events).To(HaveLen(1))
+				Expect(events[0].Attempts).To(Equal(1))
+				Expect(*events[0].LastError).To(Equal("sink down"))
+			})
+
+			It("dead-letters an event and requeues it", func() {
+				created, _ := repo.Create(ctx, user, "tester")
+				repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 0, "tester")
+
+				store.ClaimEvents(ctx, 10, time.Minute)
+				Expect(store.MarkDead(ctx, 1, "rejected")).To(Succeed())
+
+				// A dead event no longer holds back the user's later events
+				claimed, err := store.ClaimEvents(ctx, 10, time.Minute)
+				Expect(err).To(BeNil())
+				Expect(claimed).To(HaveLen(1))
+				Expect(claimed[0].ID).To(Equal(int64(2)))
+				Expect(store.MarkDelivered(ctx, 2)).To(Succeed())
+
+				dead, err := store.Events(ctx, OutboxOptions{Status: EventDead})
+				Expect(err).To(BeNil())
+				Expect(dead).To(HaveLen(1))
+				Expect(dead[0].Attempts).To(Equal(1))
+				Expect(*dead[0].LastError).To(Equal("rejected"))
+
+				Expect(store.RequeueEvent(ctx, 2)).To(Equal(ErrEventNotDead))
+				Expect(store.RequeueEvent(ctx, 99)).To(Equal(ErrEventNotFound))
+				Expect(store.RequeueEvent(ctx, 1)).To(Succeed())
+
+				claimed, err = store.ClaimEvents(ctx, 10, time.Minute)
+				Expect(err).To(BeNil())
+				Expect(claimed).To(HaveLen(1))
+				Expect(claimed[0].ID).To(Equal(int64(1)))
+				Expect(claimed[0].Attempts).To(BeZero())
+				Expect(claimed[0].LastError).To(BeNil())
+			})
+
+			It("refuses to update an event that isn't pending", func() {
+				repo.Create(ctx, user, "tester")
+				Expect(store.MarkDelivered(ctx, 1)).To(Succeed())
+
+				Expect(store.MarkDelivered(ctx, 1)).To(Equal(ErrEventNotFound))
+				Expect(store.MarkFailed(ctx, 1, "late", time.Now())).To(Equal(ErrEventNotFound))
+				Expect(store.MarkDead(ctx, 99, "unknown")).To(Equal(ErrEventNotFound))
+
+				events, err := store.Events(ctx, OutboxOptions{Status: EventDelivered})
+				Expect(err).To(BeNil())
+				Expect(events).To(HaveLen(1))
+				Expect(events[0].DeliveredAt).ToNot(BeNil())
+			})
+
+			It("pages the outbox", func() {
+				for _, name := range []string{"a", "b", "c"} {
+					repo.Create(ctx, &User{UserName: name, FirstName: "A", LastName: "B", Email: name + "@example.com", UserStatus: "A"}, "tester")
+				}
+
+				events, err := store.Events(ctx, OutboxOptions{Limit: 2, Offset: 1})
+				Expect(err).To(BeNil())
+				Expect(events).To(HaveLen(2))
+				Expect(events[0].ID).To(Equal(int64(2)))
+
+				events, err = store.Events(ctx, OutboxOptions{Limit: 2, Offset: 5})
+				Expect(err).To(BeNil())
+				Expect(events).ToNot(BeNil())
+				Expect(events).To(BeEmpty())
+			})
+		})
+	}
+})
+
+var _ = Describe("OutboxOptions", func() {
+	It("checks the status, limit and offset", func() {
+		Expect(OutboxOptions{Status: EventDead, Limit: 50}.Validate()).To(Succeed())
+		Expect(OutboxOptions{Status: "lost", Limit: 50}.Validate()).To(Equal(ErrInvalidEventStatus))
+		Expect(OutboxOptions{Limit: 0}.Validate()).To(Equal(ErrInvalidLimit))
+		Expect(OutboxOptions{Limit: 501}.Validate()).To(Equal(ErrInvalidLimit))
+		Expect(OutboxOptions{Limit: 50, Offset: -1}.Validate()).To(Equal(ErrInvalidOffset))
+	})
+})
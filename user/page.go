@@ -0,0 +1,286 @@
+package user
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest page of users a single list request returns
+const MaxPageLimit = 1000
+
+// Columns a list can be sorted on, and how each is ordered in SQL. Users
+// without a department sort as if it were empty.
+var sortColumns = map[string]string{
+	"user_id":     "user_id",
+	"user_name":   "user_name",
+	"first_name":  "first_name",
+	"last_name":   "last_name",
+	"email":       "email",
+	"user_status": "user_status",
+	"department":  "COALESCE(department, '')",
+	"created_at":  "created_at",
+	"updated_at":  "updated_at",
+}
+
+// Columns holding PII, which can't be sorted on when it's encrypted
+var encryptedColumns = map[string]bool{
+	"first_name": true,
+	"last_name":  true,
+	"email":      true,
+}
+
+// Times in cursors are fixed width, so they order as strings do
+const cursorTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// SortField orders a list on one column
+type SortField struct {
+	Column string
+	Desc   bool
+}
+
+// Parses a sort like `last_name,-user_id`: columns to order on in turn, each
+// descending when prefixed with `-`
+func ParseSort(value string) ([]SortField, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var fields []SortField
+	seen := make(map[string]bool)
+
+	for _, part := range strings.Split(value, ",") {
+		field := SortField{Column: strings.TrimSpace(part)}
+		if strings.HasPrefix(field.Column, "-") {
+			field.Column, field.Desc = field.Column[1:], true
+		}
+
+		if _, ok := sortColumns[field.Column]; !ok || seen[field.Column] {
+			return nil, ErrInvalidSort
+		}
+		seen[field.Column] = true
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// Formats a sort as ParseSort reads it
+func FormatSort(fields []SortField) string {
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		parts[i] = field.Column
+		if field.Desc {
+			parts[i] = "-" + field.Column
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// The full order a list is read in: the sort asked for, then user_id to
+// break ties, which is what keeps pages from overlapping
+func sortOrder(fields []SortField) []SortField {
+	for _, field := range fields {
+		if field.Column == "user_id" {
+			return fields
+		}
+	}
+
+	return append(append([]SortField(nil), fields...), SortField{Column: "user_id"})
+}
+
+// Reports whether the sort orders on a PII column
+func sortsOnPII(fields []SortField) bool {
+	for _, field := range fields {
+		if encryptedColumns[field.Column] {
+			return true
+		}
+	}
+	return false
+}
+
+// Cursor marks where a page of users ended, by the last user's values for
+// each column of the page's order. Clients only ever see it encoded, so what
+// it holds can change without breaking them.
+type Cursor struct {
+	// Sort is the sort the page was listed with; the next page must use it
+	Sort string   `json:"sort,omitempty"`
+	Keys []string `json:"keys"`
+}
+
+// Returns the cursor resuming a listing in fields' order after u
+func CursorAfter(u User, fields []SortField) *Cursor {
+	order := sortOrder(fields)
+
+	c := &Cursor{Sort: FormatSort(fields), Keys: make([]string, len(order))}
+	for i, field := range order {
+		c.Keys[i] = sortKey(u, field.Column)
+	}
+
+	return c
+}
+
+func (c *Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decodes a cursor from Cursor.Encode. Whether it fits the sort it's used
+// with is checked with the rest of the list options.
+func DecodeCursor(value string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil || len(c.Keys) == 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// The cursor's keys as values to compare against the columns of order
+func (c *Cursor) values(order []SortField) ([]interface{}, error) {
+	if len(c.Keys) != len(order) {
+		return nil, ErrInvalidCursor
+	}
+
+	values := make([]interface{}, len(order))
+	for i, field := range order {
+		switch field.Column {
+		case "user_id":
+			id, err := strconv.ParseInt(c.Keys[i], 10, 64)
+			if err != nil {
+				return nil, ErrInvalidCursor
+			}
+			values[i] = id
+		case "created_at", "updated_at":
+			t, err := time.Parse(cursorTimeFormat, c.Keys[i])
+			if err != nil {
+				return nil, ErrInvalidCursor
+			}
+			values[i] = t
+		default:
+			values[i] = c.Keys[i]
+		}
+	}
+
+	return values, nil
+}
+
+// A user's value for a sort column, as it's kept in a cursor
+func sortKey(u User, column string) string {
+	switch column {
+	case "user_id":
+		return strconv.FormatInt(u.ID, 10)
+	case "user_name":
+		return u.UserName
+	case "first_name":
+		return u.FirstName
+	case "last_name":
+		return u.LastName
+	case "email":
+		return u.Email
+	case "user_status":
+		return u.UserStatus
+	case "department":
+		if u.Department == nil {
+			return ""
+		}
+		return *u.Department
+	case "created_at":
+		return u.CreatedAt.UTC().Format(cursorTimeFormat)
+	case "updated_at":
+		return u.UpdatedAt.UTC().Format(cursorTimeFormat)
+	}
+	return ""
+}
+
+// Compares two users' keys for a sort column
+func compareSortKeys(column string, a, b string) int {
+	if column == "user_id" {
+		x, _ := strconv.ParseInt(a, 10, 64)
+		y, _ := strconv.ParseInt(b, 10, 64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(a, b)
+}
+
+// Compares users by a list's full order
+func compareUsers(a, b User, order []SortField) int {
+	for _, field := range order {
+		c := compareSortKeys(field.Column, sortKey(a, field.Column), sortKey(b, field.Column))
+		if field.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Reports whether u comes after the cursor in a list's full order
+func afterCursor(u User, c *Cursor, order []SortField) bool {
+	for i, field := range order {
+		cmp := compareSortKeys(field.Column, sortKey(u, field.Column), c.Keys[i])
+		if field.Desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp > 0
+		}
+	}
+	return false
+}
+
+// Checks the filters and page of a list request. A zero Limit lists every
+// user.
+func validateListOptions(opts ListOptions) error {
+	if opts.Limit < 0 || opts.Limit > MaxPageLimit {
+		return ErrInvalidPageLimit
+	}
+
+	if opts.UserStatus != "" && opts.UserStatus != "A" && opts.UserStatus != "I" && opts.UserStatus != "T" {
+		return ErrInvalidStatus
+	}
+
+	if opts.EmailDomain != "" && !validEmailDomain(opts.EmailDomain) {
+		return ErrInvalidEmailDomain
+	}
+
+	if opts.After != nil {
+		if opts.After.Sort != FormatSort(opts.Sort) {
+			return ErrInvalidCursor
+		}
+
+		if _, err := opts.After.values(sortOrder(opts.Sort)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A domain as it follows the `@` of an email the users_email_check
+// constraint allows
+func validEmailDomain(domain string) bool {
+	return validEmail("x@" + domain)
+}
+
+// Escapes the wildcards of a LIKE pattern, for use with ESCAPE '\'
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
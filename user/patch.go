@@ -0,0 +1,115 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Media type of a JSON Merge Patch (RFC 7396)
+const MergePatchType = "application/merge-patch+json"
+
+// Fields the store sets, which a patch can't change and are left out of it
+var readOnlyFields = []string{"created_at", "updated_at", "deleted_at"}
+
+// Fields every user has, which a patch can't clear
+var nonNullableFields = []string{"user_name", "first_name", "last_name", "email", "user_status"}
+
+// Applies a JSON Merge Patch to u and returns the patched user, unvalidated.
+// A `null` clears a field and fields the patch leaves out keep their value;
+// only department can be cleared, and `user_id` may only be given as u's own
+// ID.
+func (u User) ApplyMergePatch(patch []byte) (*User, error) {
+	var changes map[string]interface{}
+	if err := json.Unmarshal(patch, &changes); err != nil || changes == nil {
+		return nil, ErrInvalidPatch
+	}
+
+	if id, ok := changes["user_id"]; ok {
+		if number, isNumber := id.(float64); !isNumber || int64(number) != u.ID {
+			return nil, ErrPatchUserID
+		}
+	}
+
+	for _, field := range nonNullableFields {
+		if value, ok := changes[field]; ok && value == nil {
+			return nil, &ValidationError{Field: field, Message: "invalid " + field + ": can't be null"}
+		}
+	}
+
+	for _, field := range readOnlyFields {
+		delete(changes, field)
+	}
+
+	original, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(original, &doc); err != nil {
+		return nil, err
+	}
+
+	patched, err := json.Marshal(mergePatch(doc, changes))
+	if err != nil {
+		return nil, err
+	}
+
+	result := User{}
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, patchFieldError(err)
+	}
+
+	// Not part of the JSON, so carried over from u
+	result.ID = u.ID
+	result.Version = u.Version
+	result.CreatedAt = u.CreatedAt
+	result.UpdatedAt = u.UpdatedAt
+	result.DeletedAt = u.DeletedAt
+
+	return &result, nil
+}
+
+// Merges patch into target as RFC 7396 describes: objects merge key by key,
+// a null removes the key and anything else replaces it
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	changes, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	doc, ok := target.(map[string]interface{})
+	if !ok {
+		doc = make(map[string]interface{})
+	}
+
+	for key, value := range changes {
+		if value == nil {
+			delete(doc, key)
+		} else {
+			doc[key] = mergePatch(doc[key], value)
+		}
+	}
+
+	return doc
+}
+
+// Names the field a patched user couldn't be decoded into
+func patchFieldError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return &ValidationError{Field: typeErr.Field, Message: "invalid " + typeErr.Field + ": must be a " + typeErr.Type.String()}
+	}
+
+	// encoding/json has no typed error for unknown fields
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field = strings.Trim(field, `"`)
+		return &ValidationError{Field: field, Message: "invalid " + field + ": not a user field"}
+	}
+
+	return ErrInvalidPatch
+}
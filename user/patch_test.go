@@ -0,0 +1,232 @@
+package user_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/steveperjesi/integra-demo/internal/db"
+	. "github.com/steveperjesi/integra-demo/user"
+)
+
+var _ = Describe("ApplyMergePatch", func() {
+	current := User{
+		ID:         7,
+		UserName:   "jdoe",
+		FirstName:  "John",
+		LastName:   "Doe",
+		Email:      "jdoe@example.com",
+		UserStatus: "A",
+		Department: ptr("Engineering"),
+		Version:    3,
+	}
+
+	It("changes the fields given, clears those set to null and keeps the rest", func() {
+		patched, err := current.ApplyMergePatch([]byte(`{"first_name":"Jon","department":null}`))
+		Expect(err).To(BeNil())
+		Expect(patched.FirstName).To(Equal("Jon"))
+		Expect(patched.Department).To(BeNil())
+		Expect(patched.LastName).To(Equal("Doe"))
+		Expect(patched.ID).To(Equal(int64(7)))
+		Expect(patched.Version).To(Equal(int64(3)))
+	})
+
+	It("ignores the timestamps the store sets", func() {
+		patched, err := current.ApplyMergePatch([]byte(`{"created_at":"2001-01-01T00:00:00Z","deleted_at":"2001-01-01T00:00:00Z"}`))
+		Expect(err).To(BeNil())
+		Expect(patched.CreatedAt).To(Equal(current.CreatedAt))
+		Expect(patched.DeletedAt).To(BeNil())
+	})
+
+	It("allows the user's own user_id but not another", func() {
+		_, err := current.ApplyMergePatch([]byte(`{"user_id":7,"last_name":"Dough"}`))
+		Expect(err).To(BeNil())
+
+		for _, patch := range []string{`{"user_id":8}`, `{"user_id":null}`, `{"user_id":"7"}`} {
+			_, err := current.ApplyMergePatch([]byte(patch))
+			Expect(err).To(Equal(ErrPatchUserID), patch)
+		}
+	})
+
+	It("rejects null for the fields every user has", func() {
+		for _, field := range []string{"user_name", "first_name", "last_name", "email", "user_status"} {
+			_, err := current.ApplyMergePatch([]byte(`{"` + field + `":null}`))
+			Expect(err).To(Equal(&ValidationError{Field: field, Message: "invalid " + field + ": can't be null"}), field)
+		}
+	})
+
+	It("rejects patches that aren't an object or don't fit a user", func() {
+		for _, patch := range []string{``, `null`, `[]`, `"jdoe"`, `{"user_name":`} {
+			_, err := current.ApplyMergePatch([]byte(patch))
+			Expect(err).To(Equal(ErrInvalidPatch), patch)
+		}
+
+		_, err := current.ApplyMergePatch([]byte(`{"email":5}`))
+		Expect(err).To(MatchError("invalid email: must be a string"))
+
+		_, err = current.ApplyMergePatch([]byte(`{"nickname":"jd"}`))
+		Expect(err).To(MatchError("invalid nickname: not a user field"))
+	})
+})
+
+// Patches and full replaces go through each repository's Replace
+var _ = Describe("Patch and Replace", func() {
+	for _, backend := range backends {
+		backend := backend
+
+		Describe(backend.name, func() {
+			var (
+				repo    Repository
+				service *UserService
+				created *User
+			)
+
+			BeforeEach(func() {
+				var closeRepo func()
+				repo, closeRepo = backend.open()
+				DeferCleanup(closeRepo)
+				service = &UserService{Repo: repo}
+
+				var err error
+				created, err = repo.Create(ctx, &User{
+					UserName:   "jdoe",
+					FirstName:  "John",
+					LastName:   "Doe",
+					Email:      "jdoe@example.com",
+					UserStatus: "A",
+					Department: ptr("Engineering"),
+				}, "tester")
+				Expect(err).To(BeNil())
+			})
+
+			It("clears department with null and leaves absent fields alone", func() {
+				patched, err := service.Patch(ctx, created.ID, []byte(`{"department":null,"email":"John.Doe@Example.com"}`), Precondition{}, "tester")
+				Expect(err).To(BeNil())
+				Expect(patched.Department).To(BeNil())
+				Expect(patched.Email).To(Equal("john.doe@example.com"))
+				Expect(patched.FirstName).To(Equal("John"))
+				Expect(patched.Version).To(Equal(created.Version + 1))
+
+				found, err := repo.Get(ctx, created.ID, GetOptions{})
+				Expect(err).To(BeNil())
+				Expect(found.Department).To(BeNil())
+
+				// An empty department is kept, unlike a cleared one
+				patched, err = service.Patch(ctx, created.ID, []byte(`{"department":""}`), Precondition{}, "tester")
+				Expect(err).To(BeNil())
+				Expect(patched.Department).To(Equal(ptr("")))
+			})
+
+			It("validates the patched user as a new one", func() {
+				for patch, want := range map[string]error{
+					`{"last_name":""}`:      ErrMissingLastName,
+					`{"first_name":"  "}`:   ErrMissingFirstName,
+					`{"email":"not-email"}`: ErrInvalidEmail,
+					`{"user_status":"X"}`:   ErrInvalidStatus,
+					`{"user_status":null}`:  &ValidationError{Field: "user_status", Message: "invalid user_status: can't be null"},
+				} {
+					_, err := service.Patch(ctx, created.ID, []byte(patch), Precondition{}, "tester")
+					Expect(err).To(Equal(want), patch)
+				}
+
+				found, err := repo.Get(ctx, created.ID, GetOptions{})
+				Expect(err).To(BeNil())
+				Expect(found.Version).To(Equal(created.Version))
+			})
+
+			It("rejects a taken email, a stale If-Match and a deleted user", func() {
+				_, err := repo.Create(ctx, &User{UserName: "asmith", FirstName: "Alice", LastName: "Smith", Email: "asmith@example.com", UserStatus: "A"}, "tester")
+				Expect(err).To(BeNil())
+
+				_, err = service.Patch(ctx, created.ID, []byte(`{"email":"ASmith@example.com"}`), Precondition{}, "tester")
+				Expect(err).To(Equal(ErrEmailExists))
+
+				_, err = service.Patch(ctx, created.ID, []byte(`{"user_status":"i"}`), Precondition{Version: created.Version + 1, Given: true}, "tester")
+				Expect(err).To(Equal(ErrVersionMismatch))
+
+				Expect(repo.Delete(ctx, created.ID, 0, "tester")).To(Succeed())
+				_, err = service.Patch(ctx, created.ID, []byte(`{"user_status":"i"}`), Precondition{}, "tester")
+				Expect(err).To(Equal(ErrUserNotFound))
+			})
+
+			It("replaces every field, clearing those left out", func() {
+				replaced, err := service.Replace(ctx, created.ID, &User{
+					UserName:  "jdoe",
+					FirstName: "Jon",
+					LastName:  "Doe",
+					Email:     "jdoe@example.com",
+				}, Precondition{Version: created.Version, Given: true}, "tester")
+				Expect(err).To(BeNil())
+				Expect(replaced.ID).To(Equal(created.ID))
+				Expect(replaced.FirstName).To(Equal("Jon"))
+				Expect(replaced.Department).To(BeNil())
+				Expect(replaced.UserStatus).To(Equal("I"))
+				Expect(replaced.CreatedAt).To(Equal(created.CreatedAt))
+
+				_, err = service.Replace(ctx, created.ID, &User{ID: created.ID, UserName: "jdoe"}, Precondition{}, "tester")
+				Expect(err).To(Equal(ErrMissingFirstName))
+
+				_, err = service.Replace(ctx, 99, &User{UserName: "x", FirstName: "X", LastName: "X", Email: "x@example.com"}, Precondition{}, "tester")
+				Expect(err).To(Equal(ErrUserNotFound))
+			})
+		})
+	}
+})
+
+var _ = Describe("UserService.Replace", func() {
+	It("rejects a body user_id that conflicts with the path before writing", func() {
+		service := &UserService{Repo: &MockRepository{}}
+
+		_, err := service.Replace(ctx, 1, &User{ID: 2, UserName: "jdoe"}, Precondition{}, "tester")
+		Expect(err).To(Equal(ErrUserIDMismatch))
+	})
+
+	It("passes the If-Match version to the repository", func() {
+		var gotVersion int64
+		repo := &MockRepository{
+			ReplaceFunc: func(ctx context.Context, u *User, expectedVersion int64, actor string) (*User, error) {
+				gotVersion = expectedVersion
+				return u, nil
+			},
+		}
+
+		service := &UserService{Repo: repo}
+		replaced, err := service.Replace(ctx, 1, &User{UserName: "jdoe", FirstName: "John", LastName: "Doe", Email: "jdoe@example.com", UserStatus: "a"}, Precondition{Version: 5, Given: true}, "tester")
+		Expect(err).To(BeNil())
+		Expect(gotVersion).To(Equal(int64(5)))
+		Expect(replaced.ID).To(Equal(int64(1)))
+		Expect(replaced.UserStatus).To(Equal("A"))
+	})
+})
+
+var _ = Describe("UserService.Patch", func() {
+	It("replaces the user at the version it read, so a concurrent write isn't lost", func() {
+		var gotVersion int64
+		var got *User
+		var fromPrimary bool
+		repo := &MockRepository{
+			GetFunc: func(ctx context.Context, id int64, opts GetOptions) (*User, error) {
+				fromPrimary = db.PrimaryRequested(ctx)
+				return &User{ID: id, UserName: "jdoe", FirstName: "John", LastName: "Doe", Email: "jdoe@example.com", UserStatus: "A", Version: 4}, nil
+			},
+			ReplaceFunc: func(ctx context.Context, u *User, expectedVersion int64, actor string) (*User, error) {
+				got, gotVersion = u, expectedVersion
+				return nil, ErrVersionMismatch
+			},
+		}
+
+		service := &UserService{Repo: repo}
+		_, err := service.Patch(ctx, 1, []byte(`{"user_status":"t"}`), Precondition{}, "tester")
+		Expect(err).To(Equal(ErrVersionMismatch))
+		Expect(fromPrimary).To(BeTrue())
+		Expect(gotVersion).To(Equal(int64(4)))
+		Expect(got.UserStatus).To(Equal("T"))
+	})
+
+	It("requires a precondition when configured", func() {
+		service := &UserService{Repo: &MockRepository{}, RequireIfMatch: true}
+
+		_, err := service.Patch(ctx, 1, []byte(`{}`), Precondition{}, "tester")
+		Expect(err).To(Equal(ErrPreconditionRequired))
+	})
+})
@@ -0,0 +1,206 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sink is where the relay delivers outbox events. Delivery is at least
+// once: an event can arrive again after a crash or a timed out attempt, so
+// sinks should dedupe on Event.ID.
+type Sink interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// SinkFunc adapts a function to a Sink
+type SinkFunc func(ctx context.Context, event Event) error
+
+func (f SinkFunc) Publish(ctx context.Context, event Event) error {
+	return f(ctx, event)
+}
+
+// LogSink writes a line to the log for each event. It is the default when
+// no other sink is configured. Only the names of the changed fields are
+// logged, never the user or the values, so no PII reaches the log.
+type LogSink struct{}
+
+func (LogSink) Publish(ctx context.Context, event Event) error {
+	fields := make([]string, 0, len(event.Changes))
+	for name := range event.Changes {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+
+	log.Printf("user event: event_id=%d type=%s user_id=%d actor=%q changed=%s",
+		event.ID, event.Type, event.UserID, event.Actor, strings.Join(fields, ","))
+	return nil
+}
+
+// WebhookSink POSTs each event as JSON to URL. Any status other than 2xx
+// fails the attempt.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *WebhookSink) Publish(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", strconv.FormatInt(event.ID, 10))
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// RelayConfig tunes a Relay. Start from DefaultRelayConfig.
+type RelayConfig struct {
+	// How long to wait before looking for new events when the outbox is
+	// drained
+	PollInterval time.Duration
+	// Events claimed at a time
+	BatchSize int
+	// Attempts before an event is dead-lettered
+	MaxAttempts int
+	// Retries back off exponentially from MinBackoff, up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// How long a claimed event is held for this relay. An attempt that takes
+	// longer is canceled, and the event becomes due again for any relay.
+	Lease time.Duration
+}
+
+func DefaultRelayConfig() RelayConfig {
+	return RelayConfig{
+		PollInterval: time.Second,
+		BatchSize:    100,
+		MaxAttempts:  10,
+		MinBackoff:   time.Second,
+		MaxBackoff:   5 * time.Minute,
+		Lease:        time.Minute,
+	}
+}
+
+// Backoff returns how long to wait after the given number of failed
+// attempts: MinBackoff, doubling each time, capped at MaxBackoff
+func (c RelayConfig) Backoff(attempts int) time.Duration {
+	backoff := c.MinBackoff
+	for i := 1; i < attempts && backoff < c.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > c.MaxBackoff {
+		return c.MaxBackoff
+	}
+
+	return backoff
+}
+
+// Relay delivers outbox events to a sink. Several relays may share one
+// database; each event is claimed by one of them at a time.
+type Relay struct {
+	store  OutboxStore
+	sink   Sink
+	config RelayConfig
+}
+
+func NewRelay(store OutboxStore, sink Sink, config RelayConfig) *Relay {
+	return &Relay{store: store, sink: sink, config: config}
+}
+
+// Run delivers events until ctx is done
+func (r *Relay) Run(ctx context.Context) {
+	for {
+		claimed, err := r.RelayOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Print("outbox relay failure: ", err)
+		}
+
+		// A full batch means more are probably waiting
+		if err == nil && claimed == r.config.BatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.config.PollInterval):
+		}
+	}
+}
+
+// RelayOnce claims one batch of due events and tries to deliver each of
+// them, returning how many were claimed. Failed attempts are scheduled for
+// a retry, or dead-lettered once MaxAttempts is reached.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	events, err := r.store.ClaimEvents(ctx, r.config.BatchSize, r.config.Lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, event := range events {
+		if err := r.deliver(ctx, event); err != nil {
+			if ctx.Err() != nil {
+				return len(events), ctx.Err()
+			}
+			// The event's lease runs out and it is tried again
+			log.Printf("failed to record outbox event %d delivery: %v", event.ID, err)
+		}
+	}
+
+	return len(events), nil
+}
+
+func (r *Relay) deliver(ctx context.Context, event OutboxEvent) error {
+	publishCtx, cancel := context.WithTimeout(ctx, r.config.Lease)
+	publishErr := r.sink.Publish(publishCtx, event.Event)
+	cancel()
+
+	if publishErr == nil {
+		return r.store.MarkDelivered(ctx, event.ID)
+	}
+
+	// Shutting down isn't the sink's fault; the lease runs out and the
+	// event is retried without counting the attempt
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	attempts := event.Attempts + 1
+	if attempts >= r.config.MaxAttempts {
+		log.Printf("outbox event %d dead-lettered after %d attempts: %v", event.ID, attempts, publishErr)
+		return r.store.MarkDead(ctx, event.ID, publishErr.Error())
+	}
+
+	retryAt := time.Now().Add(r.config.Backoff(attempts))
+	return r.store.MarkFailed(ctx, event.ID, publishErr.Error(), retryAt)
+}
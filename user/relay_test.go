@@ -0,0 +1,204 @@
+package user_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/steveperjesi/integra-demo/user"
+)
+
+var _ = Describe("Relay", func() {
+	var (
+		repo      *MemoryRepository
+		config    RelayConfig
+		published []Event
+		failing   error
+		sink      Sink
+	)
+
+	BeforeEach(func() {
+		repo = NewMemoryRepository()
+		config = DefaultRelayConfig()
+		published = nil
+		failing = nil
+		sink = SinkFunc(func(ctx context.Context, event Event) error {
+			if failing != nil {
+				return failing
+			}
+			published = append(published, event)
+			return nil
+		})
+	})
+
+	It("delivers each user's events in order", func() {
+		jdoe, _ := repo.Create(ctx, &User{UserName: "jdoe", Email: "jdoe@example.com"}, "tester")
+		repo.Update(ctx, &User{ID: jdoe.ID, UserStatus: "T"}, 0, "tester")
+		repo.Create(ctx, &User{UserName: "asmith", Email: "a@example.com"}, "tester")
+
+		relay := NewRelay(repo, sink, config)
+
+		claimed, err := relay.RelayOnce(ctx)
+		Expect(err).To(BeNil())
+		Expect(claimed).To(Equal(2))
+
+		claimed, err = relay.RelayOnce(ctx)
+		Expect(err).To(BeNil())
+		Expect(claimed).To(Equal(1))
+
+		Expect(published).To(HaveLen(3))
+		Expect(published[0].Type).To(Equal(EventUserCreated))
+		Expect(published[1].UserID).ToNot(Equal(jdoe.ID))
+		Expect(published[2].Type).To(Equal(EventUserDeactivated))
+
+		pending, _ := repo.Events(ctx, OutboxOptions{Status: EventPending})
+		Expect(pending).To(BeEmpty())
+	})
+
+	It("retries a failed delivery with backoff", func() {
+		repo.Create(ctx, &User{UserName: "jdoe"}, "tester")
+		failing = errors.New("sink down")
+
+		before := time.Now()
+		claimed, err := NewRelay(repo, sink, config).RelayOnce(ctx)
+		Expect(err).To(BeNil())
+		Expect(claimed).To(Equal(1))
+
+		events, _ := repo.Events(ctx, OutboxOptions{})
+		Expect(events[0].Status).To(Equal(EventPending))
+		Expect(events[0].Attempts).To(Equal(1))
+		Expect(*events[0].LastError).To(Equal("sink down"))
+		Expect(events[0].NextAttemptAt).To(BeTemporally(">=", before.Add(config.MinBackoff)))
+
+		// Not due again until the backoff has passed
+		claimed, err = NewRelay(repo, sink, config).RelayOnce(ctx)
+		Expect(err).To(BeNil())
+		Expect(claimed).To(BeZero())
+	})
+
+	It("dead-letters an event after MaxAttempts", func() {
+		repo.Create(ctx, &User{UserName: "jdoe"}, "tester")
+		failing = errors.New("rejected")
+
+		config.MaxAttempts = 2
+		config.MinBackoff = -time.Second
+		config.MaxBackoff = -time.Second
+		relay := NewRelay(repo, sink, config)
+
+		relay.RelayOnce(ctx)
+		relay.RelayOnce(ctx)
+
+		dead, _ := repo.Events(ctx, OutboxOptions{Status: EventDead})
+		Expect(dead).To(HaveLen(1))
+		Expect(dead[0].Attempts).To(Equal(2))
+
+		claimed, err := relay.RelayOnce(ctx)
+		Expect(err).To(BeNil())
+		Expect(claimed).To(BeZero())
+	})
+
+	It("leaves an event pending when it is stopped mid-delivery", func() {
+		repo.Create(ctx, &User{UserName: "jdoe"}, "tester")
+
+		stopCtx, stop := context.WithCancel(ctx)
+		blocking := SinkFunc(func(ctx context.Context, event Event) error {
+			stop()
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		_, err := NewRelay(repo, blocking, config).RelayOnce(stopCtx)
+		Expect(err).To(MatchError(context.Canceled))
+
+		events, _ := repo.Events(ctx, OutboxOptions{})
+		Expect(events[0].Status).To(Equal(EventPending))
+		Expect(events[0].Attempts).To(BeZero())
+	})
+
+	It("runs until the context is done", func() {
+		repo.Create(ctx, &User{UserName: "jdoe"}, "tester")
+
+		delivered := make(chan Event, 1)
+		config.PollInterval = time.Millisecond
+
+		runCtx, stop := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			NewRelay(repo, SinkFunc(func(ctx context.Context, event Event) error {
+				delivered <- event
+				return nil
+			}), config).Run(runCtx)
+		}()
+
+		Eventually(delivered).Should(Receive())
+		stop()
+		Eventually(done).Should(BeClosed())
+	})
+})
+
+var _ = Describe("RelayConfig.Backoff", func() {
+	It("doubles from MinBackoff up to MaxBackoff", func() {
+		config := RelayConfig{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+		Expect(config.Backoff(1)).To(Equal(time.Second))
+		Expect(config.Backoff(2)).To(Equal(2 * time.Second))
+		Expect(config.Backoff(4)).To(Equal(8 * time.Second))
+		Expect(config.Backoff(5)).To(Equal(10 * time.Second))
+		Expect(config.Backoff(100)).To(Equal(10 * time.Second))
+	})
+})
+
+var _ = Describe("LogSink", func() {
+	It("logs what changed without the user or the values", func() {
+		var out bytes.Buffer
+		log.SetOutput(&out)
+		DeferCleanup(func() { log.SetOutput(os.Stderr) })
+
+		err := LogSink{}.Publish(ctx, Event{
+			ID:      3,
+			Type:    EventUserUpdated,
+			UserID:  7,
+			Actor:   "tester",
+			User:    &User{ID: 7, UserName: "jdoe", FirstName: "Jon", Email: "jon.doe@example.com"},
+			Changes: map[string]FieldChange{"first_name": {Before: ptr("John"), After: ptr("Jon")}, "email": {Before: ptr("jdoe@example.com"), After: ptr("jon.doe@example.com")}},
+		})
+		Expect(err).To(BeNil())
+		Expect(out.String()).To(ContainSubstring(`event_id=3 type=user.updated user_id=7 actor="tester" changed=email,first_name`))
+		Expect(out.String()).NotTo(ContainSubstring("Jon"))
+		Expect(out.String()).NotTo(ContainSubstring("example.com"))
+	})
+})
+
+var _ = Describe("WebhookSink", func() {
+	It("posts the event and fails on a non-2xx response", func() {
+		status := http.StatusAccepted
+		var received Event
+		var eventID string
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			eventID = r.Header.Get("X-Event-ID")
+			json.NewDecoder(r.Body).Decode(&received)
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+
+		sink := &WebhookSink{URL: server.URL}
+		event := Event{ID: 7, Type: EventUserCreated, UserID: 1}
+
+		Expect(sink.Publish(ctx, event)).To(Succeed())
+		Expect(eventID).To(Equal("7"))
+		Expect(received.Type).To(Equal(EventUserCreated))
+
+		status = http.StatusServiceUnavailable
+		Expect(sink.Publish(ctx, event)).To(MatchError("webhook responded 503 Service Unavailable"))
+	})
+})
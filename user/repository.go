@@ -0,0 +1,86 @@
+package user
+
+import (
+	"context"
+	"time"
+)
+
+// Repository is the storage backend behind UserService. The SQL backends
+// pass ctx down to the database, so deadlines and cancellation stop queries.
+type Repository interface {
+	Get(ctx context.Context, id int64, opts GetOptions) (*User, error)
+	// List and Stream return users in the order of ListOptions.Sort
+	List(ctx context.Context, opts ListOptions) ([]User, error)
+	// Stream calls fn with each user List would return, as they are read,
+	// instead of collecting them first. It stops at the first error,
+	// including one from fn, and returns it.
+	Stream(ctx context.Context, opts ListOptions, fn func(User) error) error
+	// Count returns how many users List would return without After and
+	// Limit
+	Count(ctx context.Context, opts ListOptions) (int64, error)
+	// Search ranks live users by how well they match a validated search,
+	// best first. Results come without highlights.
+	Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error)
+	// Writes record an audit entry for actor in the same transaction as the
+	// change
+	Create(ctx context.Context, u *User, actor string) (*User, error)
+	// Update and Delete only apply when the row is still at expectedVersion,
+	// returning ErrVersionMismatch otherwise. Zero skips the check.
+	Update(ctx context.Context, u *User, expectedVersion int64, actor string) (*User, error)
+	// Replace sets every field Update would, including empty values and a
+	// nil Department, and checks expectedVersion the same way. A missing or
+	// deleted user is ErrUserNotFound.
+	Replace(ctx context.Context, u *User, expectedVersion int64, actor string) (*User, error)
+	// Delete soft deletes; Purge removes the row for good
+	Delete(ctx context.Context, id int64, expectedVersion int64, actor string) error
+	Restore(ctx context.Context, id int64, actor string) (*User, error)
+	Purge(ctx context.Context, id int64, actor string) error
+	ExistsByUserName(ctx context.Context, userName string) (bool, error)
+	// History returns a user's audit trail, newest first
+	History(ctx context.Context, userID int64, opts HistoryOptions) ([]AuditEntry, error)
+}
+
+type GetOptions struct {
+	// IncludeDeleted also finds soft-deleted users
+	IncludeDeleted bool
+	// AsOf reads the user as it was at that instant. A user that was soft
+	// deleted then counts as deleted.
+	AsOf *time.Time
+}
+
+// ListOptions narrows the users returned by Repository.List
+type ListOptions struct {
+	// IncludeDeleted also returns soft-deleted users
+	IncludeDeleted bool
+	// Time filters are exclusive; nil doesn't filter
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	UpdatedAfter  *time.Time
+	UpdatedBefore *time.Time
+	// AsOf lists users as they were at that instant; the other options
+	// apply to those versions
+	AsOf *time.Time
+	// Filters on user_status, department, the domain of email and the
+	// start of user_name; empty doesn't filter. A Department pointing at ""
+	// matches users without one. UserNamePrefix ignores case.
+	UserStatus     string
+	Department     *string
+	EmailDomain    string
+	UserNamePrefix string
+	// Sort orders the users, then by user_id; nil orders by user_id alone
+	Sort []SortField
+	// After resumes a listing past the cursor, which must come from a page
+	// with the same Sort; nil starts at the beginning
+	After *Cursor
+	// Limit caps the number of users returned; zero returns them all
+	Limit int
+}
+
+// VersionStore holds the earlier versions of users that AsOf reads from.
+// Both repositories keep one, written in the same transaction as every
+// change.
+type VersionStore interface {
+	// PruneVersions drops the versions that stopped being current before
+	// cutoff, returning how many were dropped
+	PruneVersions(ctx context.Context, cutoff time.Time) (int64, error)
+}
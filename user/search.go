@@ -0,0 +1,227 @@
+package user
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Results for searches that don't ask for a number
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+	// Longest q a search takes, in characters
+	MaxSearchQuery = 100
+)
+
+// Fields a search matches against, in the order highlights are made
+var searchFields = []string{"user_name", "first_name", "last_name", "email"}
+
+// Fields a search matches against when first_name, last_name and email are
+// encrypted. Ciphertext can't be matched in SQL, and scoring it in the
+// application would mean decrypting every user.
+var plainSearchFields = []string{"user_name"}
+
+// Word similarity a field needs to match a search without containing q.
+// pg_trgm's default of 0.6 misses one-letter typos in short names.
+const searchThreshold = 0.3
+
+// Wraps the part of a field that matched a search
+const (
+	highlightStart = "<em>"
+	highlightEnd   = "</em>"
+)
+
+// SearchResult is a user matching a search, with how well it matched
+type SearchResult struct {
+	User User `json:"user"`
+	// Score is the best word similarity of q to any of the fields
+	// searched, from 0 to 1
+	Score float64 `json:"score"`
+	// Highlights holds each matching field HTML escaped, with the
+	// stretch it shares with q wrapped in <em>
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+type SearchOptions struct {
+	// Query is matched fuzzily against user_name, first_name, last_name
+	// and email, or only user_name when they are encrypted
+	Query string
+	Limit int
+}
+
+// Checks a search and normalizes its query
+func (opts *SearchOptions) Validate() error {
+	opts.Query = normalizedKey(opts.Query)
+
+	if opts.Query == "" || utf8.RuneCountInString(opts.Query) > MaxSearchQuery {
+		return ErrInvalidSearchQuery
+	}
+
+	if opts.Limit < 1 || opts.Limit > MaxSearchLimit {
+		return ErrInvalidSearchLimit
+	}
+
+	return nil
+}
+
+// Ranks users against a search in the application, for backends without
+// trigram indexes
+type searchRanking struct {
+	query   string
+	fields  []string
+	results []SearchResult
+}
+
+func (r *searchRanking) add(u User) error {
+	if score, ok := scoreUser(u, r.query, r.fields); ok {
+		r.results = append(r.results, SearchResult{User: u, Score: score})
+	}
+	return nil
+}
+
+// The best results, highest score first
+func (r *searchRanking) top(limit int) []SearchResult {
+	sort.SliceStable(r.results, func(i, j int) bool {
+		if r.results[i].Score != r.results[j].Score {
+			return r.results[i].Score > r.results[j].Score
+		}
+		return r.results[i].User.ID < r.results[j].User.ID
+	})
+
+	if len(r.results) > limit {
+		r.results = r.results[:limit]
+	}
+
+	return r.results
+}
+
+// Scores u against query as the Postgres search does: the best word
+// similarity of any of fields, which matches when it reaches searchThreshold
+// or the field contains query
+func scoreUser(u User, query string, fields []string) (float64, bool) {
+	var best float64
+	var matched bool
+
+	for _, field := range fields {
+		value := strings.ToLower(searchValue(u, field))
+
+		score := wordSimilarity(query, value)
+		if score > best {
+			best = score
+		}
+
+		if score >= searchThreshold || strings.Contains(value, query) {
+			matched = true
+		}
+	}
+
+	return best, matched
+}
+
+func searchValue(u User, field string) string {
+	switch field {
+	case "user_name":
+		return u.UserName
+	case "first_name":
+		return u.FirstName
+	case "last_name":
+		return u.LastName
+	case "email":
+		return u.Email
+	}
+	return ""
+}
+
+// The share of query's trigrams found in value. pg_trgm's word_similarity
+// only counts the trigrams of value's best matching stretch; for the short
+// fields searched the two rarely differ.
+func wordSimilarity(query, value string) float64 {
+	wanted := trigrams(query)
+	if len(wanted) == 0 {
+		return 0
+	}
+
+	have := trigrams(value)
+
+	var shared int
+	for t := range wanted {
+		if have[t] {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(wanted))
+}
+
+// Splits s into trigrams the way pg_trgm does: each alphanumeric word is
+// padded with two spaces before and one after
+func trigrams(s string) map[string]bool {
+	set := make(map[string]bool)
+
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for _, word := range words {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+
+	return set
+}
+
+// Highlights the longest stretch each searched field of u shares with
+// query, for the fields sharing at least two characters
+func highlights(u User, query string) map[string]string {
+	marked := make(map[string]string)
+
+	for _, field := range searchFields {
+		value := []rune(searchValue(u, field))
+
+		start, end := longestCommon(value, []rune(query))
+		if end-start < 2 {
+			continue
+		}
+
+		marked[field] = html.EscapeString(string(value[:start])) +
+			highlightStart + html.EscapeString(string(value[start:end])) + highlightEnd +
+			html.EscapeString(string(value[end:]))
+	}
+
+	if len(marked) == 0 {
+		return nil
+	}
+
+	return marked
+}
+
+// Finds the longest run of value that appears in query ignoring case,
+// returning where it starts and ends in value
+func longestCommon(value, query []rune) (int, int) {
+	var bestStart, bestEnd int
+
+	// lengths[j] is how long a common run ends at the current rune of value
+	// and rune j-1 of query
+	lengths := make([]int, len(query)+1)
+
+	for i := range value {
+		for j := len(query); j > 0; j-- {
+			if unicode.ToLower(value[i]) != unicode.ToLower(query[j-1]) {
+				lengths[j] = 0
+				continue
+			}
+
+			lengths[j] = lengths[j-1] + 1
+			if lengths[j] > bestEnd-bestStart {
+				bestStart, bestEnd = i+1-lengths[j], i+1
+			}
+		}
+	}
+
+	return bestStart, bestEnd
+}
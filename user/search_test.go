@@ -0,0 +1,133 @@
+package user_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/steveperjesi/integra-demo/user"
+)
+
+// Backends without pg_trgm score searches in the application, the same way
+// as Postgres does
+var _ = Describe("Search fallback", func() {
+	for _, backend := range backends {
+		backend := backend
+
+		Describe(backend.name, func() {
+			var (
+				repo    Repository
+				service *UserService
+			)
+
+			BeforeEach(func() {
+				var closeRepo func()
+				repo, closeRepo = backend.open()
+				DeferCleanup(closeRepo)
+				service = &UserService{Repo: repo}
+
+				createListFixtures(repo)
+			})
+
+			if backend.encrypted {
+				It("matches only user_name, the one field stored in plaintext", func() {
+					results, err := service.Search(ctx, SearchOptions{Query: "Smtih", Limit: 10})
+					Expect(err).To(BeNil())
+					Expect(searchedIDs(results)).To(Equal([]int64{2}))
+
+					// John and Jones are only named in their encrypted fields
+					results, err = service.Search(ctx, SearchOptions{Query: "jonh", Limit: 10})
+					Expect(err).To(BeNil())
+					Expect(results).To(BeEmpty())
+				})
+			} else {
+				It("ranks misspelled and partial matches, best first", func() {
+					results, err := service.Search(ctx, SearchOptions{Query: "Smtih", Limit: 10})
+					Expect(err).To(BeNil())
+					Expect(searchedIDs(results)).To(Equal([]int64{2, 3, 5}))
+
+					// Jones shares more of "jonh" than John does
+					results, err = service.Search(ctx, SearchOptions{Query: "jonh", Limit: 10})
+					Expect(err).To(BeNil())
+					Expect(searchedIDs(results)).To(Equal([]int64{4, 1}))
+					Expect(results[0].Score).To(BeNumerically("~", 0.6, 0.001))
+					Expect(results[1].Score).To(BeNumerically("~", 0.4, 0.001))
+					Expect(results[1].Highlights["first_name"]).To(Equal("<em>Jo</em>hn"))
+
+					// Every example.com address shares some of it too
+					results, err = service.Search(ctx, SearchOptions{Query: "corp.exam", Limit: 2})
+					Expect(err).To(BeNil())
+					Expect(searchedIDs(results)).To(Equal([]int64{2, 5}))
+					Expect(results[0].Highlights["email"]).To(Equal("alice@<em>corp.exam</em>ple.org"))
+				})
+			}
+
+			It("leaves out deleted users and stops at the limit", func() {
+				Expect(repo.Delete(ctx, 3, 0, "tester")).To(Succeed())
+
+				results, err := service.Search(ctx, SearchOptions{Query: "smith", Limit: 1})
+				Expect(err).To(BeNil())
+				Expect(searchedIDs(results)).To(Equal([]int64{2}))
+			})
+
+			It("finds nothing for text no user resembles", func() {
+				results, err := service.Search(ctx, SearchOptions{Query: "zzyzx", Limit: 10})
+				Expect(err).To(BeNil())
+				Expect(results).To(BeEmpty())
+			})
+		})
+	}
+})
+
+var _ = Describe("UserService.Search", func() {
+	var (
+		repo    *MockRepository
+		service *UserService
+	)
+
+	BeforeEach(func() {
+		repo = &MockRepository{}
+		service = &UserService{Repo: repo}
+	})
+
+	It("normalizes q and highlights the stretch of each field it shares", func() {
+		var got SearchOptions
+		repo.SearchFunc = func(ctx context.Context, opts SearchOptions) ([]SearchResult, error) {
+			got = opts
+			return []SearchResult{{
+				User:  User{ID: 1, UserName: "<b>jdoe", FirstName: "John", LastName: "Doe", Email: "jdoe@example.com"},
+				Score: 0.75,
+			}}, nil
+		}
+
+		results, err := service.Search(ctx, SearchOptions{Query: "  JDOE ", Limit: 5})
+		Expect(err).To(BeNil())
+		Expect(got.Query).To(Equal("jdoe"))
+		Expect(results[0].Highlights).To(Equal(map[string]string{
+			"user_name": "&lt;b&gt;<em>jdoe</em>",
+			"last_name": "<em>Doe</em>",
+			"email":     "<em>jdoe</em>@example.com",
+		}))
+	})
+
+	It("rejects an empty or overlong q and a bad limit", func() {
+		for _, opts := range []SearchOptions{
+			{Query: " ", Limit: 5},
+			{Query: string(make([]rune, MaxSearchQuery+1)), Limit: 5},
+		} {
+			_, err := service.Search(ctx, opts)
+			Expect(err).To(Equal(ErrInvalidSearchQuery))
+		}
+
+		_, err := service.Search(ctx, SearchOptions{Query: "jdoe", Limit: MaxSearchLimit + 1})
+		Expect(err).To(Equal(ErrInvalidSearchLimit))
+	})
+})
+
+func searchedIDs(results []SearchResult) []int64 {
+	ids := []int64{}
+	for _, result := range results {
+		ids = append(ids, result.User.ID)
+	}
+	return ids
+}
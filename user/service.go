@@ -1,9 +1,16 @@
 package user
 
 import (
-	"database/sql"
+	"context"
+	"time"
 
-	"github.com/labstack/echo/v4"
+	"github.com/steveperjesi/integra-demo/internal/db"
+)
+
+const (
+	// Page size for history requests that don't set one
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 500
 )
 
 type User struct {
@@ -14,77 +21,198 @@ type User struct {
 	Email      string  `json:"email"`
 	UserStatus string  `json:"user_status"`
 	Department *string `json:"department,omitempty"`
+	// DeletedAt is set once the user has been soft deleted
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Version is bumped on every write and exposed as the ETag
+	Version int64 `json:"-"`
+	// Set by the store; ignored in requests
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Precondition guards a write against changes made since the caller's read
+type Precondition struct {
+	// Version the user must still be at; zero matches any version
+	Version int64
+	// Given is set when the caller stated a precondition at all, which
+	// tells "If-Match: *" apart from no If-Match
+	Given bool
 }
 
 type UserService struct {
-	ValidateUserID      func(string) (int64, error)
-	ConnectDB           func() (*sql.DB, error)
-	CheckUserNameExists func(*sql.DB, string) (bool, error)
-	CreateUserFunc      func(*sql.DB, *User) (*User, error)
-	UpdateUserFunc      func(*sql.DB, *User) (*User, error)
-	DeleteUserFunc      func(*sql.DB, int64) error
-	GetUserFunc         func(*sql.DB, int64) (*User, error)
-	GetAllUsersFunc     func(*sql.DB) ([]User, error)
+	Repo Repository
+	// RequireIfMatch rejects updates and deletes sent without a precondition
+	RequireIfMatch bool
+	// VersionRetention is how long earlier versions of users are kept for
+	// AsOf reads. Zero keeps them forever.
+	VersionRetention time.Duration
 }
 
+// Service is the user API independent of any transport. Writes take the
+// actor recorded in the audit trail; an empty actor is recorded as
+// DefaultActor.
 type Service interface {
-	GetAll(c echo.Context) ([]User, error)
-	GetByID(c echo.Context) (*User, error)
-	Create(c echo.Context, u *User) (*User, error)
-	Update(c echo.Context, u *User) (*User, error)
-	DeleteByID(c echo.Context) error
+	GetAll(ctx context.Context, opts ListOptions) ([]User, error)
+	// StreamAll calls fn with each user GetAll would return, as they are
+	// read from storage. With a Limit it returns the cursor for the next
+	// page, or an empty one after the last.
+	StreamAll(ctx context.Context, opts ListOptions, fn func(User) error) (string, error)
+	// CountAll counts the users GetAll would return across every page
+	CountAll(ctx context.Context, opts ListOptions) (int64, error)
+	// Search finds live users by partial or misspelled names and emails
+	Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error)
+	GetByID(ctx context.Context, id int64, opts GetOptions) (*User, error)
+	Create(ctx context.Context, u *User, actor string) (*User, error)
+	Update(ctx context.Context, u *User, cond Precondition, actor string) (*User, error)
+	// Replace sets the full representation of the user with `user_id` id
+	Replace(ctx context.Context, id int64, u *User, cond Precondition, actor string) (*User, error)
+	// Patch applies a JSON Merge Patch to the user with `user_id` id
+	Patch(ctx context.Context, id int64, patch []byte, cond Precondition, actor string) (*User, error)
+	DeleteByID(ctx context.Context, id int64, cond Precondition, actor string) error
+	RestoreByID(ctx context.Context, id int64, actor string) (*User, error)
+	PurgeByID(ctx context.Context, id int64, actor string) error
+	HistoryByID(ctx context.Context, id int64, opts HistoryOptions) ([]AuditEntry, error)
 }
 
 var _ Service = (*UserService)(nil)
 
 // Gets a single user by `user_id`
-func (us *UserService) GetByID(c echo.Context) (*User, error) {
-	userID := c.Param("user_id")
+func (us *UserService) GetByID(ctx context.Context, id int64, opts GetOptions) (*User, error) {
+	if err := us.checkAsOf(opts.AsOf); err != nil {
+		return nil, err
+	}
 
-	id, err := us.ValidateUserID(userID)
+	user, err := us.Repo.Get(ctx, id, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	dbcon, err := us.ConnectDB()
-	if err != nil {
+	return user, nil
+}
+
+// Gets the users matching opts in their Sort order. Limit and After page
+// through them; a zero Limit gets them all.
+func (us *UserService) GetAll(ctx context.Context, opts ListOptions) ([]User, error) {
+	if err := us.checkList(opts); err != nil {
 		return nil, err
 	}
-	defer dbcon.Close()
 
-	user, err := us.GetUserFunc(dbcon, id)
+	users, err := us.Repo.List(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	return user, nil
+	return users, nil
+}
+
+// Streams users to fn without holding them in memory. A page reads one user
+// past its Limit to learn whether another page follows.
+func (us *UserService) StreamAll(ctx context.Context, opts ListOptions, fn func(User) error) (string, error) {
+	if err := us.checkList(opts); err != nil {
+		return "", err
+	}
+
+	if opts.Limit == 0 {
+		return "", us.Repo.Stream(ctx, opts, fn)
+	}
+
+	page := opts
+	page.Limit++
+
+	var streamed int
+	var last User
+	var more bool
+
+	err := us.Repo.Stream(ctx, page, func(u User) error {
+		// The extra user only tells that another page follows
+		if streamed == opts.Limit {
+			more = true
+			return nil
+		}
+
+		streamed++
+		last = u
+		return fn(u)
+	})
+	if err != nil || !more {
+		return "", err
+	}
+
+	return CursorAfter(last, opts.Sort).Encode(), nil
 }
 
-// Gets ALL users without pagination
-func (us *UserService) GetAll(c echo.Context) ([]User, error) {
-	dbcon, err := us.ConnectDB()
+// Counts the users matching opts, ignoring the page
+func (us *UserService) CountAll(ctx context.Context, opts ListOptions) (int64, error) {
+	if err := us.checkList(opts); err != nil {
+		return 0, err
+	}
+
+	return us.Repo.Count(ctx, opts)
+}
+
+// Ranks users by how well they match a search and highlights the matches
+func (us *UserService) Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	results, err := us.Repo.Search(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
-	defer dbcon.Close()
 
-	users, err := us.GetAllUsersFunc(dbcon)
+	for i := range results {
+		results[i].Highlights = highlights(results[i].User, opts.Query)
+	}
+
+	return results, nil
+}
+
+// Creates a new user
+func (us *UserService) Create(ctx context.Context, reqUser *User, actor string) (*User, error) {
+	user, err := us.Repo.Create(ctx, reqUser, actor)
 	if err != nil {
 		return nil, err
 	}
 
-	return users, nil
+	return user, nil
 }
 
-// Creates a new user based on JSON body
-func (us *UserService) Create(c echo.Context, reqUser *User) (*User, error) {
-	dbcon, err := us.ConnectDB()
+// Updates the values given on a single user
+func (us *UserService) Update(ctx context.Context, reqUser *User, cond Precondition, actor string) (*User, error) {
+	if err := us.checkPrecondition(cond); err != nil {
+		return nil, err
+	}
+
+	if err := reqUser.ValidateUpdateRequest(); err != nil {
+		return nil, err
+	}
+
+	user, err := us.Repo.Update(ctx, reqUser, cond.Version, actor)
 	if err != nil {
 		return nil, err
 	}
-	defer dbcon.Close()
 
-	user, err := us.CreateUserFunc(dbcon, reqUser)
+	return user, nil
+}
+
+// Replaces every field a client can set on a live user with u's, validated
+// as a new user. u's ID may be left out but must otherwise be id.
+func (us *UserService) Replace(ctx context.Context, id int64, u *User, cond Precondition, actor string) (*User, error) {
+	if err := us.checkPrecondition(cond); err != nil {
+		return nil, err
+	}
+
+	if u.ID != 0 && u.ID != id {
+		return nil, ErrUserIDMismatch
+	}
+	u.ID = id
+
+	if err := u.ValidateReplaceRequest(); err != nil {
+		return nil, err
+	}
+
+	user, err := us.Repo.Replace(ctx, u, cond.Version, actor)
 	if err != nil {
 		return nil, err
 	}
@@ -92,15 +220,35 @@ func (us *UserService) Create(c echo.Context, reqUser *User) (*User, error) {
 	return user, nil
 }
 
-// Updates a single user based on JSON body
-func (us *UserService) Update(c echo.Context, reqUser *User) (*User, error) {
-	dbcon, err := us.ConnectDB()
+// Applies a JSON Merge Patch to a live user and validates the result as a
+// new user. The write only applies if the user is still as it was read, so
+// a concurrent change fails with ErrVersionMismatch rather than being lost.
+func (us *UserService) Patch(ctx context.Context, id int64, patch []byte, cond Precondition, actor string) (*User, error) {
+	if err := us.checkPrecondition(cond); err != nil {
+		return nil, err
+	}
+
+	// Read from the primary: a lagging replica would hand back a version
+	// that is already stale, and the replace would fail on it
+	current, err := us.Repo.Get(db.WithPrimary(ctx), id, GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if cond.Version != 0 && current.Version != cond.Version {
+		return nil, ErrVersionMismatch
+	}
+
+	patched, err := current.ApplyMergePatch(patch)
 	if err != nil {
 		return nil, err
 	}
-	defer dbcon.Close()
 
-	user, err := us.UpdateUserFunc(dbcon, reqUser)
+	if err := patched.ValidateReplaceRequest(); err != nil {
+		return nil, err
+	}
+
+	user, err := us.Repo.Replace(ctx, patched, current.Version, actor)
 	if err != nil {
 		return nil, err
 	}
@@ -108,25 +256,102 @@ func (us *UserService) Update(c echo.Context, reqUser *User) (*User, error) {
 	return user, nil
 }
 
-// Delete user by `user_id`
-func (us *UserService) DeleteByID(c echo.Context) error {
-	userID := c.Param("user_id")
+// Soft delete user by `user_id`
+func (us *UserService) DeleteByID(ctx context.Context, id int64, cond Precondition, actor string) error {
+	if err := us.checkPrecondition(cond); err != nil {
+		return err
+	}
 
-	id, err := us.ValidateUserID(userID)
+	err := us.Repo.Delete(ctx, id, cond.Version, actor)
 	if err != nil {
 		return err
 	}
 
-	dbcon, err := us.ConnectDB()
+	return nil
+}
+
+// Restores a soft-deleted user by `user_id`
+func (us *UserService) RestoreByID(ctx context.Context, id int64, actor string) (*User, error) {
+	user, err := us.Repo.Restore(ctx, id, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Permanently removes a user by `user_id`
+func (us *UserService) PurgeByID(ctx context.Context, id int64, actor string) error {
+	err := us.Repo.Purge(ctx, id, actor)
 	if err != nil {
 		return err
 	}
-	defer dbcon.Close()
 
-	err = us.DeleteUserFunc(dbcon, id)
+	return nil
+}
+
+// Gets a page of the audit trail for `user_id`, newest first. Unlike the
+// repository, a page must have a Limit of 1 to MaxHistoryLimit.
+func (us *UserService) HistoryByID(ctx context.Context, id int64, opts HistoryOptions) ([]AuditEntry, error) {
+	if err := validateHistoryOptions(opts); err != nil {
+		return nil, err
+	}
+
+	entries, err := us.Repo.History(ctx, id, opts)
 	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Checks the filters and page of a history request
+func validateHistoryOptions(opts HistoryOptions) error {
+	if opts.Operation != "" && !IsAuditOperation(opts.Operation) {
+		return ErrInvalidOperation
+	}
+
+	if opts.From != nil && opts.To != nil && !opts.From.Before(*opts.To) {
+		return ErrInvalidDateRange
+	}
+
+	if opts.Limit < 1 || opts.Limit > MaxHistoryLimit {
+		return ErrInvalidLimit
+	}
+
+	if opts.Offset < 0 {
+		return ErrInvalidOffset
+	}
+
+	return nil
+}
+
+func (us *UserService) checkPrecondition(cond Precondition) error {
+	if !cond.Given && us.RequireIfMatch {
+		return ErrPreconditionRequired
+	}
+
+	return nil
+}
+
+func (us *UserService) checkList(opts ListOptions) error {
+	if err := us.checkAsOf(opts.AsOf); err != nil {
 		return err
 	}
 
+	return validateListOptions(opts)
+}
+
+// Rejects an as-of time whose versions may already have been pruned, rather
+// than answering from incomplete history
+func (us *UserService) checkAsOf(asOf *time.Time) error {
+	if asOf == nil || us.VersionRetention == 0 {
+		return nil
+	}
+
+	if asOf.Before(time.Now().Add(-us.VersionRetention)) {
+		return ErrAsOfBeyondRetention
+	}
+
 	return nil
 }
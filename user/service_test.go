@@ -1,13 +1,10 @@
 package user_test
 
 import (
-	"database/sql"
-	"errors"
-	"net/http"
-	"net/http/httptest"
+	"context"
+	"strconv"
+	"time"
 
-	"github.com/DATA-DOG/go-sqlmock"
-	"github.com/labstack/echo/v4"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
@@ -16,98 +13,275 @@ import (
 
 var _ = Describe("UserService", func() {
 	var (
-		e      *echo.Echo
-		us     *user.UserService
-		mockDB *sql.DB
+		ctx context.Context
+		us  *user.UserService
 	)
 
 	BeforeEach(func() {
-		e = echo.New()
-		var err error
-		mockDB, _, err = sqlmock.New()
-		Expect(err).To(BeNil())
+		ctx = context.Background()
 
 		us = &user.UserService{
-			ConnectDB: func() (*sql.DB, error) { return mockDB, nil },
-			ValidateUserID: func(s string) (int64, error) {
-				if s == "bad" {
-					return 0, errors.New("invalid ID")
-				}
-				return 123, nil
-			},
-			GetUserFunc: func(db *sql.DB, id int64) (*user.User, error) {
-				return &user.User{ID: id, UserName: "testuser"}, nil
-			},
-			GetAllUsersFunc: func(db *sql.DB) ([]user.User, error) {
-				return []user.User{{ID: 1, UserName: "alice"}}, nil
-			},
-			CreateUserFunc: func(db *sql.DB, u *user.User) (*user.User, error) {
-				u.ID = 101
-				return u, nil
-			},
-			UpdateUserFunc: func(db *sql.DB, u *user.User) (*user.User, error) {
-				u.UserName = "updated"
-				return u, nil
-			},
-			DeleteUserFunc: func(db *sql.DB, id int64) error {
-				return nil
+			Repo: &user.MockRepository{
+				GetFunc: func(ctx context.Context, id int64, opts user.GetOptions) (*user.User, error) {
+					return &user.User{ID: id, UserName: "testuser"}, nil
+				},
+				ListFunc: func(ctx context.Context, opts user.ListOptions) ([]user.User, error) {
+					return []user.User{{ID: 1, UserName: "alice"}}, nil
+				},
+				CreateFunc: func(ctx context.Context, u *user.User, actor string) (*user.User, error) {
+					u.ID = 101
+					return u, nil
+				},
+				UpdateFunc: func(ctx context.Context, u *user.User, expectedVersion int64, actor string) (*user.User, error) {
+					u.UserName = "updated"
+					return u, nil
+				},
+				DeleteFunc: func(ctx context.Context, id int64, expectedVersion int64, actor string) error {
+					return nil
+				},
+				RestoreFunc: func(ctx context.Context, id int64, actor string) (*user.User, error) {
+					return &user.User{ID: id, UserName: "restored"}, nil
+				},
+				PurgeFunc: func(ctx context.Context, id int64, actor string) error {
+					return nil
+				},
 			},
 		}
 	})
 
-	AfterEach(func() {
-		mockDB.Close()
-	})
-
 	It("GetByID returns a user", func() {
-		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/users/123", nil), httptest.NewRecorder())
-		c.SetParamNames("user_id")
-		c.SetParamValues("123")
-
-		u, err := us.GetByID(c)
+		u, err := us.GetByID(ctx, 123, user.GetOptions{})
 		Expect(err).To(BeNil())
+		Expect(u.ID).To(Equal(int64(123)))
 		Expect(u.UserName).To(Equal("testuser"))
 	})
 
 	It("GetAll returns users", func() {
-		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/users", nil), httptest.NewRecorder())
-		u, err := us.GetAll(c)
+		u, err := us.GetAll(ctx, user.ListOptions{})
 		Expect(err).To(BeNil())
 		Expect(u).To(HaveLen(1))
 		Expect(u[0].UserName).To(Equal("alice"))
 	})
 
 	It("Create creates a new user", func() {
-		req := &user.User{UserName: "newuser"}
-		c := e.NewContext(nil, nil)
-		u, err := us.Create(c, req)
+		u, err := us.Create(ctx, &user.User{UserName: "newuser"}, "tester")
 		Expect(err).To(BeNil())
 		Expect(u.ID).To(Equal(int64(101)))
 	})
 
 	It("Update updates a user", func() {
-		req := &user.User{ID: 5, UserName: "old"}
-		c := e.NewContext(nil, nil)
-		u, err := us.Update(c, req)
+		u, err := us.Update(ctx, &user.User{ID: 5, UserName: "old"}, user.Precondition{}, "tester")
 		Expect(err).To(BeNil())
 		Expect(u.UserName).To(Equal("updated"))
 	})
 
 	It("DeleteByID deletes a user", func() {
-		c := e.NewContext(nil, nil)
-		c.SetParamNames("user_id")
-		c.SetParamValues("123")
+		Expect(us.DeleteByID(ctx, 123, user.Precondition{}, "tester")).To(Succeed())
+	})
+
+	It("passes the context and options through to the repository", func() {
+		type ctxKey struct{}
+		ctx = context.WithValue(ctx, ctxKey{}, "caller")
+
+		var got user.ListOptions
+		us.Repo.(*user.MockRepository).ListFunc = func(ctx context.Context, opts user.ListOptions) ([]user.User, error) {
+			Expect(ctx.Value(ctxKey{})).To(Equal("caller"))
+			got = opts
+			return nil, nil
+		}
+
+		after := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		_, err := us.GetAll(ctx, user.ListOptions{IncludeDeleted: true, CreatedAfter: &after})
+		Expect(err).To(BeNil())
+		Expect(got.IncludeDeleted).To(BeTrue())
+		Expect(*got.CreatedAfter).To(Equal(after))
+	})
+
+	It("streams a page and returns the cursor for the next one", func() {
+		var got user.ListOptions
+		us.Repo.(*user.MockRepository).StreamFunc = func(ctx context.Context, opts user.ListOptions, fn func(user.User) error) error {
+			got = opts
+
+			var after int64
+			if opts.After != nil {
+				after, _ = strconv.ParseInt(opts.After.Keys[0], 10, 64)
+			}
+
+			for id := after + 1; id <= 5 && id <= after+int64(opts.Limit); id++ {
+				if err := fn(user.User{ID: id}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		var ids []int64
+		collect := func(u user.User) error {
+			ids = append(ids, u.ID)
+			return nil
+		}
+
+		next, err := us.StreamAll(ctx, user.ListOptions{Limit: 2}, collect)
+		Expect(err).To(BeNil())
+		Expect(got.Limit).To(Equal(3))
+		Expect(ids).To(Equal([]int64{1, 2}))
+
+		after, err := user.DecodeCursor(next)
+		Expect(err).To(BeNil())
+		Expect(after.Keys).To(Equal([]string{"2"}))
+
+		ids = nil
+		next, err = us.StreamAll(ctx, user.ListOptions{Limit: 3, After: after}, collect)
+		Expect(err).To(BeNil())
+		Expect(ids).To(Equal([]int64{3, 4, 5}))
+		Expect(next).To(BeEmpty())
+	})
+
+	It("rejects a page larger than MaxPageLimit", func() {
+		_, err := us.GetAll(ctx, user.ListOptions{Limit: user.MaxPageLimit + 1})
+		Expect(err).To(Equal(user.ErrInvalidPageLimit))
+
+		_, err = us.StreamAll(ctx, user.ListOptions{Limit: -1}, func(user.User) error { return nil })
+		Expect(err).To(Equal(user.ErrInvalidPageLimit))
+	})
+
+	It("rejects cursors it didn't hand out or from another sort", func() {
+		for _, cursor := range []string{"", "not base64!", "e30"} {
+			_, err := user.DecodeCursor(cursor)
+			Expect(err).To(Equal(user.ErrInvalidCursor), cursor)
+		}
+
+		byLastName := []user.SortField{{Column: "last_name"}}
+		_, err := us.GetAll(ctx, user.ListOptions{Sort: byLastName, After: user.CursorAfter(user.User{ID: 1}, nil)})
+		Expect(err).To(Equal(user.ErrInvalidCursor))
 
-		err := us.DeleteByID(c)
+		_, err = us.GetAll(ctx, user.ListOptions{After: &user.Cursor{Keys: []string{"one"}}})
+		Expect(err).To(Equal(user.ErrInvalidCursor))
+	})
+
+	It("rejects malformed list filters", func() {
+		_, err := us.GetAll(ctx, user.ListOptions{UserStatus: "X"})
+		Expect(err).To(Equal(user.ErrInvalidStatus))
+
+		_, err = us.CountAll(ctx, user.ListOptions{EmailDomain: "localhost"})
+		Expect(err).To(Equal(user.ErrInvalidEmailDomain))
+	})
+
+	It("parses sorts against the whitelist of columns", func() {
+		fields, err := user.ParseSort("last_name,-user_id")
 		Expect(err).To(BeNil())
+		Expect(fields).To(Equal([]user.SortField{{Column: "last_name"}, {Column: "user_id", Desc: true}}))
+		Expect(user.FormatSort(fields)).To(Equal("last_name,-user_id"))
+
+		for _, sort := range []string{"password", "last_name,last_name", "-", "last_name,"} {
+			_, err := user.ParseSort(sort)
+			Expect(err).To(Equal(user.ErrInvalidSort), sort)
+		}
 	})
 
-	It("GetByID returns error on bad ID", func() {
-		c := e.NewContext(nil, nil)
-		c.SetParamNames("user_id")
-		c.SetParamValues("bad")
+	It("RestoreByID restores a user", func() {
+		u, err := us.RestoreByID(ctx, 123, "tester")
+		Expect(err).To(BeNil())
+		Expect(u.UserName).To(Equal("restored"))
+	})
 
-		_, err := us.GetByID(c)
-		Expect(err).To(MatchError("invalid ID"))
+	It("PurgeByID purges a user", func() {
+		Expect(us.PurgeByID(ctx, 123, "tester")).To(Succeed())
+	})
+
+	It("Update passes the expected version and actor to the repository", func() {
+		var gotVersion int64
+		var gotActor string
+		us.Repo.(*user.MockRepository).UpdateFunc = func(ctx context.Context, u *user.User, expectedVersion int64, actor string) (*user.User, error) {
+			gotVersion, gotActor = expectedVersion, actor
+			return u, nil
+		}
+
+		_, err := us.Update(ctx, &user.User{ID: 5, UserName: "old"}, user.Precondition{Version: 7, Given: true}, "alice")
+		Expect(err).To(BeNil())
+		Expect(gotVersion).To(Equal(int64(7)))
+		Expect(gotActor).To(Equal("alice"))
+	})
+
+	It("Update rejects values the schema doesn't allow before writing", func() {
+		us.Repo.(*user.MockRepository).UpdateFunc = func(ctx context.Context, u *user.User, expectedVersion int64, actor string) (*user.User, error) {
+			Fail("the repository should not be called")
+			return nil, nil
+		}
+
+		_, err := us.Update(ctx, &user.User{ID: 5, UserStatus: "Z"}, user.Precondition{}, "tester")
+		Expect(err).To(Equal(user.ErrInvalidStatus))
+	})
+
+	It("DeleteByID requires a precondition when configured", func() {
+		us.RequireIfMatch = true
+
+		Expect(us.DeleteByID(ctx, 123, user.Precondition{}, "tester")).To(Equal(user.ErrPreconditionRequired))
+	})
+
+	It("DeleteByID accepts a precondition matching any version when one is required", func() {
+		us.RequireIfMatch = true
+
+		Expect(us.DeleteByID(ctx, 123, user.Precondition{Given: true}, "tester")).To(Succeed())
+	})
+
+	It("rejects as-of reads older than the version retention", func() {
+		us.VersionRetention = 24 * time.Hour
+
+		lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+		_, err := us.GetByID(ctx, 123, user.GetOptions{AsOf: &lastWeek})
+		Expect(err).To(Equal(user.ErrAsOfBeyondRetention))
+		_, err = us.GetAll(ctx, user.ListOptions{AsOf: &lastWeek})
+		Expect(err).To(Equal(user.ErrAsOfBeyondRetention))
+		_, err = us.StreamAll(ctx, user.ListOptions{AsOf: &lastWeek}, func(user.User) error { return nil })
+		Expect(err).To(Equal(user.ErrAsOfBeyondRetention))
+		_, err = us.CountAll(ctx, user.ListOptions{AsOf: &lastWeek})
+		Expect(err).To(Equal(user.ErrAsOfBeyondRetention))
+
+		anHourAgo := time.Now().Add(-time.Hour)
+		_, err = us.GetByID(ctx, 123, user.GetOptions{AsOf: &anHourAgo})
+		Expect(err).To(BeNil())
+	})
+
+	Describe("HistoryByID", func() {
+		var got user.HistoryOptions
+
+		BeforeEach(func() {
+			us.Repo.(*user.MockRepository).HistoryFunc = func(ctx context.Context, userID int64, opts user.HistoryOptions) ([]user.AuditEntry, error) {
+				got = opts
+				return []user.AuditEntry{{UserID: userID, Operation: user.OpCreate}}, nil
+			}
+		})
+
+		It("passes the filters to the repository", func() {
+			from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			to := from.AddDate(0, 1, 0)
+			opts := user.HistoryOptions{From: &from, To: &to, Operation: user.OpStatusChange, Limit: 10, Offset: 20}
+
+			entries, err := us.HistoryByID(ctx, 123, opts)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(got).To(Equal(opts))
+		})
+
+		DescribeTable("rejects invalid options",
+			func(opts user.HistoryOptions, expected error) {
+				_, err := us.HistoryByID(ctx, 123, opts)
+				Expect(err).To(Equal(expected))
+			},
+			Entry("unknown operation", user.HistoryOptions{Operation: "rename", Limit: 10}, user.ErrInvalidOperation),
+			Entry("from after to", user.HistoryOptions{
+				From:  ptrTime(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)),
+				To:    ptrTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+				Limit: 10,
+			}, user.ErrInvalidDateRange),
+			Entry("limit too large", user.HistoryOptions{Limit: 501}, user.ErrInvalidLimit),
+			Entry("zero limit", user.HistoryOptions{}, user.ErrInvalidLimit),
+			Entry("negative offset", user.HistoryOptions{Limit: 10, Offset: -1}, user.ErrInvalidOffset),
+		)
 	})
 })
+
+func ptrTime(t time.Time) *time.Time {
+	return &t
+}
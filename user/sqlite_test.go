@@ -0,0 +1,735 @@
+package user_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	db "github.com/steveperjesi/integra-demo/internal/db"
+	. "github.com/steveperjesi/integra-demo/user"
+)
+
+func newSQLiteDB() *sql.DB {
+	cfg, err := db.LoadPoolConfig()
+	Expect(err).To(BeNil())
+
+	conn, err := db.OpenSQLite(":memory:", cfg)
+	Expect(err).To(BeNil())
+
+	migrator, err := db.NewMigrator(conn, db.SQLite)
+	Expect(err).To(BeNil())
+
+	_, err = migrator.Up(context.Background())
+	Expect(err).To(BeNil())
+
+	return conn
+}
+
+// SQLRepository on SQLite
+var _ = Describe("SQLRepository with SQLite", func() {
+	var (
+		conn *sql.DB
+		repo *SQLRepository
+		user *User
+	)
+
+	BeforeEach(func() {
+		conn = newSQLiteDB()
+		repo = NewSQLiteRepository(conn)
+		user = &User{
+			UserName:   "jdoe",
+			FirstName:  "John",
+			LastName:   "Doe",
+			Email:      "jdoe@example.com",
+			UserStatus: "A",
+			Department: ptr("Engineering"),
+		}
+	})
+
+	AfterEach(func() {
+		conn.Close()
+	})
+
+	It("creates and reads back a user", func() {
+		created, err := repo.Create(ctx, user, "tester")
+		Expect(err).To(BeNil())
+		Expect(created.ID).To(Equal(int64(1)))
+
+		found, err := repo.Get(ctx, created.ID, GetOptions{})
+		Expect(err).To(BeNil())
+		Expect(found).To(Equal(created))
+	})
+
+	It("keeps a version of rows changed outside the store", func() {
+		created, err := repo.Create(ctx, user, "tester")
+		Expect(err).To(BeNil())
+
+		versions := func() int {
+			var count int
+			Expect(conn.QueryRow(`SELECT COUNT(*) FROM users_history WHERE user_id = ?`, created.ID).Scan(&count)).To(Succeed())
+			return count
+		}
+
+		// A write that keeps the version isn't a change of the user
+		_, err = conn.Exec(`UPDATE users SET department = 'Finance' WHERE user_id = ?`, created.ID)
+		Expect(err).To(BeNil())
+		Expect(versions()).To(Equal(0))
+
+		time.Sleep(time.Millisecond)
+		movedAt := time.Now().UTC()
+		_, err = conn.Exec(`UPDATE users SET department = 'Sales', version = version + 1, updated_at = ? WHERE user_id = ?`, movedAt, created.ID)
+		Expect(err).To(BeNil())
+		Expect(versions()).To(Equal(1))
+
+		asOf := created.UpdatedAt
+		old, err := repo.Get(ctx, created.ID, GetOptions{AsOf: &asOf})
+		Expect(err).To(BeNil())
+		Expect(old.Department).To(Equal(ptr("Finance")))
+
+		time.Sleep(time.Millisecond)
+		_, err = conn.Exec(`DELETE FROM users WHERE user_id = ?`, created.ID)
+		Expect(err).To(BeNil())
+		Expect(versions()).To(Equal(2))
+
+		old, err = repo.Get(ctx, created.ID, GetOptions{AsOf: &movedAt})
+		Expect(err).To(BeNil())
+		Expect(old.Department).To(Equal(ptr("Sales")))
+	})
+
+	It("returns ErrUserExists on a duplicate user_name", func() {
+		_, err := repo.Create(ctx, user, "tester")
+		Expect(err).To(BeNil())
+
+		_, err = repo.Create(ctx, &User{UserName: "jdoe", FirstName: "J", LastName: "D", Email: "j@example.com", UserStatus: "A"}, "tester")
+		Expect(err).To(Equal(ErrUserExists))
+	})
+
+	It("lets only one of several concurrent creates claim a user_name", func() {
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := repo.Create(ctx, &User{UserName: "jdoe", FirstName: "J", LastName: "D", Email: "j@example.com", UserStatus: "A"}, "tester")
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		created := 0
+		for err := range errs {
+			if err == nil {
+				created++
+			} else {
+				Expect(err).To(Equal(ErrUserExists))
+			}
+		}
+		Expect(created).To(Equal(1))
+	})
+
+	It("returns ErrUserExists when renaming into a taken user_name", func() {
+		repo.Create(ctx, user, "tester")
+		other, _ := repo.Create(ctx, &User{UserName: "asmith", FirstName: "Alice", LastName: "Smith", Email: "a@example.com", UserStatus: "I"}, "tester")
+
+		_, err := repo.Update(ctx, &User{ID: other.ID, UserName: "jdoe"}, 0, "tester")
+		Expect(err).To(Equal(ErrUserExists))
+
+		// Keeping the current name is not a conflict
+		_, err = repo.Update(ctx, &User{ID: other.ID, UserName: "asmith", Email: "alice@example.com"}, 0, "tester")
+		Expect(err).To(BeNil())
+	})
+
+	It("treats user_name and email as unique regardless of case", func() {
+		user.UserName = " JDoe "
+		user.Email = "JDoe@Example.com"
+		created, err := repo.Create(ctx, user, "tester")
+		Expect(err).To(BeNil())
+		Expect(created.UserName).To(Equal("JDoe"))
+		Expect(created.Email).To(Equal("jdoe@example.com"))
+
+		exists, err := repo.ExistsByUserName(ctx, "jdoe")
+		Expect(err).To(BeNil())
+		Expect(exists).To(BeTrue())
+
+		_, err = repo.Create(ctx, &User{UserName: "jdoe", FirstName: "J", LastName: "D", Email: "j@example.com", UserStatus: "A"}, "tester")
+		Expect(err).To(Equal(ErrUserExists))
+
+		_, err = repo.Create(ctx, &User{UserName: "john", FirstName: "J", LastName: "D", Email: "JDOE@example.com", UserStatus: "A"}, "tester")
+		Expect(err).To(Equal(ErrEmailExists))
+
+		other, _ := repo.Create(ctx, &User{UserName: "asmith", FirstName: "Alice", LastName: "Smith", Email: "a@example.com", UserStatus: "I"}, "tester")
+		_, err = repo.Update(ctx, &User{ID: other.ID, Email: "jDoe@example.com"}, 0, "tester")
+		Expect(err).To(Equal(ErrEmailExists))
+
+		// Changing the case of your own user_name is not a conflict
+		updated, err := repo.Update(ctx, &User{ID: created.ID, UserName: "jdoe"}, 0, "tester")
+		Expect(err).To(BeNil())
+		Expect(updated.UserName).To(Equal("jdoe"))
+	})
+
+	It("maps CHECK constraint violations to validation errors naming the field", func() {
+		created, err := repo.Create(ctx, user, "tester")
+		Expect(err).To(BeNil())
+
+		// The repository writes what it is given; the schema has the last word
+		_, err = repo.Update(ctx, &User{ID: created.ID, UserStatus: "Z"}, 0, "tester")
+		Expect(err).To(Equal(ErrInvalidStatus))
+
+		_, err = repo.Update(ctx, &User{ID: created.ID, Email: "jdoe@localhost"}, 0, "tester")
+		var invalid *ValidationError
+		Expect(errors.As(err, &invalid)).To(BeTrue())
+		Expect(invalid.Field).To(Equal("email"))
+
+		_, err = repo.Create(ctx, &User{UserName: "asmith", FirstName: " ", LastName: "Smith", Email: "a@example.com", UserStatus: "A"}, "tester")
+		Expect(err).To(Equal(ErrMissingFirstName))
+
+		// Nothing was written
+		found, err := repo.Get(ctx, created.ID, GetOptions{})
+		Expect(err).To(BeNil())
+		Expect(found.Version).To(Equal(int64(1)))
+	})
+
+	It("streams users in the order List returns them and stops at fn's error", func() {
+		repo.Create(ctx, user, "tester")
+		repo.Create(ctx, &User{UserName: "asmith", FirstName: "Alice", LastName: "Smith", Email: "a@example.com", UserStatus: "I"}, "tester")
+
+		var names []string
+		err := repo.Stream(ctx, ListOptions{}, func(u User) error {
+			names = append(names, u.UserName)
+			return nil
+		})
+		Expect(err).To(BeNil())
+		Expect(names).To(Equal([]string{"jdoe", "asmith"}))
+
+		stop := errors.New("client went away")
+		calls := 0
+		err = repo.Stream(ctx, ListOptions{}, func(u User) error {
+			calls++
+			return stop
+		})
+		Expect(err).To(Equal(stop))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("pages through users by user_id and counts them all", func() {
+		for i, name := range []string{"jdoe", "asmith", "bjones", "cwhite", "dgreen"} {
+			_, err := repo.Create(ctx, &User{UserName: name, FirstName: "First", LastName: "Last", Email: name + "@example.com", UserStatus: "A"}, "tester")
+			Expect(err).To(BeNil(), "user %d", i)
+		}
+
+		var pages [][]string
+		var after *Cursor
+		for {
+			users, err := repo.List(ctx, ListOptions{After: after, Limit: 2})
+			Expect(err).To(BeNil())
+			if len(users) == 0 {
+				break
+			}
+
+			var names []string
+			for _, u := range users {
+				names = append(names, u.UserName)
+			}
+			pages = append(pages, names)
+			after = CursorAfter(users[len(users)-1], nil)
+		}
+		Expect(pages).To(Equal([][]string{{"jdoe", "asmith"}, {"bjones", "cwhite"}, {"dgreen"}}))
+
+		count, err := repo.Count(ctx, ListOptions{After: &Cursor{Keys: []string{"2"}}, Limit: 1})
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(int64(5)))
+
+		asOf := time.Now().Add(time.Hour)
+		count, err = repo.Count(ctx, ListOptions{AsOf: &asOf})
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(int64(5)))
+	})
+
+	It("filters on status, department, email domain and user_name prefix", func() {
+		createListFixtures(repo)
+		expectListed(repo, ListOptions{UserStatus: "A", Department: ptr("Finance")}, 1)
+		expectListed(repo, ListOptions{Department: ptr("")}, 2, 4)
+		expectListed(repo, ListOptions{EmailDomain: "EXAMPLE.com"}, 1, 3, 4)
+		expectListed(repo, ListOptions{UserNamePrefix: "a_"}, 2)
+		expectListed(repo, ListOptions{UserNamePrefix: "ASMITH"}, 3, 5)
+
+		count, err := repo.Count(ctx, ListOptions{EmailDomain: "corp.example.org"})
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(int64(2)))
+	})
+
+	It("sorts and pages on any whitelisted column", func() {
+		createListFixtures(repo)
+		expectPaged(repo, []SortField{{Column: "last_name"}, {Column: "user_id", Desc: true}}, 1, 4, 3, 2, 5)
+		expectPaged(repo, []SortField{{Column: "department"}, {Column: "user_status", Desc: true}}, 4, 2, 5, 3, 1)
+		expectPaged(repo, []SortField{{Column: "created_at", Desc: true}}, 5, 4, 3, 2, 1)
+	})
+
+	It("bulk creates users one by one in a single transaction", func() {
+		_, err := repo.Create(ctx, user, "tester")
+		Expect(err).To(BeNil())
+
+		results, err := repo.BulkCreate(ctx, []User{
+			{UserName: "asmith", FirstName: "Alice", LastName: "Smith", Email: "a@example.com", UserStatus: "I"},
+			{UserName: "JDoe", FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"},
+			{UserName: "jane", FirstName: "Jane", LastName: "Doe", Email: "JDOE@example.com"},
+			{UserName: "bad", FirstName: "Bad", LastName: "Email", Email: "nope"},
+		}, "importer")
+		Expect(err).To(BeNil())
+		Expect(results).To(Equal([]BulkResult{
+			{Row: 0, Outcome: BulkCreated, UserID: 2},
+			{Row: 1, Outcome: BulkDuplicateUserName},
+			{Row: 2, Outcome: BulkDuplicateEmail},
+			{Row: 3, Outcome: BulkInvalid, Field: "email", Error: ErrInvalidEmail.Error()},
+		}))
+
+		entries, err := repo.History(ctx, 2, HistoryOptions{})
+		Expect(err).To(BeNil())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Actor).To(Equal("importer"))
+		Expect(entries[0].Operation).To(Equal(OpCreate))
+	})
+
+	It("stops when the context is canceled", func() {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := repo.Create(canceled, user, "tester")
+		Expect(err).To(MatchError(context.Canceled))
+
+		_, err = repo.List(canceled, ListOptions{})
+		Expect(err).To(MatchError(context.Canceled))
+
+		users, err := repo.List(ctx, ListOptions{})
+		Expect(err).To(BeNil())
+		Expect(users).To(BeEmpty())
+	})
+
+	It("does not reuse IDs after a delete", func() {
+		created, _ := repo.Create(ctx, user, "tester")
+		Expect(repo.Delete(ctx, created.ID, 0, "tester")).To(Succeed())
+
+		next, err := repo.Create(ctx, &User{UserName: "asmith", FirstName: "Alice", LastName: "Smith", Email: "a@example.com", UserStatus: "I"}, "tester")
+		Expect(err).To(BeNil())
+		Expect(next.ID).To(Equal(int64(2)))
+	})
+
+	It("only updates the values given", func() {
+		created, _ := repo.Create(ctx, user, "tester")
+
+		updated, err := repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 0, "tester")
+		Expect(err).To(BeNil())
+		Expect(updated.Email).To(Equal("john@example.com"))
+		Expect(updated.FirstName).To(Equal("John"))
+		Expect(*updated.Department).To(Equal("Engineering"))
+	})
+
+	It("returns ErrUpdateUserNoRows for an unknown id", func() {
+		_, err := repo.Update(ctx, &User{ID: 99, Email: "john@example.com"}, 0, "tester")
+		Expect(err).To(Equal(ErrUpdateUserNoRows))
+	})
+
+	It("checks the expected version on update and delete", func() {
+		created, _ := repo.Create(ctx, user, "tester")
+
+		updated, err := repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 1, "tester")
+		Expect(err).To(BeNil())
+		Expect(updated.Version).To(Equal(int64(2)))
+
+		_, err = repo.Update(ctx, &User{ID: created.ID, Email: "jd@example.com"}, 1, "tester")
+		Expect(err).To(Equal(ErrVersionMismatch))
+
+		Expect(repo.Delete(ctx, created.ID, 1, "tester")).To(Equal(ErrVersionMismatch))
+		Expect(repo.Delete(ctx, created.ID, 2, "tester")).To(Succeed())
+	})
+
+	It("lists and deletes users", func() {
+		repo.Create(ctx, user, "tester")
+		repo.Create(ctx, &User{UserName: "asmith", FirstName: "Alice", LastName: "Smith", Email: "a@example.com", UserStatus: "I"}, "tester")
+
+		users, err := repo.List(ctx, ListOptions{})
+		Expect(err).To(BeNil())
+		Expect(users).To(HaveLen(2))
+		Expect(users[1].Department).To(BeNil())
+
+		Expect(repo.Delete(ctx, users[0].ID, 0, "tester")).To(Succeed())
+		Expect(repo.Delete(ctx, users[0].ID, 0, "tester")).To(MatchError(ErrUserNotFound))
+	})
+
+	It("soft deletes, restores and purges a user", func() {
+		created, _ := repo.Create(ctx, user, "tester")
+
+		Expect(repo.Delete(ctx, created.ID, 0, "tester")).To(Succeed())
+
+		_, err := repo.Get(ctx, created.ID, GetOptions{})
+		Expect(err).To(Equal(ErrUserNotFound))
+
+		deleted, err := repo.Get(ctx, created.ID, GetOptions{IncludeDeleted: true})
+		Expect(err).To(BeNil())
+		Expect(deleted.DeletedAt).ToNot(BeNil())
+
+		restored, err := repo.Restore(ctx, created.ID, "tester")
+		Expect(err).To(BeNil())
+		Expect(restored.DeletedAt).To(BeNil())
+
+		Expect(repo.Purge(ctx, created.ID, "tester")).To(Succeed())
+
+		users, err := repo.List(ctx, ListOptions{IncludeDeleted: true})
+		Expect(err).To(BeNil())
+		Expect(users).To(BeEmpty())
+	})
+
+	It("keeps an audit trail that outlives a purge", func() {
+		created, _ := repo.Create(ctx, user, "alice")
+		repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 0, "bob")
+		repo.Update(ctx, &User{ID: created.ID, UserStatus: "I"}, 0, "bob")
+		Expect(repo.Delete(ctx, created.ID, 0, "alice")).To(Succeed())
+		repo.Restore(ctx, created.ID, "alice")
+		Expect(repo.Purge(ctx, created.ID, "admin")).To(Succeed())
+
+		entries, err := repo.History(ctx, created.ID, HistoryOptions{})
+		Expect(err).To(BeNil())
+
+		var ops []string
+		for _, entry := range entries {
+			ops = append(ops, entry.Operation)
+		}
+		Expect(ops).To(Equal([]string{OpPurge, OpRestore, OpDelete, OpStatusChange, OpUpdate, OpCreate}))
+
+		update := entries[4]
+		Expect(update.Actor).To(Equal("bob"))
+		Expect(update.Changes).To(Equal(map[string]FieldChange{
+			"email": {Before: ptr("jdoe@example.com"), After: ptr("john@example.com")},
+		}))
+
+		Expect(entries[5].Changes["department"]).To(Equal(FieldChange{After: ptr("Engineering")}))
+		Expect(entries[0].Changes["user_name"]).To(Equal(FieldChange{Before: ptr("jdoe")}))
+	})
+
+	It("filters and pages the audit trail", func() {
+		created, _ := repo.Create(ctx, user, "alice")
+		repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 0, "bob")
+		repo.Update(ctx, &User{ID: created.ID, Email: "jd@example.com"}, 0, "bob")
+
+		entries, err := repo.History(ctx, created.ID, HistoryOptions{Operation: OpUpdate, Limit: 1, Offset: 1})
+		Expect(err).To(BeNil())
+		Expect(entries).To(HaveLen(1))
+		Expect(*entries[0].Changes["email"].After).To(Equal("john@example.com"))
+
+		from := entries[0].CreatedAt
+		entries, err = repo.History(ctx, created.ID, HistoryOptions{From: &from})
+		Expect(err).To(BeNil())
+		Expect(entries).To(HaveLen(2))
+
+		entries, err = repo.History(ctx, created.ID, HistoryOptions{To: &from})
+		Expect(err).To(BeNil())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Operation).To(Equal(OpCreate))
+	})
+
+	It("maintains created_at and updated_at and filters on them", func() {
+		before := time.Now()
+		created, _ := repo.Create(ctx, user, "tester")
+		Expect(created.CreatedAt).To(BeTemporally(">=", before.Add(-time.Millisecond)))
+		Expect(created.UpdatedAt).To(Equal(created.CreatedAt))
+
+		// Keep the timestamps apart
+		time.Sleep(time.Millisecond)
+		other, _ := repo.Create(ctx, &User{UserName: "asmith", FirstName: "Alice", LastName: "Smith", Email: "a@example.com", UserStatus: "I"}, "tester")
+		time.Sleep(time.Millisecond)
+
+		updated, err := repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 0, "tester")
+		Expect(err).To(BeNil())
+		Expect(updated.CreatedAt).To(Equal(created.CreatedAt))
+		Expect(updated.UpdatedAt).To(BeTemporally(">", created.UpdatedAt))
+
+		users, err := repo.List(ctx, ListOptions{CreatedAfter: &created.CreatedAt})
+		Expect(err).To(BeNil())
+		Expect(users).To(HaveLen(1))
+		Expect(users[0].ID).To(Equal(other.ID))
+
+		users, err = repo.List(ctx, ListOptions{UpdatedAfter: &other.UpdatedAt})
+		Expect(err).To(BeNil())
+		Expect(users).To(HaveLen(1))
+		Expect(users[0].ID).To(Equal(created.ID))
+
+		users, err = repo.List(ctx, ListOptions{CreatedBefore: &other.CreatedAt, UpdatedBefore: &updated.UpdatedAt})
+		Expect(err).To(BeNil())
+		Expect(users).To(BeEmpty())
+	})
+})
+
+// Creates users 1 to 5 for the list filter and sort tests, with their
+// created_at apart
+func createListFixtures(repo Repository) {
+	for _, u := range []User{
+		{UserName: "jdoe", FirstName: "John", LastName: "Doe", Email: "jdoe@example.com", UserStatus: "A", Department: ptr("Finance")},
+		{UserName: "a_smith", FirstName: "Alice", LastName: "Smith", Email: "alice@corp.example.org", UserStatus: "A"},
+		{UserName: "asmith2", FirstName: "Adam", LastName: "Smith", Email: "adam@example.com", UserStatus: "I", Department: ptr("Finance")},
+		{UserName: "bjones", FirstName: "Bob", LastName: "Jones", Email: "bob@EXAMPLE.com", UserStatus: "T", Department: ptr("")},
+		{UserName: "aSmithers", FirstName: "Ann", LastName: "Smithers", Email: "ann@corp.example.org", UserStatus: "A", Department: ptr("Engineering")},
+	} {
+		_, err := repo.Create(ctx, &u, "tester")
+		Expect(err).To(BeNil())
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func expectListed(repo Repository, opts ListOptions, ids ...int64) {
+	GinkgoHelper()
+
+	users, err := repo.List(ctx, opts)
+	Expect(err).To(BeNil())
+
+	listed := []int64{}
+	for _, u := range users {
+		listed = append(listed, u.ID)
+	}
+	Expect(listed).To(Equal(ids))
+}
+
+// Lists every user two at a time in the order of sort, checking the pages
+// add up to ids
+func expectPaged(repo Repository, sort []SortField, ids ...int64) {
+	GinkgoHelper()
+
+	listed := []int64{}
+	var after *Cursor
+
+	for {
+		users, err := repo.List(ctx, ListOptions{Sort: sort, After: after, Limit: 2})
+		Expect(err).To(BeNil())
+		if len(users) == 0 {
+			break
+		}
+
+		for _, u := range users {
+			listed = append(listed, u.ID)
+		}
+		after = CursorAfter(users[len(users)-1], sort)
+	}
+
+	Expect(listed).To(Equal(ids), FormatSort(sort))
+}
+
+var _ = Describe("SQLRepository with SQLite and a keyring", func() {
+	var (
+		conn *sql.DB
+		repo *SQLRepository
+		user *User
+	)
+
+	BeforeEach(func() {
+		conn = newSQLiteDB()
+		repo = NewSQLiteRepository(conn).WithKeyring(newTestKeyring("k1"))
+		user = &User{
+			UserName:   "jdoe",
+			FirstName:  "John",
+			LastName:   "Doe",
+			Email:      "jdoe@example.com",
+			UserStatus: "A",
+			Department: ptr("Engineering"),
+		}
+	})
+
+	AfterEach(func() {
+		conn.Close()
+	})
+
+	// The PII columns of a user as stored
+	stored := func(table string, id int64) (string, string, string) {
+		var firstName, lastName, email string
+		err := conn.QueryRow(`SELECT first_name, last_name, email FROM `+table+` WHERE user_id = ? ORDER BY updated_at DESC LIMIT 1`, id).
+			Scan(&firstName, &lastName, &email)
+		Expect(err).To(BeNil())
+		return firstName, lastName, email
+	}
+
+	It("stores the PII encrypted and reads it back decrypted", func() {
+		created, err := repo.Create(ctx, user, "tester")
+		Expect(err).To(BeNil())
+
+		firstName, lastName, email := stored(DbName, created.ID)
+		Expect(firstName).To(HavePrefix("enc:k1:"))
+		Expect(lastName).To(HavePrefix("enc:k1:"))
+		Expect(email).To(HavePrefix("enc:k1:"))
+
+		found, err := repo.Get(ctx, created.ID, GetOptions{})
+		Expect(err).To(BeNil())
+		Expect(found).To(Equal(created))
+
+		updated, err := repo.Update(ctx, &User{ID: created.ID, Email: "john.doe@example.com"}, 0, "tester")
+		Expect(err).To(BeNil())
+		Expect(updated.Email).To(Equal("john.doe@example.com"))
+		Expect(updated.FirstName).To(Equal("John"))
+
+		// The version before the update is kept encrypted too
+		_, _, email = stored(HistoryTable, created.ID)
+		Expect(email).To(HavePrefix("enc:k1:"))
+
+		asOf := created.UpdatedAt
+		old, err := repo.Get(ctx, created.ID, GetOptions{AsOf: &asOf})
+		Expect(err).To(BeNil())
+		Expect(old.Email).To(Equal("jdoe@example.com"))
+	})
+
+	It("keeps encrypted emails unique regardless of case", func() {
+		_, err := repo.Create(ctx, user, "tester")
+		Expect(err).To(BeNil())
+
+		_, err = repo.Create(ctx, &User{UserName: "other", FirstName: "J", LastName: "D", Email: "JDoe@Example.com", UserStatus: "A"}, "tester")
+		Expect(err).To(Equal(ErrEmailExists))
+
+		other, err := repo.Create(ctx, &User{UserName: "other", FirstName: "J", LastName: "D", Email: "other@example.com", UserStatus: "A"}, "tester")
+		Expect(err).To(BeNil())
+
+		// Caught by the unique blind index rather than the check before it
+		_, err = repo.Update(ctx, &User{ID: other.ID, Email: "JDOE@example.com"}, 0, "tester")
+		Expect(err).To(Equal(ErrEmailExists))
+	})
+
+	It("seals the PII in the audit trail and the outbox and opens it on read", func() {
+		created, err := repo.Create(ctx, user, "tester")
+		Expect(err).To(BeNil())
+
+		_, err = repo.Update(ctx, &User{ID: created.ID, FirstName: "Jon", Email: "jon.doe@example.com"}, 0, "tester")
+		Expect(err).To(BeNil())
+
+		for _, query := range []string{`SELECT changes FROM user_audit`, `SELECT payload FROM user_outbox`} {
+			rows, err := conn.Query(query)
+			Expect(err).To(BeNil())
+			for rows.Next() {
+				var doc string
+				Expect(rows.Scan(&doc)).To(Succeed())
+				for _, value := range []string{"John", "Jon", "Doe", "example.com"} {
+					Expect(doc).NotTo(ContainSubstring(value), query)
+				}
+				Expect(doc).To(ContainSubstring("enc:k1:"))
+			}
+			Expect(rows.Close()).To(Succeed())
+		}
+
+		history, err := repo.History(ctx, created.ID, HistoryOptions{})
+		Expect(err).To(BeNil())
+		Expect(history).To(HaveLen(2))
+		Expect(history[0].Changes["first_name"]).To(Equal(FieldChange{Before: ptr("John"), After: ptr("Jon")}))
+		Expect(*history[1].Changes["email"].After).To(Equal("jdoe@example.com"))
+
+		events, err := repo.Events(ctx, OutboxOptions{Limit: 10})
+		Expect(err).To(BeNil())
+		Expect(events).To(HaveLen(2))
+		Expect(events[1].User.FirstName).To(Equal("Jon"))
+		Expect(events[1].User.Email).To(Equal("jon.doe@example.com"))
+		Expect(*events[1].Changes["email"].Before).To(Equal("jdoe@example.com"))
+	})
+
+	It("filters on email_domain by its blind index and refuses to sort on encrypted columns", func() {
+		createListFixtures(repo)
+
+		expectListed(repo, ListOptions{EmailDomain: "EXAMPLE.com"}, 1, 3, 4)
+		expectListed(repo, ListOptions{EmailDomain: "corp.example.org", UserStatus: "A"}, 2, 5)
+		users, err := repo.List(ctx, ListOptions{EmailDomain: "example.org"})
+		Expect(err).To(BeNil())
+		Expect(users).To(BeEmpty())
+
+		count, err := repo.Count(ctx, ListOptions{EmailDomain: "corp.example.org"})
+		Expect(err).To(BeNil())
+		Expect(count).To(Equal(int64(2)))
+
+		// Versions keep the index, so earlier domains are found as_of
+		before := time.Now().UTC()
+		time.Sleep(time.Millisecond)
+		_, err = repo.Update(ctx, &User{ID: 1, Email: "jdoe@corp.example.org"}, 0, "tester")
+		Expect(err).To(BeNil())
+		expectListed(repo, ListOptions{EmailDomain: "corp.example.org"}, 1, 2, 5)
+		expectListed(repo, ListOptions{EmailDomain: "example.com", AsOf: &before}, 1, 3, 4)
+
+		_, err = repo.List(ctx, ListOptions{Sort: []SortField{{Column: "last_name"}}})
+		Expect(err).To(Equal(ErrEncryptedField))
+
+		_, err = repo.Count(ctx, ListOptions{Sort: []SortField{{Column: "email", Desc: true}}})
+		Expect(err).To(Equal(ErrEncryptedField))
+
+		_, err = repo.List(ctx, ListOptions{Sort: []SortField{{Column: "user_name"}}, UserStatus: "A"})
+		Expect(err).To(BeNil())
+	})
+
+	It("indexes the email domains of rows encrypted before they were indexed", func() {
+		created, err := repo.Create(ctx, user, "tester")
+		Expect(err).To(BeNil())
+
+		_, err = conn.Exec(`UPDATE users SET email_domain_hash = NULL`)
+		Expect(err).To(BeNil())
+		users, err := repo.List(ctx, ListOptions{EmailDomain: "example.com"})
+		Expect(err).To(BeNil())
+		Expect(users).To(BeEmpty())
+
+		rotated, err := repo.RotateKeys(ctx, 10)
+		Expect(err).To(BeNil())
+		Expect(rotated).To(Equal(int64(1)))
+		expectListed(repo, ListOptions{EmailDomain: "example.com"}, created.ID)
+	})
+
+	It("encrypts plaintext rows and moves rows to a new primary key in batches", func() {
+		plain := NewSQLiteRepository(conn)
+		for _, name := range []string{"a", "b", "c"} {
+			_, err := plain.Create(ctx, &User{UserName: name, FirstName: "First", LastName: "Last", Email: name + "@example.com", UserStatus: "A"}, "tester")
+			Expect(err).To(BeNil())
+		}
+		_, err := plain.Update(ctx, &User{ID: 1, FirstName: "Changed"}, 0, "tester")
+		Expect(err).To(BeNil())
+
+		_, err = plain.RotateKeys(ctx, 2)
+		Expect(err).To(Equal(ErrNoKeyring))
+
+		// Three users and one earlier version, and the four audit entries
+		// and events recorded for them
+		rotated, err := repo.RotateKeys(ctx, 2)
+		Expect(err).To(BeNil())
+		Expect(rotated).To(Equal(int64(12)))
+
+		_, _, email := stored(DbName, 2)
+		Expect(email).To(HavePrefix("enc:k1:"))
+		firstName, _, _ := stored(HistoryTable, 1)
+		Expect(firstName).To(HavePrefix("enc:k1:"))
+
+		// Nothing left to do under the same key
+		rotated, err = repo.RotateKeys(ctx, 2)
+		Expect(err).To(BeNil())
+		Expect(rotated).To(BeZero())
+
+		// The blind index now guards the rotated rows
+		_, err = repo.Create(ctx, &User{UserName: "d", FirstName: "F", LastName: "L", Email: "B@example.com", UserStatus: "A"}, "tester")
+		Expect(err).To(Equal(ErrEmailExists))
+
+		rotated, err = repo.WithKeyring(newTestKeyring("k2")).RotateKeys(ctx, 10)
+		Expect(err).To(BeNil())
+		Expect(rotated).To(Equal(int64(12)))
+
+		_, _, email = stored(DbName, 3)
+		Expect(email).To(HavePrefix("enc:k2:"))
+
+		var changes string
+		Expect(conn.QueryRow(`SELECT changes FROM user_audit WHERE user_id = 1 AND operation = 'update'`).Scan(&changes)).To(Succeed())
+		Expect(changes).NotTo(ContainSubstring("Changed"))
+		Expect(changes).To(ContainSubstring("enc:k2:"))
+
+		history, err := repo.History(ctx, 1, HistoryOptions{Operation: OpUpdate})
+		Expect(err).To(BeNil())
+		Expect(*history[0].Changes["first_name"].Before).To(Equal("First"))
+
+		users, err := repo.List(ctx, ListOptions{})
+		Expect(err).To(BeNil())
+		Expect(users).To(HaveLen(3))
+		Expect(users[0].FirstName).To(Equal("Changed"))
+		Expect(users[2].Email).To(Equal("c@example.com"))
+		Expect(users[0].Version).To(Equal(int64(2)))
+	})
+})
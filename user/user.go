@@ -1,48 +1,1673 @@
 package user
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
 	"github.com/steveperjesi/integra-demo/internal/db"
 )
 
-func GetAllUsers(dbcon *sql.DB) ([]User, error) {
-	query, args, err := sq.Select(db.AllColumns).
+// SQLRepository stores users in a SQL database using squirrel-built
+// queries. The dialect smooths over differences between Postgres and SQLite.
+type SQLRepository struct {
+	db      *sql.DB
+	dialect db.Dialect
+	// Optional; serves Get, List, Search, ExistsByUserName and History while healthy
+	replica *db.Replica
+	// Optional; encrypts the PII columns when set
+	keys *db.Keyring
+}
+
+var _ Repository = (*SQLRepository)(nil)
+
+func NewSQLRepository(dbcon *sql.DB, dialect db.Dialect) *SQLRepository {
+	return &SQLRepository{db: dbcon, dialect: dialect}
+}
+
+func NewPostgresRepository(dbcon *sql.DB) *SQLRepository {
+	return NewSQLRepository(dbcon, db.Postgres)
+}
+
+func NewSQLiteRepository(dbcon *sql.DB) *SQLRepository {
+	return NewSQLRepository(dbcon, db.SQLite)
+}
+
+// Sends reads outside of writes to replica. Writes, and the reads they make,
+// stay on the primary.
+func (r *SQLRepository) WithReplica(replica *db.Replica) *SQLRepository {
+	r.replica = replica
+	return r
+}
+
+// Encrypts first_name, last_name and email with keys from here on. Rows
+// written before stay readable; RotateKeys encrypts them.
+func (r *SQLRepository) WithKeyring(keys *db.Keyring) *SQLRepository {
+	r.keys = keys
+	return r
+}
+
+func (r *SQLRepository) List(ctx context.Context, opts ListOptions) ([]User, error) {
+	query, args, err := r.listQuery(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []User
+
+	err = r.read(ctx, func(q queryer) error {
+		results = nil
+
+		return r.scanUsers(ctx, q, query, args, func(u User) error {
+			results = append(results, u)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (r *SQLRepository) Stream(ctx context.Context, opts ListOptions, fn func(User) error) error {
+	query, args, err := r.listQuery(opts)
+	if err != nil {
+		return err
+	}
+
+	var streamed bool
+	var streamErr error
+
+	return r.read(ctx, func(q queryer) error {
+		// Users already handed out from a failing replica can't be taken
+		// back, so the primary only gets a retry if none were
+		if streamed {
+			return streamErr
+		}
+
+		streamErr = r.scanUsers(ctx, q, query, args, func(u User) error {
+			streamed = true
+			return fn(u)
+		})
+
+		return streamErr
+	})
+}
+
+// Builds the select shared by List and Stream
+func (r *SQLRepository) listQuery(opts ListOptions) (string, []interface{}, error) {
+	if err := r.checkListable(opts); err != nil {
+		return "", nil, err
+	}
+
+	order := sortOrder(opts.Sort)
+
+	selectUsers := selectListed(opts, r.keys).
+		PlaceholderFormat(r.dialect.Placeholder)
+
+	for _, field := range order {
+		if field.Desc {
+			selectUsers = selectUsers.OrderBy(sortColumns[field.Column] + " DESC")
+		} else {
+			selectUsers = selectUsers.OrderBy(sortColumns[field.Column])
+		}
+	}
+
+	if opts.After != nil {
+		values, err := opts.After.values(order)
+		if err != nil {
+			return "", nil, err
+		}
+		selectUsers = selectUsers.Where(keysetAfter(order, values))
+	}
+
+	if opts.Limit > 0 {
+		selectUsers = selectUsers.Limit(uint64(opts.Limit))
+	}
+
+	query, args, err := selectUsers.ToSql()
+	if err != nil {
+		log.Print("failed to build select sql: ", err)
+		return "", nil, err
+	}
+
+	return query, args, nil
+}
+
+func (r *SQLRepository) Count(ctx context.Context, opts ListOptions) (int64, error) {
+	if err := r.checkListable(opts); err != nil {
+		return 0, err
+	}
+
+	query, args, err := sq.Select("COUNT(*)").
+		FromSelect(selectListed(opts, r.keys), "listed").
+		PlaceholderFormat(r.dialect.Placeholder).
+		ToSql()
+	if err != nil {
+		log.Print("failed to build count sql: ", err)
+		return 0, err
+	}
+
+	var count int64
+
+	err = r.read(ctx, func(q queryer) error {
+		return q.QueryRowContext(ctx, query, args...).Scan(&count)
+	})
+	if err != nil {
+		log.Print("failed to count users: ", err)
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Ranks users with pg_trgm where its indexes can serve the search. Without
+// them, live users are streamed and scored in the application instead.
+func (r *SQLRepository) Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error) {
+	if !r.dialect.Trigram {
+		ranking := searchRanking{query: opts.Query, fields: r.searchFields()}
+		if err := r.Stream(ctx, ListOptions{}, ranking.add); err != nil {
+			return nil, err
+		}
+		return ranking.top(opts.Limit), nil
+	}
+
+	query, args, err := r.searchQuery(opts)
+	if err != nil {
+		log.Print("failed to build search sql: ", err)
+		return nil, err
+	}
+
+	var results []SearchResult
+
+	err = r.read(ctx, func(q queryer) error {
+		results = nil
+
+		// The <% operator matches at the session's threshold, so it's set
+		// for a transaction of the search's own
+		tx, err := q.(txBeginner).BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+		if err != nil {
+			log.Print("failed to begin transaction: ", err)
+			return err
+		}
+		defer tx.Rollback()
+
+		threshold := strconv.FormatFloat(searchThreshold, 'f', -1, 64)
+		if _, err := tx.ExecContext(ctx, "SET LOCAL pg_trgm.word_similarity_threshold = "+threshold); err != nil {
+			log.Print("failed to set the search threshold: ", err)
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			log.Print("query failure: ", err)
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var udb db.UserDB
+			var score float64
+			if err := rows.Scan(append(udb.ScanFields(), &score)...); err != nil {
+				log.Print("row scan failure: ", err)
+				return err
+			}
+
+			user, err := ConvertToUser(&udb, r.keys)
+			if err != nil {
+				log.Print("failed to decrypt user: ", err)
+				return err
+			}
+
+			results = append(results, SearchResult{User: user, Score: score})
+		}
+
+		if err := rows.Err(); err != nil {
+			log.Print("rows iteration error: ", err)
+			return err
+		}
+
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// The fields searches match against: those stored in plaintext
+func (r *SQLRepository) searchFields() []string {
+	if r.keys != nil {
+		return plainSearchFields
+	}
+
+	return searchFields
+}
+
+// Builds the pg_trgm search: users whose fields are word similar to q, or
+// contain it, scored by their best field
+func (r *SQLRepository) searchQuery(opts SearchOptions) (string, []interface{}, error) {
+	contains := "%" + escapeLike(opts.Query) + "%"
+	fields := r.searchFields()
+
+	scores := make([]string, len(fields))
+	var scoreArgs []interface{}
+	matches := make(sq.Or, len(fields))
+
+	for i, field := range fields {
+		column := "LOWER(" + field + ")"
+
+		scores[i] = "word_similarity(?, " + column + ")"
+		scoreArgs = append(scoreArgs, opts.Query)
+
+		matches[i] = sq.Expr("(? <% "+column+" OR "+column+` LIKE ? ESCAPE '\')`, opts.Query, contains)
+	}
+
+	score := sq.Expr("GREATEST("+strings.Join(scores, ", ")+")", scoreArgs...)
+
+	return sq.Select(db.AllColumns).
+		Column(sq.Alias(score, "score")).
 		From(DbName).
+		Where(sq.Eq{"deleted_at": nil}).
+		Where(matches).
+		OrderBy("score DESC", "user_id").
+		Limit(uint64(opts.Limit)).
+		PlaceholderFormat(r.dialect.Placeholder).
 		ToSql()
+}
+
+// Encrypted columns hold ciphertext, which can't be ordered on. Filtering
+// on email_domain goes by its blind index instead.
+func (r *SQLRepository) checkListable(opts ListOptions) error {
+	if r.keys != nil && sortsOnPII(opts.Sort) {
+		return ErrEncryptedField
+	}
+
+	return nil
+}
+
+// Selects the users opts filters down to, leaving the order and page to the
+// caller. Takes ? placeholders. With keys, emails are matched on domain by
+// their blind index.
+func selectListed(opts ListOptions, keys *db.Keyring) sq.SelectBuilder {
+	selectUsers := sq.Select(db.AllColumns).
+		From(DbName)
+
+	if opts.AsOf != nil {
+		selectUsers = selectAsOf(*opts.AsOf)
+	}
+
+	if !opts.IncludeDeleted {
+		selectUsers = selectUsers.Where(sq.Eq{"deleted_at": nil})
+	}
+
+	if opts.CreatedAfter != nil {
+		selectUsers = selectUsers.Where(sq.Gt{"created_at": opts.CreatedAfter.UTC()})
+	}
+
+	if opts.CreatedBefore != nil {
+		selectUsers = selectUsers.Where(sq.Lt{"created_at": opts.CreatedBefore.UTC()})
+	}
+
+	if opts.UpdatedAfter != nil {
+		selectUsers = selectUsers.Where(sq.Gt{"updated_at": opts.UpdatedAfter.UTC()})
+	}
+
+	if opts.UpdatedBefore != nil {
+		selectUsers = selectUsers.Where(sq.Lt{"updated_at": opts.UpdatedBefore.UTC()})
+	}
+
+	if opts.UserStatus != "" {
+		selectUsers = selectUsers.Where(sq.Eq{"user_status": opts.UserStatus})
+	}
+
+	if opts.Department != nil && *opts.Department == "" {
+		selectUsers = selectUsers.Where(sq.Or{sq.Eq{"department": nil}, sq.Eq{"department": ""}})
+	} else if opts.Department != nil {
+		selectUsers = selectUsers.Where(sq.Eq{"department": *opts.Department})
+	}
+
+	// Emails are stored lowercase, or encrypted next to the blind index of
+	// their domain
+	if hash := domainHash(keys, opts.EmailDomain); hash.Valid {
+		selectUsers = selectUsers.Where(sq.Eq{"email_domain_hash": hash.String})
+	} else if opts.EmailDomain != "" {
+		selectUsers = selectUsers.Where(sq.Expr(`email LIKE ? ESCAPE '\'`, "%@"+escapeLike(normalizedKey(opts.EmailDomain))))
+	}
+
+	if opts.UserNamePrefix != "" {
+		selectUsers = selectUsers.Where(sq.Expr(`LOWER(user_name) LIKE ? ESCAPE '\'`, escapeLike(strings.ToLower(opts.UserNamePrefix))+"%"))
+	}
+
+	return selectUsers
+}
+
+// Matches the users that come after values in order: past them on the
+// first column, or level on it and past them on the next, and so on
+func keysetAfter(order []SortField, values []interface{}) sq.Or {
+	after := make(sq.Or, len(order))
+
+	for i, field := range order {
+		level := sq.And{}
+		for j := 0; j < i; j++ {
+			level = append(level, sq.Eq{sortColumns[order[j].Column]: values[j]})
+		}
+
+		column := sortColumns[field.Column]
+		if field.Desc {
+			level = append(level, sq.Lt{column: values[i]})
+		} else {
+			level = append(level, sq.Gt{column: values[i]})
+		}
+
+		after[i] = level
+	}
+
+	return after
+}
+
+// Runs a select of db.AllColumns and calls fn with each user as its row is
+// read, stopping at the first error
+func (r *SQLRepository) scanUsers(ctx context.Context, q queryer, query string, args []interface{}, fn func(User) error) error {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Print("query failure: ", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var udb db.UserDB
+		if err := rows.Scan(udb.ScanFields()...); err != nil {
+			log.Print("row scan failure: ", err)
+			return err
+		}
+
+		// Need to convert the UserDB into User
+		user, err := ConvertToUser(&udb, r.keys)
+		if err != nil {
+			log.Print("failed to decrypt user: ", err)
+			return err
+		}
+
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Print("rows iteration error: ", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *SQLRepository) Get(ctx context.Context, id int64, opts GetOptions) (*User, error) {
+	var user *User
+
+	err := r.read(ctx, func(q queryer) error {
+		var err error
+		user, err = r.getUser(ctx, q, id, opts, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Returns true if `user_name` exists. Soft-deleted users keep their
+// `user_name` until they are purged.
+func (r *SQLRepository) ExistsByUserName(ctx context.Context, userName string) (bool, error) {
+	var exists bool
+
+	err := r.read(ctx, func(q queryer) error {
+		var err error
+		exists, err = r.existsByUserName(ctx, q, userName)
+		return err
+	})
+
+	return exists, err
+}
+
+func (r *SQLRepository) Create(ctx context.Context, u *User, actor string) (*User, error) {
+	u.Normalize()
+
+	err := r.withTx(ctx, func(tx *sql.Tx) error {
+		return r.create(ctx, tx, u, actor)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Inserts a normalized user inside tx, filling in its ID, version and
+// timestamps
+func (r *SQLRepository) create(ctx context.Context, tx *sql.Tx, u *User, actor string) error {
+	// Check if the `user_name` or `email` is already taken
+	userExists, err := r.existsByUserName(ctx, tx, u.UserName)
+	if err != nil {
+		return err
+	}
+
+	if userExists {
+		return ErrUserExists
+	}
+
+	emailExists, err := r.existsByEmail(ctx, tx, u.Email)
+	if err != nil {
+		return err
+	}
+
+	if emailExists {
+		return ErrEmailExists
+	}
+
+	u.CreatedAt = timestamp()
+	u.UpdatedAt = u.CreatedAt
+
+	// Need to convert the User into UserDB
+	userDB, err := u.ConvertToUserDB(r.keys)
+	if err != nil {
+		log.Print("failed to encrypt user: ", err)
+		return err
+	}
+
+	insert := sq.Insert(DbName).
+		Columns("user_name", "first_name", "last_name", "email", "user_status", "department", "created_at", "updated_at", "email_hash", "email_domain_hash").
+		Values(userDB.UserName, userDB.FirstName, userDB.LastName, userDB.Email, userDB.UserStatus, userDB.Department, userDB.CreatedAt, userDB.UpdatedAt, userDB.EmailHash, userDB.EmailDomainHash).
+		PlaceholderFormat(r.dialect.Placeholder)
+
+	if r.dialect.Returning {
+		insert = insert.Suffix("RETURNING user_id")
+	}
+
+	query, args, err := insert.ToSql()
+	if err != nil {
+		log.Print("failed to build create sql: ", err)
+		return err
+	}
+
+	// Execute the insert and add the `user_id` to the result. The unique
+	// indexes catch a concurrent create that slipped past the checks.
+	lastInsertID, err := r.insertReturningID(ctx, tx, query, args)
+	if conflict := uniqueConflict(err); conflict != nil {
+		return conflict
+	} else if invalid := invalidField(err); invalid != nil {
+		return invalid
+	} else if err != nil {
+		log.Print("query failure: ", err)
+		return err
+	}
+
+	u.ID = lastInsertID
+	u.Version = 1
+
+	return r.recordChange(ctx, tx, newAuditEntry(actor, OpCreate, nil, u), u)
+}
+
+var _ BulkStore = (*SQLRepository)(nil)
+
+func (r *SQLRepository) BulkCreate(ctx context.Context, users []User, actor string) ([]BulkResult, error) {
+	results, pending, err := prepareBulk(users)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 {
+		return results, nil
+	}
+
+	err = r.withTx(ctx, func(tx *sql.Tx) error {
+		if r.dialect.Copy {
+			return r.copyUsers(ctx, tx, pending, actor, results)
+		}
+
+		// Without COPY the users are created one by one, still in a single
+		// transaction
+		for _, p := range pending {
+			u := p.user
+			if err := results[p.row].record(&u, r.create(ctx, tx, &u, actor)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Loads the pending users into a staging table with COPY, then merges the
+// ones that don't collide with an existing user into the users table.
+// Audit entries and events for the created users are copied in the same way.
+func (r *SQLRepository) copyUsers(ctx context.Context, tx *sql.Tx, pending []bulkRow, actor string, results []BulkResult) error {
+	_, err := tx.ExecContext(ctx, `CREATE TEMPORARY TABLE `+bulkStagingTable+` (
+		row_num INTEGER NOT NULL,
+		user_name VARCHAR(50) NOT NULL,
+		first_name VARCHAR(255) NOT NULL,
+		last_name VARCHAR(255) NOT NULL,
+		email VARCHAR(255) NOT NULL,
+		user_status VARCHAR(1) NOT NULL,
+		department VARCHAR(255),
+		email_hash VARCHAR(64),
+		email_domain_hash VARCHAR(64)
+	) ON COMMIT DROP`)
+	if err != nil {
+		log.Print("failed to create staging table: ", err)
+		return err
+	}
+
+	staged := make([][]interface{}, 0, len(pending))
+	for _, p := range pending {
+		userDB, err := p.user.ConvertToUserDB(r.keys)
+		if err != nil {
+			log.Print("failed to encrypt user: ", err)
+			return err
+		}
+		staged = append(staged, []interface{}{p.row, userDB.UserName, userDB.FirstName, userDB.LastName, userDB.Email, userDB.UserStatus, userDB.Department, userDB.EmailHash, userDB.EmailDomainHash})
+	}
+
+	if err := copyIn(ctx, tx, bulkStagingTable, []string{"row_num", "user_name", "first_name", "last_name", "email", "user_status", "department", "email_hash", "email_domain_hash"}, staged); err != nil {
+		return err
+	}
+
+	now := timestamp()
+
+	query, args, err := sq.Insert(DbName).
+		Columns("user_name", "first_name", "last_name", "email", "user_status", "department", "created_at", "updated_at", "email_hash", "email_domain_hash").
+		Select(sq.Select("s.user_name", "s.first_name", "s.last_name", "s.email", "s.user_status", "s.department").
+			Column("CAST(? AS TIMESTAMPTZ)", now).
+			Column("CAST(? AS TIMESTAMPTZ)", now).
+			Column("s.email_hash").
+			Column("s.email_domain_hash").
+			From(bulkStagingTable + " s").
+			// Emails are compared by blind index once encrypted
+			Where("NOT EXISTS (SELECT 1 FROM " + DbName + " u WHERE LOWER(u.user_name) = LOWER(s.user_name) OR LOWER(u.email) = LOWER(s.email) OR u.email_hash = s.email_hash)").
+			OrderBy("s.row_num")).
+		// A user created concurrently since the check is skipped, not fatal
+		Suffix("ON CONFLICT DO NOTHING RETURNING user_id, user_name").
+		PlaceholderFormat(r.dialect.Placeholder).
+		ToSql()
+	if err != nil {
+		log.Print("failed to build merge sql: ", err)
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Print("query failure: ", err)
+		return err
+	}
+	defer rows.Close()
+
+	created := make(map[string]int64, len(pending))
+	for rows.Next() {
+		var (
+			userID   int64
+			userName string
+		)
+		if err := rows.Scan(&userID, &userName); err != nil {
+			log.Print("row scan error: ", err)
+			return err
+		}
+		created[normalizedKey(userName)] = userID
+	}
+	if err := rows.Err(); err != nil {
+		log.Print("rows iteration error: ", err)
+		return err
+	}
+
+	// Rows that weren't created collided with an existing user. Those whose
+	// user_name is taken are reported as such; the rest clashed on email.
+	takenUserNames, err := r.stagedUserNamesTaken(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	var audits, events [][]interface{}
+
+	for _, p := range pending {
+		userID, ok := created[normalizedKey(p.user.UserName)]
+		if !ok {
+			if takenUserNames[p.row] {
+				results[p.row].Outcome = BulkDuplicateUserName
+			} else {
+				results[p.row].Outcome = BulkDuplicateEmail
+			}
+			continue
+		}
+
+		u := p.user
+		u.ID = userID
+		u.Version = 1
+		u.CreatedAt = now
+		u.UpdatedAt = now
+
+		results[p.row].Outcome = BulkCreated
+		results[p.row].UserID = userID
+
+		entry := newAuditEntry(actor, OpCreate, nil, &u)
+
+		auditDB, err := entry.ConvertToAuditDB(r.keys)
+		if err != nil {
+			return err
+		}
+		audits = append(audits, []interface{}{auditDB.UserID, auditDB.Actor, auditDB.Operation, string(auditDB.Changes), auditDB.CreatedAt})
+
+		event := newEvent(entry, &u)
+
+		outboxDB, err := event.ConvertToOutboxDB(r.keys)
+		if err != nil {
+			return err
+		}
+		events = append(events, []interface{}{outboxDB.UserID, outboxDB.EventType, string(outboxDB.Payload), outboxDB.Status, outboxDB.NextAttemptAt, outboxDB.CreatedAt})
+	}
+
+	if len(audits) == 0 {
+		return nil
+	}
+
+	if err := copyIn(ctx, tx, AuditTable, []string{"user_id", "actor", "operation", "changes", "created_at"}, audits); err != nil {
+		return err
+	}
+
+	return copyIn(ctx, tx, OutboxTable, []string{"user_id", "event_type", "payload", "status", "next_attempt_at", "created_at"}, events)
+}
+
+// Returns the staged rows whose user_name belongs to a user in the table
+func (r *SQLRepository) stagedUserNamesTaken(ctx context.Context, tx *sql.Tx) (map[int]bool, error) {
+	query, args, err := sq.Select("s.row_num").
+		From(bulkStagingTable + " s").
+		Where("EXISTS (SELECT 1 FROM " + DbName + " u WHERE LOWER(u.user_name) = LOWER(s.user_name))").
+		PlaceholderFormat(r.dialect.Placeholder).
+		ToSql()
+	if err != nil {
+		log.Print("failed to build select sql: ", err)
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Print("query failure: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	taken := make(map[int]bool)
+	for rows.Next() {
+		var row int
+		if err := rows.Scan(&row); err != nil {
+			log.Print("row scan error: ", err)
+			return nil, err
+		}
+		taken[row] = true
+	}
+	if err := rows.Err(); err != nil {
+		log.Print("rows iteration error: ", err)
+		return nil, err
+	}
+
+	return taken, nil
+}
+
+// Streams rows into table with COPY FROM STDIN
+func copyIn(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		log.Print("failed to start copy: ", err)
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			log.Print("failed to copy row: ", err)
+			return err
+		}
+	}
+
+	// An Exec without arguments flushes the buffered rows
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		log.Print("failed to finish copy into ", table, ": ", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *SQLRepository) Update(ctx context.Context, u *User, expectedVersion int64, actor string) (*User, error) {
+	if u.ID == 0 {
+		return nil, ErrMissingUserID
+	}
+
+	u.Normalize()
+
+	updateValues := make(map[string]interface{})
+
+	// Only update the values given
+	if u.UserName != "" {
+		updateValues["user_name"] = u.UserName
+	}
+
+	// Encrypted when there is a keyring; values not given stay empty
+	sealed, err := u.ConvertToUserDB(r.keys)
+	if err != nil {
+		log.Print("failed to encrypt user: ", err)
+		return nil, err
+	}
+
+	if u.FirstName != "" {
+		updateValues["first_name"] = sealed.FirstName
+	}
+
+	if u.LastName != "" {
+		updateValues["last_name"] = sealed.LastName
+	}
+
+	if u.Email != "" {
+		updateValues["email"] = sealed.Email
+		if sealed.EmailHash.Valid {
+			updateValues["email_hash"] = sealed.EmailHash
+			updateValues["email_domain_hash"] = sealed.EmailDomainHash
+		}
+	}
+
+	if u.UserStatus != "" {
+		updateValues["user_status"] = u.UserStatus
+	}
+
+	if u.Department != nil {
+		updateValues["department"] = u.Department
+	}
+
+	if len(updateValues) == 0 {
+		return nil, ErrUpdateUserMissingValues
+	}
+
+	user, err := r.updateUser(ctx, u.ID, updateValues, expectedVersion, actor)
+	if err == ErrUserNotFound {
+		return nil, ErrUpdateUserNoRows
+	}
+
+	return user, err
+}
+
+// Replaces every field a client can set, clearing `department` when it's
+// nil. A missing or deleted user is ErrUserNotFound.
+func (r *SQLRepository) Replace(ctx context.Context, u *User, expectedVersion int64, actor string) (*User, error) {
+	if u.ID == 0 {
+		return nil, ErrMissingUserID
+	}
+
+	u.Normalize()
+
+	sealed, err := u.ConvertToUserDB(r.keys)
+	if err != nil {
+		log.Print("failed to encrypt user: ", err)
+		return nil, err
+	}
+
+	replaceValues := map[string]interface{}{
+		"user_name":   u.UserName,
+		"first_name":  sealed.FirstName,
+		"last_name":   sealed.LastName,
+		"email":       sealed.Email,
+		"user_status": u.UserStatus,
+		"department":  sealed.Department,
+	}
+
+	if sealed.EmailHash.Valid {
+		replaceValues["email_hash"] = sealed.EmailHash
+		replaceValues["email_domain_hash"] = sealed.EmailDomainHash
+	}
+
+	return r.updateUser(ctx, u.ID, replaceValues, expectedVersion, actor)
+}
+
+// Sets values on a live user at expectedVersion, bumping its version and
+// recording the change. A missing or deleted user is ErrUserNotFound.
+func (r *SQLRepository) updateUser(ctx context.Context, id int64, values map[string]interface{}, expectedVersion int64, actor string) (*User, error) {
+	values["version"] = sq.Expr("version + 1")
+	values["updated_at"] = timestamp()
+
+	// Deleted users must be restored before they can be changed
+	update := sq.Update(DbName).
+		SetMap(values).
+		Where(sq.Eq{"user_id": id, "deleted_at": nil}).
+		PlaceholderFormat(r.dialect.Placeholder)
+
+	if r.dialect.Returning {
+		update = update.Suffix("RETURNING user_id")
+	}
+
+	query, args, err := update.ToSql()
+	if err != nil {
+		log.Print("failed to build update sql: ", err)
+		return nil, err
+	}
+
+	var user *User
+
+	err = r.withTx(ctx, func(tx *sql.Tx) error {
+		before, err := r.lockLiveUser(ctx, tx, id, expectedVersion)
+		if err != nil {
+			return err
+		}
+
+		// Changing to a taken `user_name` or `email` trips a unique index,
+		// and a value the schema doesn't allow a CHECK constraint
+		if err := r.execAffectingUser(ctx, tx, query, args); err != nil {
+			if conflict := uniqueConflict(err); conflict != nil {
+				return conflict
+			} else if invalid := invalidField(err); invalid != nil {
+				return invalid
+			}
+			return err
+		}
+
+		// Pull the updated user's data
+		user, err = r.getUser(ctx, tx, id, GetOptions{}, false)
+		if err != nil {
+			return err
+		}
+
+		return r.recordChange(ctx, tx, newAuditEntry(actor, OpUpdate, before, user), user)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Soft deletes the user by stamping `deleted_at`
+func (r *SQLRepository) Delete(ctx context.Context, id int64, expectedVersion int64, actor string) error {
+	deletedAt := timestamp()
+
+	query, args, err := sq.Update(DbName).
+		Set("deleted_at", deletedAt).
+		Set("updated_at", deletedAt).
+		Set("version", sq.Expr("version + 1")).
+		Where(sq.Eq{"user_id": id, "deleted_at": nil}).
+		PlaceholderFormat(r.dialect.Placeholder).
+		ToSql()
+	if err != nil {
+		log.Print("failed to build delete sql: ", err)
+		return err
+	}
+
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		before, err := r.lockLiveUser(ctx, tx, id, expectedVersion)
+		if err != nil {
+			return err
+		}
+
+		if err := r.execAffectingUser(ctx, tx, query, args); err != nil {
+			return err
+		}
+
+		after := *before
+		after.DeletedAt = &deletedAt
+		after.UpdatedAt = deletedAt
+		after.Version++
+
+		return r.recordChange(ctx, tx, newAuditEntry(actor, OpDelete, before, &after), &after)
+	})
+}
+
+// Clears `deleted_at` on a soft-deleted user
+func (r *SQLRepository) Restore(ctx context.Context, id int64, actor string) (*User, error) {
+	restoredAt := timestamp()
+
+	query, args, err := sq.Update(DbName).
+		Set("deleted_at", nil).
+		Set("updated_at", restoredAt).
+		Set("version", sq.Expr("version + 1")).
+		Where(sq.Eq{"user_id": id}).
+		Where(sq.NotEq{"deleted_at": nil}).
+		PlaceholderFormat(r.dialect.Placeholder).
+		ToSql()
+	if err != nil {
+		log.Print("failed to build restore sql: ", err)
+		return nil, err
+	}
+
+	var restored User
+
+	err = r.withTx(ctx, func(tx *sql.Tx) error {
+		before, err := r.getUser(ctx, tx, id, GetOptions{IncludeDeleted: true}, true)
+		if err != nil {
+			return err
+		}
+
+		// Tell a live user apart from a missing one
+		if before.DeletedAt == nil {
+			return ErrUserNotDeleted
+		}
+
+		if err := r.execAffectingUser(ctx, tx, query, args); err != nil {
+			return err
+		}
+
+		restored = *before
+		restored.DeletedAt = nil
+		restored.UpdatedAt = restoredAt
+		restored.Version++
+
+		return r.recordChange(ctx, tx, newAuditEntry(actor, OpRestore, before, &restored), &restored)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &restored, nil
+}
+
+// Permanently removes the user, deleted or not. The audit trail is kept.
+func (r *SQLRepository) Purge(ctx context.Context, id int64, actor string) error {
+	query, args, err := sq.Delete(DbName).
+		Where(sq.Eq{"user_id": id}).
+		PlaceholderFormat(r.dialect.Placeholder).
+		ToSql()
+	if err != nil {
+		log.Print("failed to build purge sql: ", err)
+		return err
+	}
+
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		before, err := r.getUser(ctx, tx, id, GetOptions{IncludeDeleted: true}, true)
+		if err != nil {
+			return err
+		}
+
+		if err := r.execAffectingUser(ctx, tx, query, args); err != nil {
+			return err
+		}
+
+		return r.recordChange(ctx, tx, newAuditEntry(actor, OpPurge, before, nil), nil)
+	})
+}
+
+func (r *SQLRepository) History(ctx context.Context, userID int64, opts HistoryOptions) ([]AuditEntry, error) {
+	if userID == 0 {
+		return nil, ErrMissingUserID
+	}
+
+	selectEntries := sq.Select(db.AuditColumns).
+		From(AuditTable).
+		Where(sq.Eq{"user_id": userID}).
+		OrderBy("created_at DESC", "audit_id DESC").
+		PlaceholderFormat(r.dialect.Placeholder)
+
+	if opts.From != nil {
+		selectEntries = selectEntries.Where(sq.GtOrEq{"created_at": opts.From.UTC()})
+	}
+
+	if opts.To != nil {
+		selectEntries = selectEntries.Where(sq.Lt{"created_at": opts.To.UTC()})
+	}
+
+	if opts.Operation != "" {
+		selectEntries = selectEntries.Where(sq.Eq{"operation": opts.Operation})
+	}
+
+	if opts.Limit > 0 {
+		selectEntries = selectEntries.Limit(uint64(opts.Limit))
+
+		if opts.Offset > 0 {
+			selectEntries = selectEntries.Offset(uint64(opts.Offset))
+		}
+	}
+
+	query, args, err := selectEntries.ToSql()
+	if err != nil {
+		log.Print("failed to build history sql: ", err)
+		return nil, err
+	}
+
+	var entries []AuditEntry
+
+	err = r.read(ctx, func(q queryer) error {
+		entries = []AuditEntry{}
+
+		rows, err := q.QueryContext(ctx, query, args...)
+		if err != nil {
+			log.Print("query failure: ", err)
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var adb db.AuditDB
+			if err := rows.Scan(adb.ScanFields()...); err != nil {
+				log.Print("row scan failure: ", err)
+				return err
+			}
+
+			entry, err := ConvertToAuditEntry(&adb, r.keys)
+			if err != nil {
+				log.Print("invalid audit changes: ", err)
+				return err
+			}
+
+			entries = append(entries, entry)
+		}
+
+		if err := rows.Err(); err != nil {
+			log.Print("rows iteration error: ", err)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+var _ VersionStore = (*SQLRepository)(nil)
+
+func (r *SQLRepository) PruneVersions(ctx context.Context, cutoff time.Time) (int64, error) {
+	query, args, err := sq.Delete(HistoryTable).
+		Where(sq.Lt{"valid_to": cutoff.UTC()}).
+		PlaceholderFormat(r.dialect.Placeholder).
+		ToSql()
+	if err != nil {
+		log.Print("failed to build prune sql: ", err)
+		return 0, err
+	}
+
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		log.Print("query failure: ", err)
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+var _ KeyStore = (*SQLRepository)(nil)
+
+func (r *SQLRepository) RotateKeys(ctx context.Context, batchSize int) (int64, error) {
+	if r.keys == nil {
+		return 0, ErrNoKeyring
+	}
+
+	if batchSize < 1 {
+		return 0, ErrInvalidBatchSize
+	}
+
+	rotated, err := r.rotateTable(ctx, DbName, "user_id", batchSize)
+	if err != nil {
+		return rotated, err
+	}
+
+	versions, err := r.rotateTable(ctx, HistoryTable, "history_id", batchSize)
+	rotated += versions
+	if err != nil {
+		return rotated, err
+	}
+
+	audits, err := r.rotateDocuments(ctx, AuditTable, "audit_id", "changes", batchSize, rewrapChanges)
+	rotated += audits
+	if err != nil {
+		return rotated, err
+	}
+
+	events, err := r.rotateDocuments(ctx, OutboxTable, "event_id", "payload", batchSize, rewrapPayload)
+	return rotated + events, err
+}
+
+// A row of PII as stored, keyed by the table's primary key
+type storedPII struct {
+	id                         int64
+	firstName, lastName, email string
+	emailDomainHash            sql.NullString
+}
+
+// Rewrites the PII of every row of table under the primary key, in batches
+// ordered by idColumn. Rows already under it are skipped.
+func (r *SQLRepository) rotateTable(ctx context.Context, table string, idColumn string, batchSize int) (int64, error) {
+	var rotated, after int64
+
+	for {
+		var batch int
+
+		err := r.withTx(ctx, func(tx *sql.Tx) error {
+			rows, err := r.lockPII(ctx, tx, table, idColumn, after, batchSize)
+			if err != nil {
+				return err
+			}
+
+			batch = len(rows)
+
+			for _, row := range rows {
+				after = row.id
+
+				changed, err := r.rotateRow(ctx, tx, table, idColumn, row)
+				if err != nil {
+					return err
+				}
+				if changed {
+					rotated++
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return rotated, err
+		}
+
+		if batch < batchSize {
+			return rotated, nil
+		}
+	}
+}
+
+// Reads and locks the next batch of rows after the given id
+func (r *SQLRepository) lockPII(ctx context.Context, tx *sql.Tx, table string, idColumn string, after int64, limit int) ([]storedPII, error) {
+	selectRows := sq.Select(idColumn, "first_name", "last_name", "email", "email_domain_hash").
+		From(table).
+		Where(sq.Gt{idColumn: after}).
+		OrderBy(idColumn).
+		Limit(uint64(limit)).
+		PlaceholderFormat(r.dialect.Placeholder)
+
+	if r.dialect.ForUpdate {
+		selectRows = selectRows.Suffix("FOR UPDATE")
+	}
+
+	query, args, err := selectRows.ToSql()
+	if err != nil {
+		log.Print("failed to build select sql: ", err)
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Print("query failure: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stored []storedPII
+	for rows.Next() {
+		var row storedPII
+		if err := rows.Scan(&row.id, &row.firstName, &row.lastName, &row.email, &row.emailDomainHash); err != nil {
+			log.Print("row scan error: ", err)
+			return nil, err
+		}
+		stored = append(stored, row)
+	}
+	if err := rows.Err(); err != nil {
+		log.Print("rows iteration error: ", err)
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// Brings one row under the primary key, reporting whether it was rewritten
+func (r *SQLRepository) rotateRow(ctx context.Context, tx *sql.Tx, table string, idColumn string, row storedPII) (bool, error) {
+	firstName, firstChanged, err := r.keys.Rewrap(row.firstName)
+	if err != nil {
+		return false, err
+	}
+
+	lastName, lastChanged, err := r.keys.Rewrap(row.lastName)
+	if err != nil {
+		return false, err
+	}
+
+	email, emailChanged, err := r.keys.Rewrap(row.email)
+	if err != nil {
+		return false, err
+	}
+
+	// Rows encrypted before emails' domains were indexed get their index
+	// too
+	if !firstChanged && !lastChanged && !emailChanged && row.emailDomainHash.Valid {
+		return false, nil
+	}
+
+	update := sq.Update(table).
+		Set("first_name", firstName).
+		Set("last_name", lastName).
+		Set("email", email).
+		Where(sq.Eq{idColumn: row.id}).
+		PlaceholderFormat(r.dialect.Placeholder)
+
+	// A plaintext email gets the blind index encrypted ones have
+	if table == DbName && !db.IsEncrypted(row.email) {
+		update = update.Set("email_hash", emailHash(r.keys, row.email))
+	}
+
+	if !row.emailDomainHash.Valid {
+		plain, err := r.keys.Decrypt(row.email)
+		if err != nil {
+			return false, err
+		}
+		update = update.Set("email_domain_hash", emailDomainHash(r.keys, plain))
+	}
+
+	query, args, err := update.ToSql()
+	if err != nil {
+		log.Print("failed to build rotate sql: ", err)
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		log.Print("failed to rotate keys of ", table, " row ", row.id, ": ", err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Applies fn to the PII values of a JSON document as stored, returning the
+// document rewritten
+type documentMapper func(doc []byte, fn func(string) (string, error)) ([]byte, error)
+
+func rewrapChanges(doc []byte, fn func(string) (string, error)) ([]byte, error) {
+	var changes map[string]FieldChange
+	if err := json.Unmarshal(doc, &changes); err != nil {
+		return nil, err
+	}
+
+	rewrapped, err := mapPIIChanges(changes, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(rewrapped)
+}
+
+func rewrapPayload(doc []byte, fn func(string) (string, error)) ([]byte, error) {
+	var payload eventPayload
+	if err := json.Unmarshal(doc, &payload); err != nil {
+		return nil, err
+	}
+
+	rewrapped, err := payload.mapPII(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(rewrapped)
+}
+
+// Rewrites the PII values inside a JSON column of every row of table under
+// the primary key, in batches ordered by idColumn. Rows whose values are all
+// under it already are skipped.
+func (r *SQLRepository) rotateDocuments(ctx context.Context, table string, idColumn string, column string, batchSize int, rewrap documentMapper) (int64, error) {
+	var rotated, after int64
+
+	for {
+		var batch int
+
+		err := r.withTx(ctx, func(tx *sql.Tx) error {
+			selectRows := sq.Select(idColumn, column).
+				From(table).
+				Where(sq.Gt{idColumn: after}).
+				OrderBy(idColumn).
+				Limit(uint64(batchSize)).
+				PlaceholderFormat(r.dialect.Placeholder)
+
+			if r.dialect.ForUpdate {
+				selectRows = selectRows.Suffix("FOR UPDATE")
+			}
+
+			query, args, err := selectRows.ToSql()
+			if err != nil {
+				log.Print("failed to build select sql: ", err)
+				return err
+			}
+
+			docs, err := scanDocuments(ctx, tx, query, args)
+			if err != nil {
+				return err
+			}
+
+			batch = len(docs)
+
+			for _, doc := range docs {
+				after = doc.id
+
+				changed := false
+				rewrapped, err := rewrap(doc.value, func(value string) (string, error) {
+					if value == "" {
+						return value, nil
+					}
+
+					rewrapped, ok, err := r.keys.Rewrap(value)
+					changed = changed || ok
+					return rewrapped, err
+				})
+				if err != nil {
+					log.Print("failed to rotate keys of ", table, " row ", doc.id, ": ", err)
+					return err
+				}
+
+				if !changed {
+					continue
+				}
+
+				query, args, err := sq.Update(table).
+					Set(column, string(rewrapped)).
+					Where(sq.Eq{idColumn: doc.id}).
+					PlaceholderFormat(r.dialect.Placeholder).
+					ToSql()
+				if err != nil {
+					log.Print("failed to build rotate sql: ", err)
+					return err
+				}
+
+				if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+					log.Print("failed to rotate keys of ", table, " row ", doc.id, ": ", err)
+					return err
+				}
+
+				rotated++
+			}
+
+			return nil
+		})
+		if err != nil {
+			return rotated, err
+		}
+
+		if batch < batchSize {
+			return rotated, nil
+		}
+	}
+}
+
+// A JSON column as stored, keyed by the table's primary key
+type storedDocument struct {
+	id    int64
+	value []byte
+}
+
+func scanDocuments(ctx context.Context, tx *sql.Tx, query string, args []interface{}) ([]storedDocument, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
-		log.Print("failed to build select sql: ", err)
+		log.Print("query failure: ", err)
 		return nil, err
 	}
+	defer rows.Close()
 
-	var results []User
+	var docs []storedDocument
+	for rows.Next() {
+		var doc storedDocument
+		if err := rows.Scan(&doc.id, &doc.value); err != nil {
+			log.Print("row scan error: ", err)
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	if err := rows.Err(); err != nil {
+		log.Print("rows iteration error: ", err)
+		return nil, err
+	}
+
+	return docs, nil
+}
+
+var _ OutboxStore = (*SQLRepository)(nil)
+
+func (r *SQLRepository) ClaimEvents(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	now := time.Now().UTC()
+
+	// An event waits while an earlier one of its user is still pending, even
+	// one that isn't due yet
+	selectDue := sq.Select(db.OutboxColumns).
+		From(OutboxTable).
+		Where(sq.Eq{"status": EventPending}).
+		Where(sq.LtOrEq{"next_attempt_at": now}).
+		Where(sq.Expr("NOT EXISTS (SELECT 1 FROM "+OutboxTable+" earlier WHERE earlier.user_id = "+OutboxTable+".user_id AND earlier.status = ? AND earlier.event_id < "+OutboxTable+".event_id)", EventPending)).
+		OrderBy("event_id").
+		Limit(uint64(limit)).
+		PlaceholderFormat(r.dialect.Placeholder)
+
+	// Concurrent relays each take different events instead of queueing
+	if r.dialect.ForUpdate {
+		selectDue = selectDue.Suffix("FOR UPDATE SKIP LOCKED")
+	}
+
+	query, args, err := selectDue.ToSql()
+	if err != nil {
+		log.Print("failed to build claim sql: ", err)
+		return nil, err
+	}
+
+	var events []OutboxEvent
+
+	err = r.withTx(ctx, func(tx *sql.Tx) error {
+		events, err = r.queryEvents(ctx, tx, query, args)
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		ids := make([]int64, len(events))
+		for i, event := range events {
+			ids[i] = event.ID
+		}
+
+		// Pushing next_attempt_at past the lease hides the events from other
+		// relays. If this relay dies, they become due again when it runs out.
+		leaseUntil := now.Add(lease)
+
+		query, args, err := sq.Update(OutboxTable).
+			Set("next_attempt_at", leaseUntil).
+			Where(sq.Eq{"event_id": ids}).
+			PlaceholderFormat(r.dialect.Placeholder).
+			ToSql()
+		if err != nil {
+			log.Print("failed to build claim sql: ", err)
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			log.Print("query failure: ", err)
+			return err
+		}
+
+		for i := range events {
+			events[i].NextAttemptAt = leaseUntil
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (r *SQLRepository) MarkDelivered(ctx context.Context, eventID int64) error {
+	return r.updatePendingEvent(ctx, eventID, map[string]interface{}{
+		"status":       EventDelivered,
+		"attempts":     sq.Expr("attempts + 1"),
+		"last_error":   nil,
+		"delivered_at": timestamp(),
+	})
+}
+
+func (r *SQLRepository) MarkFailed(ctx context.Context, eventID int64, lastError string, retryAt time.Time) error {
+	return r.updatePendingEvent(ctx, eventID, map[string]interface{}{
+		"attempts":        sq.Expr("attempts + 1"),
+		"last_error":      lastError,
+		"next_attempt_at": retryAt.UTC(),
+	})
+}
+
+func (r *SQLRepository) MarkDead(ctx context.Context, eventID int64, lastError string) error {
+	return r.updatePendingEvent(ctx, eventID, map[string]interface{}{
+		"status":     EventDead,
+		"attempts":   sq.Expr("attempts + 1"),
+		"last_error": lastError,
+	})
+}
+
+func (r *SQLRepository) Events(ctx context.Context, opts OutboxOptions) ([]OutboxEvent, error) {
+	selectEvents := sq.Select(db.OutboxColumns).
+		From(OutboxTable).
+		OrderBy("event_id").
+		PlaceholderFormat(r.dialect.Placeholder)
+
+	if opts.Status != "" {
+		selectEvents = selectEvents.Where(sq.Eq{"status": opts.Status})
+	}
+
+	if opts.Limit > 0 {
+		selectEvents = selectEvents.Limit(uint64(opts.Limit))
+
+		if opts.Offset > 0 {
+			selectEvents = selectEvents.Offset(uint64(opts.Offset))
+		}
+	}
 
-	rows, err := dbcon.Query(query, args...)
+	query, args, err := selectEvents.ToSql()
+	if err != nil {
+		log.Print("failed to build outbox sql: ", err)
+		return nil, err
+	}
+
+	// Read from the primary: the relay changes these rows constantly and an
+	// operator requeueing an event wants to see the result
+	events, err := r.queryEvents(ctx, r.db, query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if events == nil {
+		events = []OutboxEvent{}
+	}
+
+	return events, nil
+}
+
+func (r *SQLRepository) RequeueEvent(ctx context.Context, eventID int64) error {
+	query, args, err := sq.Select("status").
+		From(OutboxTable).
+		Where(sq.Eq{"event_id": eventID}).
+		PlaceholderFormat(r.dialect.Placeholder).
+		ToSql()
+	if err != nil {
+		log.Print("failed to build requeue sql: ", err)
+		return err
+	}
+
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		var status string
+
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&status)
+		if err == sql.ErrNoRows {
+			return ErrEventNotFound
+		} else if err != nil {
+			log.Print("row scan error: ", err)
+			return err
+		}
+
+		if status != EventDead {
+			return ErrEventNotDead
+		}
+
+		query, args, err := sq.Update(OutboxTable).
+			Set("status", EventPending).
+			Set("attempts", 0).
+			Set("last_error", nil).
+			Set("next_attempt_at", timestamp()).
+			Where(sq.Eq{"event_id": eventID}).
+			PlaceholderFormat(r.dialect.Placeholder).
+			ToSql()
+		if err != nil {
+			log.Print("failed to build requeue sql: ", err)
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			log.Print("query failure: ", err)
+			return err
+		}
+
+		return nil
+	})
+}
+
+// Applies values to a pending event, returning ErrEventNotFound when there
+// is none with eventID
+func (r *SQLRepository) updatePendingEvent(ctx context.Context, eventID int64, values map[string]interface{}) error {
+	query, args, err := sq.Update(OutboxTable).
+		SetMap(values).
+		Where(sq.Eq{"event_id": eventID, "status": EventPending}).
+		PlaceholderFormat(r.dialect.Placeholder).
+		ToSql()
+	if err != nil {
+		log.Print("failed to build outbox sql: ", err)
+		return err
+	}
+
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		log.Print("query failure: ", err)
+		return err
+	}
+
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if numRows == 0 {
+		return ErrEventNotFound
+	}
+
+	return nil
+}
+
+func (r *SQLRepository) queryEvents(ctx context.Context, q queryer, query string, args []interface{}) ([]OutboxEvent, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
 	if err != nil {
 		log.Print("query failure: ", err)
 		return nil, err
 	}
 	defer rows.Close()
 
+	var events []OutboxEvent
+
 	for rows.Next() {
-		var udb db.UserDB
-		if err := rows.Scan(
-			&udb.UserID,
-			&udb.UserName,
-			&udb.FirstName,
-			&udb.LastName,
-			&udb.Email,
-			&udb.UserStatus,
-			&udb.Department,
-		); err != nil {
+		var odb db.OutboxDB
+		if err := rows.Scan(odb.ScanFields()...); err != nil {
 			log.Print("row scan failure: ", err)
 			return nil, err
 		}
 
-		// Need to convert the UserDB into User
-		results = append(results, ConvertToUser(&udb))
+		event, err := ConvertToOutboxEvent(&odb, r.keys)
+		if err != nil {
+			log.Print("invalid outbox payload: ", err)
+			return nil, err
+		}
+
+		events = append(events, event)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -50,19 +1675,79 @@ func GetAllUsers(dbcon *sql.DB) ([]User, error) {
 		return nil, err
 	}
 
-	return results, nil
+	return events, nil
+}
+
+// Satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Starts transactions on the primary or the replica, whichever a read runs
+// on
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// Runs a read on the replica while it is healthy, unless ctx asks for the
+// primary. A read that can't reach the replica is retried on the primary.
+func (r *SQLRepository) read(ctx context.Context, fn func(q queryer) error) error {
+	if r.replica == nil || !r.replica.Healthy() || db.PrimaryRequested(ctx) {
+		return fn(r.db)
+	}
+
+	err := fn(r.replica.DB())
+	if db.IsConnError(err) {
+		r.replica.MarkUnhealthy(err)
+		return fn(r.db)
+	}
+
+	return err
+}
+
+// Runs fn in a transaction, committing only if it succeeds
+func (r *SQLRepository) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Print("failed to begin transaction: ", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func GetUser(dbcon *sql.DB, id int64) (*User, error) {
+func (r *SQLRepository) getUser(ctx context.Context, q queryer, id int64, opts GetOptions, forUpdate bool) (*User, error) {
 	if id == 0 {
 		return nil, ErrMissingUserID
 	}
 
-	query, args, err := sq.Select(db.AllColumns).
-		From(DbName).
+	selectUser := sq.Select(db.AllColumns).
+		From(DbName)
+
+	if opts.AsOf != nil {
+		selectUser = selectAsOf(*opts.AsOf)
+	}
+
+	selectUser = selectUser.
 		Where(sq.Eq{"user_id": id}).
-		PlaceholderFormat(sq.Dollar).
-		ToSql()
+		PlaceholderFormat(r.dialect.Placeholder)
+
+	if !opts.IncludeDeleted {
+		selectUser = selectUser.Where(sq.Eq{"deleted_at": nil})
+	}
+
+	if forUpdate && r.dialect.ForUpdate {
+		selectUser = selectUser.Suffix("FOR UPDATE")
+	}
+
+	query, args, err := selectUser.ToSql()
 	if err != nil {
 		log.Print("failed to build select sql: ", err)
 		return nil, err
@@ -70,15 +1755,7 @@ func GetUser(dbcon *sql.DB, id int64) (*User, error) {
 
 	var result db.UserDB
 
-	err = dbcon.QueryRow(query, args...).Scan(
-		&result.UserID,
-		&result.UserName,
-		&result.FirstName,
-		&result.LastName,
-		&result.Email,
-		&result.UserStatus,
-		&result.Department,
-	)
+	err = q.QueryRowContext(ctx, query, args...).Scan(result.ScanFields()...)
 	if err == sql.ErrNoRows {
 		return nil, ErrUserNotFound
 	} else if err != nil {
@@ -86,156 +1763,204 @@ func GetUser(dbcon *sql.DB, id int64) (*User, error) {
 		return nil, err
 	}
 
-	user := ConvertToUser(&result)
+	user, err := ConvertToUser(&result, r.keys)
+	if err != nil {
+		log.Print("failed to decrypt user: ", err)
+		return nil, err
+	}
+
 	return &user, nil
 }
 
-// Returns true if `user_name` exists
-func CheckUserNameExists(dbcon *sql.DB, userName string) (bool, error) {
-	if userName == "" {
-		return false, ErrMissingUserName
-	}
+// Selects every user as it was at asOf: the current row if it was already
+// current then, otherwise the version that was
+func selectAsOf(asOf time.Time) sq.SelectBuilder {
+	asOf = asOf.UTC()
 
-	query, args, err := sq.Select("COUNT(*)").
+	// Subqueries take ? placeholders; the outer query converts them. They
+	// carry email_domain_hash for lists to filter on.
+	versions := sq.Select(db.AllColumns, "email_domain_hash").
+		From(HistoryTable).
+		Where(sq.LtOrEq{"updated_at": asOf}).
+		Where(sq.Gt{"valid_to": asOf})
+
+	current := sq.Select(db.AllColumns, "email_domain_hash").
 		From(DbName).
-		Where(sq.Eq{"user_name": userName}).
-		PlaceholderFormat(sq.Dollar).
-		ToSql()
-	if err != nil {
-		log.Print("failed to build select sql: ", err)
-		return false, err
-	}
+		Where(sq.LtOrEq{"updated_at": asOf}).
+		SuffixExpr(sq.ConcatExpr("UNION ALL ", versions))
 
-	var count int
+	return sq.Select(db.AllColumns).FromSelect(current, "users_as_of")
+}
 
-	err = dbcon.QueryRow(query, args...).Scan(&count)
+// Locks a live user for the rest of the transaction, checking it is still
+// at expectedVersion (when non-zero)
+func (r *SQLRepository) lockLiveUser(ctx context.Context, tx *sql.Tx, id int64, expectedVersion int64) (*User, error) {
+	user, err := r.getUser(ctx, tx, id, GetOptions{}, true)
 	if err != nil {
-		log.Print("row scan error: ", err)
-		return false, err
+		return nil, err
+	}
+
+	if expectedVersion != 0 && user.Version != expectedVersion {
+		return nil, ErrVersionMismatch
 	}
 
-	return (count == 1), nil
+	return user, nil
 }
 
-func CreateUser(dbcon *sql.DB, u *User) (*User, error) {
-	// Check if the `user_name` already exists
-	userExists, err := CheckUserNameExists(dbcon, u.UserName)
-	if err != nil {
-		return nil, err
+func (r *SQLRepository) existsByUserName(ctx context.Context, q queryer, userName string) (bool, error) {
+	if strings.TrimSpace(userName) == "" {
+		return false, ErrMissingUserName
 	}
 
-	if userExists {
-		return nil, ErrUserExists
+	return r.existsByNormalized(ctx, q, "user_name", userName)
+}
+
+// Returns true if a user has value in column, ignoring case and surrounding
+// whitespace the same way the unique indexes do
+func (r *SQLRepository) existsByNormalized(ctx context.Context, q queryer, column string, value string) (bool, error) {
+	return r.exists(ctx, q, sq.Expr("LOWER("+column+") = LOWER(?)", strings.TrimSpace(value)))
+}
+
+// Like existsByNormalized for email, which is matched by its blind index
+// once encrypted. Rows from before the keyring are still matched in
+// plaintext.
+func (r *SQLRepository) existsByEmail(ctx context.Context, q queryer, email string) (bool, error) {
+	var match sq.Sqlizer = sq.Expr("LOWER(email) = LOWER(?)", strings.TrimSpace(email))
+
+	if hash := emailHash(r.keys, email); hash.Valid {
+		match = sq.Or{match, sq.Eq{"email_hash": hash.String}}
 	}
 
-	// Need to convert the User into UserDB
-	userDB := u.ConvertToUserDB()
+	return r.exists(ctx, q, match)
+}
 
-	query, args, err := sq.Insert(DbName).
-		Columns("user_name", "first_name", "last_name", "email", "user_status", "department").
-		Values(userDB.UserName, userDB.FirstName, userDB.LastName, userDB.Email, userDB.UserStatus, userDB.Department).
-		Suffix("RETURNING user_id").
-		PlaceholderFormat(sq.Dollar).
+func (r *SQLRepository) exists(ctx context.Context, q queryer, match sq.Sqlizer) (bool, error) {
+	query, args, err := sq.Select("COUNT(*)").
+		From(DbName).
+		Where(match).
+		PlaceholderFormat(r.dialect.Placeholder).
 		ToSql()
 	if err != nil {
-		log.Print("failed to build create sql: ", err)
-		return nil, err
+		log.Print("failed to build select sql: ", err)
+		return false, err
 	}
 
-	// Execute the update and add the `user_id` to the result
-	var lastInsertID int64
-	err = dbcon.QueryRow(query, args...).Scan(&lastInsertID)
+	var count int
+
+	err = q.QueryRowContext(ctx, query, args...).Scan(&count)
 	if err != nil {
-		log.Print("query failure: ", err)
-		return nil, err
+		log.Print("row scan error: ", err)
+		return false, err
 	}
 
-	u.ID = lastInsertID
-
-	return u, nil
+	return (count > 0), nil
 }
 
-func UpdateUser(dbcon *sql.DB, u *User) (*User, error) {
-	if u.ID == 0 {
-		return nil, ErrMissingUserID
+// Maps a unique violation to the field it conflicts on, or returns nil for
+// any other error
+func uniqueConflict(err error) error {
+	index, ok := db.UniqueViolation(err)
+	if !ok {
+		return nil
 	}
 
-	updateValues := make(map[string]interface{})
-
-	// Only update the values given
-	if u.UserName != "" {
-		updateValues["user_name"] = u.UserName
+	switch index {
+	case db.IndexUsersEmail, db.IndexUsersEmailHash, DbName + ".email_hash":
+		return ErrEmailExists
 	}
 
-	if u.FirstName != "" {
-		updateValues["first_name"] = u.FirstName
-	}
+	return ErrUserExists
+}
 
-	if u.LastName != "" {
-		updateValues["last_name"] = u.LastName
+// Maps a CHECK violation to a ValidationError naming the field it guards,
+// or returns nil for any other error
+func invalidField(err error) error {
+	name, ok := db.CheckViolation(err)
+	if !ok {
+		return nil
 	}
 
-	if u.Email != "" {
-		updateValues["email"] = u.Email
+	switch name {
+	case db.CheckUsersUserName:
+		return ErrMissingUserName
+	case db.CheckUsersFirstName:
+		return ErrMissingFirstName
+	case db.CheckUsersLastName:
+		return ErrMissingLastName
+	case db.CheckUsersEmail:
+		return ErrInvalidEmail
+	case db.CheckUsersUserStatus:
+		return ErrInvalidStatus
 	}
 
-	if u.UserStatus != "" {
-		updateValues["user_status"] = u.UserStatus
-	}
+	// Other checks follow the same users_<column>_check naming
+	field := strings.TrimSuffix(strings.TrimPrefix(name, DbName+"_"), "_check")
+	return &ValidationError{Field: field, Message: "invalid " + field}
+}
 
-	if u.Department != nil {
-		updateValues["department"] = u.Department
+// Records a change in the audit trail and the outbox, inside the
+// transaction that made it. after is nil on purge. The user's earlier
+// version is kept by the users_history triggers.
+func (r *SQLRepository) recordChange(ctx context.Context, tx *sql.Tx, entry AuditEntry, after *User) error {
+	if err := r.recordAudit(ctx, tx, entry); err != nil {
+		return err
 	}
 
-	if len(updateValues) == 0 {
-		return nil, ErrUpdateUserMissingValues
-	}
+	return r.recordEvent(ctx, tx, newEvent(entry, after))
+}
 
-	query, args, err := sq.Update(DbName).
-		SetMap(updateValues).
-		Where(sq.Eq{"user_id": u.ID}).
-		Suffix("RETURNING user_id").
-		PlaceholderFormat(sq.Dollar).
-		ToSql()
+func (r *SQLRepository) recordAudit(ctx context.Context, tx *sql.Tx, entry AuditEntry) error {
+	auditDB, err := entry.ConvertToAuditDB(r.keys)
 	if err != nil {
-		log.Print("failed to build update sql: ", err)
-		return nil, err
+		return err
 	}
 
-	result, err := dbcon.Exec(query, args...)
+	query, args, err := sq.Insert(AuditTable).
+		Columns("user_id", "actor", "operation", "changes", "created_at").
+		Values(auditDB.UserID, auditDB.Actor, auditDB.Operation, string(auditDB.Changes), auditDB.CreatedAt).
+		PlaceholderFormat(r.dialect.Placeholder).
+		ToSql()
 	if err != nil {
-		return nil, err
+		log.Print("failed to build audit sql: ", err)
+		return err
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return nil, err
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		log.Print("failed to record audit entry: ", err)
+		return err
 	}
 
-	if rowsAffected == 0 {
-		return nil, ErrUpdateUserNoRows
-	}
+	return nil
+}
 
-	// Pull the updated user's data
-	user, err := GetUser(dbcon, u.ID)
+func (r *SQLRepository) recordEvent(ctx context.Context, tx *sql.Tx, event Event) error {
+	outboxDB, err := event.ConvertToOutboxDB(r.keys)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return user, nil
-}
-
-func DeleteUser(dbcon *sql.DB, id int64) error {
-	query, args, err := sq.Delete(DbName).
-		Where(sq.Eq{"user_id": id}).
-		PlaceholderFormat(sq.Dollar).
+	query, args, err := sq.Insert(OutboxTable).
+		Columns("user_id", "event_type", "payload", "status", "next_attempt_at", "created_at").
+		Values(outboxDB.UserID, outboxDB.EventType, string(outboxDB.Payload), outboxDB.Status, outboxDB.NextAttemptAt, outboxDB.CreatedAt).
+		PlaceholderFormat(r.dialect.Placeholder).
 		ToSql()
 	if err != nil {
-		log.Print("failed to build delete sql: ", err)
+		log.Print("failed to build outbox sql: ", err)
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		log.Print("failed to record outbox event: ", err)
 		return err
 	}
 
-	result, err := dbcon.Exec(query, args...)
+	return nil
+}
+
+// Runs a statement that targets one user, returning ErrUserNotFound when no
+// row was affected
+func (r *SQLRepository) execAffectingUser(ctx context.Context, q queryer, query string, args []interface{}) error {
+	result, err := q.ExecContext(ctx, query, args...)
 	if err != nil {
 		log.Print("query failure: ", err)
 		return err
@@ -252,3 +1977,20 @@ func DeleteUser(dbcon *sql.DB, id int64) error {
 
 	return nil
 }
+
+// Runs an INSERT and returns the generated `user_id`, either from the
+// RETURNING clause or from the driver's LastInsertId
+func (r *SQLRepository) insertReturningID(ctx context.Context, q queryer, query string, args []interface{}) (int64, error) {
+	if r.dialect.Returning {
+		var id int64
+		err := q.QueryRowContext(ctx, query, args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
@@ -1,14 +1,18 @@
 package user_test
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
 	"errors"
 	"fmt"
+	"net"
 	"regexp"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	db "github.com/steveperjesi/integra-demo/internal/db"
@@ -19,6 +23,37 @@ func ptr(s string) *string {
 	return &s
 }
 
+// Fixed row timestamps for scanned users
+var createdAt = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// Context for repository calls in tests
+var ctx = context.Background()
+
+// Builds a keyring of fixed keys whose primary is the given key. k1 and k2
+// are always present, so values can be moved between them.
+func newTestKeyring(primary string) *db.Keyring {
+	keys, err := db.ParseKeyring([]byte(`{
+		"primary": "` + primary + `",
+		"keys": {
+			"k1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+			"k2": "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+		},
+		"index_key": "aW5kZXgta2V5LWluZGV4LWtleS1pbmRleC1rZXktMzI="
+	}`))
+	Expect(err).To(BeNil())
+	return keys
+}
+
+// Swaps time arguments for sqlmock.AnyArg, for timestamps the store sets
+func anyTimes(args []driver.Value) []driver.Value {
+	for i, v := range args {
+		if _, ok := v.(time.Time); ok {
+			args[i] = sqlmock.AnyArg()
+		}
+	}
+	return args
+}
+
 func convertToDriverArgs(args []interface{}) []driver.Value {
 	driverArgs := make([]driver.Value, len(args))
 	for i, v := range args {
@@ -41,17 +76,17 @@ var _ = Describe("ValidateUserID", func() {
 	Context("with invalid strings", func() {
 		It("should return an error for non-numeric input", func() {
 			_, err := ValidateUserID("abc")
-			Expect(err).To(HaveOccurred())
+			Expect(err).To(Equal(ErrInvalidUserID))
 		})
 
 		It("should return an error for float-like strings", func() {
 			_, err := ValidateUserID("12.34")
-			Expect(err).To(HaveOccurred())
+			Expect(err).To(Equal(ErrInvalidUserID))
 		})
 
 		It("should return an error for empty string", func() {
 			_, err := ValidateUserID("")
-			Expect(err).To(HaveOccurred())
+			Expect(err).To(Equal(ErrInvalidUserID))
 		})
 	})
 })
@@ -104,6 +139,50 @@ var _ = Describe("ValidateNewUserRequest", func() {
 		err := user.ValidateNewUserRequest()
 		Expect(err).To(BeNil())
 	})
+
+	It("should return error when first_name is blank", func() {
+		user.FirstName = "   "
+		err := user.ValidateNewUserRequest()
+		Expect(err).To(Equal(ErrMissingFirstName))
+	})
+
+	DescribeTable("should return error when email is malformed",
+		func(email string) {
+			user.Email = email
+			Expect(user.ValidateNewUserRequest()).To(Equal(ErrInvalidEmail))
+		},
+		Entry("no @", "john.example.com"),
+		Entry("nothing before @", "@example.com"),
+		Entry("two @", "john@doe@example.com"),
+		Entry("no dot in the domain", "john@localhost"),
+		Entry("dot at the end of the domain", "john@example."),
+		Entry("whitespace", "john doe@example.com"),
+	)
+})
+
+// ValidateUpdateRequest
+var _ = Describe("ValidateUpdateRequest", func() {
+	It("allows leaving every value out", func() {
+		Expect((&User{ID: 1}).ValidateUpdateRequest()).To(Succeed())
+	})
+
+	It("upper-cases a valid user_status", func() {
+		user := User{ID: 1, UserStatus: "t"}
+		Expect(user.ValidateUpdateRequest()).To(Succeed())
+		Expect(user.UserStatus).To(Equal("T"))
+	})
+
+	It("rejects an unknown user_status", func() {
+		Expect((&User{ID: 1, UserStatus: "Z"}).ValidateUpdateRequest()).To(Equal(ErrInvalidStatus))
+	})
+
+	It("rejects a malformed email", func() {
+		Expect((&User{ID: 1, Email: "nobody"}).ValidateUpdateRequest()).To(Equal(ErrInvalidEmail))
+	})
+
+	It("rejects a blank last_name", func() {
+		Expect((&User{ID: 1, LastName: " "}).ValidateUpdateRequest()).To(Equal(ErrMissingLastName))
+	})
 })
 
 // ConvertToUserDB
@@ -135,16 +214,47 @@ var _ = Describe("ConvertToUserDB", func() {
 	})
 
 	It("should convert all fields including department", func() {
-		result := input.ConvertToUserDB()
+		result, err := input.ConvertToUserDB(nil)
+		Expect(err).To(BeNil())
 		Expect(result).To(Equal(expected))
 	})
 
 	It("should handle nil department", func() {
 		input.Department = nil
-		result := input.ConvertToUserDB()
+		result, err := input.ConvertToUserDB(nil)
+		Expect(err).To(BeNil())
 		Expect(result.Department.Valid).To(BeFalse())
 		Expect(result.Department.String).To(BeEmpty())
 	})
+
+	It("encrypts the PII and indexes the email with a keyring", func() {
+		keys := newTestKeyring("k1")
+
+		result, err := input.ConvertToUserDB(keys)
+		Expect(err).To(BeNil())
+		Expect(result.UserName).To(Equal("jdoe"))
+		Expect(result.FirstName).To(HavePrefix("enc:k1:"))
+		Expect(result.LastName).To(HavePrefix("enc:k1:"))
+		Expect(result.Email).To(HavePrefix("enc:k1:"))
+		Expect(result.Department.String).To(Equal("Engineering"))
+
+		// The index ignores case like the plaintext unique index did
+		input.Email = "John@Example.com"
+		again, err := input.ConvertToUserDB(keys)
+		Expect(err).To(BeNil())
+		Expect(again.EmailHash.Valid).To(BeTrue())
+		Expect(again.EmailHash).To(Equal(result.EmailHash))
+		Expect(again.Email).NotTo(Equal(result.Email))
+
+		user, err := ConvertToUser(&result, keys)
+		Expect(err).To(BeNil())
+		Expect(user.FirstName).To(Equal("John"))
+		Expect(user.LastName).To(Equal("Doe"))
+		Expect(user.Email).To(Equal("john@example.com"))
+
+		_, err = ConvertToUser(&result, nil)
+		Expect(err).To(Equal(db.ErrKeyringRequired))
+	})
 })
 
 // ConvertToUser
@@ -176,7 +286,8 @@ var _ = Describe("ConvertToUser", func() {
 		})
 
 		It("should convert all fields correctly including department", func() {
-			result := ConvertToUser(&input)
+			result, err := ConvertToUser(&input, nil)
+			Expect(err).To(BeNil())
 			Expect(result).To(Equal(expected))
 		})
 	})
@@ -205,15 +316,60 @@ var _ = Describe("ConvertToUser", func() {
 		})
 
 		It("should convert all fields and omit department", func() {
-			result := ConvertToUser(&input)
+			result, err := ConvertToUser(&input, nil)
+			Expect(err).To(BeNil())
 			Expect(result).To(Equal(expected))
 			Expect(result.Department).To(BeNil())
 		})
 	})
 })
 
-// GetAllUsers
-var _ = Describe("GetAllUsers", func() {
+// PostgresRepository.List
+var _ = Describe("ParseIfMatch", func() {
+	It("parses an ETag from ETag()", func() {
+		version, err := ParseIfMatch(ETag(42))
+		Expect(err).To(BeNil())
+		Expect(version).To(Equal(int64(42)))
+	})
+
+	It("returns 0 for an empty header or *", func() {
+		for _, value := range []string{"", "*"} {
+			version, err := ParseIfMatch(value)
+			Expect(err).To(BeNil())
+			Expect(version).To(BeZero())
+		}
+	})
+
+	It("rejects anything else", func() {
+		for _, value := range []string{"42", `W/"42"`, `"abc"`, `"0"`, `"1", "2"`} {
+			_, err := ParseIfMatch(value)
+			Expect(err).To(Equal(ErrInvalidIfMatch), value)
+		}
+	})
+})
+
+var _ = Describe("ParsePrecondition", func() {
+	It("records whether a precondition was given", func() {
+		cond, err := ParsePrecondition("")
+		Expect(err).To(BeNil())
+		Expect(cond).To(Equal(Precondition{}))
+
+		cond, err = ParsePrecondition("*")
+		Expect(err).To(BeNil())
+		Expect(cond).To(Equal(Precondition{Given: true}))
+
+		cond, err = ParsePrecondition(ETag(3))
+		Expect(err).To(BeNil())
+		Expect(cond).To(Equal(Precondition{Version: 3, Given: true}))
+	})
+
+	It("rejects a malformed If-Match", func() {
+		_, err := ParsePrecondition("3")
+		Expect(err).To(Equal(ErrInvalidIfMatch))
+	})
+})
+
+var _ = Describe("PostgresRepository.List", func() {
 	var (
 		mockDB *sql.DB
 		mock   sqlmock.Sqlmock
@@ -231,23 +387,23 @@ var _ = Describe("GetAllUsers", func() {
 
 	It("returns all users on success", func() {
 		columns := []string{
-			"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department",
+			"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "deleted_at", "version", "created_at", "updated_at",
 		}
 
 		mockRows := sqlmock.NewRows(columns).AddRow(
-			1, "jdoe", "John", "Doe", "jdoe@example.com", "A", sql.NullString{String: "IT", Valid: true},
+			1, "jdoe", "John", "Doe", "jdoe@example.com", "A", sql.NullString{String: "IT", Valid: true}, nil, 1, createdAt, createdAt,
 		).AddRow(
-			2, "asmith", "Alice", "Smith", "asmith@example.com", "I", sql.NullString{Valid: false},
+			2, "asmith", "Alice", "Smith", "asmith@example.com", "I", sql.NullString{Valid: false}, nil, 1, createdAt, createdAt,
 		)
 
-		query, args, buildErr := sq.Select(db.AllColumns).From(DbName).ToSql()
+		query, args, buildErr := sq.Select(db.AllColumns).From(DbName).Where(sq.Eq{"deleted_at": nil}).ToSql()
 		Expect(buildErr).To(BeNil())
 
 		driverArgs := convertToDriverArgs(args)
 
 		mock.ExpectQuery(query).WithArgs(driverArgs...).WillReturnRows(mockRows)
 
-		users, err := GetAllUsers(mockDB)
+		users, err := NewPostgresRepository(mockDB).List(ctx, ListOptions{})
 		Expect(err).ToNot(HaveOccurred())
 		Expect(users).To(HaveLen(2))
 
@@ -259,65 +415,203 @@ var _ = Describe("GetAllUsers", func() {
 		Expect(users[1].Department).To(BeNil())
 	})
 
+	It("filters on created_at and updated_at", func() {
+		after := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		before := after.AddDate(0, 1, 0)
+
+		query, args, buildErr := sq.Select(db.AllColumns).
+			From(DbName).
+			Where(sq.Eq{"deleted_at": nil}).
+			Where(sq.Gt{"created_at": after}).
+			Where(sq.Lt{"updated_at": before}).
+			PlaceholderFormat(sq.Dollar).
+			ToSql()
+		Expect(buildErr).To(BeNil())
+
+		mock.ExpectQuery(regexp.QuoteMeta(query)).
+			WithArgs(convertToDriverArgs(args)...).
+			WillReturnRows(userRows(1, "A", nil, 1))
+
+		users, err := NewPostgresRepository(mockDB).List(ctx, ListOptions{CreatedAfter: &after, UpdatedBefore: &before})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(users).To(HaveLen(1))
+		Expect(users[0].CreatedAt).To(Equal(createdAt))
+	})
+
+	It("pages with a keyset on user_id", func() {
+		query, args, buildErr := sq.Select(db.AllColumns).
+			From(DbName).
+			Where(sq.Eq{"deleted_at": nil}).
+			OrderBy("user_id").
+			Where(sq.Or{sq.And{sq.Gt{"user_id": int64(10)}}}).
+			Limit(2).
+			PlaceholderFormat(sq.Dollar).
+			ToSql()
+		Expect(buildErr).To(BeNil())
+
+		mock.ExpectQuery(regexp.QuoteMeta(query)).
+			WithArgs(convertToDriverArgs(args)...).
+			WillReturnRows(userRows(11, "A", nil, 1))
+
+		users, err := NewPostgresRepository(mockDB).List(ctx, ListOptions{After: &Cursor{Keys: []string{"10"}}, Limit: 2})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(users).To(HaveLen(1))
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+	})
+
+	It("compiles the filters and sort to conditions and an order", func() {
+		query, args, buildErr := sq.Select(db.AllColumns).
+			From(DbName).
+			Where(sq.Eq{"deleted_at": nil}).
+			Where(sq.Eq{"user_status": "A"}).
+			Where(sq.Or{sq.Eq{"department": nil}, sq.Eq{"department": ""}}).
+			Where(sq.Expr(`email LIKE ? ESCAPE '\'`, "%@example.com")).
+			Where(sq.Expr(`LOWER(user_name) LIKE ? ESCAPE '\'`, `j\_%`)).
+			OrderBy("last_name", "user_id DESC").
+			PlaceholderFormat(sq.Dollar).
+			ToSql()
+		Expect(buildErr).To(BeNil())
+
+		mock.ExpectQuery(regexp.QuoteMeta(query)).
+			WithArgs(convertToDriverArgs(args)...).
+			WillReturnRows(userRows(1, "A", nil, 1))
+
+		users, err := NewPostgresRepository(mockDB).List(ctx, ListOptions{
+			UserStatus:     "A",
+			Department:     ptr(""),
+			EmailDomain:    "Example.com",
+			UserNamePrefix: "J_",
+			Sort:           []SortField{{Column: "last_name"}, {Column: "user_id", Desc: true}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(users).To(HaveLen(1))
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+	})
+
+	It("counts the users across every page", func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM (SELECT " + db.AllColumns + " FROM users WHERE deleted_at IS NULL) AS listed")).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(42))
+
+		count, err := NewPostgresRepository(mockDB).Count(ctx, ListOptions{After: &Cursor{Keys: []string{"10"}}, Limit: 2})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(int64(42)))
+	})
+
 	It("returns error on query failure", func() {
-		query, args, buildErr := sq.Select(db.AllColumns).From(DbName).ToSql()
+		query, args, buildErr := sq.Select(db.AllColumns).From(DbName).Where(sq.Eq{"deleted_at": nil}).ToSql()
 		Expect(buildErr).To(BeNil())
 
 		driverArgs := convertToDriverArgs(args)
 
 		mock.ExpectQuery(query).WithArgs(driverArgs...).WillReturnError(errors.New("query failed"))
 
-		users, err := GetAllUsers(mockDB)
+		users, err := NewPostgresRepository(mockDB).List(ctx, ListOptions{})
 		Expect(err).To(HaveOccurred())
 		Expect(users).To(BeNil())
 	})
 
 	It("returns error on row scan failure", func() {
 		columns := []string{
-			"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department",
+			"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "deleted_at", "version", "created_at", "updated_at",
 		}
 
 		// Invalid data type to trigger scan error
 		mockRows := sqlmock.NewRows(columns).AddRow(
-			"not_an_int", "jdoe", "John", "Doe", "jdoe@example.com", "A", sql.NullString{String: "IT", Valid: true},
+			"not_an_int", "jdoe", "John", "Doe", "jdoe@example.com", "A", sql.NullString{String: "IT", Valid: true}, nil, 1, createdAt, createdAt,
 		)
 
-		query, args, buildErr := sq.Select(db.AllColumns).From(DbName).ToSql()
+		query, args, buildErr := sq.Select(db.AllColumns).From(DbName).Where(sq.Eq{"deleted_at": nil}).ToSql()
 		Expect(buildErr).To(BeNil())
 
 		driverArgs := convertToDriverArgs(args)
 
 		mock.ExpectQuery(query).WithArgs(driverArgs...).WillReturnRows(mockRows)
 
-		users, err := GetAllUsers(mockDB)
+		users, err := NewPostgresRepository(mockDB).List(ctx, ListOptions{})
 		Expect(err).To(HaveOccurred())
 		Expect(users).To(BeNil())
 	})
 
 	It("returns error when rows iteration has an error", func() {
 		columns := []string{
-			"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department",
+			"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "deleted_at", "version", "created_at", "updated_at",
 		}
 
 		mockRows := sqlmock.NewRows(columns).
-			AddRow(1, "jdoe", "John", "Doe", "jdoe@example.com", "A", sql.NullString{String: "IT", Valid: true}).
+			AddRow(1, "jdoe", "John", "Doe", "jdoe@example.com", "A", sql.NullString{String: "IT", Valid: true}, nil, 1, createdAt, createdAt).
 			RowError(0, errors.New("row iteration error"))
 
-		query, args, buildErr := sq.Select(db.AllColumns).From(DbName).ToSql()
+		query, args, buildErr := sq.Select(db.AllColumns).From(DbName).Where(sq.Eq{"deleted_at": nil}).ToSql()
 		Expect(buildErr).To(BeNil())
 
 		driverArgs := convertToDriverArgs(args)
 
 		mock.ExpectQuery(query).WithArgs(driverArgs...).WillReturnRows(mockRows)
 
-		users, err := GetAllUsers(mockDB)
+		users, err := NewPostgresRepository(mockDB).List(ctx, ListOptions{})
 		Expect(err).To(HaveOccurred())
 		Expect(users).To(BeNil())
 	})
 })
 
-// GetUser
-var _ = Describe("GetUser", func() {
+// PostgresRepository.Search
+var _ = Describe("PostgresRepository.Search", func() {
+	var (
+		mockDB *sql.DB
+		mock   sqlmock.Sqlmock
+	)
+
+	BeforeEach(func() {
+		var err error
+		mockDB, mock, err = sqlmock.New()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		mockDB.Close()
+	})
+
+	It("ranks with pg_trgm at the search threshold in a read-only transaction", func() {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("SET LOCAL pg_trgm.word_similarity_threshold = 0.3")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta(`(GREATEST(word_similarity($1, LOWER(user_name)), word_similarity($2, LOWER(first_name)), word_similarity($3, LOWER(last_name)), word_similarity($4, LOWER(email)))) AS score FROM users WHERE deleted_at IS NULL AND (($5 <% LOWER(user_name) OR LOWER(user_name) LIKE $6 ESCAPE '\')`)+
+			".*"+regexp.QuoteMeta("ORDER BY score DESC, user_id LIMIT 5")).
+			WithArgs("jonh", "jonh", "jonh", "jonh", "jonh", "%jonh%", "jonh", "%jonh%", "jonh", "%jonh%", "jonh", "%jonh%").
+			WillReturnRows(sqlmock.NewRows([]string{
+				"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "deleted_at", "version", "created_at", "updated_at", "score",
+			}).AddRow(int64(1), "jdoe", "John", "Doe", "jdoe@example.com", "A", nil, nil, int64(1), createdAt, createdAt, 0.4))
+		mock.ExpectCommit()
+
+		results, err := NewPostgresRepository(mockDB).Search(ctx, SearchOptions{Query: "jonh", Limit: 5})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].User.UserName).To(Equal("jdoe"))
+		Expect(results[0].Score).To(Equal(0.4))
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+	})
+
+	It("matches only user_name in SQL when the PII is encrypted", func() {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("SET LOCAL pg_trgm.word_similarity_threshold = 0.3")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta(`(GREATEST(word_similarity($1, LOWER(user_name)))) AS score FROM users WHERE deleted_at IS NULL AND (($2 <% LOWER(user_name) OR LOWER(user_name) LIKE $3 ESCAPE '\')) ORDER BY score DESC, user_id LIMIT 5`)).
+			WithArgs("jdoe", "jdoe", "%jdoe%").
+			WillReturnRows(sqlmock.NewRows([]string{
+				"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "deleted_at", "version", "created_at", "updated_at", "score",
+			}).AddRow(int64(1), "jdoe", "John", "Doe", "jdoe@example.com", "A", nil, nil, int64(1), createdAt, createdAt, 1.0))
+		mock.ExpectCommit()
+
+		repo := NewPostgresRepository(mockDB).WithKeyring(newTestKeyring("k1"))
+		results, err := repo.Search(ctx, SearchOptions{Query: "jdoe", Limit: 5})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(searchedIDs(results)).To(Equal([]int64{1}))
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+	})
+})
+
+// PostgresRepository.Get
+var _ = Describe("PostgresRepository.Get", func() {
 	var (
 		mockDB   *sql.DB
 		mock     sqlmock.Sqlmock
@@ -340,6 +634,9 @@ var _ = Describe("GetUser", func() {
 			Email:      "jdoe@example.com",
 			UserStatus: "A",
 			Department: &dept,
+			Version:    1,
+			CreatedAt:  createdAt,
+			UpdatedAt:  createdAt,
 		}
 	})
 
@@ -352,6 +649,7 @@ var _ = Describe("GetUser", func() {
 		query, args, err := sq.Select(db.AllColumns).
 			From(DbName).
 			Where(sq.Eq{"user_id": userID}).
+			Where(sq.Eq{"deleted_at": nil}).
 			PlaceholderFormat(sq.Dollar).
 			ToSql()
 		Expect(err).To(BeNil())
@@ -361,13 +659,13 @@ var _ = Describe("GetUser", func() {
 		mock.ExpectQuery(regexp.QuoteMeta(query)).
 			WithArgs(driverArgs...).
 			WillReturnRows(sqlmock.NewRows([]string{
-				"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department",
+				"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "deleted_at", "version", "created_at", "updated_at",
 			}).AddRow(
 				expected.ID, expected.UserName, expected.FirstName, expected.LastName,
-				expected.Email, expected.UserStatus, expected.Department,
+				expected.Email, expected.UserStatus, expected.Department, nil, 1, createdAt, createdAt,
 			))
 
-		user, err := GetUser(mockDB, userID)
+		user, err := NewPostgresRepository(mockDB).Get(ctx, userID, GetOptions{})
 		Expect(err).To(BeNil())
 		Expect(user).To(Equal(expected))
 	})
@@ -376,6 +674,7 @@ var _ = Describe("GetUser", func() {
 		query, args, err := sq.Select(db.AllColumns).
 			From(DbName).
 			Where(sq.Eq{"user_id": userID}).
+			Where(sq.Eq{"deleted_at": nil}).
 			PlaceholderFormat(sq.Dollar).
 			ToSql()
 		Expect(err).To(BeNil())
@@ -386,7 +685,7 @@ var _ = Describe("GetUser", func() {
 			WithArgs(driverArgs...).
 			WillReturnError(sql.ErrNoRows)
 
-		user, err := GetUser(mockDB, userID)
+		user, err := NewPostgresRepository(mockDB).Get(ctx, userID, GetOptions{})
 		Expect(user).To(BeNil())
 		Expect(err).To(Equal(ErrUserNotFound))
 	})
@@ -395,6 +694,7 @@ var _ = Describe("GetUser", func() {
 		query, args, err := sq.Select(db.AllColumns).
 			From(DbName).
 			Where(sq.Eq{"user_id": userID}).
+			Where(sq.Eq{"deleted_at": nil}).
 			PlaceholderFormat(sq.Dollar).
 			ToSql()
 		Expect(err).To(BeNil())
@@ -405,7 +705,7 @@ var _ = Describe("GetUser", func() {
 			WithArgs(driverArgs...).
 			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("invalid"))
 
-		user, err := GetUser(mockDB, userID)
+		user, err := NewPostgresRepository(mockDB).Get(ctx, userID, GetOptions{})
 		Expect(user).To(BeNil())
 		Expect(err).To(HaveOccurred())
 	})
@@ -414,6 +714,7 @@ var _ = Describe("GetUser", func() {
 		query, args, err := sq.Select(db.AllColumns).
 			From(DbName).
 			Where(sq.Eq{"user_id": userID}).
+			Where(sq.Eq{"deleted_at": nil}).
 			PlaceholderFormat(sq.Dollar).
 			ToSql()
 		Expect(err).To(BeNil())
@@ -423,27 +724,27 @@ var _ = Describe("GetUser", func() {
 		mock.ExpectQuery(regexp.QuoteMeta(query)).
 			WithArgs(driverArgs...).
 			WillReturnRows(sqlmock.NewRows([]string{
-				"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department",
+				"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "deleted_at", "version", "created_at", "updated_at",
 			}).AddRow(
-				userID, "jdoe", "John", "Doe", "jdoe@example.com", "A", nil, // department is NULL
+				userID, "jdoe", "John", "Doe", "jdoe@example.com", "A", nil, nil, 1, createdAt, createdAt, // department is NULL
 			))
 
-		user, err := GetUser(mockDB, userID)
+		user, err := NewPostgresRepository(mockDB).Get(ctx, userID, GetOptions{})
 		Expect(err).To(BeNil())
 		Expect(user).ToNot(BeNil())
 		Expect(user.Department).To(BeNil())
 	})
 
 	It("should return ErrMissingUserID when id == 0", func() {
-		user, err := GetUser(mockDB, 0)
+		user, err := NewPostgresRepository(mockDB).Get(ctx, 0, GetOptions{})
 		Expect(user).To(BeNil())
 		Expect(err).To(Equal(ErrMissingUserID))
 	})
 
 })
 
-// CheckUserNameExists
-var _ = Describe("CheckUserNameExists", func() {
+// PostgresRepository.ExistsByUserName
+var _ = Describe("PostgresRepository.ExistsByUserName", func() {
 	var (
 		mockDB   *sql.DB
 		mock     sqlmock.Sqlmock
@@ -465,7 +766,7 @@ var _ = Describe("CheckUserNameExists", func() {
 	It("should return true when username exists", func() {
 		query, args, err := sq.Select("COUNT(*)").
 			From(DbName).
-			Where(sq.Eq{"user_name": userName}).
+			Where(sq.Expr("LOWER(user_name) = LOWER(?)", userName)).
 			PlaceholderFormat(sq.Dollar).
 			ToSql()
 		Expect(err).To(BeNil())
@@ -476,7 +777,7 @@ var _ = Describe("CheckUserNameExists", func() {
 			WithArgs(driverArgs...).
 			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
 
-		exists, err := CheckUserNameExists(mockDB, userName)
+		exists, err := NewPostgresRepository(mockDB).ExistsByUserName(ctx, userName)
 		Expect(err).To(BeNil())
 		Expect(exists).To(BeTrue())
 	})
@@ -484,7 +785,7 @@ var _ = Describe("CheckUserNameExists", func() {
 	It("should return false when username does not exist", func() {
 		query, args, err := sq.Select("COUNT(*)").
 			From(DbName).
-			Where(sq.Eq{"user_name": userName}).
+			Where(sq.Expr("LOWER(user_name) = LOWER(?)", userName)).
 			PlaceholderFormat(sq.Dollar).
 			ToSql()
 		Expect(err).To(BeNil())
@@ -495,7 +796,7 @@ var _ = Describe("CheckUserNameExists", func() {
 			WithArgs(driverArgs...).
 			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
 
-		exists, err := CheckUserNameExists(mockDB, userName)
+		exists, err := NewPostgresRepository(mockDB).ExistsByUserName(ctx, userName)
 		Expect(err).To(BeNil())
 		Expect(exists).To(BeFalse())
 	})
@@ -503,7 +804,7 @@ var _ = Describe("CheckUserNameExists", func() {
 	It("should return error if scan fails", func() {
 		query, args, err := sq.Select("COUNT(*)").
 			From(DbName).
-			Where(sq.Eq{"user_name": userName}).
+			Where(sq.Expr("LOWER(user_name) = LOWER(?)", userName)).
 			PlaceholderFormat(sq.Dollar).
 			ToSql()
 		Expect(err).To(BeNil())
@@ -514,20 +815,20 @@ var _ = Describe("CheckUserNameExists", func() {
 			WithArgs(driverArgs...).
 			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow("invalid"))
 
-		exists, err := CheckUserNameExists(mockDB, userName)
+		exists, err := NewPostgresRepository(mockDB).ExistsByUserName(ctx, userName)
 		Expect(err).To(HaveOccurred())
 		Expect(exists).To(BeFalse())
 	})
 
 	It("should return error if username is empty", func() {
-		exists, err := CheckUserNameExists(mockDB, "")
+		exists, err := NewPostgresRepository(mockDB).ExistsByUserName(ctx, "")
 		Expect(err).To(Equal(ErrMissingUserName))
 		Expect(exists).To(BeFalse())
 	})
 })
 
-// CreateNewUser
-var _ = Describe("CreateNewUser", func() {
+// PostgresRepository.Create
+var _ = Describe("PostgresRepository.Create", func() {
 	var (
 		mockDB *sql.DB
 		mock   sqlmock.Sqlmock
@@ -551,103 +852,314 @@ var _ = Describe("CreateNewUser", func() {
 	})
 
 	AfterEach(func() {
-		mock.ExpectClose()
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
 		mockDB.Close()
 	})
 
-	It("should insert new user and return user with ID", func() {
-		// Expect the CheckUserNameExists subquery
+	expectCheck := func(column string, value string, count int) {
 		checkQuery, checkArgs, err := sq.Select("COUNT(*)").
 			From(DbName).
-			Where(sq.Eq{"user_name": user.UserName}).
+			Where(sq.Expr("LOWER("+column+") = LOWER(?)", value)).
 			PlaceholderFormat(sq.Dollar).
 			ToSql()
 		Expect(err).To(BeNil())
 
-		driverArgs := convertToDriverArgs(checkArgs)
-
 		mock.ExpectQuery(regexp.QuoteMeta(checkQuery)).
-			WithArgs(driverArgs...).
-			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			WithArgs(convertToDriverArgs(checkArgs)...).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+	}
 
-		// Expect the INSERT query
-		userDB := user.ConvertToUserDB()
-		insertQuery, insertArgs, err := sq.Insert(DbName).
-			Columns("user_name", "first_name", "last_name", "email", "user_status", "department").
-			Values(userDB.UserName, userDB.FirstName, userDB.LastName, userDB.Email, userDB.UserStatus, userDB.Department).
+	expectUserNameCheck := func(count int) {
+		expectCheck("user_name", user.UserName, count)
+	}
+
+	// Only reached once the user_name is free
+	expectEmailCheck := func(count int) {
+		expectCheck("email", user.Email, count)
+	}
+
+	insertQuery := func() (string, []driver.Value) {
+		userDB, err := user.ConvertToUserDB(nil)
+		Expect(err).To(BeNil())
+		query, args, err := sq.Insert(DbName).
+			Columns("user_name", "first_name", "last_name", "email", "user_status", "department", "created_at", "updated_at", "email_hash", "email_domain_hash").
+			Values(userDB.UserName, userDB.FirstName, userDB.LastName, userDB.Email, userDB.UserStatus, userDB.Department, time.Time{}, time.Time{}, userDB.EmailHash, userDB.EmailDomainHash).
 			Suffix("RETURNING user_id").
 			PlaceholderFormat(sq.Dollar).
 			ToSql()
 		Expect(err).To(BeNil())
 
-		driverArgs = convertToDriverArgs(insertArgs)
+		return query, anyTimes(convertToDriverArgs(args))
+	}
+
+	It("should insert new user and return user with ID", func() {
+		mock.ExpectBegin()
+
+		// Expect the user_name and email checks
+		expectUserNameCheck(0)
+		expectEmailCheck(0)
 
-		mock.ExpectQuery(regexp.QuoteMeta(insertQuery)).
+		// Expect the INSERT query
+		query, driverArgs := insertQuery()
+		mock.ExpectQuery(regexp.QuoteMeta(query)).
 			WithArgs(driverArgs...).
 			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(123))
 
-		createdUser, err := CreateUser(mockDB, user)
+		expectAudit(mock, OpCreate)
+		expectEvent(mock, EventUserCreated)
+		mock.ExpectCommit()
+
+		createdUser, err := NewPostgresRepository(mockDB).Create(ctx, user, "tester")
 		Expect(err).To(BeNil())
 		Expect(createdUser.ID).To(Equal(int64(123)))
 		Expect(createdUser.UserName).To(Equal("jdoe"))
 	})
 
 	It("should return error if username already exists", func() {
-		checkQuery, checkArgs, err := sq.Select("COUNT(*)").
-			From(DbName).
-			Where(sq.Eq{"user_name": user.UserName}).
-			PlaceholderFormat(sq.Dollar).
-			ToSql()
-		Expect(err).To(BeNil())
+		mock.ExpectBegin()
+		expectUserNameCheck(1)
+		mock.ExpectRollback()
 
-		driverArgs := convertToDriverArgs(checkArgs)
+		newUser, err := NewPostgresRepository(mockDB).Create(ctx, user, "tester")
+		Expect(err).To(Equal(ErrUserExists))
+		Expect(newUser).To(BeNil())
+	})
 
-		mock.ExpectQuery(regexp.QuoteMeta(checkQuery)).
+	It("should return error on insert scan failure", func() {
+		mock.ExpectBegin()
+
+		// Username and email do not exist
+		expectUserNameCheck(0)
+		expectEmailCheck(0)
+
+		query, driverArgs := insertQuery()
+		mock.ExpectQuery(regexp.QuoteMeta(query)).
 			WithArgs(driverArgs...).
-			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			WillReturnError(sql.ErrConnDone) // simulate scan or connection failure
 
-		newUser, err := CreateUser(mockDB, user)
-		Expect(err).To(Equal(ErrUserExists))
+		mock.ExpectRollback()
+
+		newUser, err := NewPostgresRepository(mockDB).Create(ctx, user, "tester")
+		Expect(err).To(HaveOccurred())
 		Expect(newUser).To(BeNil())
 	})
 
-	It("should return error on insert scan failure", func() {
-		// Username does not exist
-		checkQuery, checkArgs, _ := sq.Select("COUNT(*)").
-			From(DbName).
-			Where(sq.Eq{"user_name": user.UserName}).
-			PlaceholderFormat(sq.Dollar).
-			ToSql()
+	It("should return error if email already exists", func() {
+		mock.ExpectBegin()
+		expectUserNameCheck(0)
+		expectEmailCheck(1)
+		mock.ExpectRollback()
 
-		driverArgs := convertToDriverArgs(checkArgs)
+		newUser, err := NewPostgresRepository(mockDB).Create(ctx, user, "tester")
+		Expect(err).To(Equal(ErrEmailExists))
+		Expect(newUser).To(BeNil())
+	})
 
-		mock.ExpectQuery(regexp.QuoteMeta(checkQuery)).
+	It("normalizes user_name and email before checking them", func() {
+		user.UserName = "  jdoe "
+		user.Email = " JDoe@Example.com"
+
+		mock.ExpectBegin()
+		expectCheck("user_name", "jdoe", 0)
+		expectCheck("email", "jdoe@example.com", 1)
+		mock.ExpectRollback()
+
+		_, err := NewPostgresRepository(mockDB).Create(ctx, user, "tester")
+		Expect(err).To(Equal(ErrEmailExists))
+	})
+
+	It("returns ErrUserExists when a concurrent create wins the race", func() {
+		mock.ExpectBegin()
+		expectUserNameCheck(0)
+		expectEmailCheck(0)
+
+		query, driverArgs := insertQuery()
+		mock.ExpectQuery(regexp.QuoteMeta(query)).
 			WithArgs(driverArgs...).
-			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			WillReturnError(&pq.Error{Code: "23505"})
 
-		// Insert query
-		userDB := user.ConvertToUserDB()
-		insertQuery, insertArgs, _ := sq.Insert(DbName).
-			Columns("user_name", "first_name", "last_name", "email", "user_status", "department").
-			Values(userDB.UserName, userDB.FirstName, userDB.LastName, userDB.Email, userDB.UserStatus, userDB.Department).
-			Suffix("RETURNING user_id").
-			PlaceholderFormat(sq.Dollar).
-			ToSql()
+		mock.ExpectRollback()
+
+		_, err := NewPostgresRepository(mockDB).Create(ctx, user, "tester")
+		Expect(err).To(Equal(ErrUserExists))
+	})
 
-		driverArgs = convertToDriverArgs(insertArgs)
+	It("returns ErrEmailExists when a concurrent create takes the email", func() {
+		mock.ExpectBegin()
+		expectUserNameCheck(0)
+		expectEmailCheck(0)
 
-		mock.ExpectQuery(regexp.QuoteMeta(insertQuery)).
+		query, driverArgs := insertQuery()
+		mock.ExpectQuery(regexp.QuoteMeta(query)).
 			WithArgs(driverArgs...).
-			WillReturnError(sql.ErrConnDone) // simulate scan or connection failure
+			WillReturnError(&pq.Error{Code: "23505", Constraint: db.IndexUsersEmail})
 
-		newUser, err := CreateUser(mockDB, user)
-		Expect(err).To(HaveOccurred())
-		Expect(newUser).To(BeNil())
+		mock.ExpectRollback()
+
+		_, err := NewPostgresRepository(mockDB).Create(ctx, user, "tester")
+		Expect(err).To(Equal(ErrEmailExists))
+	})
+
+	It("rolls back the user when the audit entry fails", func() {
+		mock.ExpectBegin()
+		expectUserNameCheck(0)
+		expectEmailCheck(0)
+
+		query, driverArgs := insertQuery()
+		mock.ExpectQuery(regexp.QuoteMeta(query)).
+			WithArgs(driverArgs...).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(123))
+
+		mock.ExpectExec(regexp.QuoteMeta(auditQuery)).
+			WillReturnError(fmt.Errorf("audit failure"))
+		mock.ExpectRollback()
+
+		_, err := NewPostgresRepository(mockDB).Create(ctx, user, "tester")
+		Expect(err).To(MatchError("audit failure"))
+	})
+
+	It("rolls back the user when the outbox event fails", func() {
+		mock.ExpectBegin()
+		expectUserNameCheck(0)
+		expectEmailCheck(0)
+
+		query, driverArgs := insertQuery()
+		mock.ExpectQuery(regexp.QuoteMeta(query)).
+			WithArgs(driverArgs...).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(123))
+
+		expectAudit(mock, OpCreate)
+		mock.ExpectExec(regexp.QuoteMeta(outboxQuery)).
+			WillReturnError(fmt.Errorf("outbox failure"))
+		mock.ExpectRollback()
+
+		_, err := NewPostgresRepository(mockDB).Create(ctx, user, "tester")
+		Expect(err).To(MatchError("outbox failure"))
+	})
+})
+
+var _ = Describe("PostgresRepository.BulkCreate", func() {
+	var (
+		mockDB *sql.DB
+		mock   sqlmock.Sqlmock
+	)
+
+	BeforeEach(func() {
+		var err error
+		mockDB, mock, err = sqlmock.New()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+		mockDB.Close()
+	})
+
+	// Expects a COPY of rows, each given as its expected arguments
+	expectCopy := func(table string, columns []string, rows ...[]driver.Value) {
+		copyStmt := mock.ExpectPrepare(regexp.QuoteMeta(pq.CopyIn(table, columns...)))
+		for _, row := range rows {
+			copyStmt.ExpectExec().WithArgs(row...).WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		copyStmt.ExpectExec().WithoutArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	It("copies the users into a staging table and merges the new ones", func() {
+		users := []User{
+			{UserName: " jdoe ", FirstName: "John", LastName: "Doe", Email: "JDoe@Example.com", UserStatus: "A", Department: ptr("Engineering")},
+			{UserName: "asmith", FirstName: "Ann", LastName: "Smith", Email: "taken@example.com"},
+			{UserName: "nofirst", LastName: "Smith", Email: "nofirst@example.com"},
+			{UserName: "JDOE", FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"},
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TEMPORARY TABLE users_staging")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		// Only the rows that passed validation and are unique in the load
+		expectCopy("users_staging", []string{"row_num", "user_name", "first_name", "last_name", "email", "user_status", "department", "email_hash", "email_domain_hash"},
+			[]driver.Value{int64(0), "jdoe", "John", "Doe", "jdoe@example.com", "A", "Engineering", nil, nil},
+			[]driver.Value{int64(1), "asmith", "Ann", "Smith", "taken@example.com", "I", nil, nil, nil},
+		)
+
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO users (user_name,first_name,last_name,email,user_status,department,created_at,updated_at,email_hash,email_domain_hash) SELECT")).
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name"}).AddRow(7, "jdoe"))
+
+		// asmith wasn't created and its user_name is free, so the email clashed
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT s.row_num FROM users_staging s")).
+			WillReturnRows(sqlmock.NewRows([]string{"row_num"}))
+
+		expectCopy(AuditTable, []string{"user_id", "actor", "operation", "changes", "created_at"},
+			[]driver.Value{int64(7), "tester", OpCreate, sqlmock.AnyArg(), sqlmock.AnyArg()},
+		)
+		expectCopy(OutboxTable, []string{"user_id", "event_type", "payload", "status", "next_attempt_at", "created_at"},
+			[]driver.Value{int64(7), EventUserCreated, sqlmock.AnyArg(), EventPending, sqlmock.AnyArg(), sqlmock.AnyArg()},
+		)
+		mock.ExpectCommit()
+
+		results, err := NewPostgresRepository(mockDB).BulkCreate(ctx, users, "tester")
+		Expect(err).To(BeNil())
+		Expect(results).To(Equal([]BulkResult{
+			{Row: 0, Outcome: BulkCreated, UserID: 7},
+			{Row: 1, Outcome: BulkDuplicateEmail},
+			{Row: 2, Outcome: BulkInvalid, Field: "first_name", Error: "missing first_name"},
+			{Row: 3, Outcome: BulkDuplicateUserName},
+		}))
+	})
+
+	It("reports a user_name taken by an existing user", func() {
+		users := []User{{UserName: "jdoe", FirstName: "John", LastName: "Doe", Email: "jdoe@example.com", UserStatus: "A"}}
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TEMPORARY TABLE users_staging")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy("users_staging", []string{"row_num", "user_name", "first_name", "last_name", "email", "user_status", "department", "email_hash", "email_domain_hash"},
+			[]driver.Value{int64(0), "jdoe", "John", "Doe", "jdoe@example.com", "A", nil, nil, nil},
+		)
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO users")).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name"}))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT s.row_num FROM users_staging s")).
+			WillReturnRows(sqlmock.NewRows([]string{"row_num"}).AddRow(0))
+		mock.ExpectCommit()
+
+		results, err := NewPostgresRepository(mockDB).BulkCreate(ctx, users, "tester")
+		Expect(err).To(BeNil())
+		Expect(results).To(Equal([]BulkResult{{Row: 0, Outcome: BulkDuplicateUserName}}))
+	})
+
+	It("rolls back the whole load when the copy fails", func() {
+		users := []User{{UserName: "jdoe", FirstName: "John", LastName: "Doe", Email: "jdoe@example.com", UserStatus: "A"}}
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TEMPORARY TABLE users_staging")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectPrepare(regexp.QuoteMeta(`COPY "users_staging"`)).
+			ExpectExec().WillReturnError(errors.New("copy failed"))
+		mock.ExpectRollback()
+
+		results, err := NewPostgresRepository(mockDB).BulkCreate(ctx, users, "tester")
+		Expect(err).To(MatchError("copy failed"))
+		Expect(results).To(BeNil())
+	})
+
+	It("doesn't touch the database when no user is left to create", func() {
+		results, err := NewPostgresRepository(mockDB).BulkCreate(ctx, []User{{UserName: "jdoe"}}, "tester")
+		Expect(err).To(BeNil())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Outcome).To(Equal(BulkInvalid))
+	})
+
+	It("rejects an empty or oversized load", func() {
+		_, err := NewPostgresRepository(mockDB).BulkCreate(ctx, nil, "tester")
+		Expect(err).To(Equal(ErrInvalidBulkSize))
+
+		_, err = NewPostgresRepository(mockDB).BulkCreate(ctx, make([]User, MaxBulkCreate+1), "tester")
+		Expect(err).To(Equal(ErrInvalidBulkSize))
 	})
 })
 
-// UpdateUser
-var _ = Describe("UpdateUser", func() {
+var _ = Describe("PostgresRepository.Update", func() {
 	var (
 		mockDB *sql.DB
 		mock   sqlmock.Sqlmock
@@ -676,7 +1188,7 @@ var _ = Describe("UpdateUser", func() {
 		mockDB.Close()
 	})
 
-	It("successfully updates and returns user", func() {
+	expectUpdate := func() *sqlmock.ExpectedExec {
 		updateQuery, updateArgs, _ := sq.Update(DbName).
 			SetMap(map[string]interface{}{
 				"user_name":   user.UserName,
@@ -685,86 +1197,240 @@ var _ = Describe("UpdateUser", func() {
 				"email":       user.Email,
 				"user_status": user.UserStatus,
 				"department":  user.Department,
+				"version":     sq.Expr("version + 1"),
+				"updated_at":  time.Time{},
 			}).
-			Where(sq.Eq{"user_id": user.ID}).
+			Where(sq.Eq{"user_id": user.ID, "deleted_at": nil}).
 			Suffix("RETURNING user_id").
 			PlaceholderFormat(sq.Dollar).
 			ToSql()
 
-		driverArgs := convertToDriverArgs(updateArgs)
+		return mock.ExpectExec(regexp.QuoteMeta(updateQuery)).
+			WithArgs(anyTimes(convertToDriverArgs(updateArgs))...)
+	}
 
-		mock.ExpectExec(regexp.QuoteMeta(updateQuery)).
-			WithArgs(driverArgs...).
-			WillReturnResult(sqlmock.NewResult(1, 1))
+	selectQuery, _, _ := sq.Select(db.AllColumns).
+		From(DbName).
+		Where(sq.Eq{"user_id": int64(1)}).
+		Where(sq.Eq{"deleted_at": nil}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
 
-		// GetUser is called after update
-		selectQuery, selectArgs, _ := sq.Select(db.AllColumns).
-			From(DbName).
-			Where(sq.Eq{"user_id": user.ID}).
-			PlaceholderFormat(sq.Dollar).
-			ToSql()
+	It("successfully updates and returns user", func() {
+		mock.ExpectBegin()
 
-		driverArgs = convertToDriverArgs(selectArgs)
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(false))).
+			WithArgs(user.ID).
+			WillReturnRows(userRows(user.ID, "A", nil, 1))
 
+		expectUpdate().WillReturnResult(sqlmock.NewResult(1, 1))
+
+		// GetUser is called after update
 		mock.ExpectQuery(regexp.QuoteMeta(selectQuery)).
-			WithArgs(driverArgs...).
-			WillReturnRows(sqlmock.NewRows([]string{
-				"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department",
-			}).AddRow(user.ID, user.UserName, user.FirstName, user.LastName, user.Email, user.UserStatus, *user.Department))
+			WithArgs(user.ID).
+			WillReturnRows(userRows(user.ID, "A", nil, 2))
+
+		expectAudit(mock, OpUpdate)
+		expectEvent(mock, EventUserUpdated)
+		mock.ExpectCommit()
 
-		updatedUser, err := UpdateUser(mockDB, user)
+		updatedUser, err := NewPostgresRepository(mockDB).Update(ctx, user, 0, "tester")
 		Expect(err).To(BeNil())
 		Expect(updatedUser.ID).To(Equal(user.ID))
+		Expect(updatedUser.Version).To(Equal(int64(2)))
+	})
+
+	It("records a status change", func() {
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(false))).
+			WithArgs(user.ID).
+			WillReturnRows(userRows(user.ID, "I", nil, 1))
+
+		expectUpdate().WillReturnResult(sqlmock.NewResult(1, 1))
+
+		mock.ExpectQuery(regexp.QuoteMeta(selectQuery)).
+			WithArgs(user.ID).
+			WillReturnRows(userRows(user.ID, "A", nil, 2))
+
+		expectAudit(mock, OpStatusChange)
+		expectEvent(mock, EventUserActivated)
+		mock.ExpectCommit()
+
+		_, err := NewPostgresRepository(mockDB).Update(ctx, user, 1, "tester")
+		Expect(err).To(BeNil())
+	})
+
+	It("returns ErrVersionMismatch when the user moved on", func() {
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(false))).
+			WithArgs(user.ID).
+			WillReturnRows(userRows(user.ID, "A", nil, 3))
+
+		mock.ExpectRollback()
+
+		_, err := NewPostgresRepository(mockDB).Update(ctx, user, 2, "tester")
+		Expect(err).To(Equal(ErrVersionMismatch))
+	})
+
+	It("returns ErrUpdateUserNoRows when the user is missing or deleted", func() {
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(false))).
+			WithArgs(user.ID).
+			WillReturnError(sql.ErrNoRows)
+
+		mock.ExpectRollback()
+
+		_, err := NewPostgresRepository(mockDB).Update(ctx, user, 0, "tester")
+		Expect(err).To(Equal(ErrUpdateUserNoRows))
+	})
+
+	It("returns ErrUserExists when renaming into a taken user_name", func() {
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(false))).
+			WithArgs(user.ID).
+			WillReturnRows(userRows(user.ID, "A", nil, 1))
+
+		expectUpdate().WillReturnError(&pq.Error{Code: "23505"})
+		mock.ExpectRollback()
+
+		_, err := NewPostgresRepository(mockDB).Update(ctx, user, 0, "tester")
+		Expect(err).To(Equal(ErrUserExists))
 	})
 
 	It("returns error when scan in GetUser fails", func() {
-		updateQuery, updateArgs, _ := sq.Update(DbName).
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(false))).
+			WithArgs(user.ID).
+			WillReturnRows(userRows(user.ID, "A", nil, 1))
+
+		expectUpdate().WillReturnResult(sqlmock.NewResult(1, 1))
+
+		// Simulate scan failure on GetUser
+		mock.ExpectQuery(regexp.QuoteMeta(selectQuery)).
+			WithArgs(user.ID).
+			WillReturnError(sql.ErrConnDone) // simulate failure in QueryRow().Scan()
+
+		mock.ExpectRollback()
+
+		updatedUser, err := NewPostgresRepository(mockDB).Update(ctx, user, 0, "tester")
+		Expect(err).To(HaveOccurred())
+		Expect(updatedUser).To(BeNil())
+	})
+})
+
+var _ = Describe("PostgresRepository.Replace", func() {
+	var (
+		mockDB *sql.DB
+		mock   sqlmock.Sqlmock
+		user   *User
+	)
+
+	BeforeEach(func() {
+		var err error
+		mockDB, mock, err = sqlmock.New()
+		Expect(err).To(BeNil())
+
+		user = &User{
+			ID:         1,
+			UserName:   "jdoe",
+			FirstName:  "John",
+			LastName:   "",
+			Email:      "jdoe@example.com",
+			UserStatus: "A",
+		}
+	})
+
+	AfterEach(func() {
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+		mockDB.Close()
+	})
+
+	It("writes every field, clearing department and empty values", func() {
+		replaceQuery, replaceArgs, _ := sq.Update(DbName).
 			SetMap(map[string]interface{}{
-				"user_name":   user.UserName,
-				"first_name":  user.FirstName,
-				"last_name":   user.LastName,
-				"email":       user.Email,
-				"user_status": user.UserStatus,
-				"department":  user.Department,
+				"user_name":   "jdoe",
+				"first_name":  "John",
+				"last_name":   "",
+				"email":       "jdoe@example.com",
+				"user_status": "A",
+				"department":  nil,
+				"version":     sq.Expr("version + 1"),
+				"updated_at":  time.Time{},
 			}).
-			Where(sq.Eq{"user_id": user.ID}).
+			Where(sq.Eq{"user_id": user.ID, "deleted_at": nil}).
 			Suffix("RETURNING user_id").
 			PlaceholderFormat(sq.Dollar).
 			ToSql()
 
-		driverArgs := convertToDriverArgs(updateArgs)
+		mock.ExpectBegin()
 
-		mock.ExpectExec(regexp.QuoteMeta(updateQuery)).
-			WithArgs(driverArgs...).
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(false))).
+			WithArgs(user.ID).
+			WillReturnRows(userRows(user.ID, "A", nil, 4))
+
+		mock.ExpectExec(regexp.QuoteMeta(replaceQuery)).
+			WithArgs(anyTimes(convertToDriverArgs(replaceArgs))...).
 			WillReturnResult(sqlmock.NewResult(1, 1))
 
-		// Simulate scan failure on GetUser
-		selectQuery, selectArgs, _ := sq.Select(db.AllColumns).
+		// Reads the replaced user back
+		selectQuery, _, _ := sq.Select(db.AllColumns).
 			From(DbName).
-			Where(sq.Eq{"user_id": user.ID}).
+			Where(sq.Eq{"user_id": int64(1)}).
+			Where(sq.Eq{"deleted_at": nil}).
 			PlaceholderFormat(sq.Dollar).
 			ToSql()
 
-		driverArgs = convertToDriverArgs(selectArgs)
-
 		mock.ExpectQuery(regexp.QuoteMeta(selectQuery)).
-			WithArgs(driverArgs...).
-			WillReturnError(sql.ErrConnDone) // simulate failure in QueryRow().Scan()
+			WithArgs(user.ID).
+			WillReturnRows(userRows(user.ID, "A", nil, 5))
 
-		updatedUser, err := UpdateUser(mockDB, user)
-		Expect(err).To(HaveOccurred())
-		Expect(updatedUser).To(BeNil())
+		expectAudit(mock, OpUpdate)
+		expectEvent(mock, EventUserUpdated)
+		mock.ExpectCommit()
+
+		replaced, err := NewPostgresRepository(mockDB).Replace(ctx, user, 4, "tester")
+		Expect(err).To(BeNil())
+		Expect(replaced.Version).To(Equal(int64(5)))
+	})
+
+	It("returns ErrUserNotFound when the user is missing or deleted", func() {
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(false))).
+			WithArgs(user.ID).
+			WillReturnError(sql.ErrNoRows)
+
+		mock.ExpectRollback()
+
+		_, err := NewPostgresRepository(mockDB).Replace(ctx, user, 0, "tester")
+		Expect(err).To(Equal(ErrUserNotFound))
 	})
 })
 
-// DeleteUser
-var _ = Describe("DeleteUser", func() {
+// PostgresRepository.Delete
+var _ = Describe("PostgresRepository.Delete", func() {
+	// Delete is a soft delete that stamps `deleted_at`
 	var (
 		mockDB *sql.DB
 		mock   sqlmock.Sqlmock
 		userID int64 = 1
 	)
 
+	delQuery, _, _ := sq.Update(DbName).
+		Set("deleted_at", time.Now()).
+		Set("updated_at", time.Now()).
+		Set("version", sq.Expr("version + 1")).
+		Where(sq.Eq{"user_id": userID, "deleted_at": nil}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	driverArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), userID}
+
 	BeforeEach(func() {
 		var err error
 		mockDB, mock, err = sqlmock.New()
@@ -776,72 +1442,482 @@ var _ = Describe("DeleteUser", func() {
 		mockDB.Close()
 	})
 
-	It("successfully deletes a user", func() {
-		delQuery, delArgs, _ := sq.Delete(DbName).
-			Where(sq.Eq{"user_id": userID}).
-			PlaceholderFormat(sq.Dollar).
-			ToSql()
+	expectLock := func(version int64) {
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(false))).
+			WithArgs(userID).
+			WillReturnRows(userRows(userID, "A", nil, version))
+	}
 
-		driverArgs := convertToDriverArgs(delArgs)
+	It("successfully soft deletes a user", func() {
+		mock.ExpectBegin()
+		expectLock(1)
 
 		mock.ExpectExec(regexp.QuoteMeta(delQuery)).
 			WithArgs(driverArgs...).
 			WillReturnResult(sqlmock.NewResult(0, 1)) // 1 row affected
 
-		err := DeleteUser(mockDB, userID)
+		expectAudit(mock, OpDelete)
+		expectEvent(mock, EventUserDeleted)
+		mock.ExpectCommit()
+
+		err := NewPostgresRepository(mockDB).Delete(ctx, userID, 0, "tester")
 		Expect(err).To(BeNil())
 	})
 
-	It("returns ErrUserNotFound when no rows affected", func() {
-		delQuery, delArgs, _ := sq.Delete(DbName).
-			Where(sq.Eq{"user_id": userID}).
-			PlaceholderFormat(sq.Dollar).
-			ToSql()
+	It("returns ErrUserNotFound when the user is missing or deleted", func() {
+		mock.ExpectBegin()
 
-		driverArgs := convertToDriverArgs(delArgs)
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(false))).
+			WithArgs(userID).
+			WillReturnError(sql.ErrNoRows)
 
-		mock.ExpectExec(regexp.QuoteMeta(delQuery)).
-			WithArgs(driverArgs...).
-			WillReturnResult(sqlmock.NewResult(0, 0)) // 0 rows affected
+		mock.ExpectRollback()
 
-		err := DeleteUser(mockDB, userID)
+		err := NewPostgresRepository(mockDB).Delete(ctx, userID, 0, "tester")
 		Expect(err).To(MatchError(ErrUserNotFound))
 	})
 
-	It("returns error if Exec fails", func() {
-		delQuery, delArgs, _ := sq.Delete(DbName).
-			Where(sq.Eq{"user_id": userID}).
-			PlaceholderFormat(sq.Dollar).
-			ToSql()
+	It("returns ErrVersionMismatch when the user moved on", func() {
+		mock.ExpectBegin()
+		expectLock(2)
+		mock.ExpectRollback()
 
-		driverArgs := convertToDriverArgs(delArgs)
+		err := NewPostgresRepository(mockDB).Delete(ctx, userID, 1, "tester")
+		Expect(err).To(Equal(ErrVersionMismatch))
+	})
+
+	It("returns error if Exec fails", func() {
+		mock.ExpectBegin()
+		expectLock(1)
 
 		mock.ExpectExec(regexp.QuoteMeta(delQuery)).
 			WithArgs(driverArgs...).
 			WillReturnError(fmt.Errorf("exec failure"))
 
-		err := DeleteUser(mockDB, userID)
+		mock.ExpectRollback()
+
+		err := NewPostgresRepository(mockDB).Delete(ctx, userID, 0, "tester")
 		Expect(err).To(MatchError("exec failure"))
 	})
 
 	It("returns error if RowsAffected fails", func() {
-		delQuery, delArgs, _ := sq.Delete(DbName).
-			Where(sq.Eq{"user_id": userID}).
-			PlaceholderFormat(sq.Dollar).
-			ToSql()
-
-		driverArgs := convertToDriverArgs(delArgs)
+		mock.ExpectBegin()
+		expectLock(1)
 
-		// Create a result that returns error on RowsAffected()
-		_ = sqlmock.NewResult(0, 1)
 		// Wrap result to simulate RowsAffected error
 		mock.ExpectExec(regexp.QuoteMeta(delQuery)).
 			WithArgs(driverArgs...).
 			WillReturnResult(sqlmock.NewErrorResult(fmt.Errorf("rows affected failure")))
 
-		err := DeleteUser(mockDB, userID)
+		mock.ExpectRollback()
+
+		err := NewPostgresRepository(mockDB).Delete(ctx, userID, 0, "tester")
 		Expect(err).To(MatchError("rows affected failure"))
 	})
 })
 
-// GetByID
+// PostgresRepository.Restore
+var _ = Describe("PostgresRepository.Restore", func() {
+	var (
+		mockDB *sql.DB
+		mock   sqlmock.Sqlmock
+		userID int64 = 1
+	)
+
+	restoreQuery, _, _ := sq.Update(DbName).
+		Set("deleted_at", nil).
+		Set("updated_at", time.Now()).
+		Set("version", sq.Expr("version + 1")).
+		Where(sq.Eq{"user_id": userID}).
+		Where(sq.NotEq{"deleted_at": nil}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	BeforeEach(func() {
+		var err error
+		mockDB, mock, err = sqlmock.New()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+		mockDB.Close()
+	})
+
+	It("clears deleted_at and returns the user", func() {
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(true))).
+			WithArgs(userID).
+			WillReturnRows(userRows(userID, "A", time.Now(), 2))
+
+		mock.ExpectExec(regexp.QuoteMeta(restoreQuery)).
+			WithArgs(nil, sqlmock.AnyArg(), userID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expectAudit(mock, OpRestore)
+		expectEvent(mock, EventUserRestored)
+		mock.ExpectCommit()
+
+		user, err := NewPostgresRepository(mockDB).Restore(ctx, userID, "tester")
+		Expect(err).To(BeNil())
+		Expect(user.DeletedAt).To(BeNil())
+		Expect(user.Version).To(Equal(int64(3)))
+	})
+
+	It("returns ErrUserNotDeleted when the user is live", func() {
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(true))).
+			WithArgs(userID).
+			WillReturnRows(userRows(userID, "A", nil, 1))
+
+		mock.ExpectRollback()
+
+		_, err := NewPostgresRepository(mockDB).Restore(ctx, userID, "tester")
+		Expect(err).To(Equal(ErrUserNotDeleted))
+	})
+
+	It("returns ErrUserNotFound when the user does not exist", func() {
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(true))).
+			WithArgs(userID).
+			WillReturnError(sql.ErrNoRows)
+
+		mock.ExpectRollback()
+
+		_, err := NewPostgresRepository(mockDB).Restore(ctx, userID, "tester")
+		Expect(err).To(Equal(ErrUserNotFound))
+	})
+})
+
+// PostgresRepository.Purge
+var _ = Describe("PostgresRepository.Purge", func() {
+	var (
+		mockDB *sql.DB
+		mock   sqlmock.Sqlmock
+		userID int64 = 1
+	)
+
+	purgeQuery, _, _ := sq.Delete(DbName).
+		Where(sq.Eq{"user_id": userID}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	BeforeEach(func() {
+		var err error
+		mockDB, mock, err = sqlmock.New()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+		mockDB.Close()
+	})
+
+	It("hard deletes the row", func() {
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(true))).
+			WithArgs(userID).
+			WillReturnRows(userRows(userID, "A", time.Now(), 2))
+
+		mock.ExpectExec(regexp.QuoteMeta(purgeQuery)).
+			WithArgs(userID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		expectAudit(mock, OpPurge)
+		expectEvent(mock, EventUserPurged)
+		mock.ExpectCommit()
+
+		Expect(NewPostgresRepository(mockDB).Purge(ctx, userID, "tester")).To(Succeed())
+	})
+
+	It("returns ErrUserNotFound when the user does not exist", func() {
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(regexp.QuoteMeta(lockQuery(true))).
+			WithArgs(userID).
+			WillReturnError(sql.ErrNoRows)
+
+		mock.ExpectRollback()
+
+		Expect(NewPostgresRepository(mockDB).Purge(ctx, userID, "tester")).To(MatchError(ErrUserNotFound))
+	})
+})
+
+// PostgresRepository.History
+var _ = Describe("PostgresRepository.History", func() {
+	var (
+		mockDB *sql.DB
+		mock   sqlmock.Sqlmock
+		userID int64 = 1
+	)
+
+	columns := []string{"audit_id", "user_id", "actor", "operation", "changes", "created_at"}
+
+	BeforeEach(func() {
+		var err error
+		mockDB, mock, err = sqlmock.New()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+		mockDB.Close()
+	})
+
+	It("applies the filters and decodes the changes", func() {
+		from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		to := from.AddDate(0, 1, 0)
+
+		query, args, _ := sq.Select(db.AuditColumns).
+			From(AuditTable).
+			Where(sq.Eq{"user_id": userID}).
+			OrderBy("created_at DESC", "audit_id DESC").
+			Where(sq.GtOrEq{"created_at": from}).
+			Where(sq.Lt{"created_at": to}).
+			Where(sq.Eq{"operation": OpUpdate}).
+			Limit(10).
+			Offset(20).
+			PlaceholderFormat(sq.Dollar).
+			ToSql()
+
+		mock.ExpectQuery(regexp.QuoteMeta(query)).
+			WithArgs(convertToDriverArgs(args)...).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(
+				7, userID, "tester", OpUpdate, []byte(`{"email":{"before":"a@example.com","after":"b@example.com"}}`), from,
+			))
+
+		entries, err := NewPostgresRepository(mockDB).History(ctx, userID, HistoryOptions{
+			From:      &from,
+			To:        &to,
+			Operation: OpUpdate,
+			Limit:     10,
+			Offset:    20,
+		})
+		Expect(err).To(BeNil())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Actor).To(Equal("tester"))
+		Expect(entries[0].Changes).To(Equal(map[string]FieldChange{
+			"email": {Before: ptr("a@example.com"), After: ptr("b@example.com")},
+		}))
+	})
+
+	It("returns an empty list when there is no history", func() {
+		query, _, _ := sq.Select(db.AuditColumns).
+			From(AuditTable).
+			Where(sq.Eq{"user_id": userID}).
+			OrderBy("created_at DESC", "audit_id DESC").
+			PlaceholderFormat(sq.Dollar).
+			ToSql()
+
+		mock.ExpectQuery(regexp.QuoteMeta(query)).
+			WithArgs(userID).
+			WillReturnRows(sqlmock.NewRows(columns))
+
+		entries, err := NewPostgresRepository(mockDB).History(ctx, userID, HistoryOptions{})
+		Expect(err).To(BeNil())
+		Expect(entries).ToNot(BeNil())
+		Expect(entries).To(BeEmpty())
+	})
+})
+
+var auditQuery, _, _ = sq.Insert(AuditTable).
+	Columns("user_id", "actor", "operation", "changes", "created_at").
+	Values(0, "", "", "", time.Time{}).
+	PlaceholderFormat(sq.Dollar).
+	ToSql()
+
+// Expects the audit entry recorded alongside every write
+func expectAudit(mock sqlmock.Sqlmock, operation string) {
+	mock.ExpectExec(regexp.QuoteMeta(auditQuery)).
+		WithArgs(sqlmock.AnyArg(), "tester", operation, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+var outboxQuery, _, _ = sq.Insert(OutboxTable).
+	Columns("user_id", "event_type", "payload", "status", "next_attempt_at", "created_at").
+	Values(0, "", "", "", time.Time{}, time.Time{}).
+	PlaceholderFormat(sq.Dollar).
+	ToSql()
+
+// Expects the outbox event written in the same transaction as the audit entry
+func expectEvent(mock sqlmock.Sqlmock, eventType string) {
+	mock.ExpectExec(regexp.QuoteMeta(outboxQuery)).
+		WithArgs(sqlmock.AnyArg(), eventType, sqlmock.AnyArg(), EventPending, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// The SELECT ... FOR UPDATE that locks user 1 before a write
+func lockQuery(includeDeleted bool) string {
+	selectUser := sq.Select(db.AllColumns).
+		From(DbName).
+		Where(sq.Eq{"user_id": int64(1)}).
+		PlaceholderFormat(sq.Dollar)
+
+	if !includeDeleted {
+		selectUser = selectUser.Where(sq.Eq{"deleted_at": nil})
+	}
+
+	query, _, _ := selectUser.Suffix("FOR UPDATE").ToSql()
+	return query
+}
+
+func userRows(id int64, status string, deletedAt interface{}, version int64) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{
+		"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "deleted_at", "version", "created_at", "updated_at",
+	}).AddRow(id, "jdoe", "John", "Doe", "jdoe@example.com", status, "Engineering", deletedAt, version, createdAt, createdAt)
+}
+
+var _ = Describe("PostgresRepository with a read replica", func() {
+	var (
+		primaryDB, replicaDB *sql.DB
+		primary, replicaMock sqlmock.Sqlmock
+		replica              *db.Replica
+		repo                 *SQLRepository
+		getQuery             string
+	)
+
+	BeforeEach(func() {
+		var err error
+		primaryDB, primary, err = sqlmock.New()
+		Expect(err).To(BeNil())
+
+		replicaDB, replicaMock, err = sqlmock.New(sqlmock.MonitorPingsOption(true))
+		Expect(err).To(BeNil())
+
+		replica = db.NewReplica(replicaDB, time.Second)
+		replicaMock.ExpectPing()
+		Expect(replica.Check(ctx)).To(Succeed())
+
+		repo = NewPostgresRepository(primaryDB).WithReplica(replica)
+
+		getQuery, _, err = sq.Select(db.AllColumns).
+			From(DbName).
+			Where(sq.Eq{"user_id": int64(1)}).
+			Where(sq.Eq{"deleted_at": nil}).
+			PlaceholderFormat(sq.Dollar).
+			ToSql()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(primary.ExpectationsWereMet()).To(Succeed())
+		Expect(replicaMock.ExpectationsWereMet()).To(Succeed())
+		primaryDB.Close()
+		replicaDB.Close()
+	})
+
+	It("reads from the replica while it is healthy", func() {
+		replicaMock.ExpectQuery(regexp.QuoteMeta(getQuery)).
+			WillReturnRows(userRows(1, "A", nil, 1))
+
+		user, err := repo.Get(ctx, 1, GetOptions{})
+		Expect(err).To(BeNil())
+		Expect(user.ID).To(Equal(int64(1)))
+	})
+
+	It("reads from the primary when the context asks for it", func() {
+		primary.ExpectQuery(regexp.QuoteMeta(getQuery)).
+			WillReturnRows(userRows(1, "A", nil, 1))
+
+		_, err := repo.Get(db.WithPrimary(ctx), 1, GetOptions{})
+		Expect(err).To(BeNil())
+	})
+
+	It("reads from the primary while the replica is unhealthy", func() {
+		replica.MarkUnhealthy(driver.ErrBadConn)
+
+		primary.ExpectQuery(regexp.QuoteMeta(getQuery)).
+			WillReturnRows(userRows(1, "A", nil, 1))
+
+		_, err := repo.Get(ctx, 1, GetOptions{})
+		Expect(err).To(BeNil())
+	})
+
+	It("falls back to the primary when the replica can't be reached", func() {
+		replicaMock.ExpectQuery(regexp.QuoteMeta(getQuery)).
+			WillReturnError(&net.OpError{Op: "read", Err: errors.New("connection reset by peer")})
+		primary.ExpectQuery(regexp.QuoteMeta(getQuery)).
+			WillReturnRows(userRows(1, "A", nil, 1))
+
+		_, err := repo.Get(ctx, 1, GetOptions{})
+		Expect(err).To(BeNil())
+		Expect(replica.Healthy()).To(BeFalse())
+	})
+
+	It("does not retry a query that failed on a healthy replica", func() {
+		replicaMock.ExpectQuery(regexp.QuoteMeta(getQuery)).
+			WillReturnRows(sqlmock.NewRows(nil))
+
+		_, err := repo.Get(ctx, 1, GetOptions{})
+		Expect(err).To(Equal(ErrUserNotFound))
+		Expect(replica.Healthy()).To(BeTrue())
+	})
+
+	Describe("Stream", func() {
+		var listQuery string
+
+		BeforeEach(func() {
+			var err error
+			listQuery, _, err = sq.Select(db.AllColumns).
+				From(DbName).
+				Where(sq.Eq{"deleted_at": nil}).
+				PlaceholderFormat(sq.Dollar).
+				ToSql()
+			Expect(err).To(BeNil())
+		})
+
+		It("starts over on the primary when the replica fails before any user", func() {
+			replicaMock.ExpectQuery(regexp.QuoteMeta(listQuery)).
+				WillReturnError(&net.OpError{Op: "read", Err: errors.New("connection reset by peer")})
+			primary.ExpectQuery(regexp.QuoteMeta(listQuery)).
+				WillReturnRows(userRows(1, "A", nil, 1))
+
+			var streamed []User
+			err := repo.Stream(ctx, ListOptions{}, func(u User) error {
+				streamed = append(streamed, u)
+				return nil
+			})
+			Expect(err).To(BeNil())
+			Expect(streamed).To(HaveLen(1))
+		})
+
+		It("doesn't repeat users when the replica fails part way through", func() {
+			connErr := &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}
+			replicaMock.ExpectQuery(regexp.QuoteMeta(listQuery)).
+				WillReturnRows(userRows(1, "A", nil, 1).
+					AddRow(int64(2), "asmith", "Alice", "Smith", "a@example.com", "A", nil, nil, int64(1), createdAt, createdAt).
+					RowError(1, connErr))
+
+			var streamed []User
+			err := repo.Stream(ctx, ListOptions{}, func(u User) error {
+				streamed = append(streamed, u)
+				return nil
+			})
+			Expect(err).To(Equal(connErr))
+			Expect(streamed).To(HaveLen(1))
+			Expect(replica.Healthy()).To(BeFalse())
+		})
+	})
+
+	It("keeps writes and the reads they make on the primary", func() {
+		primary.ExpectBegin()
+		primary.ExpectQuery(regexp.QuoteMeta(lockQuery(false))).
+			WillReturnRows(userRows(1, "A", nil, 1))
+		primary.ExpectExec(`UPDATE users SET`).
+			WithArgs(sqlmock.AnyArg(), "I", int64(1)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		primary.ExpectQuery(regexp.QuoteMeta(getQuery)).
+			WillReturnRows(userRows(1, "I", nil, 2))
+		expectAudit(primary, OpStatusChange)
+		expectEvent(primary, EventUserDeactivated)
+		primary.ExpectCommit()
+
+		user, err := repo.Update(ctx, &User{ID: 1, UserStatus: "I"}, 0, "tester")
+		Expect(err).To(BeNil())
+		Expect(user.UserStatus).To(Equal("I"))
+	})
+})
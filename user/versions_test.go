@@ -0,0 +1,120 @@
+package user_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/steveperjesi/integra-demo/user"
+)
+
+// Both repositories keep earlier versions of users the same way
+var _ = Describe("VersionStore", func() {
+	for _, backend := range backends {
+		backend := backend
+
+		Describe(backend.name, func() {
+			var (
+				repo  testRepository
+				store VersionStore
+				user  *User
+			)
+
+			BeforeEach(func() {
+				var closeRepo func()
+				repo, closeRepo = backend.open()
+				DeferCleanup(closeRepo)
+				store = repo
+
+				user = &User{
+					UserName:   "jdoe",
+					FirstName:  "John",
+					LastName:   "Doe",
+					Email:      "jdoe@example.com",
+					UserStatus: "A",
+				}
+			})
+
+			// A point in time strictly between the writes around it
+			mark := func() time.Time {
+				time.Sleep(time.Millisecond)
+				t := time.Now().UTC()
+				time.Sleep(time.Millisecond)
+				return t
+			}
+
+			It("reads a user as they were at any time", func() {
+				beforeCreate := mark()
+				created, err := repo.Create(ctx, user, "tester")
+				Expect(err).To(BeNil())
+				afterCreate := mark()
+				repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 0, "tester")
+				afterUpdate := mark()
+				Expect(repo.Delete(ctx, created.ID, 0, "tester")).To(Succeed())
+				afterDelete := mark()
+				Expect(repo.Purge(ctx, created.ID, "admin")).To(Succeed())
+
+				_, err = repo.Get(ctx, created.ID, GetOptions{AsOf: &beforeCreate})
+				Expect(err).To(Equal(ErrUserNotFound))
+
+				u, err := repo.Get(ctx, created.ID, GetOptions{AsOf: &afterCreate})
+				Expect(err).To(BeNil())
+				Expect(u.Email).To(Equal("jdoe@example.com"))
+				Expect(u.Version).To(Equal(int64(1)))
+
+				u, err = repo.Get(ctx, created.ID, GetOptions{AsOf: &afterUpdate})
+				Expect(err).To(BeNil())
+				Expect(u.Email).To(Equal("john@example.com"))
+				Expect(u.Version).To(Equal(int64(2)))
+
+				_, err = repo.Get(ctx, created.ID, GetOptions{AsOf: &afterDelete})
+				Expect(err).To(Equal(ErrUserNotFound))
+
+				u, err = repo.Get(ctx, created.ID, GetOptions{AsOf: &afterDelete, IncludeDeleted: true})
+				Expect(err).To(BeNil())
+				Expect(u.DeletedAt).ToNot(BeNil())
+
+				// Purged for good, but still in the history
+				_, err = repo.Get(ctx, created.ID, GetOptions{IncludeDeleted: true})
+				Expect(err).To(Equal(ErrUserNotFound))
+			})
+
+			It("lists users as they were", func() {
+				jdoe, _ := repo.Create(ctx, user, "tester")
+				afterCreate := mark()
+				repo.Update(ctx, &User{ID: jdoe.ID, UserStatus: "I"}, 0, "tester")
+				repo.Create(ctx, &User{UserName: "asmith", FirstName: "Alice", LastName: "Smith", Email: "a@example.com", UserStatus: "I"}, "tester")
+				now := time.Now().UTC()
+
+				users, err := repo.List(ctx, ListOptions{AsOf: &afterCreate})
+				Expect(err).To(BeNil())
+				Expect(users).To(HaveLen(1))
+				Expect(users[0].UserStatus).To(Equal("A"))
+
+				users, err = repo.List(ctx, ListOptions{AsOf: &now})
+				Expect(err).To(BeNil())
+				Expect(users).To(HaveLen(2))
+				Expect(users[0].UserStatus).To(Equal("I"))
+			})
+
+			It("prunes versions that ended before the cutoff", func() {
+				created, _ := repo.Create(ctx, user, "tester")
+				afterCreate := mark()
+				repo.Update(ctx, &User{ID: created.ID, Email: "john@example.com"}, 0, "tester")
+				afterUpdate := mark()
+				repo.Update(ctx, &User{ID: created.ID, Email: "jd@example.com"}, 0, "tester")
+
+				pruned, err := store.PruneVersions(ctx, afterUpdate)
+				Expect(err).To(BeNil())
+				Expect(pruned).To(Equal(int64(1)))
+
+				_, err = repo.Get(ctx, created.ID, GetOptions{AsOf: &afterCreate})
+				Expect(err).To(Equal(ErrUserNotFound))
+
+				u, err := repo.Get(ctx, created.ID, GetOptions{AsOf: &afterUpdate})
+				Expect(err).To(BeNil())
+				Expect(u.Email).To(Equal("john@example.com"))
+			})
+		})
+	}
+})